@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/Elbandi/godelta/delta"
+)
+
+const (
+	// maxAdaptiveRetries is how often adaptiveBlockSize changes the block
+	// size after the first pass.
+	maxAdaptiveRetries = 3
+	// Above highLiteralRatio of the new file written as literals the
+	// block size is halved, below lowLiteralRatio it is doubled.
+	highLiteralRatio = 0.80
+	lowLiteralRatio  = 0.05
+)
+
+// adaptiveBlockSize diffs the -in file against in-memory fingerprints of
+// the -file. Starting from cfg.BlockSize, it halves the block size while
+// most of the new file is written as literals and doubles it while almost
+// nothing is, keeping the direction of the first change. It returns the
+// block size chosen and the fingerprint generated with it.
+func adaptiveBlockSize(ctx context.Context, cfg delta.Config, src, in *os.File) (int, *bytes.Buffer, error) {
+	blockSize := cfg.BlockSize
+	direction := 0
+	for try := 0; ; try++ {
+		fp, ratio, err := literalRatio(ctx, cfg, src, in, blockSize)
+		if err != nil {
+			return 0, nil, err
+		}
+		slog.Debug("adaptive block size", "phase", "diff", "blocksize", blockSize, "literal", ratio)
+		next := 0
+		switch {
+		case ratio > highLiteralRatio && blockSize/2 >= delta.MinBlockSize:
+			next = -1
+		case ratio < lowLiteralRatio && blockSize*2 <= delta.MaxBlockSize:
+			next = 1
+		}
+		if next == 0 || try == maxAdaptiveRetries || (direction != 0 && next != direction) {
+			return blockSize, fp, nil
+		}
+		direction = next
+		if next < 0 {
+			blockSize /= 2
+		} else {
+			blockSize *= 2
+		}
+	}
+}
+
+// literalRatio returns the fingerprint of src for blockSize and the share
+// of in that a diff against it writes as literals.
+func literalRatio(ctx context.Context, cfg delta.Config, src, in *os.File, blockSize int) (*bytes.Buffer, float64, error) {
+	for _, f := range []*os.File{src, in} {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, 0, err
+		}
+	}
+	fpCfg := delta.DefaultConfig()
+	fpCfg.BlockSize = blockSize
+	fpCfg.Hash = cfg.Hash
+	fpCfg.Workers = cfg.Workers
+	fp := &bytes.Buffer{}
+	if err := delta.GenerateFingerprint(ctx, src, fp, delta.WithConfig(fpCfg)); err != nil {
+		return nil, 0, err
+	}
+
+	var st delta.DeltaStats
+	fpCfg.StatsFunc = func(phase string, s delta.DeltaStats) { st = s }
+	fpCfg.OverrideBlockSize = true
+	if _, err := delta.MakeDiff(ctx, bytes.NewReader(fp.Bytes()), in, io.Discard, delta.WithConfig(fpCfg)); err != nil {
+		return nil, 0, err
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	if st.NewSize == 0 {
+		return fp, 0, nil
+	}
+	return fp, float64(st.LiteralBytes) / float64(st.NewSize), nil
+}
+
+// adaptiveFingerprint picks the block size for the diff of the -in file
+// against the -file and returns the fingerprint generated with it.
+func adaptiveFingerprint(ctx context.Context, cfg *delta.Config) (io.Reader, error) {
+	if *infilePath == "" || *remoteSource != "" {
+		return nil, errors.New("-adaptive-blocksize requires -in and a local -file")
+	}
+	src, err := os.Open(*sourcefilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	in, err := os.Open(*infilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	blockSize, fp, err := adaptiveBlockSize(ctx, *cfg, src, in)
+	if err != nil {
+		return nil, err
+	}
+	cfg.BlockSize = blockSize
+	cfg.OverrideBlockSize = false
+	slog.Info("adaptive block size chosen", "phase", "diff", "blocksize", blockSize)
+	return fp, nil
+}
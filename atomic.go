@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// atomicFile is written in a temporary file next to its destination, or in
+// -tmpdir, and renamed over it on Commit, so the destination always holds
+// either the complete new content or the previous file.
+type atomicFile struct {
+	*os.File
+	path string
+	done bool
+}
+
+func createAtomic(path string) (*atomicFile, error) {
+	dir := filepath.Dir(path)
+	if *tmpDir != "" {
+		dir = *tmpDir
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err = f.Chmod(mode); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	af := &atomicFile{File: f, path: path}
+	pending.Lock()
+	pending.files[af] = struct{}{}
+	pending.Unlock()
+	return af, nil
+}
+
+// pending holds the atomic files neither committed nor aborted yet, which
+// abortPending removes when the process is interrupted.
+var pending = struct {
+	sync.Mutex
+	files map[*atomicFile]struct{}
+}{files: make(map[*atomicFile]struct{})}
+
+// finish marks f as committed or aborted. It reports false if it already
+// was.
+func (f *atomicFile) finish() bool {
+	pending.Lock()
+	defer pending.Unlock()
+	if f.done {
+		return false
+	}
+	f.done = true
+	delete(pending.files, f)
+	return true
+}
+
+// abortPending removes the temporary files of all pending atomic files.
+func abortPending() {
+	pending.Lock()
+	files := make([]*atomicFile, 0, len(pending.files))
+	for f := range pending.files {
+		files = append(files, f)
+	}
+	pending.Unlock()
+	for _, f := range files {
+		f.Abort()
+	}
+}
+
+// Commit flushes the temporary file and renames it to the destination.
+func (f *atomicFile) Commit() error {
+	if !f.finish() {
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	err := os.Rename(f.Name(), f.path)
+	if errors.Is(err, syscall.EXDEV) {
+		// -tmpdir is on another file system than the destination.
+		err = copyRename(f.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// copyRename copies src to a temporary file next to dst, renames that over
+// dst and removes src.
+func copyRename(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	if err = out.Chmod(fi.Mode().Perm()); err == nil {
+		if _, err = io.Copy(out, in); err == nil {
+			err = out.Sync()
+		}
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(out.Name(), dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Abort removes the temporary file unless it was already committed.
+func (f *atomicFile) Abort() {
+	if !f.finish() {
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Elbandi/godelta/delta"
+)
+
+// batchEntry is a line of a batch manifest.
+type batchEntry struct {
+	line    int
+	source  string
+	newFile string
+	out     string
+	err     error
+	// attempts is the number of times the entry was run.
+	attempts int
+}
+
+// retryPolicy sets how often a failed batch entry is retried.
+type retryPolicy struct {
+	retries int
+	// delay is the wait before the first retry, doubled before each
+	// following one.
+	delay time.Duration
+}
+
+// permanentErrors are the failures that a retry cannot fix.
+var permanentErrors = []error{
+	delta.ErrFingerprintCorrupt,
+	delta.ErrDeltaCorrupt,
+	delta.ErrPatchMismatch,
+	delta.ErrUnsupportedVersion,
+	delta.ErrSourceModified,
+	delta.ErrWrongSourceFile,
+	delta.ErrVersionMismatch,
+	delta.ErrHashAlgorithmMismatch,
+	delta.ErrSignatureMismatch,
+	delta.ErrOutputSizeMismatch,
+	errDeltaTooLarge,
+	os.ErrNotExist,
+	os.ErrPermission,
+	context.Canceled,
+}
+
+// retryable reports whether err may be transient. Errors not known to be
+// permanent, like I/O errors and timeouts, are retried.
+func retryable(err error) bool {
+	for _, p := range permanentErrors {
+		if errors.Is(err, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// run diffs the entry, retrying transient failures with exponential
+// backoff as set by policy.
+func (e *batchEntry) run(ctx context.Context, cfg delta.Config, policy retryPolicy) {
+	delay := policy.delay
+	for {
+		e.attempts++
+		start := time.Now()
+		e.err = diffFiles(ctx, cfg, e.source, e.newFile, e.out)
+		appMetrics.observe("diff", start, e.err)
+		if e.err == nil || e.attempts > policy.retries || !retryable(e.err) {
+			return
+		}
+		slog.Warn("batch entry failed, retrying", "error", e.err, "file", e.newFile, "line", e.line, "attempt", e.attempts, "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay *= 2
+	}
+}
+
+// readManifest parses a manifest of tab separated source, new file and
+// output delta paths. Empty lines and lines starting with # are skipped.
+func readManifest(path string) ([]*batchEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*batchEntry
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected 3 tab separated fields, got %d", path, line, len(fields))
+		}
+		entries = append(entries, &batchEntry{line: line, source: fields[0], newFile: fields[1], out: fields[2]})
+	}
+	return entries, scanner.Err()
+}
+
+// diffFiles writes the delta from source to newFile into out. The
+// fingerprint of source is generated in memory.
+func diffFiles(ctx context.Context, cfg delta.Config, source, newFile, out string) error {
+	srcFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	var fp bytes.Buffer
+	if err = delta.GenerateFingerprint(ctx, srcFile, &fp, delta.WithConfig(cfg)); err != nil {
+		return err
+	}
+
+	inFile, err := os.Open(newFile)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	tmpFile, err := createAtomic(out)
+	if err != nil {
+		return err
+	}
+	defer tmpFile.Abort()
+
+	if _, err = delta.MakeDiff(ctx, &fp, inFile, tmpFile.File, delta.WithConfig(cfg)); err != nil {
+		return err
+	}
+	return tmpFile.Commit()
+}
+
+// runBatch creates the deltas listed in the manifest with up to parallel
+// entries at a time. Entries whose new file the filter excludes are skipped.
+// A failed entry is retried as set by policy, then logged, and does not
+// stop the others. It reports whether every entry succeeded.
+func runBatch(ctx context.Context, cfg delta.Config, manifest string, parallel int, filter *pathFilter, policy retryPolicy) (bool, error) {
+	all, err := readManifest(manifest)
+	if err != nil {
+		return false, err
+	}
+	var entries []*batchEntry
+	for _, e := range all {
+		if filter.excluded(e.newFile) {
+			slog.Debug("batch entry excluded", "file", e.newFile, "line", e.line)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+	if parallel > 1 {
+		// The progress bar follows a single operation.
+		cfg.ProgressFunc = nil
+		cfg.MatchFunc = nil
+	}
+
+	jobs := make(chan *batchEntry)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range jobs {
+				slog.Debug("batch entry", "file", e.newFile, "source", e.source, "out", e.out)
+				e.run(ctx, cfg, policy)
+				if e.err != nil {
+					slog.Error(e.err.Error(), "manifest", manifest, "line", e.line, "file", e.newFile, "attempts", e.attempts)
+				}
+			}
+		}()
+	}
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			e.err = ctx.Err()
+			continue
+		}
+		jobs <- e
+	}
+	close(jobs)
+	wg.Wait()
+
+	failed, retried := 0, 0
+	for _, e := range entries {
+		if e.err != nil {
+			failed++
+		}
+		if e.attempts > 1 {
+			retried++
+		}
+	}
+	fmt.Printf("total: %d, successful: %d, failed: %d, retried: %d, excluded: %d\n", len(entries), len(entries)-failed, failed, retried, len(all)-len(entries))
+	for _, e := range entries {
+		if e.err != nil {
+			fmt.Printf("  %s: %v (attempts: %d)\n", e.out, e.err, e.attempts)
+		}
+	}
+	return failed == 0, nil
+}
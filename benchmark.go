@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Elbandi/godelta/delta"
+)
+
+// formatSize formats n bytes in the largest of the TB, GB, MB and KB
+// units of parseSize it reaches, with one decimal unless it is 0.
+func formatSize(n int64) string {
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}} {
+		if n >= u.size {
+			v := strconv.FormatFloat(float64(n)/float64(u.size), 'f', 1, 64)
+			return strings.TrimSuffix(v, ".0") + " " + u.suffix
+		}
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// parseSize parses a byte count with an optional KB, MB, GB or TB suffix,
+// all powers of 1024.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(upper, u.suffix) {
+			upper = strings.TrimSpace(strings.TrimSuffix(upper, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// parsePercent parses a percentage with an optional % suffix.
+func parsePercent(s string) (float64, error) {
+	p, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || p < 0 || p > 100 {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	return p, nil
+}
+
+// benchmarkFiles writes a random source file of size bytes to dir and a
+// copy of it with mutate percent of its blocks replaced by random data.
+func benchmarkFiles(dir string, size int64, blockSize int, mutate float64) (string, string, error) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	srcPath := filepath.Join(dir, "source")
+	newPath := filepath.Join(dir, "new")
+
+	src, err := os.Create(srcPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer src.Close()
+	if _, err = io.CopyN(src, rng, size); err != nil {
+		return "", "", err
+	}
+	if _, err = src.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+
+	dst, err := os.Create(newPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer dst.Close()
+	if _, err = io.Copy(dst, src); err != nil {
+		return "", "", err
+	}
+
+	blocks := int((size + int64(blockSize) - 1) / int64(blockSize))
+	buf := make([]byte, blockSize)
+	for _, i := range rng.Perm(blocks)[:int(float64(blocks)*mutate/100)] {
+		rng.Read(buf)
+		offset := int64(i) * int64(blockSize)
+		n := int64(blockSize)
+		if offset+n > size {
+			n = size - offset
+		}
+		if _, err = dst.WriteAt(buf[:n], offset); err != nil {
+			return "", "", err
+		}
+	}
+	return srcPath, newPath, nil
+}
+
+// runBenchmark times every phase of a round trip on generated files and
+// reports the delta size for block sizes from 1 KB to 64 KB.
+func runBenchmark(ctx context.Context, cfg delta.Config, sizeFlag, mutateFlag string) error {
+	size, err := parseSize(sizeFlag)
+	if err != nil {
+		return err
+	}
+	mutate, err := parsePercent(mutateFlag)
+	if err != nil {
+		return err
+	}
+	cfg.ProgressFunc = nil
+	cfg.MatchFunc = nil
+
+	dir, err := os.MkdirTemp(*tmpDir, "godelta-benchmark")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	srcPath, newPath, err := benchmarkFiles(dir, size, cfg.BlockSize, mutate)
+	if err != nil {
+		return err
+	}
+	fpPath := filepath.Join(dir, "fingerprint")
+	deltaPath := filepath.Join(dir, "delta")
+	outPath := filepath.Join(dir, "out")
+
+	phases := []struct {
+		name string
+		run  func() error
+	}{
+		{"fpgen", func() error {
+			return withFiles(srcPath, fpPath, func(in *os.File, out *os.File) error {
+				return delta.GenerateFingerprint(ctx, in, out, delta.WithConfig(cfg))
+			})
+		}},
+		{"diff", func() error {
+			fp, err := os.Open(fpPath)
+			if err != nil {
+				return err
+			}
+			defer fp.Close()
+			return withFiles(newPath, deltaPath, func(in *os.File, out *os.File) error {
+				_, err := delta.MakeDiff(ctx, fp, in, out, delta.WithConfig(cfg))
+				return err
+			})
+		}},
+		{"patch", func() error {
+			src, err := os.Open(srcPath)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			return withFiles(deltaPath, outPath, func(in *os.File, out *os.File) error {
+				_, err := delta.ApplyPatch(ctx, src, in, out, delta.WithConfig(cfg))
+				return err
+			})
+		}},
+		{"verify", func() error {
+			src, err := os.Open(srcPath)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			in, err := os.Open(deltaPath)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			_, _, err = delta.Verify(ctx, src, in, delta.WithConfig(cfg))
+			return err
+		}},
+	}
+
+	blocks := (size + int64(cfg.BlockSize) - 1) / int64(cfg.BlockSize)
+	fmt.Printf("# size: %d bytes, block size: %d, mutated: %.1f%%\n", size, cfg.BlockSize, mutate)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "phase\ttime\tMB/s\tblocks\t")
+	for _, p := range phases {
+		start := time.Now()
+		if err = p.run(); err != nil {
+			return fmt.Errorf("%s: %w", p.name, err)
+		}
+		elapsed := time.Since(start)
+		fmt.Fprintf(tw, "%s\t%s\t%.1f\t%d\t\n", p.name, elapsed.Round(time.Millisecond),
+			float64(size)/(1<<20)/elapsed.Seconds(), blocks)
+	}
+	if err = tw.Flush(); err != nil {
+		return err
+	}
+
+	// The sweep compares the delta sizes with and without compressed
+	// literals, lz4 unless -literal-compression selects another.
+	literals := cfg.LiteralCompression
+	if literals == delta.CompressNone {
+		literals = delta.CompressLZ4
+	}
+	fmt.Println()
+	tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "block size\tdelta size\t%s literals\t\n", literals)
+	for bs := 1024; bs <= 64*1024; bs *= 2 {
+		sweep := cfg
+		sweep.BlockSize = bs
+		sweep.LiteralCompression = delta.CompressNone
+		n, err := deltaSize(ctx, sweep, srcPath, newPath)
+		if err != nil {
+			return fmt.Errorf("block size %d: %w", bs, err)
+		}
+		// librsync and vcdiff deltas have no compressed literals.
+		if cfg.Format == delta.FormatLibrsync || cfg.Format == delta.FormatVCDIFF {
+			fmt.Fprintf(tw, "%d\t%d\t-\t\n", bs, n)
+			continue
+		}
+		sweep.LiteralCompression = literals
+		compressed, err := deltaSize(ctx, sweep, srcPath, newPath)
+		if err != nil {
+			return fmt.Errorf("block size %d with %s literals: %w", bs, literals, err)
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t\n", bs, n, compressed)
+	}
+	return tw.Flush()
+}
+
+// withFiles opens inPath, creates outPath and passes both to fn.
+func withFiles(inPath, outPath string, fn func(in *os.File, out *os.File) error) error {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return fn(in, out)
+}
+
+// deltaSize returns the size of the delta from srcPath to newPath made
+// with cfg, keeping the fingerprint in memory.
+func deltaSize(ctx context.Context, cfg delta.Config, srcPath, newPath string) (int64, error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	var fp bytes.Buffer
+	if err = delta.GenerateFingerprint(ctx, src, &fp, delta.WithConfig(cfg)); err != nil {
+		return 0, err
+	}
+	in, err := os.Open(newPath)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	counter := &byteCounter{}
+	if _, err = delta.MakeDiff(ctx, &fp, in, counter, delta.WithConfig(cfg)); err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+// byteCounter discards what is written to it and counts the bytes.
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
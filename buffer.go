@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bufio"
+	"io"
+)
+
+// encodeBuffer is the -encode-buffer size in bytes, 0 leaves fingerprint
+// I/O unbuffered.
+var encodeBuffer int64
+
+// bufferedWriter wraps w in a buffer of -encode-buffer bytes, so a slow
+// file system sees a few large writes instead of one per record. The
+// returned function flushes the buffer.
+func bufferedWriter(w io.Writer) (io.Writer, func() error) {
+	if encodeBuffer <= 0 {
+		return w, func() error { return nil }
+	}
+	bw := bufio.NewWriterSize(w, int(encodeBuffer))
+	return bw, bw.Flush
+}
+
+// bufferedReader wraps r in a buffer of -encode-buffer bytes.
+func bufferedReader(r io.Reader) io.Reader {
+	if encodeBuffer <= 0 {
+		return r
+	}
+	return bufio.NewReaderSize(r, int(encodeBuffer))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/Elbandi/godelta/delta"
+)
+
+// latencyWriter simulates a file on a high-latency file system, like NFS,
+// where every write costs a round trip.
+type latencyWriter struct {
+	latency time.Duration
+	writes  int
+}
+
+func (l *latencyWriter) Write(p []byte) (int, error) {
+	time.Sleep(l.latency)
+	l.writes++
+	return len(p), nil
+}
+
+func BenchmarkEncodeBuffer(b *testing.B) {
+	defer func(size int64) { encodeBuffer = size }(encodeBuffer)
+	src := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(src)
+	for _, size := range []int64{0, 4 << 20} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			encodeBuffer = size
+			dst := &latencyWriter{latency: 100 * time.Microsecond}
+			b.SetBytes(int64(len(src)))
+			for b.Loop() {
+				dst.writes = 0
+				out, flush := bufferedWriter(dst)
+				if err := delta.GenerateFingerprint(context.Background(), bytes.NewReader(src), out, delta.WithBlockSize(1024)); err != nil {
+					b.Fatal(err)
+				}
+				if err := flush(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(dst.writes), "writes/op")
+		})
+	}
+}
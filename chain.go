@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/Elbandi/godelta/delta"
+)
+
+// spillBuffer keeps the data written to it in memory up to limit bytes and
+// moves it to a temporary file beyond that.
+type spillBuffer struct {
+	limit int64
+	buf   bytes.Buffer
+	f     *os.File
+}
+
+func (s *spillBuffer) Write(p []byte) (int, error) {
+	if s.f == nil && int64(s.buf.Len()+len(p)) > s.limit {
+		f, err := os.CreateTemp(*tmpDir, "godelta-chain")
+		if err != nil {
+			return 0, err
+		}
+		s.f = f
+		if _, err = s.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+	if s.f != nil {
+		return s.f.Write(p)
+	}
+	return s.buf.Write(p)
+}
+
+// ReaderAt returns the written data.
+func (s *spillBuffer) ReaderAt() io.ReaderAt {
+	if s.f != nil {
+		return s.f
+	}
+	return bytes.NewReader(s.buf.Bytes())
+}
+
+// Close releases the memory or removes the temporary file.
+func (s *spillBuffer) Close() error {
+	s.buf = bytes.Buffer{}
+	if s.f == nil {
+		return nil
+	}
+	s.f.Close()
+	return os.Remove(s.f.Name())
+}
+
+// chainDeltas applies the comma separated deltas one after the other to
+// the base file. The intermediate versions are kept in memory up to
+// memLimit bytes each, in temporary files beyond that.
+func chainDeltas(ctx context.Context, cfg delta.Config, deltas string, memLimit string) error {
+	if deltas == "" {
+		return errors.New("chain requires -deltas")
+	}
+	limit, err := parseSize(memLimit)
+	if err != nil {
+		return err
+	}
+	paths := strings.Split(deltas, ",")
+
+	srcFile, err := os.Open(*sourcefilePath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	outFile := os.Stdout
+	var tmpFile *atomicFile
+	if *outfilePath != "" {
+		tmpFile, err = createAtomic(*outfilePath)
+		if err != nil {
+			return err
+		}
+		defer tmpFile.Abort()
+		outFile = tmpFile.File
+	}
+
+	var src io.ReaderAt = srcFile
+	var prev *spillBuffer
+	var datahash []byte
+	for i, path := range paths {
+		var out io.Writer = outFile
+		var stage *spillBuffer
+		if i < len(paths)-1 {
+			stage = &spillBuffer{limit: limit}
+			out = stage
+		}
+		datahash, err = applyStage(ctx, cfg, src, path, out)
+		if prev != nil {
+			prev.Close()
+		}
+		if err != nil {
+			if stage != nil {
+				stage.Close()
+			}
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		slog.Debug("delta applied", "phase", "patch", "file", path, "datahash", hex.EncodeToString(datahash))
+		if stage != nil {
+			src = stage.ReaderAt()
+			prev = stage
+		}
+	}
+	if err = commitOutput(ctx, tmpFile); err != nil {
+		return err
+	}
+	slog.Info("patch applied", "phase", "patch", "file", *outfilePath, "datahash", hex.EncodeToString(datahash))
+	return nil
+}
+
+// applyStage applies the delta at path to src and writes the result to out.
+func applyStage(ctx context.Context, cfg delta.Config, src io.ReaderAt, path string, out io.Writer) ([]byte, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	return delta.ApplyPatch(ctx, src, in, out, delta.WithConfig(cfg))
+}
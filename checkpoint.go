@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Elbandi/godelta/delta"
+)
+
+// partialFile is the output of a checkpointed patch. It is written in
+// place at path.partial with the checkpoints in path.checkpoint, which
+// both stay when the patch is interrupted, and renamed to path on Commit.
+type partialFile struct {
+	*os.File
+	path       string
+	checkpoint string
+}
+
+// openPartial opens the partial output for path and sets up the
+// checkpoints of cfg. With resume, it continues from the last checkpoint.
+func openPartial(path string, every int, resume bool, cfg *delta.Config) (*partialFile, error) {
+	if path == "" {
+		return nil, errors.New("-checkpoint-every and -resume require -out")
+	}
+	p := &partialFile{path: path, checkpoint: path + ".checkpoint"}
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if resume {
+		data, err := os.ReadFile(p.checkpoint)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resume: %w", err)
+		}
+		var cp delta.Checkpoint
+		if err = json.Unmarshal(data, &cp); err != nil {
+			return nil, fmt.Errorf("%w: %v", delta.ErrCheckpointMismatch, err)
+		}
+		cfg.Resume = &cp
+		flags = os.O_RDWR
+	} else if err := os.Remove(p.checkpoint); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path+".partial", flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p.File = f
+	cfg.CheckpointEvery = every
+	cfg.CheckpointFunc = p.save
+	return p, nil
+}
+
+// save records cp once the output up to it is on disk.
+func (p *partialFile) save(cp delta.Checkpoint) error {
+	if err := p.Sync(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	f, err := createAtomic(p.checkpoint)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// Commit renames the complete output to its path and removes the
+// checkpoint.
+func (p *partialFile) Commit() error {
+	if err := p.Sync(); err != nil {
+		return err
+	}
+	if err := p.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(p.Name(), p.path); err != nil {
+		return err
+	}
+	if err := os.Remove(p.checkpoint); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
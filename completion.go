@@ -0,0 +1,195 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/Elbandi/godelta/delta"
+)
+
+// actions are the subcommands given after the flags.
+var actions = []string{
+	"fpgen", "updatefp", "optimize", "check", "diff", "patch", "verify", "reverse", "compose", "merge-fp", "diff3", "chain",
+	"batch", "watch", "benchmark", "serve", "grpc-serve", "grpc-client", "info", "inspect", "stats", "split", "join", "completion",
+}
+
+// Flags completed with file and directory names.
+var (
+	fileFlags = map[string]bool{
+		"file": true, "in": true, "out": true, "fp": true, "manifest": true, "config": true, "exclude-from": true,
+		"delta1": true, "delta2": true, "fp1": true, "fp2": true, "base": true, "a": true, "b": true,
+		"conflict-map": true, "tls-cert": true, "tls-key": true, "tls-ca": true,
+	}
+	dirFlags = map[string]bool{"root": true}
+)
+
+// flagValues returns the values completed for the flags that take one of
+// a fixed set.
+func flagValues() map[string][]string {
+	return map[string][]string{
+		"hash":                delta.HashAlgorithms(),
+		"format":              {"gob", "json", "msgpack", "librsync", "vcdiff", "zsync", "compact", "proto"},
+		"compress":            {"none", "gzip", "zstd", "lz4"},
+		"compress-fp":         {"none", "gzip", "zstd", "lz4"},
+		"literal-compression": {"none", "gzip", "zstd", "lz4"},
+		"chunking":            {"fixed", "cdc"},
+		"weak-hash":           {"gsync", "adler32", "crc32"},
+		"log-format":          {"text", "json"},
+		"rpc":                 {"fingerprint", "delta", "apply"},
+	}
+}
+
+// printCompletion writes the completion script of the shell to w.
+func printCompletion(w io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		return bashCompletion(w)
+	case "zsh":
+		return zshCompletion(w)
+	case "fish":
+		return fishCompletion(w)
+	}
+	return fmt.Errorf("unknown shell %q, expected bash, zsh or fish", shell)
+}
+
+// flagsOf returns the flags sorted by name.
+func flagsOf() []*flag.Flag {
+	var flags []*flag.Flag
+	flag.VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags
+}
+
+func bashCompletion(w io.Writer) error {
+	var names, files, dirs, takesValue []string
+	for _, f := range flagsOf() {
+		names = append(names, "-"+f.Name)
+		if !isBoolFlag(f) {
+			takesValue = append(takesValue, "-"+f.Name, "--"+f.Name)
+		}
+		if fileFlags[f.Name] {
+			files = append(files, "-"+f.Name, "--"+f.Name)
+		}
+		if dirFlags[f.Name] {
+			dirs = append(dirs, "-"+f.Name, "--"+f.Name)
+		}
+	}
+	fmt.Fprintf(w, `# bash completion for godelta
+#
+# Install it for the current user by adding this line to ~/.bashrc:
+#   source <(godelta completion bash)
+# or for every user with:
+#   godelta completion bash > /etc/bash_completion.d/godelta
+
+_godelta() {
+	local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"
+	COMPREPLY=()
+	case "$prev" in
+	%s)
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return
+		;;
+	%s)
+		COMPREPLY=($(compgen -d -- "$cur"))
+		return
+		;;
+`, strings.Join(files, "|"), strings.Join(dirs, "|"))
+	values := flagValues()
+	for _, f := range flagsOf() {
+		if v, ok := values[f.Name]; ok {
+			fmt.Fprintf(w, "\t-%s|--%s)\n\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\t\treturn\n\t\t;;\n", f.Name, f.Name, strings.Join(v, " "))
+		}
+	}
+	fmt.Fprintf(w, `	%s)
+		return
+		;;
+	completion)
+		COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur"))
+		return
+		;;
+	esac
+	if [[ "$cur" == -* ]]; then
+		COMPREPLY=($(compgen -W %q -- "$cur"))
+	else
+		COMPREPLY=($(compgen -W %q -- "$cur"))
+	fi
+}
+complete -F _godelta godelta
+`, strings.Join(takesValue, "|"), strings.Join(names, " "), strings.Join(actions, " "))
+	return nil
+}
+
+// zshQuote escapes s for a description or value list of _arguments.
+var zshQuote = strings.NewReplacer(`'`, `'\''`, `:`, `\:`, `[`, `\[`, `]`, `\]`)
+
+func zshCompletion(w io.Writer) error {
+	fmt.Fprint(w, `#compdef godelta
+#
+# Install it by writing it to a file called _godelta in a directory of
+# $fpath, e.g.:
+#   godelta completion zsh > "${fpath[1]}/_godelta"
+# and start a new shell. To load it only in the current shell run:
+#   source <(godelta completion zsh); compdef _godelta godelta
+
+_godelta() {
+	_arguments \
+`)
+	values := flagValues()
+	for _, f := range flagsOf() {
+		spec := fmt.Sprintf("-%s[%s]", f.Name, zshQuote.Replace(f.Usage))
+		switch {
+		case isBoolFlag(f):
+		case fileFlags[f.Name]:
+			spec += ":file:_files"
+		case dirFlags[f.Name]:
+			spec += ":directory:_files -/"
+		case values[f.Name] != nil:
+			spec += fmt.Sprintf(":%s:(%s)", f.Name, strings.Join(values[f.Name], " "))
+		default:
+			spec += ":" + f.Name + ": "
+		}
+		fmt.Fprintf(w, "\t\t'%s' \\\n", spec)
+	}
+	fmt.Fprintf(w, "\t\t'1:action:(%s)' \\\n", strings.Join(actions, " "))
+	fmt.Fprint(w, `		'2:shell:(bash zsh fish)'
+}
+
+_godelta "$@"
+`)
+	return nil
+}
+
+// fishQuote escapes s for a single quoted fish string.
+var fishQuote = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+func fishCompletion(w io.Writer) error {
+	fmt.Fprintf(w, `# fish completion for godelta
+#
+# Install it with:
+#   godelta completion fish > ~/.config/fish/completions/godelta.fish
+
+complete -c godelta -f
+complete -c godelta -n __fish_use_subcommand -a '%s'
+complete -c godelta -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'
+`, strings.Join(actions, " "))
+	values := flagValues()
+	for _, f := range flagsOf() {
+		args := ""
+		switch {
+		case isBoolFlag(f):
+		case fileFlags[f.Name]:
+			args = " -r -F"
+		case dirFlags[f.Name]:
+			args = " -r -a '(__fish_complete_directories)'"
+		case values[f.Name] != nil:
+			args = fmt.Sprintf(" -r -a '%s'", strings.Join(values[f.Name], " "))
+		default:
+			args = " -r"
+		}
+		fmt.Fprintf(w, "complete -c godelta -o %s%s -d '%s'\n", f.Name, args, fishQuote.Replace(f.Usage))
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Flags that make no sense in a config file.
+var configSkipped = map[string]bool{"config": true, "version": true}
+
+func init() {
+	flag.Usage = usage
+}
+
+// usage prints the flags followed by the TOML keys the config files accept.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nConfig file keys, read from $HOME/.godelta.toml and then -config, overridden by the command line.\n")
+	fmt.Fprintf(out, "Every key is a flag name, flags that can be repeated take an array of strings:\n")
+	flag.VisitAll(func(f *flag.Flag) {
+		if configSkipped[f.Name] {
+			return
+		}
+		typ, _ := flag.UnquoteUsage(f)
+		switch typ {
+		case "":
+			typ = "bool"
+		case "value":
+			typ = "string"
+		case "duration":
+			typ = "string, a duration like \"1s\""
+		}
+		fmt.Fprintf(out, "  %s = %s\n", f.Name, typ)
+	})
+	printExitCodes(out)
+}
+
+// loadConfig sets the flags from $HOME/.godelta.toml, if it exists, and
+// then from the -config file of args. It runs before flag.Parse so the
+// command line overrides both files. Repeatable flags keep the values of
+// the files and the command line adds to them.
+func loadConfig(args []string) error {
+	var paths []string
+	if home, err := os.UserHomeDir(); err == nil {
+		path := filepath.Join(home, ".godelta.toml")
+		if _, err = os.Stat(path); err == nil {
+			paths = append(paths, path)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if path := configArg(args); path != "" {
+		paths = append(paths, path)
+	}
+	for _, path := range paths {
+		if err := applyConfig(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configArg returns the value of -config in args, which are parsed the way
+// flag.Parse does: up to the first argument that is not a flag.
+func configArg(args []string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || len(arg) < 2 || arg[0] != '-' {
+			return ""
+		}
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(arg[1:], "-"), "=")
+		if name == "config" {
+			if !hasValue && i+1 < len(args) {
+				value = args[i+1]
+			}
+			return value
+		}
+		f := flag.Lookup(name)
+		if f == nil || hasValue {
+			continue
+		}
+		if !isBoolFlag(f) {
+			i++
+		}
+	}
+	return ""
+}
+
+// isBoolFlag reports whether the flag takes no value on the command line.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// applyConfig sets the flags named by the keys of a TOML file.
+func applyConfig(path string) error {
+	values := make(map[string]interface{})
+	if _, err := toml.DecodeFile(path, &values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if configSkipped[key] || flag.Lookup(key) == nil {
+			return fmt.Errorf("%s: unknown key %q", path, key)
+		}
+		list, ok := values[key].([]interface{})
+		if !ok {
+			list = []interface{}{values[key]}
+		}
+		for _, v := range list {
+			if _, ok := v.(map[string]interface{}); ok {
+				return fmt.Errorf("%s: %s: tables are not supported", path, key)
+			}
+			if err := flag.Set(key, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("%s: %s: %w", path, key, err)
+			}
+		}
+	}
+	return nil
+}
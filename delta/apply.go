@@ -0,0 +1,111 @@
+package delta
+
+import (
+	"context"
+	"hash"
+	"io"
+	"sync"
+
+	"github.com/Elbandi/gsync"
+)
+
+type seqOperation struct {
+	seq uint64
+	op  gsync.BlockOperation
+}
+
+type seqBlock struct {
+	seq  uint64
+	data []byte
+	err  error
+}
+
+// parallelApply works like gsync.Apply, but resolves the operations on
+// workers goroutines. The blocks are numbered in delta order and a reorder
+// buffer writes them to dst in that order, however the workers finish.
+func parallelApply(ctx context.Context, dst io.Writer, src io.ReaderAt, datahash hash.Hash, ops <-chan gsync.BlockOperation, workers int) error {
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	blockSize := int64(gsync.BlockSize)
+	jobs := make(chan seqOperation)
+	results := make(chan seqBlock)
+	// Every block holds a slot until it is written, which bounds the
+	// reorder buffer when one worker falls behind.
+	slots := make(chan struct{}, workers*4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				b := seqBlock{seq: j.seq, data: j.op.Data}
+				if len(j.op.Data) == 0 {
+					buf := make([]byte, blockSize)
+					n, err := src.ReadAt(buf, int64(j.op.Index)*blockSize)
+					if err != nil && err != io.EOF {
+						b.err = err
+					}
+					b.data = buf[:n]
+				}
+				select {
+				case results <- b:
+				case <-workCtx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	var opsErr error
+	go func() {
+		defer close(jobs)
+		var seq uint64
+		for o := range ops {
+			if o.Error != nil {
+				opsErr = o.Error
+				return
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-workCtx.Done():
+				return
+			}
+			select {
+			case jobs <- seqOperation{seq: seq, op: o}:
+			case <-workCtx.Done():
+				return
+			}
+			seq++
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pending := make(map[uint64][]byte)
+	var next uint64
+	for b := range results {
+		if b.err != nil {
+			return b.err
+		}
+		pending[b.seq] = b.data
+		for data, ok := pending[next]; ok; data, ok = pending[next] {
+			delete(pending, next)
+			if _, err := dst.Write(data); err != nil {
+				return err
+			}
+			if datahash != nil {
+				datahash.Write(data)
+			}
+			<-slots
+			next++
+		}
+	}
+	if opsErr != nil {
+		return opsErr
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,47 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestParallelApplyOrder(t *testing.T) {
+	const literals = 12000
+	old := randomBytes(1, 64*testBlockSize)
+	// Every literal block is followed by a reference, so the workers
+	// resolve literals and source reads mixed.
+	var new []byte
+	for i := 0; i < literals; i++ {
+		new = append(new, randomBytes(int64(i)+2, testBlockSize)...)
+		off := i % 64 * testBlockSize
+		new = append(new, old[off:off+testBlockSize]...)
+	}
+	d, _ := roundTrip(t, old, new)
+	st, err := Stats(context.Background(), bytes.NewReader(d), int64(len(old)), WithBlockSize(testBlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.LiteralBlocks <= 10000 {
+		t.Fatalf("delta has %d literal blocks, want more than 10000", st.LiteralBlocks)
+	}
+
+	var sequential, parallel bytes.Buffer
+	want, err := ApplyPatch(context.Background(), bytes.NewReader(old), bytes.NewReader(d), &sequential, WithBlockSize(testBlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ApplyPatch(context.Background(), bytes.NewReader(old), bytes.NewReader(d), &parallel, WithBlockSize(testBlockSize), WithConcurrency(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parallel.Bytes(), sequential.Bytes()) {
+		t.Error("parallel patch differs from the sequential one")
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("datahash = %x, want %x", got, want)
+	}
+	if !bytes.Equal(sequential.Bytes(), new) {
+		t.Error("sequential patch differs from the new file")
+	}
+}
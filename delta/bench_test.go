@@ -0,0 +1,71 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+)
+
+const benchSize = 16 << 20
+
+// benchFiles returns a source file and a new file differing from it in
+// every 64th block.
+func benchFiles() (old, new []byte) {
+	old = randomBytes(1, benchSize)
+	new = bytes.Clone(old)
+	for off := 0; off < len(new); off += 64 * testBlockSize {
+		copy(new[off:], randomBytes(int64(off), 100))
+	}
+	return old, new
+}
+
+func BenchmarkGenerateFingerprint(b *testing.B) {
+	old, _ := benchFiles()
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(old)))
+			for b.Loop() {
+				err := GenerateFingerprint(context.Background(), bytes.NewReader(old), io.Discard,
+					WithBlockSize(testBlockSize), WithConcurrency(workers))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMakeDiff(b *testing.B) {
+	old, new := benchFiles()
+	var fp bytes.Buffer
+	if err := GenerateFingerprint(context.Background(), bytes.NewReader(old), &fp, WithBlockSize(testBlockSize)); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(new)))
+	for b.Loop() {
+		_, err := MakeDiff(context.Background(), bytes.NewReader(fp.Bytes()), bytes.NewReader(new), io.Discard,
+			WithBlockSize(testBlockSize))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkApplyPatch(b *testing.B) {
+	old, new := benchFiles()
+	d, _ := roundTrip(b, old, new)
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(new)))
+			for b.Loop() {
+				_, err := ApplyPatch(context.Background(), bytes.NewReader(old), bytes.NewReader(d), io.Discard,
+					WithBlockSize(testBlockSize), WithConcurrency(workers))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
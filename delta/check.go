@@ -0,0 +1,173 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"io"
+	"sort"
+
+	"github.com/Elbandi/gsync"
+)
+
+// FingerprintMismatch is a block whose signature in a fingerprint differs
+// from the one computed from the source file.
+type FingerprintMismatch struct {
+	Index uint64 `json:"block_index"`
+	// Field is "weak" or "strong" for a checksum mismatch, "missing" for a
+	// source block the fingerprint does not have and "extra" for a block of
+	// the fingerprint past the end of the source.
+	Field    string `json:"field"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+func (m FingerprintMismatch) String() string {
+	switch m.Field {
+	case "missing":
+		return fmt.Sprintf("block %d: not in the fingerprint", m.Index)
+	case "extra":
+		return fmt.Sprintf("block %d: past the end of the source file", m.Index)
+	}
+	return fmt.Sprintf("block %d: %s mismatch (expected %s, got %s)", m.Index, m.Field, m.Expected, m.Actual)
+}
+
+// CheckFingerprint computes the signatures of src with the block size,
+// chunking and strong hash recorded in the fingerprint read from fp and
+// returns the blocks whose weak or strong checksum differs. No mismatch
+// means fp is the intact fingerprint of src.
+func CheckFingerprint(ctx context.Context, fp io.Reader, src io.Reader, opts ...Option) (mismatches []FingerprintMismatch, err error) {
+	ctx, span := tracer.Start(ctx, "CheckFingerprint")
+	defer func() { endSpan(span, err) }()
+
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	fr, err := NewFingerprintReader(fp)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFingerprintCorrupt, err)
+	}
+	strong, err := fr.strongHash()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFingerprintCorrupt, err)
+	}
+	expected := make(map[uint64]sigRecord)
+	for {
+		r, err := fr.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fingerprintCorrupt(err)
+		}
+		expected[r.Index] = r
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	counted := &countingReader{r: src}
+	blockSize := cfg.resolveBlockSize(fr.BlockSize)
+	var sigs <-chan checkedRecord
+	if fr.Chunking == ChunkCDC {
+		sigs = chunkRecords(ctx, counted, blockSize, strong)
+	} else {
+		gsync.BlockSize = blockSize
+		sigsCh, err := fr.WeakHash.signatures(ctx, counted, strong)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBlockChecksumFail, err)
+		}
+		defer drain(sigsCh)
+		sigs = blockRecords(ctx, sigsCh)
+	}
+
+	bar := cfg.newProgress("fpgen", int64(len(expected)))
+	for r := range sigs {
+		if r.err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBlockChecksumFail, r.err)
+		}
+		bar.Increment()
+		want, ok := expected[r.Index]
+		if !ok {
+			mismatches = append(mismatches, FingerprintMismatch{Index: r.Index, Field: "missing"})
+			continue
+		}
+		delete(expected, r.Index)
+		if want.Weak != r.Weak {
+			mismatches = append(mismatches, FingerprintMismatch{Index: r.Index, Field: "weak",
+				Expected: fmt.Sprintf("0x%08x", want.Weak), Actual: fmt.Sprintf("0x%08x", r.Weak)})
+		}
+		if !bytes.Equal(want.Strong, r.Strong) {
+			mismatches = append(mismatches, FingerprintMismatch{Index: r.Index, Field: "strong",
+				Expected: "0x" + hex.EncodeToString(want.Strong), Actual: "0x" + hex.EncodeToString(r.Strong)})
+		}
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	for index := range expected {
+		mismatches = append(mismatches, FingerprintMismatch{Index: index, Field: "extra"})
+	}
+	sort.SliceStable(mismatches, func(i, j int) bool { return mismatches[i].Index < mismatches[j].Index })
+	bar.Finish(counted.n, 0)
+	return mismatches, nil
+}
+
+// checkedRecord is a block signature computed by CheckFingerprint.
+type checkedRecord struct {
+	sigRecord
+	err error
+}
+
+// blockRecords converts the signatures of fixed size blocks.
+func blockRecords(ctx context.Context, sigsCh <-chan gsync.BlockSignature) <-chan checkedRecord {
+	out := make(chan checkedRecord)
+	go func() {
+		defer close(out)
+		for c := range sigsCh {
+			select {
+			case out <- checkedRecord{sigRecord: sigRecord{Index: c.Index, Weak: c.Weak, Strong: c.Strong}, err: c.Error}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// chunkRecords computes the signatures of the content-defined chunks of src
+// the way GenerateFingerprint does.
+func chunkRecords(ctx context.Context, src io.Reader, avg int, strong hash.Hash) <-chan checkedRecord {
+	out := make(chan checkedRecord)
+	go func() {
+		defer close(out)
+		ch := newChunker(src, avg)
+		var offset uint64
+		for index := uint64(0); ; index++ {
+			chunk, err := ch.next()
+			if err == io.EOF {
+				return
+			}
+			r := checkedRecord{err: err}
+			if err == nil {
+				strong.Reset()
+				strong.Write(chunk)
+				r.sigRecord = sigRecord{Index: index, Weak: adler32.Checksum(chunk), Strong: strong.Sum(nil), Offset: offset, Length: uint32(len(chunk))}
+				offset += uint64(len(chunk))
+			}
+			select {
+			case out <- r:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return out
+}
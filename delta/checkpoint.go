@@ -0,0 +1,105 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/Elbandi/gsync"
+)
+
+// Checkpoint records how far ApplyPatch got, so an interrupted patch can
+// continue from there.
+type Checkpoint struct {
+	// Operations is the number of delta operations written.
+	Operations uint64 `json:"operations"`
+	// Index is the Index of the last written operation.
+	Index uint64 `json:"index"`
+	// Size is the number of bytes written.
+	Size int64 `json:"size"`
+	// Hash is the SHA-256 of the written bytes.
+	Hash []byte `json:"hash"`
+}
+
+// CheckpointFunc receives a checkpoint once the output up to it was
+// written. An error stops the patch.
+type CheckpointFunc func(Checkpoint) error
+
+// resumeOutput checks that out starts with the bytes recorded by cp, feeds
+// them to datahash and positions out after them.
+func resumeOutput(out io.Writer, datahash hash.Hash, cp Checkpoint) error {
+	rws, ok := out.(io.ReadWriteSeeker)
+	if !ok {
+		return fmt.Errorf("resuming a patch requires an output supporting Read and Seek")
+	}
+	if _, err := rws.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(datahash, rws, cp.Size); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("%w: output is shorter than %d bytes", ErrCheckpointMismatch, cp.Size)
+		}
+		return err
+	}
+	// Sum does not change the state, so the hash continues after it.
+	if !bytes.Equal(datahash.Sum(nil), cp.Hash) {
+		return fmt.Errorf("%w: output does not match the checkpoint hash", ErrCheckpointMismatch)
+	}
+	// Drop what was written after the checkpoint.
+	if t, ok := out.(interface{ Truncate(int64) error }); ok {
+		if err := t.Truncate(cp.Size); err != nil {
+			return err
+		}
+	}
+	_, err := rws.Seek(cp.Size, io.SeekStart)
+	return err
+}
+
+// checkpointApply works like gsync.Apply, but skips the operations written
+// before cfg.Resume and passes a checkpoint to cfg.CheckpointFunc after
+// every cfg.CheckpointEvery operations. dst must count the bytes from the
+// start of the output.
+func checkpointApply(ctx context.Context, dst *countingWriter, src io.ReaderAt, datahash hash.Hash, ops <-chan gsync.BlockOperation, cfg Config) error {
+	var cp Checkpoint
+	if cfg.Resume != nil {
+		cp = *cfg.Resume
+	}
+	skip := cp.Operations
+	buf := make([]byte, gsync.BlockSize)
+	for o := range ops {
+		if o.Error != nil {
+			return o.Error
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		b := o.Data
+		if len(b) == 0 {
+			n, err := src.ReadAt(buf, int64(o.Index)*int64(gsync.BlockSize))
+			if err != nil && err != io.EOF {
+				return err
+			}
+			b = buf[:n]
+		}
+		if _, err := dst.Write(b); err != nil {
+			return err
+		}
+		datahash.Write(b)
+		cp.Operations++
+		cp.Index = o.Index
+		if cfg.CheckpointFunc != nil && cfg.CheckpointEvery > 0 && cp.Operations%uint64(cfg.CheckpointEvery) == 0 {
+			cp.Size = dst.n
+			cp.Hash = datahash.Sum(nil)
+			if err := cfg.CheckpointFunc(cp); err != nil {
+				return fmt.Errorf("checkpoint: %w", err)
+			}
+		}
+	}
+	if skip > 0 {
+		return fmt.Errorf("%w: delta has fewer operations than the checkpoint", ErrCheckpointMismatch)
+	}
+	return ctx.Err()
+}
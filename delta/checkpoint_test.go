@@ -0,0 +1,64 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	old := randomBytes(1, 100*testBlockSize)
+	new := append(randomBytes(2, 50*testBlockSize), old[:100*testBlockSize]...)
+	d, _ := roundTrip(t, old, new)
+	st, err := Stats(context.Background(), bytes.NewReader(d), int64(len(old)), WithBlockSize(testBlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	// Interrupts the patch once half of the operations were written.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var last Checkpoint
+	interrupted := Config{
+		BlockSize:       testBlockSize,
+		CheckpointEvery: 10,
+		CheckpointFunc: func(cp Checkpoint) error {
+			last = cp
+			if int64(cp.Operations) >= st.TotalBlocks/2 {
+				cancel()
+			}
+			return nil
+		},
+	}
+	_, err = ApplyPatch(ctx, bytes.NewReader(old), bytes.NewReader(d), out, WithConfig(interrupted))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted patch returned %v, want %v", err, context.Canceled)
+	}
+	if last.Operations == 0 || int64(last.Operations) >= st.TotalBlocks {
+		t.Fatalf("checkpoint after %d of %d operations", last.Operations, st.TotalBlocks)
+	}
+
+	resumed := Config{BlockSize: testBlockSize, CheckpointEvery: 10, Resume: &last}
+	if _, err = ApplyPatch(context.Background(), bytes.NewReader(old), bytes.NewReader(d), out, WithConfig(resumed)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = out.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, new) {
+		t.Errorf("resumed patch wrote %d bytes, want %d bytes of the new file", len(got), len(new))
+	}
+}
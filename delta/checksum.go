@@ -0,0 +1,101 @@
+package delta
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// Fingerprints with flagChecksum end with the big endian CRC-32 (IEEE) of
+// their content before it, header included. With compression the CRC is
+// the end of the decompressed stream. JSON fingerprints end with a line
+// holding it in hex instead.
+
+// checksumWriter appends the CRC-32 of the data written through it on
+// Close, before closing the underlying writer. With text it is appended
+// as a jsonChecksum line.
+type checksumWriter struct {
+	w    io.WriteCloser
+	crc  hash.Hash32
+	text bool
+}
+
+func newChecksumWriter(w io.WriteCloser, text bool) *checksumWriter {
+	return &checksumWriter{w: w, crc: crc32.NewIEEE(), text: text}
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.crc.Write(p[:n])
+	return n, err
+}
+
+func (c *checksumWriter) Close() error {
+	sum := c.crc.Sum(nil)
+	if c.text {
+		line, err := json.Marshal(jsonChecksum{hex.EncodeToString(sum)})
+		if err != nil {
+			return err
+		}
+		sum = append(line, '\n')
+	}
+	if _, err := c.w.Write(sum); err != nil {
+		return err
+	}
+	return c.w.Close()
+}
+
+// checksumReader passes the data read from r through except for its last
+// crc32.Size bytes, which it compares with the CRC-32 of the data instead
+// of returning io.EOF.
+type checksumReader struct {
+	r   io.Reader
+	crc hash.Hash32
+	// pending holds the data read from r but not returned yet, at least
+	// the last crc32.Size bytes read.
+	pending []byte
+	buf     []byte
+	err     error
+}
+
+func newChecksumReader(r io.Reader) *checksumReader {
+	return &checksumReader{r: r, crc: crc32.NewIEEE(), buf: make([]byte, 32<<10)}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	for len(c.pending) <= crc32.Size && c.err == nil {
+		n, err := c.r.Read(c.buf)
+		c.pending = append(c.pending, c.buf[:n]...)
+		c.err = err
+	}
+	if c.err != nil && c.err != io.EOF {
+		return 0, c.err
+	}
+	if avail := len(c.pending) - crc32.Size; avail > 0 {
+		n := copy(p, c.pending[:avail])
+		c.crc.Write(p[:n])
+		c.pending = c.pending[:copy(c.pending, c.pending[n:])]
+		return n, nil
+	}
+	if len(c.pending) < crc32.Size {
+		return 0, fmt.Errorf("%w: checksum missing", ErrFingerprintChecksumFail)
+	}
+	if stored, actual := binary.BigEndian.Uint32(c.pending), c.crc.Sum32(); stored != actual {
+		return 0, fmt.Errorf("%w: stored %08x, computed %08x", ErrFingerprintChecksumFail, stored, actual)
+	}
+	return 0, io.EOF
+}
+
+// fingerprintCorrupt wraps err, a failure to read a fingerprint, in
+// ErrFingerprintCorrupt. Checksum failures stay detectable as such.
+func fingerprintCorrupt(err error) error {
+	if errors.Is(err, ErrFingerprintChecksumFail) {
+		return fmt.Errorf("%w: %w", ErrFingerprintCorrupt, err)
+	}
+	return fmt.Errorf("%w: %v", ErrFingerprintCorrupt, err)
+}
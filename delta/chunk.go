@@ -0,0 +1,239 @@
+package delta
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"math/bits"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Chunking selects how files are split into blocks.
+type Chunking string
+
+const (
+	// ChunkFixed splits files into blocks of BlockSize bytes.
+	ChunkFixed Chunking = "fixed"
+	// ChunkCDC cuts blocks where the content matches a rolling gear hash,
+	// so an insertion only changes the blocks around it. BlockSize is the
+	// average block size.
+	ChunkCDC Chunking = "cdc"
+)
+
+// ParseChunking returns the Chunking named by s.
+func ParseChunking(s string) (Chunking, error) {
+	switch c := Chunking(s); c {
+	case ChunkFixed, ChunkCDC:
+		return c, nil
+	case "":
+		return ChunkFixed, nil
+	}
+	return "", fmt.Errorf("unknown chunking: %s", s)
+}
+
+// gearTable holds the random values of the gear hash. Chunked fingerprints
+// depend on it, it must never change.
+var gearTable = func() (t [256]uint64) {
+	// splitmix64
+	x := uint64(0x676f64656c7461)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
+
+// chunker splits a stream into content-defined chunks of avg bytes on
+// average, between avg/4 and avg*4 bytes long.
+type chunker struct {
+	r        *bufio.Reader
+	min, max int
+	mask     uint64
+}
+
+func newChunker(r io.Reader, avg int) *chunker {
+	min, max := avg/4, avg*4
+	// The cut condition holds once every 2^n bytes past min.
+	n := bits.Len(uint(avg-min)) - 1
+	return &chunker{
+		r:    bufio.NewReaderSize(r, max),
+		min:  min,
+		max:  max,
+		mask: (1<<uint(n) - 1) << uint(64-n),
+	}
+}
+
+// next returns the next chunk, or io.EOF at the end of the stream.
+func (c *chunker) next() ([]byte, error) {
+	buf, err := c.r.Peek(c.max)
+	if len(buf) == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	n := c.cut(buf)
+	chunk := make([]byte, n)
+	copy(chunk, buf)
+	_, err = c.r.Discard(n)
+	return chunk, err
+}
+
+// cut returns the length of the chunk at the start of buf.
+func (c *chunker) cut(buf []byte) int {
+	if len(buf) <= c.min {
+		return len(buf)
+	}
+	var h uint64
+	for i := c.min; i < len(buf); i++ {
+		h = h<<1 + gearTable[buf[i]]
+		if h&c.mask == 0 {
+			return i + 1
+		}
+	}
+	return len(buf)
+}
+
+// diffChunks is MakeDiff for chunked fingerprints. in is split the same
+// way as the source file and every chunk found in the fingerprint becomes
+// a reference to the source chunk.
+func diffChunks(ctx context.Context, cfg Config, fpReader *FingerprintReader, strong hash.Hash, in io.Reader, out io.Writer, bar *progress) ([]byte, error) {
+	logger := cfg.logger()
+	logger.Debug("create lookup table", "phase", "diff")
+	_, lookupSpan := tracer.Start(ctx, "build lookup table")
+	chunks := make(map[string]sigRecord)
+	var err error
+	for {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		var r sigRecord
+		r, err = fpReader.next()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			err = fingerprintCorrupt(err)
+			break
+		}
+		if _, ok := chunks[string(r.Strong)]; !ok {
+			chunks[string(r.Strong)] = r
+		}
+		bar.Increment()
+	}
+	endSpan(lookupSpan, err)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("lookup table loaded", "phase", "diff")
+	if err = cfg.checkSourceHash(fpReader.SourceHash); err != nil {
+		return nil, err
+	}
+
+	logger.Debug("create block diff", "phase", "diff")
+	bar.Reset(cfg.inputSize(in) / int64(cfg.BlockSize))
+	counted := &countingReader{r: in}
+	datahash := sha256.New()
+	written := &countingWriter{w: out}
+	// The number of chunks is not known in advance.
+	dw, err := newDeltaWriter(written, cfg, 0, fpReader.SourceHash)
+	if err != nil {
+		return nil, err
+	}
+	ch := newChunker(io.TeeReader(counted, datahash), cfg.BlockSize)
+	if err = writeChunkOperations(ctx, logger, dw, ch, strong, chunks, bar); err != nil {
+		return nil, err
+	}
+	if err = dw.close(datahash.Sum(nil), counted.n); err != nil {
+		return nil, err
+	}
+	logger.Debug("diff done", "phase", "diff", "bytesProcessed", counted.n)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("godelta.blocks", bar.done),
+		attribute.Int64("godelta.file_size", counted.n), attribute.Int64("godelta.delta_size", written.n))
+	bar.Finish(counted.n, written.n)
+	return datahash.Sum(nil), nil
+}
+
+// writeChunkOperations writes a reference for every chunk of ch found in
+// chunks and a literal for the others.
+func writeChunkOperations(ctx context.Context, logger *slog.Logger, dw *deltaWriter, ch *chunker, strong hash.Hash, chunks map[string]sigRecord, bar *progress) (err error) {
+	_, span := tracer.Start(ctx, "sync blocks")
+	defer func() { endSpan(span, err) }()
+
+	var chunk []byte
+	for index := uint64(0); ; index++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		chunk, err = ch.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("diff error: %w", err)
+		}
+		strong.Reset()
+		strong.Write(chunk)
+		r, ok := chunks[string(strong.Sum(nil))]
+		if ok {
+			err = dw.writeRecord(opRecord{Index: r.Index, Offset: r.Offset, Length: r.Length})
+			bar.Match()
+		} else {
+			err = dw.writeRecord(opRecord{Data: chunk})
+			bar.Literal(len(chunk))
+		}
+		if err != nil {
+			return err
+		}
+		if logger.Enabled(ctx, slog.LevelDebug) {
+			logger.Debug("block operation", "phase", "diff", "op", index, "blockIndex", r.Index, "matched", ok, "length", len(chunk))
+		}
+		bar.Increment()
+	}
+}
+
+// applyChunks writes the file described by the chunked delta dr to dst,
+// reading the referenced chunks from src.
+func applyChunks(ctx context.Context, dst io.Writer, src io.ReaderAt, datahash hash.Hash, dr *deltaReader, bar *progress) error {
+	var buf []byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r, err := dr.nextRecord()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data := r.Data
+		if data == nil {
+			if cap(buf) < int(r.Length) {
+				buf = make([]byte, r.Length)
+			}
+			data = buf[:r.Length]
+			if _, err = src.ReadAt(data, int64(r.Offset)); err != nil {
+				return fmt.Errorf("chunk %d at offset %d: %w", r.Index, r.Offset, err)
+			}
+			bar.Match()
+		} else {
+			bar.Literal(len(data))
+		}
+		if _, err = dst.Write(data); err != nil {
+			return err
+		}
+		datahash.Write(data)
+		bar.Increment()
+	}
+}
@@ -0,0 +1,107 @@
+package delta
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+)
+
+// Compact fingerprints store every block in compactRecordSize bytes: the
+// big endian weak checksum, the first compactStrongSize bytes of the strong
+// hash and the big endian block index. The trailer starts with an index of
+// compactTrailerIndex, followed by the SHA-256 of the source, its size and
+// the length prefixed state of the SHA-256.
+const (
+	compactStrongSize   = 8
+	compactRecordSize   = 4 + compactStrongSize + 8
+	compactTrailerIndex = math.MaxUint64
+)
+
+// truncatedHash returns the first size bytes of the sum of a strong hash,
+// so that blocks compare equal to the truncated hashes of compact
+// fingerprints.
+type truncatedHash struct {
+	hash.Hash
+	size int
+}
+
+func (h truncatedHash) Sum(b []byte) []byte {
+	return append(b, h.Hash.Sum(nil)[:h.size]...)
+}
+
+func (h truncatedHash) Size() int {
+	return h.size
+}
+
+type compactSigEncoder struct {
+	w io.Writer
+}
+
+// Encode writes r without its offset and length, compact fingerprints only
+// hold fixed size blocks.
+func (e *compactSigEncoder) Encode(r sigRecord) error {
+	if len(r.Strong) < compactStrongSize {
+		return fmt.Errorf("block %d: strong hash of %d bytes is too short", r.Index, len(r.Strong))
+	}
+	buf := make([]byte, compactRecordSize)
+	binary.BigEndian.PutUint32(buf, r.Weak)
+	copy(buf[4:], r.Strong[:compactStrongSize])
+	binary.BigEndian.PutUint64(buf[4+compactStrongSize:], r.Index)
+	_, err := e.w.Write(buf)
+	return err
+}
+
+func (e *compactSigEncoder) EncodeTrailer(t sigRecord) error {
+	buf := make([]byte, 8, 8+len(t.SourceHash)+8+2+len(t.SourceState))
+	binary.BigEndian.PutUint64(buf, compactTrailerIndex)
+	buf = append(buf, t.SourceHash...)
+	buf = binary.BigEndian.AppendUint64(buf, t.SourceSize)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(t.SourceState)))
+	buf = append(buf, t.SourceState...)
+	_, err := e.w.Write(buf)
+	return err
+}
+
+type compactSigDecoder struct {
+	r io.Reader
+}
+
+func (d *compactSigDecoder) Decode(r *sigRecord) error {
+	*r = sigRecord{}
+	buf := make([]byte, compactRecordSize)
+	if _, err := io.ReadFull(d.r, buf[:8]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint64(buf) == compactTrailerIndex {
+		return d.decodeTrailer(r)
+	}
+	if _, err := io.ReadFull(d.r, buf[8:]); err != nil {
+		return noEOF(err)
+	}
+	r.Weak = binary.BigEndian.Uint32(buf)
+	r.Strong = append([]byte(nil), buf[4:4+compactStrongSize]...)
+	r.Index = binary.BigEndian.Uint64(buf[4+compactStrongSize:])
+	return nil
+}
+
+func (d *compactSigDecoder) decodeTrailer(r *sigRecord) error {
+	buf := make([]byte, 32+8+2)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return noEOF(err)
+	}
+	r.SourceHash = buf[:32]
+	r.SourceSize = binary.BigEndian.Uint64(buf[32:])
+	r.SourceState = make([]byte, binary.BigEndian.Uint16(buf[40:]))
+	_, err := io.ReadFull(d.r, r.SourceState)
+	return noEOF(err)
+}
+
+// noEOF turns io.EOF in the middle of a record into io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
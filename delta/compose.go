@@ -0,0 +1,170 @@
+package delta
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/Elbandi/gsync"
+)
+
+// extent is a run of the intermediate file produced by one operation of the
+// first delta.
+type extent struct {
+	offset int64
+	length int64
+	// index is the base block referenced when data is nil.
+	index uint64
+	data  []byte
+}
+
+// Compose merges first, a delta from base to an intermediate file, and
+// second, a delta from that intermediate file to a new one, into a single
+// delta from base to the new file written to out. baseSize is the size of
+// base. The literal data of first is held in memory, the intermediate file
+// is never rebuilt.
+func Compose(ctx context.Context, base io.ReaderAt, baseSize int64, first, second io.Reader, out io.Writer, opts ...Option) error {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	dr1, err := newDeltaReader(first, cfg)
+	if err != nil {
+		return err
+	}
+	dr2, err := newDeltaReader(second, cfg)
+	if err != nil {
+		return err
+	}
+	if dr1.chunked() || dr2.chunked() {
+		return fmt.Errorf("chunked deltas cannot be composed")
+	}
+	if cfg.EmbedSourceHashes {
+		return fmt.Errorf("composed deltas cannot embed source hashes")
+	}
+	if (dr1.header.Flags|dr2.header.Flags)&flagIndexed != 0 {
+		return fmt.Errorf("deltas with sorted operations cannot be composed")
+	}
+	if dr1.header.BlockSize != dr2.header.BlockSize {
+		return fmt.Errorf("deltas use different block sizes: %d and %d", dr1.header.BlockSize, dr2.header.BlockSize)
+	}
+	cfg.BlockSize = cfg.resolveBlockSize(int(dr1.header.BlockSize))
+	blockSize := int64(cfg.BlockSize)
+	// The composed delta goes from the source of first to the new file of
+	// second.
+	if cfg.FromVersion == "" {
+		cfg.FromVersion = dr1.header.FromVersion
+	}
+	if cfg.ToVersion == "" {
+		cfg.ToVersion = dr2.header.ToVersion
+	}
+
+	var extents []extent
+	var size int64
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		o, err := dr1.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		e := extent{offset: size, index: o.Index, data: o.Data}
+		if len(o.Data) > 0 {
+			e.length = int64(len(o.Data))
+		} else {
+			e.length = blockSize
+			if offset := int64(o.Index) * blockSize; offset+e.length > baseSize {
+				e.length = baseSize - offset
+			}
+			if e.length <= 0 {
+				return fmt.Errorf("%w: block %d is past the end of the base file", ErrDeltaCorrupt, o.Index)
+			}
+		}
+		extents = append(extents, e)
+		size += e.length
+	}
+
+	// outSize is the length of the new file, counted from the operations.
+	var outSize int64
+	bar := cfg.newProgress("compose", dr2.total)
+	dw, err := newDeltaWriter(out, cfg, dr2.total, dr1.header.BaseHash)
+	if err != nil {
+		return err
+	}
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		o, err := dr2.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(o.Data) == 0 {
+			o, err = resolveExtents(base, extents, int64(o.Index)*blockSize, blockSize, size)
+			if err != nil {
+				return err
+			}
+		}
+		if err = dw.write(o); err != nil {
+			return err
+		}
+		if len(o.Data) == 0 {
+			outSize += min(blockSize, baseSize-int64(o.Index)*blockSize)
+			bar.Match()
+		} else {
+			outSize += int64(len(o.Data))
+		}
+		bar.Increment()
+	}
+	if dr2.datahash == nil {
+		return fmt.Errorf("%w: second delta has no datahash", ErrDeltaCorrupt)
+	}
+	return dw.close(dr2.datahash, outSize)
+}
+
+// resolveExtents translates the block of the intermediate file at offset
+// into an operation on the base file. A block that is exactly one base
+// block stays a reference, anything else becomes a literal.
+func resolveExtents(base io.ReaderAt, extents []extent, offset, blockSize, size int64) (gsync.BlockOperation, error) {
+	length := blockSize
+	if offset+length > size {
+		length = size - offset
+	}
+	if length <= 0 {
+		return gsync.BlockOperation{}, fmt.Errorf("%w: block at offset %d is past the end of the intermediate file", ErrDeltaCorrupt, offset)
+	}
+	i := sort.Search(len(extents), func(i int) bool {
+		return extents[i].offset+extents[i].length > offset
+	})
+	if e := extents[i]; e.data == nil && e.offset == offset && e.length == length {
+		return gsync.BlockOperation{Index: e.index}, nil
+	}
+
+	data := make([]byte, 0, length)
+	for ; i < len(extents) && int64(len(data)) < length; i++ {
+		e := extents[i]
+		from := offset + int64(len(data)) - e.offset
+		n := e.length - from
+		if rest := length - int64(len(data)); n > rest {
+			n = rest
+		}
+		if e.data != nil {
+			data = append(data, e.data[from:from+n]...)
+			continue
+		}
+		buf := make([]byte, n)
+		if _, err := base.ReadAt(buf, int64(e.index)*blockSize+from); err != nil && err != io.EOF {
+			return gsync.BlockOperation{}, err
+		}
+		data = append(data, buf...)
+	}
+	return gsync.BlockOperation{Data: data}, nil
+}
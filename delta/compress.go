@@ -0,0 +1,159 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// CompressionType selects the compression of delta files.
+type CompressionType string
+
+const (
+	CompressNone CompressionType = "none"
+	CompressGzip CompressionType = "gzip"
+	CompressZstd CompressionType = "zstd"
+	CompressLZ4  CompressionType = "lz4"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4Magic  = []byte{0x04, 0x22, 0x4d, 0x18}
+)
+
+// ParseCompression returns the CompressionType named by s.
+func ParseCompression(s string) (CompressionType, error) {
+	switch c := CompressionType(s); c {
+	case CompressNone, CompressGzip, CompressZstd, CompressLZ4:
+		return c, nil
+	case "":
+		return CompressNone, nil
+	}
+	return "", fmt.Errorf("unknown compression: %s", s)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressWriter wraps w in a compressor for c. The returned writer must
+// be closed to flush the compressed stream.
+func compressWriter(w io.Writer, c CompressionType) (io.WriteCloser, error) {
+	switch c {
+	case CompressGzip:
+		return gzip.NewWriter(w), nil
+	case CompressZstd:
+		return zstd.NewWriter(w)
+	case CompressLZ4:
+		return lz4.NewWriter(w), nil
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// decompressReader detects the compression of r by its magic bytes and
+// returns a reader for the decompressed stream. Streams without known
+// magic bytes are returned as they are.
+func decompressReader(r io.Reader) (io.Reader, error) {
+	r, _, err := detectCompression(r)
+	return r, err
+}
+
+// detectCompression is decompressReader also returning the detected
+// compression.
+func detectCompression(r io.Reader) (io.Reader, CompressionType, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		return zr, CompressZstd, err
+	case bytes.HasPrefix(magic, lz4Magic):
+		return lz4.NewReader(br), CompressLZ4, nil
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		return zr, CompressGzip, err
+	}
+	return br, CompressNone, nil
+}
+
+// literalCompressor compresses the data of single literals with
+// Config.LiteralCompression, reusing one compressor for all of them.
+type literalCompressor struct {
+	buf bytes.Buffer
+	w   interface {
+		io.WriteCloser
+		Reset(io.Writer)
+	}
+}
+
+// newLiteralCompressor returns a compressor for c, nil for CompressNone.
+func newLiteralCompressor(c CompressionType) (*literalCompressor, error) {
+	if c == CompressNone || c == "" {
+		return nil, nil
+	}
+	lc := &literalCompressor{}
+	w, err := compressWriter(&lc.buf, c)
+	if err != nil {
+		return nil, err
+	}
+	lc.w = w.(interface {
+		io.WriteCloser
+		Reset(io.Writer)
+	})
+	return lc, nil
+}
+
+// compress returns data compressed, or nil if compressing does not make it
+// smaller. The result is only valid until the next call.
+func (lc *literalCompressor) compress(data []byte) ([]byte, error) {
+	lc.buf.Reset()
+	lc.w.Reset(&lc.buf)
+	if _, err := lc.w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := lc.w.Close(); err != nil {
+		return nil, err
+	}
+	if lc.buf.Len() >= len(data) {
+		return nil, nil
+	}
+	return lc.buf.Bytes(), nil
+}
+
+// literalDecoder decodes the zstd compressed literals of all deltas. A
+// zstd.Decoder per literal would start its goroutines for every one.
+var literalDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+})
+
+// decompressLiteral returns the data of a literal compressed by
+// literalCompressor, detecting its compression by the magic bytes.
+func decompressLiteral(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, zstdMagic) {
+		dec, err := literalDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return dec.DecodeAll(data, nil)
+	}
+	r, c, err := detectCompression(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if c == CompressNone {
+		return nil, fmt.Errorf("unknown compression")
+	}
+	return io.ReadAll(r)
+}
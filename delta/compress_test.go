@@ -0,0 +1,45 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// textBytes returns about n bytes of JSON lines, compressible like the
+// text files literal compression is meant for.
+func textBytes(seed int64, n int) []byte {
+	r := rand.New(rand.NewSource(seed))
+	var b bytes.Buffer
+	for b.Len() < n {
+		fmt.Fprintf(&b, `{"id":%d,"name":"user%d","active":%t,"score":%.2f}`+"\n", r.Intn(1e6), r.Intn(1e4), r.Intn(2) == 0, r.Float64()*100)
+	}
+	return b.Bytes()
+}
+
+func BenchmarkLiteralCompression(b *testing.B) {
+	old := textBytes(1, 4<<20)
+	new := append(textBytes(2, 1<<20), old...)
+	var fp bytes.Buffer
+	if err := GenerateFingerprint(context.Background(), bytes.NewReader(old), &fp, WithBlockSize(testBlockSize)); err != nil {
+		b.Fatal(err)
+	}
+	for _, ct := range []CompressionType{CompressNone, CompressLZ4, CompressZstd, CompressGzip} {
+		b.Run(string(ct), func(b *testing.B) {
+			d := &countingWriter{w: io.Discard}
+			b.SetBytes(int64(len(new)))
+			for b.Loop() {
+				d.n = 0
+				_, err := MakeDiff(context.Background(), bytes.NewReader(fp.Bytes()), bytes.NewReader(new), d,
+					WithBlockSize(testBlockSize), WithLiteralCompression(ct))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(d.n), "delta-bytes")
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package delta
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Elbandi/gsync"
+)
+
+// copiesWhole reports whether MakeDiff writes in as a single literal: it
+// is a regular file smaller than cfg.CopyThreshold.
+func (cfg Config) copiesWhole(in io.Reader) bool {
+	if cfg.CopyThreshold <= 0 {
+		return false
+	}
+	f, ok := in.(interface{ Stat() (os.FileInfo, error) })
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode().IsRegular() && fi.Size() < cfg.CopyThreshold
+}
+
+// copyDiff writes a delta holding all of in as one literal, without a
+// fingerprint. Patching it does not read the source file. The header
+// records cfg.SourceHash as the hash of the source, if set.
+func copyDiff(ctx context.Context, cfg Config, in io.Reader, out io.Writer) (_ []byte, err error) {
+	_, span := tracer.Start(ctx, "copy new file")
+	defer func() { endSpan(span, err) }()
+
+	if cfg.Format == FormatLibrsync || cfg.Format == FormatVCDIFF || cfg.Merkle || cfg.IndexOut != nil {
+		return nil, fmt.Errorf("full copy deltas do not support librsync or vcdiff format, Merkle trees or sorted operations")
+	}
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, fmt.Errorf("diff error: %w", err)
+	}
+	cfg.Chunking = ChunkFixed
+	cfg.EmbedSourceHashes = false
+	written := &countingWriter{w: out}
+	bar := cfg.newProgress("diff", 1)
+	total := int64(0)
+	if len(data) > 0 {
+		total = 1
+	}
+	dw, err := newDeltaWriter(written, cfg, total, cfg.SourceHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err = dw.write(gsync.BlockOperation{Data: data}); err != nil {
+			return nil, err
+		}
+		bar.Literal(len(data))
+		bar.Increment()
+	}
+	datahash := sha256.Sum256(data)
+	if err = dw.close(datahash[:], int64(len(data))); err != nil {
+		return nil, err
+	}
+	cfg.logger().Debug("new file copied", "phase", "diff", "bytesProcessed", len(data))
+	bar.Finish(int64(len(data)), written.n)
+	return datahash[:], nil
+}
@@ -0,0 +1,346 @@
+// Package delta implements binary diff and patch on top of gsync.
+//
+// A patch round trip has three steps: GenerateFingerprint reads the base
+// file and writes its block signatures, MakeDiff compares a new file with
+// those signatures and writes a delta, and ApplyPatch rebuilds the new
+// file from the base file and the delta.
+package delta
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"os"
+)
+
+const (
+	// MinKeyLength is the length a key must exceed to enable encryption.
+	MinKeyLength = 10
+)
+
+// ProgressFunc receives the progress of an operation. phase is one of
+// "fpgen", "diff" or "patch", total is an estimate and 0 if unknown.
+type ProgressFunc func(phase string, done, total int64)
+
+// StatsFunc receives the counts of a completed "fpgen", "diff" or "patch"
+// phase. For a fingerprint only TotalBlocks and NewSize, the size of the
+// source file, are set.
+type StatsFunc func(phase string, st DeltaStats)
+
+// MatchFunc receives how many of the done blocks of a phase are copied from
+// the source file. It stays 0 while generating a fingerprint.
+type MatchFunc func(phase string, matched, done int64)
+
+// Config holds the settings shared by all operations.
+type Config struct {
+	// BlockSize is the size of the blocks the files are split into. It is
+	// replaced by the block size recorded in the fingerprint or delta
+	// unless OverrideBlockSize is set.
+	BlockSize int
+	// OverrideBlockSize keeps BlockSize even if a file records another one.
+	OverrideBlockSize bool
+	// ProgressFunc is called after each processed block, nil disables
+	// progress reporting.
+	ProgressFunc ProgressFunc
+	// MatchFunc is called after each processed block, nil disables it.
+	MatchFunc MatchFunc
+	// StatsFunc is called when an operation completed, nil disables it.
+	StatsFunc StatsFunc
+	// Logger receives warnings and, at debug level, every processed
+	// block. nil uses slog.Default().
+	Logger *slog.Logger
+	// Key encrypts the delta stream when it is longer than MinKeyLength.
+	Key string
+	// EncryptKey is a GCMKeySize bytes key encrypting the delta stream
+	// with AES-256-GCM instead.
+	EncryptKey []byte
+	// EncryptPassword derives the AES-256-GCM key with scrypt when
+	// EncryptKey is not set.
+	EncryptPassword string
+	// Format is the serialization used for new fingerprint files.
+	Format Format
+	// URL is the download location of the source file recorded in zsync
+	// fingerprints.
+	URL string
+	// Compression is the compression used for new delta files.
+	Compression CompressionType
+	// FingerprintCompression is the compression used for new fingerprint
+	// files.
+	FingerprintCompression CompressionType
+	// LiteralCompression compresses the data of every literal of new delta
+	// files on its own, where that makes it smaller. Unlike Compression it
+	// keeps the operations of the delta readable one by one.
+	LiteralCompression CompressionType
+	// Chunking is how new fingerprints split the source file. Diffs use
+	// the chunking recorded in the fingerprint.
+	Chunking Chunking
+	// Hash is the strong hash for new fingerprints. When set for a diff,
+	// it must match the hash recorded in the fingerprint.
+	Hash HashAlgorithm
+	// WeakHash is the rolling weak checksum for new fingerprints of fixed
+	// size blocks, WeakGsync if empty. When set for a diff, it must match
+	// the one recorded in the fingerprint.
+	WeakHash WeakHash
+	// Workers is the number of goroutines computing fingerprint signatures
+	// or resolving patch operations.
+	Workers int
+	// HashSource makes GenerateFingerprint with more than one of Workers
+	// record the SHA-256 of the source file. A single goroutine reads the
+	// whole file for it, which bounds the speedup of the workers. Without
+	// it MakeDiff cannot detect a modified source by Config.SourceHash,
+	// and UpdateFingerprint needs a new fingerprint. One worker always
+	// records it.
+	HashSource bool
+	// SourceHash is the SHA-256 of the source file. When set, MakeDiff
+	// returns ErrSourceModified if the fingerprint was generated from
+	// another content, and ApplyPatch returns ErrWrongSourceFile before
+	// applying anything if the delta was made for another content.
+	SourceHash []byte
+	// Force makes MakeDiff only warn about a modified source file.
+	Force bool
+	// VerifyBlocks is the fingerprint of the source file. When set,
+	// ApplyPatch checks every block read from the source against it and
+	// fails with a *BlockMismatchError on the first mismatch.
+	VerifyBlocks io.Reader
+	// Merkle makes MakeDiff store a Merkle tree over the operations of the
+	// delta, which needs a SHA-256 fingerprint and an output supporting
+	// WriteAt. ApplyPatch then verifies the output of every operation
+	// against it.
+	Merkle bool
+	// CheckpointEvery makes ApplyPatch pass a checkpoint to
+	// CheckpointFunc after every CheckpointEvery operations.
+	CheckpointEvery int
+	// CheckpointFunc receives the checkpoints of ApplyPatch.
+	CheckpointFunc CheckpointFunc
+	// IndexOut makes MakeDiff sort the references of the delta by source
+	// block, so a patch reads the source sequentially, and write the
+	// operation index restoring the order of the new file to it.
+	IndexOut io.Writer
+	// Index is the operation index written to IndexOut with the delta.
+	// ApplyPatch needs it for such deltas and holds the new file in
+	// memory to write it in order.
+	Index io.Reader
+	// Resume continues a patch from a checkpoint. The output must then be
+	// an io.ReadWriteSeeker starting with the bytes written up to the
+	// checkpoint, which ApplyPatch verifies before it continues after them.
+	Resume *Checkpoint
+	// MaxMemory is the estimated size in bytes above which MakeDiff moves
+	// the lookup table of the fingerprint from memory to a temporary
+	// BoltDB file. 0 keeps it in memory.
+	MaxMemory int64
+	// CopyThreshold makes MakeDiff write new files smaller than this many
+	// bytes as a single literal, without reading the fingerprint. 0
+	// always diffs.
+	CopyThreshold int64
+	// SourceSize is the size in bytes of the source file passed to
+	// GenerateFingerprint when its Stat does not report it, like for a
+	// block device. Parallel signatures read the source up to it.
+	SourceSize int64
+	// InputSize is the expected size in bytes of the new file passed to
+	// MakeDiff when it cannot be determined, like for a pipe. It is only
+	// used for the progress of the diff and of patching the delta.
+	InputSize int64
+	// TempDir is the directory of the temporary files, like the lookup
+	// table past MaxMemory. Empty means os.TempDir.
+	TempDir string
+	// Pipeline makes MakeDiff start comparing the new file while the
+	// fingerprint is still loading. Blocks matching signatures that are not
+	// loaded yet become literals, so the delta may be larger.
+	Pipeline bool
+	// EmbedSourceHashes makes MakeDiff store the strong hash of the source
+	// block in every reference of the delta.
+	EmbedSourceHashes bool
+	// VerifySourceHashes makes ApplyPatch check every source block against
+	// the strong hash embedded in its reference, and fail with a
+	// *BlockMismatchError on the first mismatch.
+	VerifySourceHashes bool
+	// FromVersion and ToVersion are recorded in the header of new deltas
+	// as the versions of the source and the new file, at most 256 bytes
+	// of UTF-8 each.
+	FromVersion string
+	ToVersion   string
+	// ExpectFromVersion makes ApplyPatch fail with ErrVersionMismatch
+	// before applying anything unless the delta records it as the version
+	// of its source.
+	ExpectFromVersion string
+}
+
+// progress reports the blocks processed in one phase to a ProgressFunc.
+type progress struct {
+	fn      ProgressFunc
+	matchFn MatchFunc
+	statsFn StatsFunc
+	phase   string
+	done    int64
+	matched int64
+	literal int64
+	total   int64
+	// blockSize is reported in the stats.
+	blockSize int
+}
+
+func (cfg Config) newProgress(phase string, total int64) *progress {
+	return &progress{fn: cfg.ProgressFunc, matchFn: cfg.MatchFunc, statsFn: cfg.StatsFunc, phase: phase, total: total,
+		blockSize: cfg.BlockSize}
+}
+
+// Increment counts a processed block.
+func (p *progress) Increment() {
+	p.done++
+	if p.fn != nil {
+		p.fn(p.phase, p.done, p.total)
+	}
+	if p.matchFn != nil {
+		p.matchFn(p.phase, p.matched, p.done)
+	}
+}
+
+// Match counts a block copied from the source file. It is called before
+// the Increment for that block.
+func (p *progress) Match() {
+	p.matched++
+}
+
+// Literal counts the bytes of a literal block.
+func (p *progress) Literal(n int) {
+	p.literal += int64(n)
+}
+
+// Reset restarts counting with a new total.
+func (p *progress) Reset(total int64) {
+	p.done = 0
+	p.matched = 0
+	p.literal = 0
+	p.total = total
+}
+
+// Finish reports the counts of the completed phase to the StatsFunc.
+// newSize is the size of the file described by the blocks, deltaSize the
+// size of the delta read or written.
+func (p *progress) Finish(newSize, deltaSize int64) {
+	if p.statsFn == nil {
+		return
+	}
+	st := DeltaStats{TotalBlocks: p.done, NewSize: newSize, DeltaSize: deltaSize, BlockSize: p.blockSize}
+	if p.phase != "fpgen" {
+		st.ReferenceBlocks = p.matched
+		st.LiteralBlocks = p.done - p.matched
+		st.LiteralBytes = p.literal
+		st.ReferenceBytes = newSize - p.literal
+	}
+	st.complete()
+	p.statsFn(p.phase, st)
+}
+
+func (cfg Config) logger() *slog.Logger {
+	if cfg.Logger != nil {
+		return cfg.Logger
+	}
+	return slog.Default()
+}
+
+// resolveBlockSize returns the block size to use for a file that records
+// stored, which is 0 for files without a recorded block size.
+func (cfg Config) resolveBlockSize(stored int) int {
+	if stored == 0 || stored == cfg.BlockSize {
+		return cfg.BlockSize
+	}
+	if cfg.OverrideBlockSize {
+		cfg.logger().Warn("file was written with another block size, using the requested one", "stored", stored, "blockSize", cfg.BlockSize)
+		return cfg.BlockSize
+	}
+	cfg.logger().Warn("file was written with another block size, using the stored one", "stored", stored, "blockSize", cfg.BlockSize)
+	return stored
+}
+
+func (cfg Config) encrypted() bool {
+	return len(cfg.Key) > MinKeyLength
+}
+
+// encryptWriter writes a random IV to w and returns a writer encrypting
+// everything after it.
+func (cfg Config) encryptWriter(w io.Writer) (io.Writer, error) {
+	block, err := aes.NewCipher([]byte(cfg.Key))
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err = rand.Read(iv); err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(iv); err != nil {
+		return nil, err
+	}
+	return &cipher.StreamWriter{S: cipher.NewOFB(block, iv), W: w}, nil
+}
+
+// decryptReader reads the IV written by encryptWriter from r and returns
+// a reader decrypting the rest of the stream.
+func (cfg Config) decryptReader(r io.Reader) (io.Reader, error) {
+	block, err := aes.NewCipher([]byte(cfg.Key))
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err = io.ReadFull(r, iv); err != nil {
+		return nil, err
+	}
+	return &cipher.StreamReader{S: cipher.NewOFB(block, iv), R: r}, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// inputSize returns the size of in, the new file passed to MakeDiff, or
+// cfg.InputSize if it is unknown.
+func (cfg Config) inputSize(in io.Reader) int64 {
+	if n := sizeOf(in); n > 0 {
+		return n
+	}
+	return cfg.InputSize
+}
+
+// sourceSize returns the size of src, the source file passed to
+// GenerateFingerprint, or cfg.SourceSize if it is unknown.
+func (cfg Config) sourceSize(src io.Reader) int64 {
+	if n := sizeOf(src); n > 0 {
+		return n
+	}
+	return cfg.SourceSize
+}
+
+// sizeOf returns the size of r if it is backed by a file, or 0.
+func sizeOf(r interface{}) int64 {
+	if f, ok := r.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if fi, err := f.Stat(); err == nil {
+			return fi.Size()
+		}
+	}
+	if s, ok := r.(interface{ Size() int64 }); ok {
+		return s.Size()
+	}
+	return 0
+}
@@ -0,0 +1,78 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+)
+
+const testBlockSize = 1024
+
+// randomBytes returns n pseudo-random bytes generated from seed.
+func randomBytes(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// withFormat sets the format of the fingerprint and the delta.
+func withFormat(f Format) Option {
+	return func(c *Config) error {
+		c.Format = f
+		return nil
+	}
+}
+
+// roundTrip generates the fingerprint of old, diffs new against it and
+// patches old with the delta. It returns the delta and the patched file.
+func roundTrip(t testing.TB, old, new []byte, opts ...Option) (delta, patched []byte) {
+	t.Helper()
+	ctx := context.Background()
+	opts = append([]Option{WithBlockSize(testBlockSize)}, opts...)
+	var fp, d, out bytes.Buffer
+	if err := GenerateFingerprint(ctx, bytes.NewReader(old), &fp, opts...); err != nil {
+		t.Fatalf("GenerateFingerprint: %v", err)
+	}
+	datahash, err := MakeDiff(ctx, &fp, bytes.NewReader(new), &d, opts...)
+	if err != nil {
+		t.Fatalf("MakeDiff: %v", err)
+	}
+	delta = bytes.Clone(d.Bytes())
+	got, err := ApplyPatch(ctx, bytes.NewReader(old), &d, &out, opts...)
+	if err != nil {
+		t.Fatalf("ApplyPatch: %v", err)
+	}
+	if !bytes.Equal(got, datahash) {
+		t.Errorf("datahash = %x, want %x", got, datahash)
+	}
+	return delta, out.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	base := randomBytes(1, 10*testBlockSize+123)
+	tests := []struct {
+		name     string
+		old, new []byte
+	}{
+		{"empty", nil, nil},
+		{"empty old", nil, base},
+		{"empty new", base, nil},
+		{"same", base, base},
+		{"appended", base, append(bytes.Clone(base), randomBytes(2, 3*testBlockSize)...)},
+		{"shifted", base, append([]byte("inserted at the start"), base...)},
+		{"one byte", base, append(append(bytes.Clone(base[:5000]), base[5000]^0xff), base[5001:]...)},
+		{"random", base, randomBytes(3, 7*testBlockSize+45)},
+	}
+	formats := []Format{FormatGob, FormatMsgpack, FormatJSON, FormatProto}
+	for _, f := range formats {
+		for _, tt := range tests {
+			t.Run(string(f)+"/"+tt.name, func(t *testing.T) {
+				_, got := roundTrip(t, tt.old, tt.new, withFormat(f))
+				if !bytes.Equal(got, tt.new) {
+					t.Errorf("patched %d bytes, want %d bytes of the new file", len(got), len(tt.new))
+				}
+			})
+		}
+	}
+}
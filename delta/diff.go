@@ -0,0 +1,313 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/Elbandi/gsync"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// MakeDiff loads the fingerprint from fp, compares in against it and
+// writes the delta to out. It returns the SHA-256 hash of in. fp is not
+// read, and may be nil, if in is smaller than Config.CopyThreshold.
+func MakeDiff(ctx context.Context, fp io.Reader, in io.Reader, out io.Writer, opts ...Option) (_ []byte, err error) {
+	ctx, span := tracer.Start(ctx, "MakeDiff")
+	defer func() { endSpan(span, err) }()
+	// Stops the goroutines still reading the fingerprint or the new file
+	// when the diff fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.copiesWhole(in) {
+		return copyDiff(ctx, cfg, in, out)
+	}
+	if cfg.LiteralCompression != CompressNone && cfg.LiteralCompression != "" && (cfg.Format == FormatLibrsync || cfg.Format == FormatVCDIFF) {
+		return nil, fmt.Errorf("librsync and vcdiff format do not support literal compression")
+	}
+	if cfg.Format == FormatLibrsync {
+		return diffLibrsync(ctx, cfg, fp, in, out)
+	}
+	fpReader, err := NewFingerprintReader(fp)
+	if errors.Is(err, ErrUnsupportedVersion) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFingerprintCorrupt, err)
+	}
+	cfg.BlockSize = cfg.resolveBlockSize(fpReader.BlockSize)
+	gsync.BlockSize = cfg.BlockSize
+	bar := cfg.newProgress("diff", sizeOf(fp)/int64(cfg.BlockSize))
+
+	if cfg.Hash != 0 && cfg.Hash != fpReader.Hash {
+		return nil, fmt.Errorf("%w: fingerprint uses %s, requested %s", ErrHashAlgorithmMismatch, fpReader.Hash, cfg.Hash)
+	}
+	if cfg.WeakHash != "" && cfg.WeakHash != fpReader.WeakHash {
+		return nil, fmt.Errorf("%w: fingerprint uses %s weak hashes, requested %s", ErrHashAlgorithmMismatch, fpReader.WeakHash, cfg.WeakHash)
+	}
+	strong, err := fpReader.strongHash()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFingerprintCorrupt, err)
+	}
+	cfg.Chunking = fpReader.Chunking
+	if cfg.IndexOut != nil && (cfg.Chunking == ChunkCDC || cfg.Format == FormatVCDIFF || cfg.Merkle) {
+		return nil, fmt.Errorf("sorted operations are not supported for chunked fingerprints, vcdiff format or Merkle trees")
+	}
+	if cfg.EmbedSourceHashes {
+		if cfg.Chunking == ChunkCDC || cfg.Format == FormatVCDIFF {
+			return nil, fmt.Errorf("source hashes are not supported for chunked fingerprints or vcdiff format")
+		}
+		cfg.Hash = fpReader.Hash
+	}
+	if cfg.Chunking == ChunkCDC {
+		if cfg.Format == FormatVCDIFF || cfg.Merkle {
+			return nil, fmt.Errorf("vcdiff format and Merkle trees do not support chunked fingerprints")
+		}
+		return diffChunks(ctx, cfg, fpReader, strong, in, out, bar)
+	}
+	if cfg.Pipeline && (cfg.Merkle || cfg.Format == FormatVCDIFF || cfg.MaxMemory > 0 || cfg.EmbedSourceHashes) {
+		return nil, fmt.Errorf("pipelined diffs do not support Merkle trees, vcdiff format, a memory limit or source hashes")
+	}
+	_, lookupSpan := tracer.Start(ctx, "build lookup table")
+	sigsCh := make(chan gsync.BlockSignature)
+	if cfg.Pipeline {
+		sigsCh = make(chan gsync.BlockSignature, pipelineBuffer)
+	}
+	var lastIndex uint64
+	var strongs map[uint64][]byte
+	var rootOut io.WriterAt
+	if cfg.Merkle {
+		if fpReader.Hash != HashSHA256 || fpReader.StrongSize != 0 {
+			return nil, fmt.Errorf("a Merkle tree requires a SHA-256 fingerprint with complete hashes")
+		}
+		var ok bool
+		if rootOut, ok = out.(io.WriterAt); !ok {
+			return nil, fmt.Errorf("a Merkle tree requires a delta output supporting WriteAt")
+		}
+		// Pipes implement WriteAt but fail once the delta is written.
+		if s, ok := out.(io.Seeker); ok {
+			if _, err := s.Seek(0, io.SeekCurrent); err != nil {
+				return nil, fmt.Errorf("a Merkle tree requires a seekable delta output: %w", err)
+			}
+		}
+	}
+	if cfg.Merkle || cfg.EmbedSourceHashes {
+		strongs = make(map[uint64][]byte)
+	}
+	go func() {
+		defer close(sigsCh)
+
+		for {
+			// Allow for cancellation, the lookup table reports ctx.Err()
+			// itself. Every send also gives up once ctx is done, the
+			// lookup table may be gone.
+			select {
+			case <-ctx.Done():
+				return
+			default:
+				// break out of the select block and continue reading
+				break
+			}
+			b, err := fpReader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				select {
+				case sigsCh <- gsync.BlockSignature{Index: b.Index, Error: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			lastIndex = max(lastIndex, b.Index)
+			if strongs != nil {
+				strongs[b.Index] = b.Strong
+			}
+			select {
+			case sigsCh <- b:
+			case <-ctx.Done():
+				return
+			}
+			if !cfg.Pipeline {
+				bar.Increment()
+			}
+		}
+	}()
+	logger := cfg.logger()
+	var table *lookupTable
+	var pipe *pipelineTable
+	if cfg.Pipeline {
+		logger.Debug("load lookup table while diffing", "phase", "diff")
+		pipe = loadPipelineTable(ctx, sigsCh)
+		endSpan(lookupSpan, nil)
+	} else {
+		logger.Debug("create lookup table", "phase", "diff")
+		strongSize := fpReader.StrongSize
+		if strongSize == 0 {
+			strongSize = strong.Size()
+		}
+		table, err = buildLookupTable(ctx, sigsCh, fingerprintBlocks(fp, strongSize), cfg.MaxMemory, cfg.TempDir, logger)
+		endSpan(lookupSpan, err)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fingerprintCorrupt(err)
+		}
+		logger.Debug("lookup table loaded", "phase", "diff")
+		if err = cfg.checkSourceHash(fpReader.SourceHash); err != nil {
+			table.close()
+			return nil, err
+		}
+	}
+
+	total := cfg.inputSize(in) / int64(cfg.BlockSize)
+	counted := &countingReader{r: in}
+	datahash := sha256.New()
+	var opsCh <-chan gsync.BlockOperation
+	if pipe != nil {
+		opsCh = syncRolling(ctx, counted, strong, datahash, fpReader.WeakHash, pipe, nil)
+	} else if opsCh, err = table.sync(ctx, counted, strong, datahash, fpReader.WeakHash); err != nil {
+		return nil, fmt.Errorf("diff error: %w", err)
+	}
+	defer drain(opsCh)
+
+	logger.Debug("create block diff", "phase", "diff")
+	bar.Reset(total)
+
+	written := &countingWriter{w: out}
+	if cfg.Format == FormatVCDIFF {
+		if cfg.encrypted() || cfg.Compression != CompressNone {
+			return nil, fmt.Errorf("vcdiff format does not support encryption or compression")
+		}
+		vw := newVCDIFFWriter(written, cfg.BlockSize, lastIndex)
+		if err = writeVCDIFFOperations(ctx, vw, opsCh, bar); err != nil {
+			return nil, err
+		}
+		if err = vw.close(uint64(counted.n)); err != nil {
+			return nil, err
+		}
+	} else {
+		// A pipelined diff writes the header before the source hash at the
+		// end of the fingerprint is read.
+		var baseHash []byte
+		if pipe == nil {
+			baseHash = fpReader.SourceHash
+		}
+		dw, err := newDeltaWriter(written, cfg, total, baseHash)
+		if err != nil {
+			return nil, err
+		}
+		dw.strongs, dw.merkle, dw.sourceHashes = strongs, cfg.Merkle, cfg.EmbedSourceHashes
+		var positions []uint64
+		if cfg.IndexOut != nil {
+			var ops []gsync.BlockOperation
+			if ops, positions, err = sortOperations(ctx, opsCh); err != nil {
+				return nil, err
+			}
+			opsCh = sendOperations(ctx, ops)
+		}
+		if err = writeOperations(ctx, logger, dw, opsCh, bar); err != nil {
+			return nil, err
+		}
+		if pipe != nil {
+			// The source hash is only known once the whole fingerprint
+			// is read.
+			if err = pipe.wait(); err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				return nil, fingerprintCorrupt(err)
+			}
+			if err = cfg.checkSourceHash(fpReader.SourceHash); err != nil {
+				return nil, err
+			}
+		}
+		if cfg.IndexOut != nil {
+			if err = writeIndex(cfg.IndexOut, positions); err != nil {
+				return nil, fmt.Errorf("index write error: %w", err)
+			}
+		}
+		if err = dw.close(datahash.Sum(nil), counted.n); err != nil {
+			return nil, err
+		}
+		if cfg.Merkle {
+			if err = writeMerkleRoot(rootOut, dw.root); err != nil {
+				return nil, err
+			}
+		}
+	}
+	logger.Debug("diff done", "phase", "diff", "bytesProcessed", counted.n)
+	span.SetAttributes(attribute.Int64("godelta.blocks", bar.done), attribute.Int64("godelta.file_size", counted.n),
+		attribute.Int64("godelta.delta_size", written.n))
+	bar.Finish(counted.n, written.n)
+	return datahash.Sum(nil), nil
+}
+
+// checkSourceHash compares the source hash recorded in a fingerprint with
+// cfg.SourceHash. A mismatch is only logged if cfg.Force is set.
+func (cfg Config) checkSourceHash(fpHash []byte) error {
+	if cfg.SourceHash == nil || fpHash == nil || bytes.Equal(cfg.SourceHash, fpHash) {
+		return nil
+	}
+	err := fmt.Errorf("%w: fingerprint was generated from %x, source is %x", ErrSourceModified, fpHash, cfg.SourceHash)
+	if !cfg.Force {
+		return err
+	}
+	cfg.logger().Warn("source file changed since its fingerprint was generated", "error", err)
+	return nil
+}
+
+// writeOperations writes the block operations received from opsCh to dw.
+func writeOperations(ctx context.Context, logger *slog.Logger, dw *deltaWriter, opsCh <-chan gsync.BlockOperation, bar *progress) (err error) {
+	_, span := tracer.Start(ctx, "sync blocks")
+	defer func() { endSpan(span, err) }()
+
+	index := uint64(0)
+	for o := range opsCh {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			break
+		}
+
+		if o.Error != nil {
+			return fmt.Errorf("diff error: %w", o.Error)
+		}
+		if logger.Enabled(ctx, slog.LevelDebug) {
+			logger.Debug("block operation", "phase", "diff", "op", index, "blockIndex", o.Index, "literalBytes", len(o.Data))
+		}
+		if err = dw.write(o); err != nil {
+			return err
+		}
+		index++
+		if len(o.Data) == 0 {
+			bar.Match()
+		} else {
+			bar.Literal(len(o.Data))
+		}
+		bar.Increment()
+	}
+	// The sync stops without an error when ctx is cancelled.
+	return ctx.Err()
+}
+
+// drain discards what is left in ch in the background. The goroutines of
+// gsync block on their sends even after ctx is cancelled, until the
+// channel is read.
+func drain[T any](ch <-chan T) {
+	go func() {
+		for range ch {
+		}
+	}()
+}
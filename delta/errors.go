@@ -0,0 +1,45 @@
+package delta
+
+import "errors"
+
+var (
+	// ErrFingerprintCorrupt is returned when a fingerprint file cannot be
+	// decoded.
+	ErrFingerprintCorrupt = errors.New("fingerprint corrupt")
+	// ErrFingerprintChecksumFail is returned, wrapped in
+	// ErrFingerprintCorrupt, when the content of a fingerprint does not
+	// match its CRC-32.
+	ErrFingerprintChecksumFail = errors.New("fingerprint checksum mismatch")
+	// ErrDeltaCorrupt is returned when a delta file cannot be decoded.
+	ErrDeltaCorrupt = errors.New("delta corrupt")
+	// ErrPatchMismatch is returned when the patched data does not match the
+	// datahash stored in the delta.
+	ErrPatchMismatch = errors.New("patch datahash mismatch")
+	// ErrBlockChecksumFail is returned when a block signature cannot be
+	// computed.
+	ErrBlockChecksumFail = errors.New("block checksum failed")
+	// ErrUnsupportedVersion is returned when a file was written by an
+	// unknown format version.
+	ErrUnsupportedVersion = errors.New("unsupported format version")
+	// ErrSourceModified is returned when the source file changed since its
+	// fingerprint was generated.
+	ErrSourceModified = errors.New("source file modified")
+	// ErrWrongSourceFile is returned when the source file of a patch is
+	// not the one the delta was made for.
+	ErrWrongSourceFile = errors.New("wrong source file")
+	// ErrVersionMismatch is returned when a delta records another source
+	// version than the expected one.
+	ErrVersionMismatch = errors.New("version mismatch")
+	// ErrHashAlgorithmMismatch is returned when the requested strong or
+	// weak hash differs from the one the fingerprint was generated with.
+	ErrHashAlgorithmMismatch = errors.New("hash algorithm mismatch")
+	// ErrSignatureMismatch is returned when the HMAC of a signed file does
+	// not match its content.
+	ErrSignatureMismatch = errors.New("signature mismatch")
+	// ErrCheckpointMismatch is returned when a patch cannot be resumed
+	// because the output or the delta does not match the checkpoint.
+	ErrCheckpointMismatch = errors.New("checkpoint mismatch")
+	// ErrOutputSizeMismatch is returned when the patched data is not as
+	// long as the size recorded in the delta.
+	ErrOutputSizeMismatch = errors.New("output size mismatch")
+)
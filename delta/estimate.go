@@ -0,0 +1,96 @@
+package delta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/Elbandi/gsync"
+)
+
+// estimatedOpSize is the approximate encoded size of an operation record
+// besides its literal data.
+const estimatedOpSize = 8
+
+// weakIndex is a blockIndex matching blocks by their weak checksum alone.
+type weakIndex map[uint32]uint64
+
+func (w weakIndex) find(_ int64, weak uint32, _ []byte, _ hash.Hash) (uint64, bool) {
+	index, ok := w[weak]
+	return index, ok
+}
+
+// EstimateDiff estimates the delta MakeDiff would write for in and the
+// fingerprint read from fp. It matches blocks by their weak checksum only,
+// which is faster than computing strong hashes but counts the collisions
+// of the weak checksum as matches. DeltaSize is the estimated size of the
+// delta before compression.
+func EstimateDiff(ctx context.Context, fp io.Reader, in io.Reader, opts ...Option) (_ DeltaStats, err error) {
+	ctx, span := tracer.Start(ctx, "EstimateDiff")
+	defer func() { endSpan(span, err) }()
+	// Stops syncRolling when the estimate fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var st DeltaStats
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return st, err
+	}
+	fpReader, err := NewFingerprintReader(fp)
+	if errors.Is(err, ErrUnsupportedVersion) {
+		return st, err
+	}
+	if err != nil {
+		return st, fmt.Errorf("%w: %v", ErrFingerprintCorrupt, err)
+	}
+	if fpReader.Chunking == ChunkCDC {
+		return st, fmt.Errorf("estimates are not supported for chunked fingerprints")
+	}
+	cfg.BlockSize = cfg.resolveBlockSize(fpReader.BlockSize)
+	gsync.BlockSize = cfg.BlockSize
+
+	weaks := make(weakIndex)
+	for {
+		b, err := fpReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return st, fingerprintCorrupt(err)
+		}
+		if _, ok := weaks[b.Weak]; !ok {
+			weaks[b.Weak] = b.Index
+		}
+	}
+
+	bar := cfg.newProgress("estimate", cfg.inputSize(in)/int64(cfg.BlockSize))
+	counted := &countingReader{r: in}
+	opsCh := syncRolling(ctx, counted, nil, nil, fpReader.WeakHash, weaks, nil)
+	defer drain(opsCh)
+	for o := range opsCh {
+		if o.Error != nil {
+			return st, fmt.Errorf("diff error: %w", o.Error)
+		}
+		st.TotalBlocks++
+		if len(o.Data) == 0 {
+			st.ReferenceBlocks++
+		} else {
+			st.LiteralBlocks++
+			st.LiteralBytes += int64(len(o.Data))
+		}
+		bar.Increment()
+	}
+	// The sync stops without an error when ctx is cancelled.
+	if err = ctx.Err(); err != nil {
+		return st, err
+	}
+	st.NewSize = counted.n
+	st.ReferenceBytes = st.NewSize - st.LiteralBytes
+	st.DeltaSize = st.LiteralBytes + st.TotalBlocks*estimatedOpSize
+	st.BlockSize = cfg.BlockSize
+	st.complete()
+	return st, nil
+}
@@ -0,0 +1,427 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/Elbandi/gsync"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// GenerateFingerprint reads src block by block and writes the block
+// signatures to dst, encoded as selected by cfg.Format and compressed as
+// selected by cfg.FingerprintCompression.
+func GenerateFingerprint(ctx context.Context, src io.Reader, dst io.Writer, opts ...Option) (err error) {
+	ctx, span := tracer.Start(ctx, "GenerateFingerprint")
+	defer func() { endSpan(span, err) }()
+	// Stops the signature goroutines when the fingerprint cannot be
+	// written.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	gsync.BlockSize = cfg.BlockSize
+	bar := cfg.newProgress("fpgen", cfg.sourceSize(src)/int64(cfg.BlockSize))
+	if (cfg.Format == FormatLibrsync || cfg.Format == FormatZsync) && cfg.WeakHash != "" && cfg.WeakHash != WeakGsync {
+		return fmt.Errorf("%s fingerprints have their own weak checksum", cfg.Format)
+	}
+	switch cfg.Format {
+	case FormatLibrsync:
+		return writeLibrsyncSignature(ctx, cfg, src, dst, bar)
+	case FormatZsync:
+		return writeZsync(ctx, cfg, src, dst, bar)
+	}
+
+	if cfg.Format == FormatCompact && cfg.Chunking == ChunkCDC {
+		return fmt.Errorf("compact fingerprints do not support content-defined chunking")
+	}
+	if cfg.Chunking == ChunkCDC && cfg.WeakHash != "" && cfg.WeakHash != WeakGsync {
+		return fmt.Errorf("content-defined chunking does not support weak hashes, chunks are matched by their Adler-32")
+	}
+	alg := cfg.Hash
+	if alg == 0 {
+		alg = HashSHA256
+	}
+	strong, err := alg.New()
+	if err != nil {
+		return err
+	}
+	fpWriter, err := newFingerprintWriter(dst, cfg.FingerprintCompression, cfg.Format)
+	if err != nil {
+		return fmt.Errorf("fingerprint compress error: %w", err)
+	}
+	fh := fingerprintHeader{Hash: alg, BlockSize: uint32(cfg.BlockSize)}
+	if cfg.Chunking == ChunkCDC {
+		fh.Flags = flagChunked
+	}
+	fh.Flags |= weakFlags(cfg.WeakHash)
+	enc, err := newFingerprintEncoder(fpWriter, cfg.Format, fh)
+	if err != nil {
+		return fmt.Errorf("fingerprint write error: %w", err)
+	}
+
+	srcHash := sha256.New()
+	counted := &countingWriter{w: srcHash}
+	var hashErr chan error
+	if cfg.Chunking == ChunkCDC {
+		if err = writeChunkSignatures(ctx, cfg, enc, io.TeeReader(src, counted), strong, bar); err != nil {
+			return err
+		}
+	} else {
+		var sigsCh <-chan gsync.BlockSignature
+		if ra, ok := src.(io.ReaderAt); ok && cfg.Workers > 1 {
+			size := cfg.sourceSize(src)
+			// A single goroutine hashes the whole file, which would bound
+			// the speedup of the workers.
+			if cfg.HashSource {
+				hashErr = make(chan error, 1)
+				go func() {
+					_, err := io.Copy(counted, io.NewSectionReader(ra, 0, size))
+					hashErr <- err
+				}()
+			} else {
+				srcHash, counted.n = nil, size
+			}
+			sigsCh, err = parallelSignatures(ctx, ra, size, alg, cfg.WeakHash, cfg.Workers)
+		} else {
+			sigsCh, err = cfg.WeakHash.signatures(ctx, io.TeeReader(src, counted), strong)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBlockChecksumFail, err)
+		}
+		defer drain(sigsCh)
+		if err = writeSignatures(ctx, cfg, enc, sigsCh, bar); err != nil {
+			return err
+		}
+	}
+	if hashErr != nil {
+		if err = <-hashErr; err != nil {
+			return fmt.Errorf("%w: %v", ErrBlockChecksumFail, err)
+		}
+	}
+	if srcHash != nil {
+		trailer, err := sourceTrailer(srcHash, counted.n)
+		if err != nil {
+			return err
+		}
+		if err = enc.EncodeTrailer(trailer); err != nil {
+			return fmt.Errorf("fingerprint write error: %w", err)
+		}
+	}
+	if err = fpWriter.Close(); err != nil {
+		return fmt.Errorf("fingerprint compress error: %w", err)
+	}
+	cfg.logger().Debug("fingerprint done", "phase", "fpgen", "bytesProcessed", counted.n)
+	span.SetAttributes(attribute.Int64("godelta.blocks", bar.done), attribute.Int64("godelta.file_size", counted.n))
+	bar.Finish(counted.n, 0)
+	return nil
+}
+
+// newFingerprintWriter returns a writer of a fingerprint in format f to
+// dst compressed with c, which appends the checksum of flagChecksum on
+// Close, or its line for JSON.
+func newFingerprintWriter(dst io.Writer, c CompressionType, f Format) (io.WriteCloser, error) {
+	w, err := compressWriter(dst, c)
+	if err != nil {
+		return nil, err
+	}
+	return newChecksumWriter(w, f == FormatJSON), nil
+}
+
+// writeSignatures encodes the signatures received from sigsCh.
+func writeSignatures(ctx context.Context, cfg Config, enc sigEncoder, sigsCh <-chan gsync.BlockSignature, bar *progress) (err error) {
+	_, span := tracer.Start(ctx, "compute block signatures")
+	defer func() { endSpan(span, err) }()
+
+	for c := range sigsCh {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			break
+		}
+
+		if c.Error != nil {
+			return fmt.Errorf("%w: %v", ErrBlockChecksumFail, c.Error)
+		}
+
+		if logger := cfg.logger(); logger.Enabled(ctx, slog.LevelDebug) {
+			logger.Debug("block signature", "phase", "fpgen", "blockIndex", c.Index,
+				"weakHash", fmt.Sprintf("%08x", c.Weak), "strongHash", hex.EncodeToString(c.Strong))
+		}
+		err = enc.Encode(sigRecord{Index: c.Index, Weak: c.Weak, Strong: c.Strong})
+		if err != nil {
+			return fmt.Errorf("fingerprint write error: %w", err)
+		}
+		bar.Increment()
+	}
+	// The signatures stop without an error when ctx is cancelled.
+	return ctx.Err()
+}
+
+// writeChunkSignatures splits src into content-defined chunks and encodes
+// their signatures. The weak checksum of a chunk is its Adler-32.
+func writeChunkSignatures(ctx context.Context, cfg Config, enc sigEncoder, src io.Reader, strong hash.Hash, bar *progress) (err error) {
+	_, span := tracer.Start(ctx, "compute block signatures")
+	defer func() { endSpan(span, err) }()
+
+	ch := newChunker(src, cfg.BlockSize)
+	var offset uint64
+	var chunk []byte
+	for index := uint64(0); ; index++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		chunk, err = ch.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBlockChecksumFail, err)
+		}
+		strong.Reset()
+		strong.Write(chunk)
+		r := sigRecord{
+			Index:  index,
+			Weak:   adler32.Checksum(chunk),
+			Strong: strong.Sum(nil),
+			Offset: offset,
+			Length: uint32(len(chunk)),
+		}
+		if logger := cfg.logger(); logger.Enabled(ctx, slog.LevelDebug) {
+			logger.Debug("block signature", "phase", "fpgen", "blockIndex", r.Index, "offset", r.Offset, "length", r.Length,
+				"weakHash", fmt.Sprintf("%08x", r.Weak), "strongHash", hex.EncodeToString(r.Strong))
+		}
+		if err = enc.Encode(r); err != nil {
+			return fmt.Errorf("fingerprint write error: %w", err)
+		}
+		offset += uint64(len(chunk))
+		bar.Increment()
+	}
+}
+
+// parallelSignatures splits src into workers segments of whole blocks and
+// computes their signatures concurrently. The returned channel yields all
+// signatures ordered by index once every segment is done.
+func parallelSignatures(ctx context.Context, src io.ReaderAt, size int64, alg HashAlgorithm, weak WeakHash, workers int) (<-chan gsync.BlockSignature, error) {
+	blockSize := int64(gsync.BlockSize)
+	blocks := (size + blockSize - 1) / blockSize
+	perWorker := (blocks + int64(workers) - 1) / int64(workers)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		sigs     []gsync.BlockSignature
+		firstErr error
+	)
+	for first := int64(0); first < blocks; first += perWorker {
+		strong, err := alg.New()
+		if err != nil {
+			return nil, err
+		}
+		offset := first * blockSize
+		length := perWorker * blockSize
+		if offset+length > size {
+			length = size - offset
+		}
+		segCh, err := weak.signatures(ctx, io.NewSectionReader(src, offset, length), strong)
+		if err != nil {
+			return nil, err
+		}
+		wg.Add(1)
+		go func(first uint64, segCh <-chan gsync.BlockSignature) {
+			defer wg.Done()
+			var seg []gsync.BlockSignature
+			for c := range segCh {
+				if c.Error != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = c.Error
+					}
+					mu.Unlock()
+					continue
+				}
+				c.Index += first
+				seg = append(seg, c)
+			}
+			mu.Lock()
+			sigs = append(sigs, seg...)
+			mu.Unlock()
+		}(uint64(first), segCh)
+	}
+
+	sigsCh := make(chan gsync.BlockSignature)
+	go func() {
+		defer close(sigsCh)
+		wg.Wait()
+		if firstErr != nil {
+			select {
+			case sigsCh <- gsync.BlockSignature{Error: firstErr}:
+			case <-ctx.Done():
+			}
+			return
+		}
+		sort.Slice(sigs, func(i, j int) bool { return sigs[i].Index < sigs[j].Index })
+		for _, c := range sigs {
+			select {
+			case sigsCh <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return sigsCh, nil
+}
+
+// FingerprintReader reads the block signatures of a fingerprint file.
+type FingerprintReader struct {
+	// Hash is the strong hash the fingerprint was generated with.
+	Hash HashAlgorithm
+	// BlockSize is the block size the fingerprint was generated with, or
+	// 0 if the fingerprint does not record it. For chunked fingerprints it
+	// is the average block size.
+	BlockSize int
+	// Chunking is how the source file was split into blocks.
+	Chunking Chunking
+	// WeakHash is the weak checksum of the blocks.
+	WeakHash WeakHash
+	// SourceHash is the SHA-256 of the source file. It is set once Next
+	// returned io.EOF, and stays nil for fingerprints without it.
+	SourceHash []byte
+	// SourceSize is the size of the source file, set with SourceHash by
+	// fingerprints recording it.
+	SourceSize uint64
+	// StrongSize is the length the strong hashes are truncated to, or 0
+	// if they are complete.
+	StrongSize int
+
+	dec sigDecoder
+	// sourceState is the state of the SHA-256 of the source file.
+	sourceState []byte
+	// checksum verifies fingerprints with flagChecksum.
+	checksum *checksumReader
+}
+
+// NewFingerprintReader detects the compression of r, reads the fingerprint
+// header and detects the encoding of the signatures that follow. The
+// checksum of fingerprints ending with one is verified when Next reaches
+// the end, which then fails with ErrFingerprintChecksumFail instead of
+// returning io.EOF on a mismatch.
+func NewFingerprintReader(r io.Reader) (*FingerprintReader, error) {
+	r, err := decompressReader(r)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(r)
+	// The checksum covers the header, so the flag is peeked at first.
+	var checksum *checksumReader
+	if buf, _ := br.Peek(headerSize); len(buf) == headerSize && bytes.HasPrefix(buf, fingerprintMagic) &&
+		binary.BigEndian.Uint16(buf[6:])&flagChecksum != 0 {
+		checksum = newChecksumReader(br)
+		br = bufio.NewReader(checksum)
+	}
+	fh, err := readFingerprintHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := newSigDecoder(br, fh.Flags)
+	if err != nil {
+		return nil, err
+	}
+	if jd, ok := dec.(*jsonSigDecoder); ok && jd.header != nil {
+		fh = *jd.header
+	}
+	fr := &FingerprintReader{Hash: fh.Hash, BlockSize: int(fh.BlockSize), Chunking: ChunkFixed, WeakHash: weakHashOf(fh.Flags), dec: dec, checksum: checksum}
+	if fh.Flags&flagChunked != 0 {
+		fr.Chunking = ChunkCDC
+	}
+	if fh.Flags&flagCompact != 0 {
+		fr.StrongSize = compactStrongSize
+	}
+	return fr, nil
+}
+
+// strongHash returns a new strong hash of the fingerprint, truncated like
+// its block signatures.
+func (fr *FingerprintReader) strongHash() (hash.Hash, error) {
+	h, err := fr.Hash.New()
+	if err != nil || fr.StrongSize == 0 {
+		return h, err
+	}
+	return truncatedHash{Hash: h, size: fr.StrongSize}, nil
+}
+
+// format returns the encoding of the signatures.
+func (fr *FingerprintReader) format() Format {
+	switch fr.dec.(type) {
+	case *jsonSigDecoder:
+		return FormatJSON
+	case *msgpackSigDecoder:
+		return FormatMsgpack
+	case *compactSigDecoder:
+		return FormatCompact
+	case *protoSigDecoder:
+		return FormatProto
+	}
+	return FormatGob
+}
+
+// Next returns the next block signature, or io.EOF after the last one.
+func (fr *FingerprintReader) Next() (gsync.BlockSignature, error) {
+	r, err := fr.next()
+	if err != nil {
+		return gsync.BlockSignature{}, err
+	}
+	return gsync.BlockSignature{Index: r.Index, Weak: r.Weak, Strong: r.Strong}, nil
+}
+
+// next returns the next block signature record, which holds the offset and
+// length of the block in chunked fingerprints.
+func (fr *FingerprintReader) next() (sigRecord, error) {
+	for {
+		var r sigRecord
+		if err := fr.dec.Decode(&r); err != nil {
+			if fr.checksum != nil {
+				// A corrupt record may fail to decode or, with gob, pass
+				// for the end of the stream. Reading up to the real end
+				// reports the checksum mismatch instead.
+				if _, err := io.Copy(io.Discard, fr.checksum); err != nil {
+					return r, err
+				}
+			}
+			return r, err
+		}
+		if r.SourceHash != nil {
+			fr.SourceHash = r.SourceHash
+			fr.SourceSize = r.SourceSize
+			fr.sourceState = r.SourceState
+			continue
+		}
+		return r, nil
+	}
+}
+
+// sourceTrailer returns the trailer recording the SHA-256 srcHash of a
+// source file of size bytes.
+func sourceTrailer(srcHash hash.Hash, size int64) (sigRecord, error) {
+	state, err := srcHash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return sigRecord{}, fmt.Errorf("fingerprint write error: %w", err)
+	}
+	return sigRecord{SourceHash: srcHash.Sum(nil), SourceSize: uint64(size), SourceState: state}, nil
+}
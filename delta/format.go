@@ -0,0 +1,499 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Format selects the serialization of fingerprint and delta files.
+type Format string
+
+const (
+	// FormatGob writes gob encoded records.
+	FormatGob Format = "gob"
+	// FormatJSON writes fingerprints as newline delimited JSON: a header
+	// line, one object per block signature, the source hash and a last
+	// line with the checksum of the lines before it. It applies to
+	// fingerprints only, deltas are written as gob.
+	FormatJSON Format = "json"
+	// FormatMsgpack writes MessagePack encoded records.
+	FormatMsgpack Format = "msgpack"
+	// FormatLibrsync writes signatures and deltas readable by librsync
+	// and rdiff. It has no header, so no compression or encryption.
+	FormatLibrsync Format = "librsync"
+	// FormatVCDIFF writes deltas as VCDIFF (RFC 3284). It applies to
+	// deltas only, fingerprints are written as gob.
+	FormatVCDIFF Format = "vcdiff"
+	// FormatZsync writes fingerprints as .zsync metadata for zsync
+	// clients. It applies to fingerprints only and needs Config.URL.
+	FormatZsync Format = "zsync"
+	// FormatCompact writes fingerprints as fixed width binary records of
+	// 20 bytes with the strong hash truncated to 8 bytes. It applies to
+	// fingerprints of fixed size blocks only, deltas are written as gob.
+	FormatCompact Format = "compact"
+	// FormatProto writes the messages of deltapb/records.proto, each
+	// preceded by its length as a big endian uint32.
+	FormatProto Format = "proto"
+)
+
+// ParseFormat returns the Format named by s.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatGob, FormatJSON, FormatMsgpack, FormatLibrsync, FormatVCDIFF, FormatZsync, FormatCompact, FormatProto:
+		return f, nil
+	case "":
+		return FormatGob, nil
+	}
+	return "", fmt.Errorf("unknown format: %s", s)
+}
+
+// sigRecord is a fingerprint record. It holds either a block signature or,
+// as the last record of the fingerprint, the SHA-256 of the source file,
+// which is only known once the whole file was read. Offset and Length are
+// only set in chunked fingerprints, where blocks vary in size. The trailer
+// also holds the size of the source file and the state of its SHA-256,
+// which UpdateFingerprint continues for appended data.
+//
+// Records hold only integers and byte slices. gob writes maps in random
+// order, so a map field would make fingerprints of the same file differ.
+type sigRecord struct {
+	Index       uint64
+	Weak        uint32
+	Strong      []byte
+	SourceHash  []byte
+	Offset      uint64
+	Length      uint32
+	SourceSize  uint64
+	SourceState []byte
+}
+
+type sigEncoder interface {
+	Encode(r sigRecord) error
+	// EncodeTrailer writes the trailer t, which holds only the source
+	// fields.
+	EncodeTrailer(t sigRecord) error
+}
+
+type sigDecoder interface {
+	Decode(r *sigRecord) error
+}
+
+// formatFlags returns the header flags recording f.
+func formatFlags(f Format) uint16 {
+	switch f {
+	case FormatMsgpack:
+		return flagMsgpack
+	case FormatProto:
+		return flagProto
+	}
+	return 0
+}
+
+// fingerprintFlags returns the header flags recording f for a fingerprint,
+// which is written by a newFingerprintWriter. JSON fingerprints have no
+// binary header, their checksum is always there.
+func fingerprintFlags(f Format) uint16 {
+	switch f {
+	case FormatCompact:
+		return flagCompact | flagChecksum
+	case FormatJSON:
+		return 0
+	}
+	return formatFlags(f) | flagChecksum
+}
+
+// newFingerprintEncoder writes the header fh of a fingerprint in format f
+// to w and returns the encoder of its records. JSON fingerprints start
+// with a JSON header line instead of the binary header.
+func newFingerprintEncoder(w io.Writer, f Format, fh fingerprintHeader) (sigEncoder, error) {
+	fh.Flags |= fingerprintFlags(f)
+	if f == FormatJSON {
+		e := &jsonSigEncoder{json.NewEncoder(w)}
+		jh := jsonHeader{
+			Format:    jsonFingerprintFormat,
+			Version:   fingerprintVersion,
+			Hash:      fh.Hash.String(),
+			BlockSize: fh.BlockSize,
+			Chunked:   fh.Flags&flagChunked != 0,
+		}
+		if weak := weakHashOf(fh.Flags); weak != WeakGsync {
+			jh.WeakHash = string(weak)
+		}
+		return e, e.enc.Encode(jh)
+	}
+	if err := writeFingerprintHeader(w, fh); err != nil {
+		return nil, err
+	}
+	return newSigEncoder(w, f), nil
+}
+
+func newSigEncoder(w io.Writer, f Format) sigEncoder {
+	switch f {
+	case FormatCompact:
+		return &compactSigEncoder{w}
+	case FormatProto:
+		return &protoSigEncoder{w}
+	case FormatMsgpack:
+		return &msgpackSigEncoder{msgpack.NewEncoder(w)}
+	}
+	return &gobSigEncoder{gob.NewEncoder(w)}
+}
+
+// newSigDecoder returns a decoder for the fingerprint read from r. The
+// header flags select MessagePack, compact or protobuf records, otherwise JSON
+// fingerprints are detected by their leading '{', which also reads their
+// header line, and anything else is decoded as gob.
+func newSigDecoder(r io.Reader, flags uint16) (sigDecoder, error) {
+	br := bufio.NewReader(r)
+	if flags&flagCompact != 0 {
+		return &compactSigDecoder{br}, nil
+	}
+	if flags&flagProto != 0 {
+		return &protoSigDecoder{br}, nil
+	}
+	if flags&flagMsgpack != 0 {
+		return &msgpackSigDecoder{msgpack.NewDecoder(br)}, nil
+	}
+	b, err := br.Peek(1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(b) > 0 && b[0] == '{' {
+		return newJSONSigDecoder(br)
+	}
+	return &gobSigDecoder{gob.NewDecoder(br)}, nil
+}
+
+// recordEncoder and recordDecoder are implemented by the gob, MessagePack
+// and protobuf streams of delta records.
+type recordEncoder interface {
+	Encode(v interface{}) error
+}
+
+type recordDecoder interface {
+	Decode(v interface{}) error
+}
+
+func newRecordEncoder(w io.Writer, f Format) recordEncoder {
+	switch f {
+	case FormatMsgpack:
+		return msgpack.NewEncoder(w)
+	case FormatProto:
+		return &protoRecordCodec{w: w}
+	}
+	return gob.NewEncoder(w)
+}
+
+func newRecordDecoder(r io.Reader, flags uint16) recordDecoder {
+	switch {
+	case flags&flagMsgpack != 0:
+		return msgpack.NewDecoder(r)
+	case flags&flagProto != 0:
+		return &protoRecordCodec{r: bufio.NewReader(r)}
+	}
+	return gob.NewDecoder(r)
+}
+
+// init numbers the gob types in a fixed order. gob assigns type ids once
+// per process, in the order types are first encoded, and writes them into
+// every stream, so a process encoding an opRecord before a sigRecord would
+// write other bytes for the same delta than one that encoded them the
+// other way around. Every stream has its own encoder, which sends each
+// type description once.
+func init() {
+	enc := gob.NewEncoder(io.Discard)
+	for _, v := range []any{sigRecord{}, opRecord{}, []uint64{}} {
+		if err := enc.Encode(v); err != nil {
+			panic(err)
+		}
+	}
+}
+
+type gobSigEncoder struct {
+	enc *gob.Encoder
+}
+
+// Encode writes r without its zero fields, so fingerprints of fixed size
+// blocks still decode into gsync.BlockSignature.
+func (e *gobSigEncoder) Encode(r sigRecord) error {
+	return e.enc.Encode(r)
+}
+
+func (e *gobSigEncoder) EncodeTrailer(t sigRecord) error {
+	return e.enc.Encode(t)
+}
+
+// gobSigDecoder decodes into sigRecord, gob matches the fields of the
+// gsync.BlockSignature records of older fingerprints by name.
+type gobSigDecoder struct {
+	dec *gob.Decoder
+}
+
+func (d *gobSigDecoder) Decode(r *sigRecord) error {
+	*r = sigRecord{}
+	return d.dec.Decode(r)
+}
+
+// jsonFingerprintFormat is the Format of the header line of JSON
+// fingerprints. JSON fingerprints written before it follow a binary
+// header or have no header at all.
+const jsonFingerprintFormat = "godelta-fingerprint"
+
+// jsonHeader is the first line of a JSON fingerprint.
+type jsonHeader struct {
+	Format    string
+	Version   uint16
+	Hash      string
+	BlockSize uint32
+	Chunked   bool   `json:",omitempty"`
+	WeakHash  string `json:",omitempty"`
+}
+
+// jsonSignature is the JSON representation of a gsync.BlockSignature.
+type jsonSignature struct {
+	Index  uint64
+	Weak   string
+	Strong string
+	Offset uint64 `json:",omitempty"`
+	Length uint32 `json:",omitempty"`
+}
+
+type jsonTrailer struct {
+	SourceHash  string
+	SourceSize  uint64 `json:",omitempty"`
+	SourceState string `json:",omitempty"`
+}
+
+// jsonChecksum is the last line of a JSON fingerprint with a header line,
+// see checksumWriter.
+type jsonChecksum struct {
+	Checksum string
+}
+
+type jsonSigEncoder struct {
+	enc *json.Encoder
+}
+
+func (e *jsonSigEncoder) Encode(r sigRecord) error {
+	return e.enc.Encode(jsonSignature{
+		Index:  r.Index,
+		Weak:   fmt.Sprintf("%08x", r.Weak),
+		Strong: hex.EncodeToString(r.Strong),
+		Offset: r.Offset,
+		Length: r.Length,
+	})
+}
+
+func (e *jsonSigEncoder) EncodeTrailer(t sigRecord) error {
+	return e.enc.Encode(jsonTrailer{
+		SourceHash:  hex.EncodeToString(t.SourceHash),
+		SourceSize:  t.SourceSize,
+		SourceState: hex.EncodeToString(t.SourceState),
+	})
+}
+
+// jsonSigDecoder decodes a JSON fingerprint line by line. header is set
+// when it starts with a header line, which makes the checksum line at its
+// end required.
+type jsonSigDecoder struct {
+	br      *bufio.Reader
+	crc     hash.Hash32
+	header  *fingerprintHeader
+	pending []byte
+	done    bool
+}
+
+func newJSONSigDecoder(br *bufio.Reader) (*jsonSigDecoder, error) {
+	d := &jsonSigDecoder{br: br, crc: crc32.NewIEEE()}
+	line, err := d.line()
+	if err != nil {
+		return nil, err
+	}
+	var jh jsonHeader
+	if err = json.Unmarshal(line, &jh); err != nil {
+		return nil, err
+	}
+	if jh.Format != jsonFingerprintFormat {
+		d.pending = line
+		return d, nil
+	}
+	if jh.Version == 0 || jh.Version > fingerprintVersion {
+		return nil, fmt.Errorf("%w: JSON fingerprint version %d", ErrUnsupportedVersion, jh.Version)
+	}
+	alg, err := ParseHashAlgorithm(jh.Hash)
+	if err != nil {
+		return nil, err
+	}
+	d.header = &fingerprintHeader{Hash: alg, BlockSize: jh.BlockSize}
+	d.header.Version = jh.Version
+	if jh.Chunked {
+		d.header.Flags = flagChunked
+	}
+	weak, err := ParseWeakHash(jh.WeakHash)
+	if err != nil {
+		return nil, err
+	}
+	d.header.Flags |= weakFlags(weak)
+	d.crc.Write(line)
+	return d, nil
+}
+
+// line returns the next line that is not blank, or io.EOF.
+func (d *jsonSigDecoder) line() ([]byte, error) {
+	if line := d.pending; line != nil {
+		d.pending = nil
+		return line, nil
+	}
+	for {
+		line, err := d.br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		d.crc.Write(line)
+	}
+}
+
+func (d *jsonSigDecoder) Decode(r *sigRecord) error {
+	line, err := d.line()
+	if err == io.EOF && d.header != nil && !d.done {
+		return fmt.Errorf("%w: checksum missing", ErrFingerprintChecksumFail)
+	}
+	if err != nil {
+		return err
+	}
+	if d.done {
+		return fmt.Errorf("data after the checksum")
+	}
+	var js struct {
+		jsonSignature
+		jsonTrailer
+		jsonChecksum
+	}
+	if err := json.Unmarshal(line, &js); err != nil {
+		return err
+	}
+	if js.Checksum != "" {
+		if err = d.checkSum(js.Checksum); err != nil {
+			return err
+		}
+		return d.Decode(r)
+	}
+	d.crc.Write(line)
+	if js.SourceHash != "" {
+		sourceHash, err := hex.DecodeString(js.SourceHash)
+		if err != nil {
+			return fmt.Errorf("invalid source hash: %v", err)
+		}
+		sourceState, err := hex.DecodeString(js.SourceState)
+		if err != nil {
+			return fmt.Errorf("invalid source hash state: %v", err)
+		}
+		*r = sigRecord{SourceHash: sourceHash, SourceSize: js.SourceSize, SourceState: sourceState}
+		return nil
+	}
+	weak, err := strconv.ParseUint(js.Weak, 16, 32)
+	if err != nil {
+		return fmt.Errorf("block %d: invalid weak checksum: %v", js.Index, err)
+	}
+	strong, err := hex.DecodeString(js.Strong)
+	if err != nil {
+		return fmt.Errorf("block %d: invalid strong checksum: %v", js.Index, err)
+	}
+	*r = sigRecord{
+		Index:  js.Index,
+		Weak:   uint32(weak),
+		Strong: strong,
+		Offset: js.Offset,
+		Length: js.Length,
+	}
+	return nil
+}
+
+// checkSum compares checksum, read from the last line, with the CRC-32 of
+// the lines before it.
+func (d *jsonSigDecoder) checkSum(checksum string) error {
+	d.done = true
+	if actual := fmt.Sprintf("%08x", d.crc.Sum32()); checksum != actual {
+		return fmt.Errorf("%w: stored %s, computed %s", ErrFingerprintChecksumFail, checksum, actual)
+	}
+	return nil
+}
+
+// msgpackSignature is the MessagePack representation of a sigRecord.
+type msgpackSignature struct {
+	Index       uint64 `msgpack:"index,omitempty"`
+	Weak        uint32 `msgpack:"weak,omitempty"`
+	Strong      []byte `msgpack:"strong,omitempty"`
+	SourceHash  []byte `msgpack:"source_hash,omitempty"`
+	Offset      uint64 `msgpack:"offset,omitempty"`
+	Length      uint32 `msgpack:"length,omitempty"`
+	SourceSize  uint64 `msgpack:"source_size,omitempty"`
+	SourceState []byte `msgpack:"source_state,omitempty"`
+}
+
+type msgpackSigEncoder struct {
+	enc *msgpack.Encoder
+}
+
+func (e *msgpackSigEncoder) Encode(r sigRecord) error {
+	return e.enc.Encode(msgpackSignature(r))
+}
+
+func (e *msgpackSigEncoder) EncodeTrailer(t sigRecord) error {
+	return e.enc.Encode(msgpackSignature(t))
+}
+
+type msgpackSigDecoder struct {
+	dec *msgpack.Decoder
+}
+
+func (d *msgpackSigDecoder) Decode(r *sigRecord) error {
+	var ms msgpackSignature
+	if err := d.dec.Decode(&ms); err != nil {
+		return err
+	}
+	*r = sigRecord(ms)
+	return nil
+}
+
+// opRecord is a delta record. It holds either a block operation or, as the
+// last record of the delta, the hash of the new file, which is only known
+// once the whole file was diffed. gob matches the fields by name, so
+// records written as gsync.BlockOperation decode into it as well. In
+// chunked deltas a reference carries the Offset and Length of the source
+// chunk instead of relying on the block size. The trailer of deltas with
+// flagMerkle also holds the nodes of the Merkle tree over the operations,
+// and the references of deltas with flagSourceHashes the Strong hash of
+// their source block. The Flags of literals in deltas with
+// flagCompressedLiterals tell whether their Data is compressed. Like
+// sigRecord it must not hold maps.
+type opRecord struct {
+	Index    uint64   `msgpack:"index,omitempty"`
+	Data     []byte   `msgpack:"data,omitempty"`
+	Datahash []byte   `msgpack:"datahash,omitempty"`
+	Offset   uint64   `msgpack:"offset,omitempty"`
+	Length   uint32   `msgpack:"length,omitempty"`
+	Merkle   [][]byte `msgpack:"merkle,omitempty"`
+	Strong   []byte   `msgpack:"strong,omitempty"`
+	Flags    uint8    `msgpack:"flags,omitempty"`
+}
+
+// Operation record flags.
+const (
+	// opCompressed marks a literal whose data is compressed, recognized
+	// by the magic bytes of its compression.
+	opCompressed uint8 = 1 << iota
+)
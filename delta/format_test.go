@@ -0,0 +1,35 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestDeterministicOutput(t *testing.T) {
+	old := randomBytes(1, 20*testBlockSize+7)
+	new := append(randomBytes(2, 3*testBlockSize), old[testBlockSize:]...)
+	for _, f := range []Format{FormatGob, FormatMsgpack, FormatJSON, FormatProto} {
+		t.Run(string(f), func(t *testing.T) {
+			workers := []int{1, 1, 4}
+			fps := make([]bytes.Buffer, len(workers))
+			for i, n := range workers {
+				err := GenerateFingerprint(context.Background(), bytes.NewReader(old), &fps[i],
+					WithBlockSize(testBlockSize), withFormat(f), WithConcurrency(n), WithHashSource())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 1; i < len(fps); i++ {
+				if !bytes.Equal(fps[i].Bytes(), fps[0].Bytes()) {
+					t.Errorf("fingerprint with %d workers differs", workers[i])
+				}
+			}
+			d1, _ := roundTrip(t, old, new, withFormat(f))
+			d2, _ := roundTrip(t, old, new, withFormat(f))
+			if !bytes.Equal(d1, d2) {
+				t.Error("deltas of the same files differ")
+			}
+		})
+	}
+}
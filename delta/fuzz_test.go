@@ -0,0 +1,25 @@
+package delta
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzRoundTrip(f *testing.F) {
+	base := randomBytes(1, 3*testBlockSize+17)
+	edited := bytes.Clone(base)
+	// Crosses the boundary of the first and the second block.
+	copy(edited[testBlockSize-4:], "boundary")
+	f.Add([]byte{}, []byte{})
+	f.Add(base, base)
+	f.Add(base, append(bytes.Clone(base[:100]), append([]byte{base[100] + 1}, base[101:]...)...))
+	f.Add(base, base[:2*testBlockSize])
+	f.Add(base[:testBlockSize+1], base)
+	f.Add(base, edited)
+	f.Fuzz(func(t *testing.T, old, new []byte) {
+		_, got := roundTrip(t, old, new)
+		if !bytes.Equal(got, new) {
+			t.Fatalf("patched %d bytes, want %d bytes of the new file", len(got), len(new))
+		}
+	})
+}
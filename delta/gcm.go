@@ -0,0 +1,179 @@
+package delta
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// GCMKeySize is the size of the AES-256-GCM keys encrypting deltas.
+const GCMKeySize = 32
+
+// gcmNonceSize is the size of the nonce stored in the header of GCM
+// encrypted deltas.
+const gcmNonceSize = 12
+
+// gcmSegmentSize is the plaintext size of the segments a GCM encrypted
+// stream is sealed in, so it can be decrypted without reading it all.
+const gcmSegmentSize = 64 << 10
+
+// gcmEncrypted reports whether new deltas are encrypted with AES-256-GCM.
+func (cfg Config) gcmEncrypted() bool {
+	return cfg.EncryptKey != nil || cfg.EncryptPassword != ""
+}
+
+// gcmKey returns EncryptKey or, for a password, derives the key with
+// scrypt using the nonce of the delta as salt.
+func (cfg Config) gcmKey(nonce []byte) ([]byte, error) {
+	if cfg.EncryptKey != nil {
+		if len(cfg.EncryptKey) != GCMKeySize {
+			return nil, fmt.Errorf("invalid encryption key: %d bytes, expected %d", len(cfg.EncryptKey), GCMKeySize)
+		}
+		return cfg.EncryptKey, nil
+	}
+	return scrypt.Key([]byte(cfg.EncryptPassword), nonce, 1<<15, 8, 1, GCMKeySize)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newGCMNonce returns a random nonce for the header of a new delta.
+func newGCMNonce() ([]byte, error) {
+	nonce := make([]byte, gcmNonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// segmentNonce returns the nonce of segment n: the last 8 bytes of the
+// header nonce are XORed with n.
+func segmentNonce(nonce []byte, n uint64) []byte {
+	sn := make([]byte, gcmNonceSize)
+	copy(sn, nonce)
+	binary.BigEndian.PutUint64(sn[4:], binary.BigEndian.Uint64(nonce[4:])^n)
+	return sn
+}
+
+// segmentAAD marks the last segment, so a truncated stream fails to open.
+func segmentAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// gcmWriter seals the data written to it in segments of gcmSegmentSize.
+// Close seals the last, possibly empty segment.
+type gcmWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	n     uint64
+	buf   []byte
+}
+
+func newGCMWriter(w io.Writer, key, nonce []byte) (*gcmWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmWriter{w: w, aead: aead, nonce: nonce, buf: make([]byte, 0, gcmSegmentSize)}, nil
+}
+
+func (g *gcmWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more data follows, as the
+		// last one has to be marked.
+		if len(g.buf) == gcmSegmentSize {
+			if err := g.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(g.buf[len(g.buf):gcmSegmentSize], p)
+		g.buf = g.buf[:len(g.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (g *gcmWriter) seal(last bool) error {
+	sealed := g.aead.Seal(nil, segmentNonce(g.nonce, g.n), g.buf, segmentAAD(last))
+	g.n++
+	g.buf = g.buf[:0]
+	_, err := g.w.Write(sealed)
+	return err
+}
+
+func (g *gcmWriter) Close() error {
+	return g.seal(true)
+}
+
+// gcmReader opens the segments written by a gcmWriter.
+type gcmReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	n     uint64
+	buf   []byte
+	plain []byte
+	done  bool
+}
+
+func newGCMReader(r io.Reader, key, nonce []byte) (*gcmReader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmReader{
+		r:     bufio.NewReader(r),
+		aead:  aead,
+		nonce: nonce,
+		buf:   make([]byte, gcmSegmentSize+aead.Overhead()),
+	}, nil
+}
+
+func (g *gcmReader) Read(p []byte) (int, error) {
+	for len(g.plain) == 0 {
+		if g.done {
+			return 0, io.EOF
+		}
+		if err := g.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, g.plain)
+	g.plain = g.plain[n:]
+	return n, nil
+}
+
+// open reads and opens the next segment. A segment shorter than a full
+// one, or followed by the end of the stream, is the last.
+func (g *gcmReader) open() error {
+	n, err := io.ReadFull(g.r, g.buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		g.done = true
+	} else if err != nil {
+		return err
+	} else if _, err = g.r.Peek(1); err == io.EOF {
+		g.done = true
+	}
+	plain, err := g.aead.Open(g.buf[:0], segmentNonce(g.nonce, g.n), g.buf[:n], segmentAAD(g.done))
+	if err != nil {
+		return fmt.Errorf("segment %d: %w", g.n, err)
+	}
+	g.n++
+	g.plain = plain
+	return nil
+}
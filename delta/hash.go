@@ -0,0 +1,76 @@
+package delta
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// HashAlgorithm identifies the strong hash used for block signatures. The
+// value is stored in the fingerprint header, so existing values must not
+// change.
+type HashAlgorithm byte
+
+const (
+	HashSHA256  HashAlgorithm = 1
+	HashSHA512  HashAlgorithm = 2
+	HashMD5     HashAlgorithm = 3
+	HashBLAKE2b HashAlgorithm = 4
+)
+
+var hashNames = map[HashAlgorithm]string{
+	HashSHA256:  "sha256",
+	HashSHA512:  "sha512",
+	HashMD5:     "md5",
+	HashBLAKE2b: "blake2b",
+}
+
+// ParseHashAlgorithm returns the HashAlgorithm named by s. An empty name
+// returns 0, which means the algorithm is taken from the fingerprint or
+// defaults to SHA-256.
+func ParseHashAlgorithm(s string) (HashAlgorithm, error) {
+	if s == "" {
+		return 0, nil
+	}
+	for h, name := range hashNames {
+		if name == s {
+			return h, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown hash algorithm: %s", s)
+}
+
+// HashAlgorithms returns the names of the supported hash algorithms.
+func HashAlgorithms() []string {
+	names := make([]string, 0, len(hashNames))
+	for h := HashSHA256; h <= HashBLAKE2b; h++ {
+		names = append(names, hashNames[h])
+	}
+	return names
+}
+
+func (h HashAlgorithm) String() string {
+	if name, ok := hashNames[h]; ok {
+		return name
+	}
+	return fmt.Sprintf("hash(%d)", byte(h))
+}
+
+// New returns a new hash.Hash computing h. The zero value yields SHA-256.
+func (h HashAlgorithm) New() (hash.Hash, error) {
+	switch h {
+	case 0, HashSHA256:
+		return sha256.New(), nil
+	case HashSHA512:
+		return sha512.New(), nil
+	case HashMD5:
+		return md5.New(), nil
+	case HashBLAKE2b:
+		return blake2b.New256(nil)
+	}
+	return nil, fmt.Errorf("unknown hash algorithm: %d", byte(h))
+}
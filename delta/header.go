@@ -0,0 +1,275 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Every file starts with a 4 byte magic, a big endian uint16 format
+// version and uint16 flags. Files written before the header was introduced
+// have none and are still read as version 0.
+var (
+	fingerprintMagic = []byte("GDFP")
+	deltaMagic       = []byte("GDLT")
+)
+
+const (
+	fingerprintVersion = 2
+	deltaVersion       = 2
+)
+
+// Header flags.
+const (
+	flagEncrypted uint16 = 1 << iota
+	flagMsgpack
+	// flagChunked marks files split by content-defined chunking.
+	flagChunked
+	// flagMerkle marks deltas with a Merkle tree over their operations.
+	// The root follows the block size in the header.
+	flagMerkle
+	// flagGCM marks deltas encrypted with AES-256-GCM. The nonce follows
+	// the block size and Merkle root in the header.
+	flagGCM
+	// flagSize marks deltas ending with the size of the new file as a big
+	// endian uint64, after the encrypted and compressed stream.
+	flagSize
+	// flagIndexed marks deltas with the references sorted by source
+	// block, which need their operation index to be applied.
+	flagIndexed
+	// flagCompact marks fingerprints of fixed width binary records with
+	// truncated strong hashes.
+	flagCompact
+	// flagProto marks files of length prefixed protobuf records.
+	flagProto
+	// flagSourceHashes marks deltas whose references carry the strong hash
+	// of their source block. The hash algorithm follows the nonce in the
+	// header.
+	flagSourceHashes
+	// flagChecksum marks fingerprints ending with a CRC-32 of their
+	// content.
+	flagChecksum
+	// flagBaseHash marks deltas recording the SHA-256 of the source file
+	// the fingerprint was generated from. It follows the source hash
+	// algorithm in the header.
+	flagBaseHash
+	// flagVersions marks deltas recording the versions of their source
+	// and new file as two NUL terminated strings after the base hash.
+	flagVersions
+	// flagCompressedLiterals marks deltas whose literals may hold data
+	// compressed on its own, marked by opCompressed in their record.
+	flagCompressedLiterals
+	// flagWeakAdler32 and flagWeakCRC32 mark fingerprints whose weak
+	// checksums are WeakAdler32 or WeakCRC32 instead of WeakGsync.
+	flagWeakAdler32
+	flagWeakCRC32
+
+	knownFlags = flagEncrypted | flagMsgpack | flagChunked | flagMerkle | flagGCM | flagSize | flagIndexed | flagCompact | flagProto | flagSourceHashes | flagChecksum | flagBaseHash | flagVersions | flagCompressedLiterals | flagWeakAdler32 | flagWeakCRC32
+)
+
+// maxVersionLength is the maximum length in bytes of the version strings
+// of flagVersions.
+const maxVersionLength = 256
+
+const headerSize = 8
+
+// merkleRootOffset is the position of the Merkle root in a delta header.
+const merkleRootOffset = headerSize + 4
+
+type header struct {
+	Version uint16
+	Flags   uint16
+}
+
+func writeHeader(w io.Writer, magic []byte, h header) error {
+	buf := make([]byte, headerSize)
+	copy(buf, magic)
+	binary.BigEndian.PutUint16(buf[4:], h.Version)
+	binary.BigEndian.PutUint16(buf[6:], h.Flags)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readHeader consumes the header from br if it starts with magic. Streams
+// without the magic return a zero header and are left untouched. Versions
+// newer than maxVersion or with unknown flags return ErrUnsupportedVersion.
+func readHeader(br *bufio.Reader, magic []byte, maxVersion uint16) (header, error) {
+	var h header
+	buf, err := br.Peek(headerSize)
+	if err != nil && err != io.EOF {
+		return h, err
+	}
+	if !bytes.HasPrefix(buf, magic) {
+		return h, nil
+	}
+	if len(buf) < headerSize {
+		return h, io.ErrUnexpectedEOF
+	}
+	h.Version = binary.BigEndian.Uint16(buf[4:])
+	h.Flags = binary.BigEndian.Uint16(buf[6:])
+	if h.Version == 0 || h.Version > maxVersion {
+		return h, fmt.Errorf("%w: %s version %d", ErrUnsupportedVersion, magic, h.Version)
+	}
+	if h.Flags&^knownFlags != 0 {
+		return h, fmt.Errorf("%w: %s flags %#04x", ErrUnsupportedVersion, magic, h.Flags)
+	}
+	_, err = br.Discard(headerSize)
+	return h, err
+}
+
+// fingerprintHeader is the header of a fingerprint file. Version 1 adds
+// the hash algorithm, version 2 the block size.
+type fingerprintHeader struct {
+	header
+	Hash      HashAlgorithm
+	BlockSize uint32
+}
+
+func writeFingerprintHeader(w io.Writer, fh fingerprintHeader) error {
+	fh.Version = fingerprintVersion
+	if err := writeHeader(w, fingerprintMagic, fh.header); err != nil {
+		return err
+	}
+	buf := make([]byte, 5)
+	buf[0] = byte(fh.Hash)
+	binary.BigEndian.PutUint32(buf[1:], fh.BlockSize)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readFingerprintHeader consumes the header from br if there is one.
+// Fingerprints without a header always use SHA-256 and do not record
+// their block size.
+func readFingerprintHeader(br *bufio.Reader) (fingerprintHeader, error) {
+	var fh fingerprintHeader
+	var err error
+	fh.header, err = readHeader(br, fingerprintMagic, fingerprintVersion)
+	if err != nil {
+		return fh, err
+	}
+	if fh.Version == 0 {
+		fh.Hash = HashSHA256
+		return fh, nil
+	}
+	alg, err := br.ReadByte()
+	if err != nil {
+		return fh, err
+	}
+	fh.Hash = HashAlgorithm(alg)
+	if fh.Version >= 2 {
+		if err = binary.Read(br, binary.BigEndian, &fh.BlockSize); err != nil {
+			return fh, err
+		}
+	}
+	return fh, nil
+}
+
+// deltaHeader is the header of a delta file. Version 2 adds the block
+// size. MerkleRoot is only present with flagMerkle, Nonce with flagGCM,
+// Hash with flagSourceHashes, BaseHash with flagBaseHash and the versions
+// with flagVersions.
+type deltaHeader struct {
+	header
+	BlockSize   uint32
+	MerkleRoot  []byte
+	Nonce       []byte
+	Hash        HashAlgorithm
+	BaseHash    []byte
+	FromVersion string
+	ToVersion   string
+}
+
+func writeDeltaHeader(w io.Writer, dh deltaHeader) error {
+	dh.Version = deltaVersion
+	if err := writeHeader(w, deltaMagic, dh.header); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, dh.BlockSize); err != nil {
+		return err
+	}
+	if dh.Flags&flagMerkle != 0 {
+		// The root is only known once the delta is written, see
+		// writeMerkleRoot.
+		if _, err := w.Write(make([]byte, sha256.Size)); err != nil {
+			return err
+		}
+	}
+	if dh.Flags&flagGCM != 0 {
+		if _, err := w.Write(dh.Nonce); err != nil {
+			return err
+		}
+	}
+	if dh.Flags&flagSourceHashes != 0 {
+		if _, err := w.Write([]byte{byte(dh.Hash)}); err != nil {
+			return err
+		}
+	}
+	if dh.Flags&flagBaseHash != 0 {
+		if _, err := w.Write(dh.BaseHash); err != nil {
+			return err
+		}
+	}
+	if dh.Flags&flagVersions != 0 {
+		if _, err := io.WriteString(w, dh.FromVersion+"\x00"+dh.ToVersion+"\x00"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readVersion reads a NUL terminated version string of flagVersions.
+func readVersion(br *bufio.Reader) (string, error) {
+	var b []byte
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		if len(b) == maxVersionLength {
+			return "", fmt.Errorf("version string longer than %d bytes", maxVersionLength)
+		}
+		b = append(b, c)
+	}
+}
+
+// readDeltaHeader consumes the header from br if there is one.
+func readDeltaHeader(br *bufio.Reader) (deltaHeader, error) {
+	var dh deltaHeader
+	var err error
+	dh.header, err = readHeader(br, deltaMagic, deltaVersion)
+	if err != nil {
+		return dh, err
+	}
+	if dh.Version >= 2 {
+		err = binary.Read(br, binary.BigEndian, &dh.BlockSize)
+	}
+	if err == nil && dh.Flags&flagMerkle != 0 {
+		dh.MerkleRoot = make([]byte, sha256.Size)
+		_, err = io.ReadFull(br, dh.MerkleRoot)
+	}
+	if err == nil && dh.Flags&flagGCM != 0 {
+		dh.Nonce = make([]byte, gcmNonceSize)
+		_, err = io.ReadFull(br, dh.Nonce)
+	}
+	if err == nil && dh.Flags&flagSourceHashes != 0 {
+		var alg byte
+		alg, err = br.ReadByte()
+		dh.Hash = HashAlgorithm(alg)
+	}
+	if err == nil && dh.Flags&flagBaseHash != 0 {
+		dh.BaseHash = make([]byte, sha256.Size)
+		_, err = io.ReadFull(br, dh.BaseHash)
+	}
+	if err == nil && dh.Flags&flagVersions != 0 {
+		if dh.FromVersion, err = readVersion(br); err == nil {
+			dh.ToVersion, err = readVersion(br)
+		}
+	}
+	return dh, err
+}
@@ -0,0 +1,146 @@
+package delta
+
+import (
+	"errors"
+	"io"
+)
+
+// DeltaHeader describes how a delta file is encoded.
+type DeltaHeader struct {
+	// Magic is the magic of the header, empty for deltas written before
+	// the header was introduced.
+	Magic       string          `json:"magic"`
+	Version     uint16          `json:"version"`
+	Flags       []string        `json:"flags"`
+	BlockSize   uint32          `json:"block_size"`
+	Encoding    string          `json:"encoding"`
+	Compression CompressionType `json:"compression"`
+	Encryption  string          `json:"encryption"`
+	MerkleRoot  []byte          `json:"merkle_root,omitempty"`
+	FromVersion string          `json:"from_version,omitempty"`
+	ToVersion   string          `json:"to_version,omitempty"`
+	// Operations is the number of operations recorded by the writer, or 0
+	// if it was unknown.
+	Operations int64 `json:"operations"`
+}
+
+// Operation is a decoded block operation of a delta.
+type Operation struct {
+	// Entry is the position of the operation in the delta.
+	Entry int64 `json:"entry"`
+	// Type is "reference" for a block copied from the source file and
+	// "literal" for data stored in the delta.
+	Type string `json:"type"`
+	// Index is the source block of a reference.
+	Index uint64 `json:"index"`
+	// Offset and Length locate the source block of a reference in chunked
+	// deltas. For a literal Length is the length of its data.
+	Offset uint64 `json:"offset,omitempty"`
+	Length uint32 `json:"length,omitempty"`
+	Data   []byte `json:"-"`
+}
+
+var flagNames = []struct {
+	flag uint16
+	name string
+}{
+	{flagEncrypted, "encrypted"},
+	{flagMsgpack, "msgpack"},
+	{flagChunked, "chunked"},
+	{flagMerkle, "merkle"},
+	{flagGCM, "gcm"},
+	{flagSize, "size"},
+	{flagIndexed, "indexed"},
+	{flagCompact, "compact"},
+	{flagProto, "proto"},
+	{flagSourceHashes, "source-hashes"},
+	{flagChecksum, "checksum"},
+	{flagBaseHash, "base-hash"},
+	{flagVersions, "versions"},
+	{flagCompressedLiterals, "compressed-literals"},
+}
+
+// DeltaReader decodes the operations of a delta file one by one, for
+// inspecting it rather than applying it.
+type DeltaReader struct {
+	// Header is read by NewDeltaReader.
+	Header DeltaHeader
+	// Datahash is the hash of the new file. It is set once Next returned
+	// io.EOF, and stays nil for deltas without it.
+	Datahash []byte
+
+	dr    *deltaReader
+	entry int64
+}
+
+// NewDeltaReader reads the header of the delta read from in. Encrypted
+// deltas need their key in opts.
+func NewDeltaReader(in io.Reader, opts ...Option) (*DeltaReader, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	dr, err := newDeltaReader(in, cfg)
+	if err != nil {
+		return nil, err
+	}
+	h := dr.header
+	info := DeltaHeader{
+		Version:     h.Version,
+		Flags:       []string{},
+		BlockSize:   h.BlockSize,
+		Encoding:    "gob",
+		Compression: dr.compression,
+		Encryption:  "none",
+		MerkleRoot:  h.MerkleRoot,
+		FromVersion: h.FromVersion,
+		ToVersion:   h.ToVersion,
+		Operations:  dr.total,
+	}
+	if h.Version > 0 {
+		info.Magic = string(deltaMagic)
+	}
+	for _, f := range flagNames {
+		if h.Flags&f.flag != 0 {
+			info.Flags = append(info.Flags, f.name)
+		}
+	}
+	switch {
+	case h.Flags&flagMsgpack != 0:
+		info.Encoding = "msgpack"
+	case h.Flags&flagProto != 0:
+		info.Encoding = "proto"
+	}
+	switch {
+	case h.Flags&flagGCM != 0:
+		info.Encryption = "aes-256-gcm"
+	case h.Flags&flagEncrypted != 0 || (h.Version == 0 && cfg.encrypted()):
+		info.Encryption = "aes-ofb"
+	}
+	return &DeltaReader{Header: info, dr: dr}, nil
+}
+
+// Next returns the next operation, or io.EOF after the last one.
+func (r *DeltaReader) Next() (Operation, error) {
+	rec, err := r.dr.nextRecord()
+	if errors.Is(err, io.EOF) {
+		r.Datahash = r.dr.datahash
+		return Operation{}, io.EOF
+	}
+	if err != nil {
+		return Operation{}, err
+	}
+	op := Operation{Entry: r.entry, Type: "reference", Index: rec.Index, Offset: rec.Offset, Length: rec.Length, Data: rec.Data}
+	if len(rec.Data) > 0 {
+		op = Operation{Entry: r.entry, Type: "literal", Length: uint32(len(rec.Data)), Data: rec.Data}
+	}
+	r.entry++
+	return op, nil
+}
+
+// OutputSize returns the size of the new file recorded at the end of the
+// delta, or -1 if the delta has none. It skips the operations not read by
+// Next.
+func (r *DeltaReader) OutputSize() (int64, error) {
+	return r.dr.outputSize()
+}
@@ -0,0 +1,106 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/Elbandi/gsync"
+)
+
+// syntheticFile is a source file of the given size whose bytes are
+// computed from their offset, so block indexes and offsets above
+// math.MaxUint32 are tested without a large file.
+type syntheticFile int64
+
+func (f syntheticFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(f) {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), int64(f)-off))
+	for i := range n {
+		pos := off + int64(i)
+		p[i] = byte(pos ^ pos>>8 ^ pos>>32 ^ pos>>40)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f syntheticFile) Size() int64 {
+	return int64(f)
+}
+
+func TestLargeOffsets(t *testing.T) {
+	ctx := context.Background()
+	// The last block is short, and past the 32 bit index range.
+	last := uint64(math.MaxUint32 + 2)
+	src := syntheticFile(int64(last)*testBlockSize + 100)
+	ops := []gsync.BlockOperation{
+		{Index: 0},
+		{Index: math.MaxUint32/testBlockSize + 1},
+		{Data: []byte("literal")},
+		{Index: math.MaxUint32},
+		{Index: math.MaxUint32 + 1},
+		{Index: last},
+	}
+	var want []byte
+	for _, o := range ops {
+		if len(o.Data) > 0 {
+			want = append(want, o.Data...)
+			continue
+		}
+		block := make([]byte, testBlockSize)
+		n, err := src.ReadAt(block, int64(o.Index)*testBlockSize)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		want = append(want, block[:n]...)
+	}
+	datahash := sha256.Sum256(want)
+
+	for _, f := range []Format{FormatGob, FormatMsgpack, FormatProto} {
+		var d bytes.Buffer
+		cfg, err := newConfig([]Option{WithBlockSize(testBlockSize), withFormat(f)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dw, err := newDeltaWriter(&d, cfg, int64(len(ops)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range ops {
+			if err = dw.write(o); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = dw.close(datahash[:], int64(len(want))); err != nil {
+			t.Fatal(err)
+		}
+
+		st, err := Stats(ctx, bytes.NewReader(d.Bytes()), src.Size(), WithBlockSize(testBlockSize))
+		if err != nil {
+			t.Fatalf("%s: Stats: %v", f, err)
+		}
+		if st.NewSize != int64(len(want)) {
+			t.Errorf("%s: Stats reports a new size of %d, want %d", f, st.NewSize, len(want))
+		}
+		for _, workers := range []int{1, 4} {
+			t.Run(fmt.Sprintf("%s/workers=%d", f, workers), func(t *testing.T) {
+				var out bytes.Buffer
+				_, err := ApplyPatch(ctx, src, bytes.NewReader(d.Bytes()), &out, WithBlockSize(testBlockSize), WithConcurrency(workers))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(out.Bytes(), want) {
+					t.Error("patched file differs from the referenced blocks")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/md4"
+)
+
+// librsync file magics. Signatures use the rollsum weak checksum and are
+// written with BLAKE2b strong sums; older MD4 signatures are read too.
+const (
+	librsyncMD4SigMagic    uint32 = 0x72730136
+	librsyncBLAKE2SigMagic uint32 = 0x72730137
+	librsyncDeltaMagic     uint32 = 0x72730236
+
+	librsyncStrongLen = 32
+	librsyncCharOff   = 31
+)
+
+// librsync delta commands. Literal and copy commands are followed by their
+// arguments in 1, 2, 4 or 8 big-endian bytes; literals of up to 64 bytes
+// store their length in the command itself.
+const (
+	librsyncOpEnd     = 0x00
+	librsyncOpLiteral = 0x41
+	librsyncOpCopy    = 0x45
+)
+
+// rollsum is the rolling checksum of librsync.
+type rollsum struct {
+	count, s1, s2 uint32
+}
+
+func (r *rollsum) update(p []byte) {
+	for _, b := range p {
+		r.s1 += uint32(b) + librsyncCharOff
+		r.s2 += r.s1
+	}
+	r.count += uint32(len(p))
+}
+
+// rotate moves the window one byte forward.
+func (r *rollsum) rotate(out, in byte) {
+	r.s1 += uint32(in) - uint32(out)
+	r.s2 += r.s1 - r.count*(uint32(out)+librsyncCharOff)
+}
+
+// rollout drops out from the start of the window.
+func (r *rollsum) rollout(out byte) {
+	r.s1 -= uint32(out) + librsyncCharOff
+	r.s2 -= r.count * (uint32(out) + librsyncCharOff)
+	r.count--
+}
+
+func (r *rollsum) digest() uint32 {
+	return r.s2<<16 | r.s1&0xffff
+}
+
+// checkHeaderless rejects the options that formats without a godelta
+// header, named by format, have no room for.
+func (cfg Config) checkHeaderless(format string) error {
+	compressed := func(c CompressionType) bool { return c != "" && c != CompressNone }
+	if cfg.Key != "" || compressed(cfg.Compression) || compressed(cfg.FingerprintCompression) || cfg.Chunking == ChunkCDC {
+		return fmt.Errorf("%s format does not support encryption, compression or chunking", format)
+	}
+	return nil
+}
+
+// writeLibrsyncSignature writes the signature of src in the librsync
+// format.
+func writeLibrsyncSignature(ctx context.Context, cfg Config, src io.Reader, dst io.Writer, bar *progress) (err error) {
+	_, span := tracer.Start(ctx, "compute block signatures")
+	defer func() { endSpan(span, err) }()
+
+	if err = cfg.checkHeaderless("librsync"); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(dst)
+	var hdr [12]byte
+	binary.BigEndian.PutUint32(hdr[0:], librsyncBLAKE2SigMagic)
+	binary.BigEndian.PutUint32(hdr[4:], uint32(cfg.BlockSize))
+	binary.BigEndian.PutUint32(hdr[8:], librsyncStrongLen)
+	if _, err = w.Write(hdr[:]); err != nil {
+		return fmt.Errorf("fingerprint write error: %w", err)
+	}
+	strong, err := blake2b.New256(nil)
+	if err != nil {
+		return err
+	}
+	block := make([]byte, cfg.BlockSize)
+	var n, total int
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		n, err = io.ReadFull(src, block)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: %v", ErrBlockChecksumFail, err)
+		}
+		var weak rollsum
+		weak.update(block[:n])
+		var sum [4]byte
+		binary.BigEndian.PutUint32(sum[:], weak.digest())
+		strong.Reset()
+		strong.Write(block[:n])
+		w.Write(sum[:])
+		if _, err = w.Write(strong.Sum(nil)[:librsyncStrongLen]); err != nil {
+			return fmt.Errorf("fingerprint write error: %w", err)
+		}
+		total += n
+		bar.Increment()
+	}
+	if err = w.Flush(); err != nil {
+		return fmt.Errorf("fingerprint write error: %w", err)
+	}
+	cfg.logger().Debug("fingerprint done", "phase", "fpgen", "bytesProcessed", total)
+	span.SetAttributes(attribute.Int64("godelta.blocks", bar.done), attribute.Int64("godelta.file_size", int64(total)))
+	bar.Finish(int64(total), 0)
+	return nil
+}
+
+// librsyncSignature is a loaded librsync signature file.
+type librsyncSignature struct {
+	magic     uint32
+	blockSize int
+	strongLen int
+	blocks    map[uint32][]librsyncBlock
+}
+
+type librsyncBlock struct {
+	index  uint64
+	strong []byte
+}
+
+func readLibrsyncSignature(r io.Reader, bar *progress) (*librsyncSignature, error) {
+	br := bufio.NewReader(r)
+	var hdr [12]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFingerprintCorrupt, err)
+	}
+	maxStrongLen := librsyncStrongLen
+	switch magic := binary.BigEndian.Uint32(hdr[0:]); magic {
+	case librsyncBLAKE2SigMagic:
+	case librsyncMD4SigMagic:
+		maxStrongLen = md4.Size
+	default:
+		return nil, fmt.Errorf("%w: librsync signature magic %08x", ErrUnsupportedVersion, magic)
+	}
+	sig := &librsyncSignature{
+		magic:     binary.BigEndian.Uint32(hdr[0:]),
+		blockSize: int(binary.BigEndian.Uint32(hdr[4:])),
+		strongLen: int(binary.BigEndian.Uint32(hdr[8:])),
+		blocks:    make(map[uint32][]librsyncBlock),
+	}
+	if sig.blockSize == 0 || sig.strongLen == 0 || sig.strongLen > maxStrongLen {
+		return nil, fmt.Errorf("%w: block size %d, strong sum length %d", ErrFingerprintCorrupt, sig.blockSize, sig.strongLen)
+	}
+	rec := make([]byte, 4+sig.strongLen)
+	for index := uint64(0); ; index++ {
+		_, err := io.ReadFull(br, rec)
+		if err == io.EOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrFingerprintCorrupt, err)
+		}
+		weak := binary.BigEndian.Uint32(rec)
+		sig.blocks[weak] = append(sig.blocks[weak], librsyncBlock{index: index, strong: bytes.Clone(rec[4:])})
+		bar.Increment()
+	}
+}
+
+// newStrong returns the strong hash of the signature.
+func (sig *librsyncSignature) newStrong() (hash.Hash, error) {
+	if sig.magic == librsyncMD4SigMagic {
+		return md4.New(), nil
+	}
+	return blake2b.New256(nil)
+}
+
+// lookup returns the index of the block matching data.
+func (sig *librsyncSignature) lookup(weak uint32, data []byte, strong hash.Hash) (uint64, bool) {
+	candidates := sig.blocks[weak]
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	strong.Reset()
+	strong.Write(data)
+	sum := strong.Sum(nil)[:sig.strongLen]
+	for _, b := range candidates {
+		if bytes.Equal(b.strong, sum) {
+			return b.index, true
+		}
+	}
+	return 0, false
+}
+
+// librsyncWriter writes librsync delta commands, merging adjacent copies.
+type librsyncWriter struct {
+	w                *bufio.Writer
+	copyPos, copyLen uint64
+}
+
+// librsyncIntSize returns the number of bytes librsync stores v in, and
+// its size class.
+func librsyncIntSize(v uint64) (int, byte) {
+	switch {
+	case v <= 0xff:
+		return 1, 0
+	case v <= 0xffff:
+		return 2, 1
+	case v <= 0xffffffff:
+		return 4, 2
+	}
+	return 8, 3
+}
+
+func (lw *librsyncWriter) writeInt(v uint64, size int) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	lw.w.Write(buf[8-size:])
+}
+
+func (lw *librsyncWriter) copy(pos, length uint64) {
+	if lw.copyLen > 0 && lw.copyPos+lw.copyLen == pos {
+		lw.copyLen += length
+		return
+	}
+	lw.flushCopy()
+	lw.copyPos, lw.copyLen = pos, length
+}
+
+func (lw *librsyncWriter) flushCopy() {
+	if lw.copyLen == 0 {
+		return
+	}
+	posSize, posClass := librsyncIntSize(lw.copyPos)
+	lenSize, lenClass := librsyncIntSize(lw.copyLen)
+	lw.w.WriteByte(librsyncOpCopy + posClass*4 + lenClass)
+	lw.writeInt(lw.copyPos, posSize)
+	lw.writeInt(lw.copyLen, lenSize)
+	lw.copyLen = 0
+}
+
+func (lw *librsyncWriter) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	lw.flushCopy()
+	if len(data) <= 64 {
+		lw.w.WriteByte(byte(len(data)))
+	} else {
+		size, class := librsyncIntSize(uint64(len(data)))
+		lw.w.WriteByte(librsyncOpLiteral + class)
+		lw.writeInt(uint64(len(data)), size)
+	}
+	_, err := lw.w.Write(data)
+	return err
+}
+
+func (lw *librsyncWriter) close() error {
+	lw.flushCopy()
+	lw.w.WriteByte(librsyncOpEnd)
+	return lw.w.Flush()
+}
+
+// librsyncLiteralLimit is how much unmatched data is buffered before it is
+// written as a literal command.
+const librsyncLiteralLimit = 1 << 20
+
+// diffLibrsync is MakeDiff for librsync signatures. It writes a librsync
+// delta of in.
+func diffLibrsync(ctx context.Context, cfg Config, fp io.Reader, in io.Reader, out io.Writer) (_ []byte, err error) {
+	if err = cfg.checkHeaderless("librsync"); err != nil {
+		return nil, err
+	}
+	logger := cfg.logger()
+	logger.Debug("create lookup table", "phase", "diff")
+	bar := cfg.newProgress("diff", sizeOf(fp)/int64(4+librsyncStrongLen))
+	_, lookupSpan := tracer.Start(ctx, "build lookup table")
+	sig, err := readLibrsyncSignature(fp, bar)
+	endSpan(lookupSpan, err)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("lookup table loaded", "phase", "diff")
+	strong, err := sig.newStrong()
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("create block diff", "phase", "diff")
+	bar.Reset(cfg.inputSize(in) / int64(sig.blockSize))
+	bar.blockSize = sig.blockSize
+	counted := &countingReader{r: in}
+	datahash := sha256.New()
+	written := &countingWriter{w: out}
+	lw := &librsyncWriter{w: bufio.NewWriter(written)}
+	var magic [4]byte
+	binary.BigEndian.PutUint32(magic[:], librsyncDeltaMagic)
+	if _, err = lw.w.Write(magic[:]); err != nil {
+		return nil, err
+	}
+	if err = writeLibrsyncOperations(ctx, sig, lw, io.TeeReader(counted, datahash), strong, bar); err != nil {
+		return nil, err
+	}
+	if err = lw.close(); err != nil {
+		return nil, err
+	}
+	logger.Debug("diff done", "phase", "diff", "bytesProcessed", counted.n)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("godelta.blocks", bar.done),
+		attribute.Int64("godelta.file_size", counted.n), attribute.Int64("godelta.delta_size", written.n))
+	bar.Finish(counted.n, written.n)
+	return datahash.Sum(nil), nil
+}
+
+// writeLibrsyncOperations rolls a block sized window over in and writes a
+// copy command for every window found in sig and literals for the bytes
+// in between.
+func writeLibrsyncOperations(ctx context.Context, sig *librsyncSignature, lw *librsyncWriter, in io.Reader, strong hash.Hash, bar *progress) (err error) {
+	_, span := tracer.Start(ctx, "sync blocks")
+	defer func() { endSpan(span, err) }()
+
+	bs := sig.blockSize
+	var (
+		buf   []byte
+		pos   int
+		eof   bool
+		sum   rollsum
+		valid bool
+	)
+	chunk := make([]byte, bs)
+	for {
+		// One byte beyond the window is needed to roll it forward.
+		for !eof && len(buf)-pos <= bs {
+			n, err := in.Read(chunk)
+			buf = append(buf, chunk[:n]...)
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return fmt.Errorf("diff error: %w", err)
+			}
+		}
+		n := min(bs, len(buf)-pos)
+		if n == 0 {
+			break
+		}
+		if !valid {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			sum = rollsum{}
+			sum.update(buf[pos : pos+n])
+			valid = true
+		}
+		if index, ok := sig.lookup(sum.digest(), buf[pos:pos+n], strong); ok {
+			if err = lw.literal(buf[:pos]); err != nil {
+				return err
+			}
+			if pos > 0 {
+				bar.Literal(pos)
+			}
+			lw.copy(index*uint64(bs), uint64(n))
+			bar.Match()
+			bar.Increment()
+			buf = append(buf[:0], buf[pos+n:]...)
+			pos, valid = 0, false
+			continue
+		}
+		if pos+n < len(buf) {
+			sum.rotate(buf[pos], buf[pos+n])
+		} else {
+			sum.rollout(buf[pos])
+		}
+		pos++
+		if pos >= librsyncLiteralLimit {
+			if err = lw.literal(buf[:pos]); err != nil {
+				return err
+			}
+			bar.Literal(pos)
+			bar.Increment()
+			buf = append(buf[:0], buf[pos:]...)
+			pos = 0
+		}
+	}
+	if pos > 0 {
+		bar.Literal(pos)
+		bar.Increment()
+	}
+	return lw.literal(buf[:pos])
+}
+
+// applyLibrsync is ApplyPatch for librsync deltas. librsync deltas carry
+// no datahash, so only the hash of the written data is returned.
+func applyLibrsync(ctx context.Context, src io.ReaderAt, in io.Reader, out io.Writer, cfg Config) ([]byte, []byte, error) {
+	read := &countingReader{r: in}
+	br := bufio.NewReader(read)
+	var magic [4]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrDeltaCorrupt, err)
+	}
+	if m := binary.BigEndian.Uint32(magic[:]); m != librsyncDeltaMagic {
+		return nil, nil, fmt.Errorf("%w: librsync delta magic %08x", ErrUnsupportedVersion, m)
+	}
+	bar := cfg.newProgress("patch", 0)
+	datahash := sha256.New()
+	counted := &countingWriter{w: out}
+	dst := io.MultiWriter(counted, datahash)
+	_, applySpan := tracer.Start(ctx, "apply blocks")
+	err := applyLibrsyncCommands(ctx, br, src, dst, bar)
+	endSpan(applySpan, err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("patch error: %w", err)
+	}
+	cfg.logger().Debug("patch done", "phase", "patch", "bytesProcessed", counted.n)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("godelta.blocks", bar.done),
+		attribute.Int64("godelta.file_size", counted.n), attribute.Int64("godelta.delta_size", read.n))
+	bar.Finish(counted.n, read.n)
+	return datahash.Sum(nil), nil, nil
+}
+
+func applyLibrsyncCommands(ctx context.Context, br *bufio.Reader, src io.ReaderAt, dst io.Writer, bar *progress) error {
+	readInt := func(size int) (uint64, error) {
+		var buf [8]byte
+		if _, err := io.ReadFull(br, buf[8-size:]); err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint64(buf[:]), nil
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		op, err := br.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrDeltaCorrupt, err)
+		}
+		switch {
+		case op == librsyncOpEnd:
+			return nil
+		case op < librsyncOpLiteral:
+			if _, err = io.CopyN(dst, br, int64(op)); err != nil {
+				return fmt.Errorf("%w: %v", ErrDeltaCorrupt, err)
+			}
+			bar.Literal(int(op))
+		case op < librsyncOpCopy:
+			n, err := readInt(1 << (op - librsyncOpLiteral))
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrDeltaCorrupt, err)
+			}
+			if _, err = io.CopyN(dst, br, int64(n)); err != nil {
+				return fmt.Errorf("%w: %v", ErrDeltaCorrupt, err)
+			}
+			bar.Literal(int(n))
+		case op < librsyncOpCopy+16:
+			pos, err := readInt(1 << ((op - librsyncOpCopy) / 4))
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrDeltaCorrupt, err)
+			}
+			n, err := readInt(1 << ((op - librsyncOpCopy) % 4))
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrDeltaCorrupt, err)
+			}
+			if _, err = io.Copy(dst, io.NewSectionReader(src, int64(pos), int64(n))); err != nil {
+				return err
+			}
+			bar.Match()
+		default:
+			return fmt.Errorf("%w: unknown librsync command %#x", ErrDeltaCorrupt, op)
+		}
+		bar.Increment()
+	}
+}
@@ -0,0 +1,396 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/Elbandi/gsync"
+	"github.com/bits-and-blooms/bloom/v3"
+	bolt "go.etcd.io/bbolt"
+)
+
+// lookupEntrySize estimates the memory a block signature takes in the
+// lookup table besides its strong hash: the map entry, the slice header
+// and the BlockSignature itself.
+const lookupEntrySize = 40
+
+// diskBatchSize is the number of signatures written to the disk index per
+// transaction.
+const diskBatchSize = 4096
+
+// bloomFalsePositives is the false positive rate of the Bloom filter over
+// the weak checksums of a lookup table.
+const bloomFalsePositives = 0.01
+
+// defaultFilterBlocks is the number of blocks the Bloom filter is sized
+// for when the size of the fingerprint is unknown, like for a pipe.
+const defaultFilterBlocks = 1 << 20
+
+var lookupBucket = []byte("signatures")
+
+// lookupTable maps weak checksums to the signatures of the fingerprint,
+// in memory or, past Config.MaxMemory, in a temporary BoltDB file. Either
+// has a Bloom filter over its weak checksums in front of it, so most
+// windows of the new file that match no block skip the lookup.
+type lookupTable struct {
+	sigs   map[uint32][]gsync.BlockSignature
+	disk   *diskIndex
+	filter *bloom.BloomFilter
+}
+
+// buildLookupTable reads the signatures from sigsCh like
+// gsync.LookUpTable. blocks is the estimated number of signatures, which
+// sizes the Bloom filter up front, 0 if unknown. Once their estimated
+// size exceeds maxMemory, the table moves to a disk index in tempDir; 0
+// keeps it in memory.
+func buildLookupTable(ctx context.Context, sigsCh <-chan gsync.BlockSignature, blocks int64, maxMemory int64, tempDir string, logger *slog.Logger) (*lookupTable, error) {
+	if blocks <= 0 {
+		blocks = defaultFilterBlocks
+	}
+	t := &lookupTable{
+		sigs:   make(map[uint32][]gsync.BlockSignature),
+		filter: bloom.NewWithEstimates(uint(blocks), bloomFalsePositives),
+	}
+	var size int64
+	var batch []gsync.BlockSignature
+	for b := range sigsCh {
+		if b.Error != nil {
+			t.close()
+			return nil, b.Error
+		}
+		key := weakKey(b.Weak)
+		t.filter.Add(key[:])
+		if t.disk != nil {
+			if batch = append(batch, b); len(batch) == diskBatchSize {
+				if err := t.disk.add(batch); err != nil {
+					t.close()
+					return nil, err
+				}
+				batch = batch[:0]
+			}
+			continue
+		}
+		t.sigs[b.Weak] = append(t.sigs[b.Weak], b)
+		size += lookupEntrySize + int64(len(b.Strong))
+		if maxMemory > 0 && size > maxMemory {
+			logger.Info("lookup table exceeds the memory limit, moving it to disk", "phase", "diff", "maxMemory", maxMemory)
+			if err := t.spill(tempDir); err != nil {
+				t.close()
+				return nil, err
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		t.close()
+		return nil, err
+	}
+	if t.disk != nil && len(batch) > 0 {
+		if err := t.disk.add(batch); err != nil {
+			t.close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// fingerprintBlocks estimates the number of signatures of the fingerprint
+// fp from its size and the smallest record, a weak checksum and a strong
+// hash of strongSize bytes, or returns 0 if its size is unknown.
+func fingerprintBlocks(fp io.Reader, strongSize int) int64 {
+	return sizeOf(fp) / int64(4+strongSize)
+}
+
+// weakKey is the key of a weak checksum in the Bloom filter and the prefix
+// of its keys in a disk index.
+func weakKey(weak uint32) [4]byte {
+	var key [4]byte
+	binary.BigEndian.PutUint32(key[:], weak)
+	return key
+}
+
+// spill moves the signatures held in memory to a new disk index in dir.
+func (t *lookupTable) spill(dir string) error {
+	d, err := newDiskIndex(dir)
+	if err != nil {
+		return err
+	}
+	t.disk = d
+	var batch []gsync.BlockSignature
+	for _, sigs := range t.sigs {
+		batch = append(batch, sigs...)
+		if len(batch) >= diskBatchSize {
+			if err = d.add(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	t.sigs = nil
+	return d.add(batch)
+}
+
+// sync compares in against the table like gsync.Sync. A disk index is
+// closed once the operations are sent.
+func (t *lookupTable) sync(ctx context.Context, in io.Reader, strong hash.Hash, datahash hash.Hash, weak WeakHash) (<-chan gsync.BlockOperation, error) {
+	if t.disk == nil {
+		return syncRolling(ctx, in, strong, datahash, weak, memoryLookup{sigs: t.sigs, filter: t.filter}, nil), nil
+	}
+	return syncDisk(ctx, in, strong, datahash, weak, t.disk, t.filter)
+}
+
+func (t *lookupTable) close() {
+	if t.disk != nil {
+		t.disk.close()
+	}
+}
+
+// diskIndex stores block signatures in a BoltDB bucket keyed by the big
+// endian weak checksum followed by the big endian block index, so the
+// blocks sharing a weak checksum are adjacent. The values are the strong
+// hashes.
+type diskIndex struct {
+	db *bolt.DB
+}
+
+func newDiskIndex(dir string) (*diskIndex, error) {
+	f, err := os.CreateTemp(dir, "godelta-lookup-*.db")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	db, err := bolt.Open(f.Name(), 0o600, nil)
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	// The file is removed afterwards, there is nothing to keep safe
+	// across a crash.
+	db.NoSync = true
+	return &diskIndex{db: db}, nil
+}
+
+func (d *diskIndex) add(sigs []gsync.BlockSignature) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(lookupBucket)
+		if err != nil {
+			return err
+		}
+		for _, s := range sigs {
+			if err = b.Put(diskKey(s.Weak, s.Index), s.Strong); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func diskKey(weak uint32, index uint64) []byte {
+	key := make([]byte, 12)
+	binary.BigEndian.PutUint32(key, weak)
+	binary.BigEndian.PutUint64(key[4:], index)
+	return key
+}
+
+func (d *diskIndex) close() {
+	path := d.db.Path()
+	d.db.Close()
+	os.Remove(path)
+}
+
+// blockIndex finds the fingerprint block matching the window of the new
+// file starting at offset.
+type blockIndex interface {
+	find(offset int64, weak uint32, block []byte, strong hash.Hash) (uint64, bool)
+}
+
+// memoryLookup is a blockIndex probing the map of a lookupTable held in
+// memory for the weak checksums that filter may hold.
+type memoryLookup struct {
+	sigs   map[uint32][]gsync.BlockSignature
+	filter *bloom.BloomFilter
+}
+
+func (l memoryLookup) find(_ int64, weak uint32, block []byte, strong hash.Hash) (uint64, bool) {
+	key := weakKey(weak)
+	if !l.filter.Test(key[:]) {
+		return 0, false
+	}
+	sigs := l.sigs[weak]
+	if len(sigs) == 0 {
+		return 0, false
+	}
+	sum := blockSum(strong, block)
+	for _, s := range sigs {
+		if bytes.Equal(sum, s.Strong) {
+			return s.Index, true
+		}
+	}
+	return 0, false
+}
+
+// diskLookup is a blockIndex reading a diskIndex in one transaction. It
+// only looks up the weak checksums that filter may hold.
+type diskLookup struct {
+	bucket *bolt.Bucket
+	filter *bloom.BloomFilter
+}
+
+func (l diskLookup) find(_ int64, weak uint32, block []byte, strong hash.Hash) (uint64, bool) {
+	if l.bucket == nil {
+		return 0, false
+	}
+	key := weakKey(weak)
+	if l.filter != nil && !l.filter.Test(key[:]) {
+		return 0, false
+	}
+	var sum []byte
+	c := l.bucket.Cursor()
+	for k, v := c.Seek(key[:]); k != nil && bytes.HasPrefix(k, key[:]); k, v = c.Next() {
+		if sum == nil {
+			sum = blockSum(strong, block)
+		}
+		if bytes.Equal(sum, v) {
+			return binary.BigEndian.Uint64(k[4:]), true
+		}
+	}
+	return 0, false
+}
+
+func blockSum(strong hash.Hash, block []byte) []byte {
+	strong.Reset()
+	strong.Write(block)
+	return strong.Sum(nil)
+}
+
+// syncDisk computes the block operations of in like gsync.Sync, looking
+// the blocks up in d behind filter, and closes d when done.
+func syncDisk(ctx context.Context, in io.Reader, strong hash.Hash, datahash hash.Hash, weak WeakHash, d *diskIndex, filter *bloom.BloomFilter) (<-chan gsync.BlockOperation, error) {
+	tx, err := d.db.Begin(false)
+	if err != nil {
+		d.close()
+		return nil, err
+	}
+	return syncRolling(ctx, in, strong, datahash, weak, diskLookup{bucket: tx.Bucket(lookupBucket), filter: filter}, func() {
+		tx.Rollback()
+		d.close()
+	}), nil
+}
+
+// syncRolling computes the block operations of in like gsync.Sync, with
+// the rolling weak checksum weak, looking the blocks up in idx. release,
+// if not nil, is called once the operations are sent.
+func syncRolling(ctx context.Context, in io.Reader, strong hash.Hash, datahash hash.Hash, weak WeakHash, idx blockIndex, release func()) <-chan gsync.BlockOperation {
+	if datahash != nil {
+		in = io.TeeReader(in, datahash)
+	}
+	r := bufio.NewReaderSize(in, 2*gsync.BlockSize)
+	opsCh := make(chan gsync.BlockOperation)
+	send := func(op gsync.BlockOperation) bool {
+		select {
+		case opsCh <- op:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	go func() {
+		defer close(opsCh)
+		if release != nil {
+			defer release()
+		}
+
+		s := &rollingSync{r: r, size: gsync.BlockSize, h: weak.rolling()}
+		var literal []byte
+		for {
+			if err := s.fill(); err != nil {
+				send(gsync.BlockOperation{Error: err})
+				return
+			}
+			for len(s.window) > 0 {
+				if index, ok := idx.find(s.offset, s.weak(), s.window, strong); ok {
+					if len(literal) > 0 && !send(gsync.BlockOperation{Data: literal}) {
+						return
+					}
+					literal = nil
+					if !send(gsync.BlockOperation{Index: index}) {
+						return
+					}
+					s.offset += int64(len(s.window))
+					s.window = s.window[:0]
+					break
+				}
+				literal = append(literal, s.window[0])
+				if len(literal) == gsync.BlockSize {
+					if !send(gsync.BlockOperation{Data: literal}) {
+						return
+					}
+					literal = nil
+				}
+				if err := s.roll(); err != nil {
+					send(gsync.BlockOperation{Error: err})
+					return
+				}
+			}
+			if s.eof {
+				break
+			}
+		}
+		if len(literal) > 0 {
+			send(gsync.BlockOperation{Data: literal})
+		}
+	}()
+	return opsCh
+}
+
+// rollingSync is the window of syncRolling with its weak checksum.
+type rollingSync struct {
+	r      *bufio.Reader
+	size   int
+	window []byte
+	// offset is the position of the window in the input.
+	offset int64
+	h      rollingHash
+	eof    bool
+}
+
+// fill reads a whole window after a match or at the start.
+func (s *rollingSync) fill() error {
+	s.window = make([]byte, s.size)
+	n, err := io.ReadFull(s.r, s.window)
+	s.window = s.window[:n]
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		s.eof, err = true, nil
+	}
+	s.h.reset(s.window)
+	return err
+}
+
+// roll moves the window one byte forward, or shrinks it at the end of the
+// input.
+func (s *rollingSync) roll() error {
+	out := s.window[0]
+	s.offset++
+	c, err := s.r.ReadByte()
+	if err == io.EOF {
+		s.eof = true
+		s.h.shrink(out)
+		s.window = s.window[1:]
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.h.roll(out, c)
+	s.window = append(s.window[1:], c)
+	return nil
+}
+
+func (s *rollingSync) weak() uint32 {
+	return s.h.sum()
+}
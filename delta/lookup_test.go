@@ -0,0 +1,31 @@
+package delta
+
+import (
+	"bytes"
+	"testing"
+)
+
+func withMaxMemory(n int64) Option {
+	return func(c *Config) error {
+		c.MaxMemory = n
+		return nil
+	}
+}
+
+// TestLookupTableOnDisk checks that a lookup table moved to disk behind its
+// Bloom filter finds the same blocks as the one in memory.
+func TestLookupTableOnDisk(t *testing.T) {
+	old := randomBytes(1, 64*testBlockSize+5)
+	new := append(randomBytes(2, 3*testBlockSize+17), old[5*testBlockSize:]...)
+	want, patched := roundTrip(t, old, new)
+	if !bytes.Equal(patched, new) {
+		t.Fatal("patched file differs from the new file")
+	}
+	got, patched := roundTrip(t, old, new, withMaxMemory(1))
+	if !bytes.Equal(patched, new) {
+		t.Fatal("patched file differs from the new file with the table on disk")
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("delta with the table on disk differs from the one in memory")
+	}
+}
@@ -0,0 +1,58 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"go.uber.org/goleak"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+// TestCancel cancels every phase after its first blocks. TestMain fails if
+// a goroutine of the phase is left behind.
+func TestCancel(t *testing.T) {
+	old := randomBytes(1, 200*testBlockSize)
+	new := append(randomBytes(2, 100*testBlockSize), old...)
+	d, _ := roundTrip(t, old, new)
+	var fp bytes.Buffer
+	if err := GenerateFingerprint(context.Background(), bytes.NewReader(old), &fp, WithBlockSize(testBlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	phases := map[string]func(ctx context.Context, opts ...Option) error{
+		"fpgen": func(ctx context.Context, opts ...Option) error {
+			return GenerateFingerprint(ctx, bytes.NewReader(old), io.Discard, opts...)
+		},
+		"diff": func(ctx context.Context, opts ...Option) error {
+			_, err := MakeDiff(ctx, bytes.NewReader(fp.Bytes()), bytes.NewReader(new), io.Discard, opts...)
+			return err
+		},
+		"patch": func(ctx context.Context, opts ...Option) error {
+			_, err := ApplyPatch(ctx, bytes.NewReader(old), bytes.NewReader(d), io.Discard, opts...)
+			return err
+		},
+	}
+	for name, run := range phases {
+		for _, workers := range []int{1, 4} {
+			t.Run(fmt.Sprintf("%s/workers=%d", name, workers), func(t *testing.T) {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				cancelAfter := func(phase string, done, total int64) {
+					if done == 10 {
+						cancel()
+					}
+				}
+				err := run(ctx, WithBlockSize(testBlockSize), WithConcurrency(workers), WithProgressFunc(cancelAfter))
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("got %v, want %v", err, context.Canceled)
+				}
+			})
+		}
+	}
+}
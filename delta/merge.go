@@ -0,0 +1,115 @@
+package delta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MergeFingerprints writes the fingerprint of the concatenation of the
+// files first and second were generated from, encoded as selected by
+// cfg.Format and compressed as selected by cfg.FingerprintCompression.
+//
+// The blocks of second are moved behind the last block of first, so their
+// Index still locates them in the combined file; with fixed size blocks,
+// the first file must be a multiple of the block size for them to line
+// up. Blocks with a strong hash already seen are dropped, a diff copies
+// them from the first occurrence. The merged fingerprint has no source
+// hash.
+func MergeFingerprints(ctx context.Context, first, second io.Reader, dst io.Writer, opts ...Option) (err error) {
+	ctx, span := tracer.Start(ctx, "MergeFingerprints")
+	defer func() { endSpan(span, err) }()
+
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	switch cfg.Format {
+	case FormatGob, FormatJSON, FormatMsgpack, FormatCompact, FormatProto:
+	default:
+		return fmt.Errorf("cannot write merged fingerprints as %s", cfg.Format)
+	}
+	fr1, err := NewFingerprintReader(first)
+	if err != nil {
+		return fmt.Errorf("%w: first: %v", ErrFingerprintCorrupt, err)
+	}
+	fr2, err := NewFingerprintReader(second)
+	if err != nil {
+		return fmt.Errorf("%w: second: %v", ErrFingerprintCorrupt, err)
+	}
+	if fr1.Hash != fr2.Hash {
+		return fmt.Errorf("%w: fingerprints use %s and %s", ErrHashAlgorithmMismatch, fr1.Hash, fr2.Hash)
+	}
+	if (fr1.StrongSize != 0 || fr2.StrongSize != 0) && cfg.Format != FormatCompact {
+		return fmt.Errorf("compact fingerprints can only be merged into a compact fingerprint")
+	}
+	if fr1.BlockSize != fr2.BlockSize || fr1.Chunking != fr2.Chunking {
+		return fmt.Errorf("fingerprints use different blocks: %d %s and %d %s", fr1.BlockSize, fr1.Chunking, fr2.BlockSize, fr2.Chunking)
+	}
+	if fr1.WeakHash != fr2.WeakHash {
+		return fmt.Errorf("%w: fingerprints use %s and %s weak hashes", ErrHashAlgorithmMismatch, fr1.WeakHash, fr2.WeakHash)
+	}
+
+	fpWriter, err := newFingerprintWriter(dst, cfg.FingerprintCompression, cfg.Format)
+	if err != nil {
+		return fmt.Errorf("fingerprint compress error: %w", err)
+	}
+	fh := fingerprintHeader{Hash: fr1.Hash, BlockSize: uint32(fr1.BlockSize)}
+	if fr1.Chunking == ChunkCDC {
+		fh.Flags = flagChunked
+	}
+	fh.Flags |= weakFlags(fr1.WeakHash)
+	enc, err := newFingerprintEncoder(fpWriter, cfg.Format, fh)
+	if err != nil {
+		return fmt.Errorf("fingerprint write error: %w", err)
+	}
+	bar := cfg.newProgress("merge", 0)
+	seen := make(map[string]struct{})
+
+	// copyRecords encodes the records of fr moved behind the index and
+	// offset of at, and returns the index and offset following its last block.
+	type position struct {
+		index  uint64
+		offset uint64
+	}
+	copyRecords := func(fr *FingerprintReader, at position) (position, error) {
+		next := at
+		for {
+			if err := ctx.Err(); err != nil {
+				return next, err
+			}
+			r, err := fr.next()
+			if errors.Is(err, io.EOF) {
+				return next, nil
+			}
+			if err != nil {
+				return next, fingerprintCorrupt(err)
+			}
+			r.Index += at.index
+			r.Offset += at.offset
+			next.index = max(next.index, r.Index+1)
+			next.offset = max(next.offset, r.Offset+uint64(r.Length))
+			if _, ok := seen[string(r.Strong)]; ok {
+				continue
+			}
+			seen[string(r.Strong)] = struct{}{}
+			if err = enc.Encode(r); err != nil {
+				return next, fmt.Errorf("fingerprint write error: %w", err)
+			}
+			bar.Increment()
+		}
+	}
+	next, err := copyRecords(fr1, position{})
+	if err != nil {
+		return err
+	}
+	if _, err = copyRecords(fr2, next); err != nil {
+		return err
+	}
+	if err = fpWriter.Close(); err != nil {
+		return fmt.Errorf("fingerprint compress error: %w", err)
+	}
+	cfg.logger().Debug("fingerprints merged", "phase", "merge", "blocks", bar.done)
+	return nil
+}
@@ -0,0 +1,161 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// MerkleMismatchError reports the first delta operation whose output does
+// not match the Merkle tree stored in the delta.
+type MerkleMismatchError struct {
+	Op       uint64
+	Expected []byte
+	Actual   []byte
+}
+
+func (e *MerkleMismatchError) Error() string {
+	return fmt.Sprintf("%v: operation %d: expected %x, got %x", ErrPatchMismatch, e.Op, e.Expected, e.Actual)
+}
+
+func (e *MerkleMismatchError) Unwrap() error {
+	return ErrPatchMismatch
+}
+
+// merkleTree returns the nodes of the binary Merkle tree over leaves,
+// level by level from the leaves up to the root. An internal node is the
+// SHA-256 of its two children, a node without a sibling moves up
+// unchanged.
+func merkleTree(leaves [][]byte) [][]byte {
+	if len(leaves) == 0 {
+		empty := sha256.Sum256(nil)
+		return [][]byte{empty[:]}
+	}
+	nodes := append([][]byte(nil), leaves...)
+	level := leaves
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		nodes = append(nodes, next...)
+		level = next
+	}
+	return nodes
+}
+
+// merkleLevels splits the nodes returned by merkleTree for leaves leaves
+// into its levels, leaves first.
+func merkleLevels(nodes [][]byte, leaves int) ([][][]byte, error) {
+	var levels [][][]byte
+	for n := leaves; ; n = (n + 1) / 2 {
+		if len(nodes) < n {
+			return nil, fmt.Errorf("%w: Merkle tree too short", ErrDeltaCorrupt)
+		}
+		levels = append(levels, nodes[:n])
+		nodes = nodes[n:]
+		if n <= 1 {
+			break
+		}
+	}
+	if len(nodes) != 0 {
+		return nil, fmt.Errorf("%w: Merkle tree too long", ErrDeltaCorrupt)
+	}
+	return levels, nil
+}
+
+// firstMismatch descends from the root to the first leaf where the stored
+// and the computed tree differ, comparing two nodes per level.
+func firstMismatch(stored, actual [][][]byte) int {
+	i := 0
+	for level := len(stored) - 1; level > 0; level-- {
+		left := 2 * i
+		if !bytes.Equal(stored[level-1][left], actual[level-1][left]) {
+			i = left
+		} else {
+			i = left + 1
+		}
+	}
+	return i
+}
+
+// verifyMerkle checks the leaves computed while patching against the tree
+// stored in the delta and the root from its header.
+func verifyMerkle(root []byte, nodes [][]byte, leaves [][]byte) error {
+	if root == nil || nodes == nil {
+		return fmt.Errorf("%w: delta has no Merkle tree", ErrDeltaCorrupt)
+	}
+	if !bytes.Equal(nodes[len(nodes)-1], root) {
+		return fmt.Errorf("%w: Merkle tree does not match the root in the header", ErrDeltaCorrupt)
+	}
+	computed := merkleTree(leaves)
+	if bytes.Equal(computed[len(computed)-1], root) {
+		return nil
+	}
+	if len(leaves) == 0 {
+		return fmt.Errorf("%w: delta has no operations", ErrPatchMismatch)
+	}
+	stored, err := merkleLevels(nodes, len(leaves))
+	if err != nil {
+		return fmt.Errorf("%w: %d operations applied", err, len(leaves))
+	}
+	actual, _ := merkleLevels(computed, len(leaves))
+	op := firstMismatch(stored, actual)
+	return &MerkleMismatchError{Op: uint64(op), Expected: stored[0][op], Actual: actual[0][op]}
+}
+
+// writeMerkleRoot fills in the root reserved in the header of the delta
+// written to out.
+func writeMerkleRoot(out io.WriterAt, root []byte) error {
+	if _, err := out.WriteAt(root, merkleRootOffset); err != nil {
+		return fmt.Errorf("delta write error: %w", err)
+	}
+	return nil
+}
+
+// applyMerkle writes the file described by dr to dst one operation after
+// the other and returns the SHA-256 of the output of every operation.
+func applyMerkle(ctx context.Context, dst io.Writer, src io.ReaderAt, datahash hash.Hash, dr *deltaReader, blockSize int, bar *progress) ([][]byte, error) {
+	var leaves [][]byte
+	buf := make([]byte, blockSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		o, err := dr.next()
+		if err == io.EOF {
+			return leaves, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		data := o.Data
+		if len(data) == 0 {
+			n, err := src.ReadAt(buf, int64(o.Index)*int64(blockSize))
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			data = buf[:n]
+			bar.Match()
+		} else {
+			bar.Literal(len(data))
+		}
+		if _, err = dst.Write(data); err != nil {
+			return nil, err
+		}
+		datahash.Write(data)
+		leaf := sha256.Sum256(data)
+		leaves = append(leaves, leaf[:])
+		bar.Increment()
+	}
+}
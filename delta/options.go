@@ -0,0 +1,168 @@
+package delta
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+const (
+	// MinBlockSize and MaxBlockSize bound Config.BlockSize. A block is
+	// held in memory by every worker, and headers store the size in 32
+	// bits.
+	MinBlockSize = 1 << 10
+	MaxBlockSize = 64 << 20
+)
+
+// Option configures an operation.
+type Option func(*Config) error
+
+// DefaultConfig returns the configuration used when no options are given.
+func DefaultConfig() Config {
+	return Config{
+		BlockSize:              6 * 1024,
+		Format:                 FormatGob,
+		Compression:            CompressNone,
+		FingerprintCompression: CompressNone,
+		LiteralCompression:     CompressNone,
+		Chunking:               ChunkFixed,
+		Workers:                1,
+	}
+}
+
+func newConfig(opts []Option) (Config, error) {
+	cfg := DefaultConfig()
+	for _, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return cfg, err
+		}
+	}
+	if err := CheckBlockSize(cfg.BlockSize); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// CheckBlockSize returns an error if n is not between MinBlockSize and
+// MaxBlockSize.
+func CheckBlockSize(n int) error {
+	if n < MinBlockSize || n > MaxBlockSize {
+		return fmt.Errorf("invalid block size %d, must be between %d and %d", n, MinBlockSize, MaxBlockSize)
+	}
+	return nil
+}
+
+// WithConfig replaces the whole configuration with cfg.
+func WithConfig(cfg Config) Option {
+	return func(c *Config) error {
+		*c = cfg
+		return nil
+	}
+}
+
+// WithBlockSize sets the size of the blocks the files are split into.
+func WithBlockSize(n int) Option {
+	return func(c *Config) error {
+		c.BlockSize = n
+		return nil
+	}
+}
+
+// WithChunking sets how new fingerprints split the source file.
+func WithChunking(ch Chunking) Option {
+	return func(c *Config) error {
+		c.Chunking = ch
+		return nil
+	}
+}
+
+// WithHashAlgorithm sets the strong hash by name, see ParseHashAlgorithm.
+func WithHashAlgorithm(name string) Option {
+	return func(c *Config) error {
+		h, err := ParseHashAlgorithm(name)
+		if err != nil {
+			return err
+		}
+		c.Hash = h
+		return nil
+	}
+}
+
+// WithWeakHash selects the rolling weak checksum of new fingerprints, or
+// the one a diff expects in the fingerprint.
+func WithWeakHash(w WeakHash) Option {
+	return func(c *Config) error {
+		if _, err := ParseWeakHash(string(w)); err != nil {
+			return err
+		}
+		c.WeakHash = w
+		return nil
+	}
+}
+
+// WithCompression sets the compression of new delta files.
+func WithCompression(ct CompressionType) Option {
+	return func(c *Config) error {
+		c.Compression = ct
+		return nil
+	}
+}
+
+// WithLiteralCompression sets the compression of the literals of new delta
+// files.
+func WithLiteralCompression(ct CompressionType) Option {
+	return func(c *Config) error {
+		c.LiteralCompression = ct
+		return nil
+	}
+}
+
+// WithConcurrency sets the number of goroutines computing fingerprint
+// signatures or resolving patch operations.
+func WithConcurrency(n int) Option {
+	return func(c *Config) error {
+		c.Workers = n
+		return nil
+	}
+}
+
+// WithHashSource makes GenerateFingerprint record the SHA-256 of the
+// source file with more than one worker as well.
+func WithHashSource() Option {
+	return func(c *Config) error {
+		c.HashSource = true
+		return nil
+	}
+}
+
+// WithProgressFunc sets the function receiving the progress.
+func WithProgressFunc(f ProgressFunc) Option {
+	return func(c *Config) error {
+		c.ProgressFunc = f
+		return nil
+	}
+}
+
+// WithMatchFunc sets the function receiving the matched block count.
+func WithMatchFunc(f MatchFunc) Option {
+	return func(c *Config) error {
+		c.MatchFunc = f
+		return nil
+	}
+}
+
+// WithStatsFunc sets the function receiving the counts of a completed
+// operation.
+func WithStatsFunc(f StatsFunc) Option {
+	return func(c *Config) error {
+		c.StatsFunc = f
+		return nil
+	}
+}
+
+// WithLogger sets the logger receiving warnings and per-block details.
+func WithLogger(l *slog.Logger) Option {
+	return func(c *Config) error {
+		c.Logger = l
+		return nil
+	}
+}
@@ -0,0 +1,132 @@
+package delta
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/Elbandi/gsync"
+)
+
+// An operation index starts with a header like the other files, followed
+// by the gob encoded position in the new file of every delta operation.
+var indexMagic = []byte("GDIX")
+
+const indexVersion = 1
+
+// sortOperations reads every operation of opsCh and returns them with the
+// references first, by ascending source block, followed by the literals
+// in their order, and the position in the new file of each of them.
+func sortOperations(ctx context.Context, opsCh <-chan gsync.BlockOperation) ([]gsync.BlockOperation, []uint64, error) {
+	var ops []gsync.BlockOperation
+	for o := range opsCh {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		if o.Error != nil {
+			return nil, nil, fmt.Errorf("diff error: %w", o.Error)
+		}
+		ops = append(ops, o)
+	}
+	positions := make([]uint64, len(ops))
+	for i := range positions {
+		positions[i] = uint64(i)
+	}
+	sort.SliceStable(positions, func(i, j int) bool {
+		a, b := ops[positions[i]], ops[positions[j]]
+		if len(a.Data) > 0 || len(b.Data) > 0 {
+			return len(a.Data) == 0 && len(b.Data) > 0
+		}
+		return a.Index < b.Index
+	})
+	sorted := make([]gsync.BlockOperation, len(ops))
+	for i, pos := range positions {
+		sorted[i] = ops[pos]
+	}
+	return sorted, positions, nil
+}
+
+// sendOperations sends ops to the returned channel.
+func sendOperations(ctx context.Context, ops []gsync.BlockOperation) <-chan gsync.BlockOperation {
+	opsCh := make(chan gsync.BlockOperation)
+	go func() {
+		defer close(opsCh)
+		for _, o := range ops {
+			select {
+			case opsCh <- o:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return opsCh
+}
+
+func writeIndex(w io.Writer, positions []uint64) error {
+	if err := writeHeader(w, indexMagic, header{Version: indexVersion}); err != nil {
+		return err
+	}
+	return gob.NewEncoder(w).Encode(positions)
+}
+
+func readIndex(r io.Reader) ([]uint64, error) {
+	br := bufio.NewReader(r)
+	h, err := readHeader(br, indexMagic, indexVersion)
+	if err != nil {
+		return nil, err
+	}
+	if h.Version == 0 {
+		return nil, fmt.Errorf("not an operation index")
+	}
+	var positions []uint64
+	if err = gob.NewDecoder(br).Decode(&positions); err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
+
+// indexedApply works like gsync.Apply for operations sorted by
+// sortOperations. It resolves them in delta order, so the source is read
+// sequentially, holds the new file in memory and writes it to dst in the
+// order of positions.
+func indexedApply(ctx context.Context, dst io.Writer, src io.ReaderAt, datahash io.Writer, ops <-chan gsync.BlockOperation, positions []uint64) error {
+	blockSize := int64(gsync.BlockSize)
+	blocks := make([][]byte, len(positions))
+	var k int
+	for o := range ops {
+		if o.Error != nil {
+			return o.Error
+		}
+		if k >= len(positions) {
+			return fmt.Errorf("%w: delta has more operations than its index", ErrDeltaCorrupt)
+		}
+		pos := positions[k]
+		if pos >= uint64(len(blocks)) || blocks[pos] != nil {
+			return fmt.Errorf("%w: invalid index position %d", ErrDeltaCorrupt, pos)
+		}
+		data := o.Data
+		if len(data) == 0 {
+			buf := make([]byte, blockSize)
+			n, err := src.ReadAt(buf, int64(o.Index)*blockSize)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			data = buf[:n]
+		}
+		blocks[pos] = data
+		k++
+	}
+	if k != len(positions) {
+		return fmt.Errorf("%w: delta has fewer operations than its index", ErrDeltaCorrupt)
+	}
+	for _, b := range blocks {
+		if _, err := dst.Write(b); err != nil {
+			return err
+		}
+		datahash.Write(b)
+	}
+	return ctx.Err()
+}
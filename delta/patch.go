@@ -0,0 +1,252 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/Elbandi/gsync"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ApplyPatch rebuilds the new file from src and the delta read from in and
+// writes it to out. It returns the SHA-256 hash of the written data.
+func ApplyPatch(ctx context.Context, src io.ReaderAt, in io.Reader, out io.Writer, opts ...Option) (_ []byte, err error) {
+	ctx, span := tracer.Start(ctx, "ApplyPatch")
+	defer func() { endSpan(span, err) }()
+
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	datahash, _, err := applyPatch(ctx, src, in, out, cfg)
+	return datahash, err
+}
+
+// ApplyPatchDatahash is ApplyPatch also returning the datahash stored in
+// the delta, which is nil for deltas written without one. It does not
+// compare the two.
+func ApplyPatchDatahash(ctx context.Context, src io.ReaderAt, in io.Reader, out io.Writer, opts ...Option) (expected, actual []byte, err error) {
+	ctx, span := tracer.Start(ctx, "ApplyPatch")
+	defer func() { endSpan(span, err) }()
+
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	actual, expected, err = applyPatch(ctx, src, in, out, cfg)
+	return expected, actual, err
+}
+
+// Verify replays the delta read from in against src without writing the
+// result. It returns the datahash stored in the delta and the one computed
+// from the replayed data, and ErrPatchMismatch if they differ.
+func Verify(ctx context.Context, src io.ReaderAt, in io.Reader, opts ...Option) (expected, actual []byte, err error) {
+	ctx, span := tracer.Start(ctx, "Verify")
+	defer func() { endSpan(span, err) }()
+
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	actual, expected, err = applyPatch(ctx, src, in, io.Discard, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, hashSpan := tracer.Start(ctx, "verify hash")
+	defer func() { endSpan(hashSpan, err) }()
+	if expected == nil {
+		return nil, nil, fmt.Errorf("%w: delta has no datahash", ErrDeltaCorrupt)
+	}
+	if !bytes.Equal(expected, actual) {
+		return expected, actual, ErrPatchMismatch
+	}
+	return expected, actual, nil
+}
+
+// applyPatch returns the hash of the written data and the datahash stored
+// in the delta trailer, which is nil for deltas written without one.
+func applyPatch(ctx context.Context, src io.ReaderAt, in io.Reader, out io.Writer, cfg Config) ([]byte, []byte, error) {
+	if cfg.Format == FormatLibrsync {
+		if cfg.SourceHash != nil || cfg.ExpectFromVersion != "" {
+			return nil, nil, fmt.Errorf("librsync deltas do not record the hash or version of their source file")
+		}
+		return applyLibrsync(ctx, src, in, out, cfg)
+	}
+	// Stops decodeOperations when the operations are not all consumed.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	peekedSize := peekOutputSize(in)
+	read := &countingReader{r: in}
+	dr, err := newDeltaReader(read, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.BlockSize = cfg.resolveBlockSize(int(dr.header.BlockSize))
+	gsync.BlockSize = cfg.BlockSize
+	bar := cfg.newProgress("patch", dr.total)
+
+	if cfg.SourceHash != nil {
+		if dr.header.BaseHash == nil {
+			return nil, nil, fmt.Errorf("delta does not record the hash of its source file")
+		}
+		if !bytes.Equal(cfg.SourceHash, dr.header.BaseHash) {
+			return nil, nil, fmt.Errorf("%w: delta was made for %x, source is %x", ErrWrongSourceFile, dr.header.BaseHash, cfg.SourceHash)
+		}
+	}
+	if cfg.ExpectFromVersion != "" {
+		if dr.header.Flags&flagVersions == 0 {
+			return nil, nil, fmt.Errorf("%w: delta does not record the version of its source, expected %q", ErrVersionMismatch, cfg.ExpectFromVersion)
+		}
+		if dr.header.FromVersion != cfg.ExpectFromVersion {
+			return nil, nil, fmt.Errorf("%w: delta is for version %q, expected %q", ErrVersionMismatch, dr.header.FromVersion, cfg.ExpectFromVersion)
+		}
+	}
+
+	if cfg.VerifyBlocks != nil {
+		if dr.chunked() {
+			return nil, nil, fmt.Errorf("block verification is not supported for chunked deltas")
+		}
+		src, err = newVerifyingReaderAt(src, cfg.VerifyBlocks, cfg.BlockSize)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if cfg.VerifySourceHashes {
+		if dr.header.Flags&flagSourceHashes == 0 {
+			return nil, nil, fmt.Errorf("delta has no source hashes")
+		}
+		if dr.sourceHashes, err = newSourceHashReaderAt(src, dr.header.Hash, cfg.BlockSize); err != nil {
+			return nil, nil, err
+		}
+		src = dr.sourceHashes
+	}
+
+	checkpoints := cfg.CheckpointEvery > 0 || cfg.Resume != nil
+	if checkpoints && (cfg.Merkle || dr.chunked() || cfg.Index != nil) {
+		return nil, nil, fmt.Errorf("checkpoints are not supported for chunked deltas, Merkle verification or operation indexes")
+	}
+	var positions []uint64
+	switch {
+	case dr.header.Flags&flagIndexed != 0 && cfg.Index == nil:
+		return nil, nil, fmt.Errorf("delta has sorted operations, its operation index is required")
+	case dr.header.Flags&flagIndexed == 0 && cfg.Index != nil:
+		return nil, nil, fmt.Errorf("delta has no operation index")
+	case cfg.Index != nil:
+		if positions, err = readIndex(cfg.Index); err != nil {
+			return nil, nil, fmt.Errorf("index read error: %w", err)
+		}
+	}
+
+	logger := cfg.logger()
+	logger.Debug("rebuild file", "phase", "patch")
+	datahash := sha256.New()
+	counted := &countingWriter{w: out}
+	if cfg.Resume != nil {
+		if err = resumeOutput(out, datahash, *cfg.Resume); err != nil {
+			return nil, nil, err
+		}
+		counted.n = cfg.Resume.Size
+		logger.Info("resuming patch", "phase", "patch", "operations", cfg.Resume.Operations, "size", cfg.Resume.Size)
+	}
+	if dr.trailer != nil && peekedSize >= 0 {
+		if err = preallocate(out, counted.n, peekedSize); err != nil {
+			logger.Warn("cannot preallocate the output", "phase", "patch", "size", peekedSize, "error", err)
+		}
+	}
+	_, applySpan := tracer.Start(ctx, "apply blocks")
+	var leaves [][]byte
+	switch {
+	case cfg.Merkle:
+		if dr.header.Flags&flagMerkle == 0 {
+			err = fmt.Errorf("%w: delta has no Merkle tree", ErrDeltaCorrupt)
+			break
+		}
+		leaves, err = applyMerkle(ctx, counted, src, datahash, dr, cfg.BlockSize, bar)
+		if err == nil {
+			err = verifyMerkle(dr.header.MerkleRoot, dr.merkle, leaves)
+		}
+	case positions != nil:
+		err = indexedApply(ctx, counted, src, datahash, decodeOperations(ctx, dr, bar), positions)
+	case checkpoints:
+		err = checkpointApply(ctx, counted, src, datahash, decodeOperations(ctx, dr, bar), cfg)
+	case dr.chunked():
+		err = applyChunks(ctx, counted, src, datahash, dr, bar)
+	case cfg.Workers > 1:
+		err = parallelApply(ctx, counted, src, datahash, decodeOperations(ctx, dr, bar), cfg.Workers)
+	default:
+		err = gsync.Apply(ctx, counted, src, datahash, decodeOperations(ctx, dr, bar))
+	}
+	if err == nil {
+		// The operations end without an error when ctx is cancelled.
+		err = ctx.Err()
+	}
+	endSpan(applySpan, err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("patch error: %w", err)
+	}
+	size, err := dr.outputSize()
+	if err != nil {
+		return nil, nil, err
+	}
+	if size >= 0 && peekedSize >= 0 && size != peekedSize {
+		return nil, nil, fmt.Errorf("%w: size trailer changed while reading", ErrDeltaCorrupt)
+	}
+	if size >= 0 && size != counted.n {
+		return nil, nil, fmt.Errorf("%w: delta records %d bytes, wrote %d", ErrOutputSizeMismatch, size, counted.n)
+	}
+	logger.Debug("patch done", "phase", "patch", "bytesProcessed", counted.n)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("godelta.blocks", bar.done),
+		attribute.Int64("godelta.file_size", counted.n), attribute.Int64("godelta.delta_size", read.n))
+	bar.Finish(counted.n, read.n)
+	return datahash.Sum(nil), dr.datahash, nil
+}
+
+// decodeOperations sends the operations of dr to the returned channel and
+// counts them in bar.
+func decodeOperations(ctx context.Context, dr *deltaReader, bar *progress) <-chan gsync.BlockOperation {
+	opsCh := make(chan gsync.BlockOperation)
+	go func() {
+		defer close(opsCh)
+
+		for {
+			// Allow for cancellation, applyPatch reports ctx.Err()
+			// itself. Every send also gives up once ctx is done, the
+			// consumer may be gone.
+			select {
+			case <-ctx.Done():
+				return
+			default:
+				// break out of the select block and continue reading
+				break
+			}
+			o, err := dr.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				select {
+				case opsCh <- gsync.BlockOperation{Error: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			select {
+			case opsCh <- o:
+			case <-ctx.Done():
+				return
+			}
+			if len(o.Data) == 0 {
+				bar.Match()
+			} else {
+				bar.Literal(len(o.Data))
+			}
+			bar.Increment()
+		}
+	}()
+	return opsCh
+}
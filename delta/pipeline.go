@@ -0,0 +1,83 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"hash"
+	"sync"
+
+	"github.com/Elbandi/gsync"
+)
+
+// pipelineBuffer is the number of signatures the fingerprint reader may
+// get ahead of the table being filled.
+const pipelineBuffer = 1024
+
+// pipelineTable is a lookup table filled from the fingerprint while the
+// diff already looks blocks up in it. A lookup at an offset of the new file
+// waits for the signatures of the blocks up to that offset, so unchanged
+// regions still match; blocks matching a later signature become literals.
+type pipelineTable struct {
+	mu       sync.RWMutex
+	cond     *sync.Cond
+	sigs     map[uint32][]gsync.BlockSignature
+	loaded   uint64
+	finished bool
+	done     chan struct{}
+	err      error
+}
+
+// loadPipelineTable fills a pipelineTable from sigsCh in the background.
+func loadPipelineTable(ctx context.Context, sigsCh <-chan gsync.BlockSignature) *pipelineTable {
+	t := &pipelineTable{sigs: make(map[uint32][]gsync.BlockSignature), done: make(chan struct{})}
+	t.cond = sync.NewCond(t.mu.RLocker())
+	go func() {
+		defer close(t.done)
+		defer func() {
+			t.mu.Lock()
+			t.finished = true
+			t.mu.Unlock()
+			t.cond.Broadcast()
+		}()
+		for b := range sigsCh {
+			if b.Error != nil {
+				t.err = b.Error
+				return
+			}
+			t.mu.Lock()
+			t.sigs[b.Weak] = append(t.sigs[b.Weak], b)
+			t.loaded++
+			t.mu.Unlock()
+			t.cond.Broadcast()
+		}
+		t.err = ctx.Err()
+	}()
+	return t
+}
+
+// wait returns once the whole fingerprint is loaded, with the error that
+// stopped loading it.
+func (t *pipelineTable) wait() error {
+	<-t.done
+	return t.err
+}
+
+func (t *pipelineTable) find(offset int64, weak uint32, block []byte, strong hash.Hash) (uint64, bool) {
+	need := uint64(offset/int64(gsync.BlockSize)) + 1
+	t.mu.RLock()
+	for !t.finished && t.loaded < need {
+		t.cond.Wait()
+	}
+	sigs := t.sigs[weak]
+	t.mu.RUnlock()
+	if len(sigs) == 0 {
+		return 0, false
+	}
+	sum := blockSum(strong, block)
+	for _, s := range sigs {
+		if bytes.Equal(sum, s.Strong) {
+			return s.Index, true
+		}
+	}
+	return 0, false
+}
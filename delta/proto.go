@@ -0,0 +1,118 @@
+package delta
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/Elbandi/godelta/deltapb"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxProtoMessage bounds the length prefix of a protobuf record, so a
+// corrupt prefix fails instead of allocating gigabytes.
+const maxProtoMessage = 1 << 30
+
+// writeProto writes m preceded by its length as a big endian uint32.
+func writeProto(w io.Writer, m proto.Message) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	_, err = w.Write(append(buf, b...))
+	return err
+}
+
+// readProto reads a record written by writeProto into m. It returns io.EOF
+// only at the start of a record.
+func readProto(r io.Reader, m proto.Message) error {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.EOF {
+			return err
+		}
+		return noEOF(err)
+	}
+	n := binary.BigEndian.Uint32(prefix[:])
+	if n > maxProtoMessage {
+		return fmt.Errorf("protobuf record of %d bytes is too long", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return noEOF(err)
+	}
+	return proto.Unmarshal(b, m)
+}
+
+type protoSigEncoder struct {
+	w io.Writer
+}
+
+func (e *protoSigEncoder) Encode(r sigRecord) error {
+	return writeProto(e.w, &deltapb.SignatureRecord{Index: r.Index, Weak: r.Weak, Strong: r.Strong, Offset: r.Offset, Length: r.Length})
+}
+
+func (e *protoSigEncoder) EncodeTrailer(t sigRecord) error {
+	return writeProto(e.w, &deltapb.SignatureRecord{SourceHash: t.SourceHash, SourceSize: t.SourceSize, SourceState: t.SourceState})
+}
+
+type protoSigDecoder struct {
+	r io.Reader
+}
+
+func (d *protoSigDecoder) Decode(r *sigRecord) error {
+	var m deltapb.SignatureRecord
+	if err := readProto(d.r, &m); err != nil {
+		return err
+	}
+	*r = sigRecord{
+		Index:       m.Index,
+		Weak:        m.Weak,
+		Strong:      m.Strong,
+		SourceHash:  m.SourceHash,
+		Offset:      m.Offset,
+		Length:      m.Length,
+		SourceSize:  m.SourceSize,
+		SourceState: m.SourceState,
+	}
+	return nil
+}
+
+// protoRecordCodec encodes the operation count and the operation records
+// of a delta as DeltaStart and OperationRecord messages.
+type protoRecordCodec struct {
+	w io.Writer
+	r io.Reader
+}
+
+func (c *protoRecordCodec) Encode(v interface{}) error {
+	switch v := v.(type) {
+	case int64:
+		return writeProto(c.w, &deltapb.DeltaStart{Operations: v})
+	case opRecord:
+		return writeProto(c.w, &deltapb.OperationRecord{Index: v.Index, Data: v.Data, Datahash: v.Datahash, Offset: v.Offset, Length: v.Length, Merkle: v.Merkle, Strong: v.Strong, Flags: uint32(v.Flags)})
+	}
+	return fmt.Errorf("cannot encode %T as protobuf", v)
+}
+
+func (c *protoRecordCodec) Decode(v interface{}) error {
+	switch v := v.(type) {
+	case *int64:
+		var m deltapb.DeltaStart
+		if err := readProto(c.r, &m); err != nil {
+			return err
+		}
+		*v = m.Operations
+		return nil
+	case *opRecord:
+		var m deltapb.OperationRecord
+		if err := readProto(c.r, &m); err != nil {
+			return err
+		}
+		*v = opRecord{Index: m.Index, Data: m.Data, Datahash: m.Datahash, Offset: m.Offset, Length: m.Length, Merkle: m.Merkle, Strong: m.Strong, Flags: uint8(m.Flags)}
+		return nil
+	}
+	return fmt.Errorf("cannot decode %T from protobuf", v)
+}
@@ -0,0 +1,143 @@
+package delta
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/Elbandi/gsync"
+)
+
+// deltaReader decodes the block operations of a delta file.
+type deltaReader struct {
+	header deltaHeader
+	// total is the number of operations recorded by the writer, or 0 if
+	// it was unknown.
+	total int64
+	// datahash is the hash of the new file. It is set once next returned
+	// io.EOF, and stays nil for deltas without a trailer.
+	datahash []byte
+	// merkle holds the nodes of the Merkle tree stored in the trailer.
+	merkle [][]byte
+	// trailer withholds the size of the new file from the decoders of
+	// deltas with flagSize.
+	trailer *trailerReader
+	// compression is the compression detected after decryption.
+	compression CompressionType
+	// sourceHashes receives the source hashes of the references when
+	// they are verified.
+	sourceHashes *sourceHashReaderAt
+
+	dec recordDecoder
+}
+
+// newDeltaReader reads the header of the delta read from in, sets up
+// decryption and decompression and decodes the operation count.
+func newDeltaReader(in io.Reader, cfg Config) (*deltaReader, error) {
+	br := bufio.NewReader(in)
+	h, err := readDeltaHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("delta read error: %w", err)
+	}
+
+	// Deltas without a header do not record encryption, so the key decides.
+	encrypted := h.Flags&flagEncrypted != 0 || (h.Version == 0 && cfg.encrypted())
+	if encrypted && !cfg.encrypted() {
+		return nil, fmt.Errorf("delta is encrypted, a key is required")
+	}
+
+	if h.Flags&flagGCM != 0 && !cfg.gcmEncrypted() {
+		return nil, fmt.Errorf("delta is encrypted with AES-256-GCM, a key is required")
+	}
+
+	var streamReader io.Reader = br
+	var trailer *trailerReader
+	if h.Flags&flagSize != 0 {
+		trailer = newTrailerReader(br)
+		streamReader = trailer
+	}
+	switch {
+	case encrypted:
+		streamReader, err = cfg.decryptReader(streamReader)
+		if err != nil {
+			return nil, fmt.Errorf("delta decrypt error: %w", err)
+		}
+	case h.Flags&flagGCM != 0:
+		key, err := cfg.gcmKey(h.Nonce)
+		if err != nil {
+			return nil, fmt.Errorf("delta decrypt error: %w", err)
+		}
+		streamReader, err = newGCMReader(streamReader, key, h.Nonce)
+		if err != nil {
+			return nil, fmt.Errorf("delta decrypt error: %w", err)
+		}
+	}
+
+	streamReader, compression, err := detectCompression(streamReader)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDeltaCorrupt, err)
+	}
+
+	dr := &deltaReader{header: h, compression: compression, trailer: trailer, dec: newRecordDecoder(streamReader, h.Flags)}
+	if err = dr.dec.Decode(&dr.total); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDeltaCorrupt, err)
+	}
+	return dr, nil
+}
+
+// outputSize returns the size of the new file recorded at the end of the
+// delta, skipping what was not decoded, or -1 if the delta has none.
+func (dr *deltaReader) outputSize() (int64, error) {
+	if dr.trailer == nil {
+		return -1, nil
+	}
+	return dr.trailer.size()
+}
+
+// chunked reports whether the references of the delta carry their offset
+// and length.
+func (dr *deltaReader) chunked() bool {
+	return dr.header.Flags&flagChunked != 0
+}
+
+// next returns the next block operation, or io.EOF after the last one.
+func (dr *deltaReader) next() (gsync.BlockOperation, error) {
+	r, err := dr.nextRecord()
+	if err != nil {
+		return gsync.BlockOperation{}, err
+	}
+	return gsync.BlockOperation{Index: r.Index, Data: r.Data}, nil
+}
+
+// nextRecord returns the next operation record, or io.EOF after the last
+// one.
+func (dr *deltaReader) nextRecord() (opRecord, error) {
+	for {
+		var r opRecord
+		err := dr.dec.Decode(&r)
+		if err == io.EOF {
+			return r, err
+		}
+		if err != nil {
+			return r, fmt.Errorf("%w: %v", ErrDeltaCorrupt, err)
+		}
+		if r.Datahash != nil {
+			dr.datahash = r.Datahash
+			dr.merkle = r.Merkle
+			continue
+		}
+		if r.Flags&opCompressed != 0 {
+			if r.Data, err = decompressLiteral(r.Data); err != nil {
+				return r, fmt.Errorf("%w: literal of operation %d: %v", ErrDeltaCorrupt, r.Index, err)
+			}
+			r.Flags &^= opCompressed
+		}
+		if dr.sourceHashes != nil && len(r.Data) == 0 {
+			if len(r.Strong) == 0 {
+				return r, fmt.Errorf("%w: reference to block %d has no source hash", ErrDeltaCorrupt, r.Index)
+			}
+			dr.sourceHashes.add(r.Index, r.Strong)
+		}
+		return r, nil
+	}
+}
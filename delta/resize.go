@@ -0,0 +1,53 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ResizeFingerprint writes the fingerprint of src for blockSize, keeping the
+// strong and weak hash, chunking and encoding of the fingerprint read from fp. The
+// strong hash of a block cannot be derived from the hashes of the blocks
+// it spans, so every block of src is hashed again. When fp records the
+// SHA-256 of its source, src is checked against it and a mismatch returns
+// ErrSourceModified.
+func ResizeFingerprint(ctx context.Context, fp io.Reader, src io.Reader, dst io.Writer, blockSize int, opts ...Option) (err error) {
+	ctx, span := tracer.Start(ctx, "ResizeFingerprint")
+	defer func() { endSpan(span, err) }()
+
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	fr, err := NewFingerprintReader(fp)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFingerprintCorrupt, err)
+	}
+	for {
+		_, err := fr.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fingerprintCorrupt(err)
+		}
+	}
+
+	cfg.BlockSize = blockSize
+	cfg.Hash = fr.Hash
+	cfg.Chunking = fr.Chunking
+	cfg.WeakHash = fr.WeakHash
+	cfg.Format = fr.format()
+	srcHash := sha256.New()
+	if err = GenerateFingerprint(ctx, io.TeeReader(src, srcHash), dst, WithConfig(cfg)); err != nil {
+		return err
+	}
+	if fr.SourceHash != nil && !bytes.Equal(srcHash.Sum(nil), fr.SourceHash) {
+		return fmt.Errorf("%w: the source does not match the fingerprint", ErrSourceModified)
+	}
+	return nil
+}
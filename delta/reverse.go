@@ -0,0 +1,35 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// Source is a source file that is read both sequentially and at random
+// offsets.
+type Source interface {
+	io.ReaderAt
+	io.ReadSeeker
+}
+
+// Reverse writes to out the delta that turns the result of applying
+// forward to src back into src. The patched file is written to target,
+// which must be empty, and its fingerprint is kept in memory.
+func Reverse(ctx context.Context, src Source, forward io.Reader, target io.ReadWriteSeeker, out io.Writer, opts ...Option) error {
+	if _, err := ApplyPatch(ctx, src, forward, target, opts...); err != nil {
+		return err
+	}
+	if _, err := target.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var fp bytes.Buffer
+	if err := GenerateFingerprint(ctx, target, &fp, opts...); err != nil {
+		return err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := MakeDiff(ctx, &fp, src, out, opts...)
+	return err
+}
@@ -0,0 +1,96 @@
+package delta
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// SignKeySize is the size of the HMAC-SHA256 keys signing fingerprint and
+// delta files.
+const SignKeySize = 32
+
+// signSalt and signIterations derive signing keys from passwords. The salt
+// is fixed, so the same password always yields the same key.
+var signSalt = []byte("godelta-sign")
+
+const signIterations = 600000
+
+// ParseSignKey decodes a hex encoded signing key.
+func ParseSignKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key: %v", err)
+	}
+	if len(key) != SignKeySize {
+		return nil, fmt.Errorf("invalid signing key: %d bytes, expected %d", len(key), SignKeySize)
+	}
+	return key, nil
+}
+
+// DeriveSignKey derives a signing key from password with PBKDF2.
+func DeriveSignKey(password string) []byte {
+	return pbkdf2.Key([]byte(password), signSalt, signIterations, SignKeySize, sha256.New)
+}
+
+// SignWriter passes the written data through and appends its HMAC-SHA256
+// on Close. It does not close the underlying writer.
+type SignWriter struct {
+	w   io.Writer
+	mac hash.Hash
+}
+
+// NewSignWriter returns a SignWriter signing the data written to w with
+// key.
+func NewSignWriter(w io.Writer, key []byte) *SignWriter {
+	return &SignWriter{w: w, mac: hmac.New(sha256.New, key)}
+}
+
+func (s *SignWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.mac.Write(p[:n])
+	return n, err
+}
+
+// Close appends the MAC.
+func (s *SignWriter) Close() error {
+	_, err := s.w.Write(s.mac.Sum(nil))
+	return err
+}
+
+// Sign returns the HMAC-SHA256 of the data read from r, which is the
+// trailer a SignWriter would have appended to it.
+func Sign(r io.Reader, key []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, key)
+	if _, err := io.Copy(mac, r); err != nil {
+		return nil, err
+	}
+	return mac.Sum(nil), nil
+}
+
+// VerifySignature checks the HMAC-SHA256 trailer of the size bytes signed
+// file read from r and returns a reader of the content before it. It
+// returns ErrSignatureMismatch if the file was not signed with key or was
+// modified since.
+func VerifySignature(r io.ReaderAt, size int64, key []byte) (*io.SectionReader, error) {
+	if size < sha256.Size {
+		return nil, fmt.Errorf("%w: file too short", ErrSignatureMismatch)
+	}
+	actual, err := Sign(io.NewSectionReader(r, 0, size-sha256.Size), key)
+	if err != nil {
+		return nil, err
+	}
+	expected := make([]byte, sha256.Size)
+	if _, err = r.ReadAt(expected, size-sha256.Size); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(expected, actual) {
+		return nil, ErrSignatureMismatch
+	}
+	return io.NewSectionReader(r, 0, size-sha256.Size), nil
+}
@@ -0,0 +1,100 @@
+package delta
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// sizeTrailerLen is the length of the new file size ending deltas with
+// flagSize.
+const sizeTrailerLen = 8
+
+// trailerReader reads r except for its last sizeTrailerLen bytes, so the
+// decoders never see the size trailer.
+type trailerReader struct {
+	r          io.Reader
+	buf        []byte
+	start, end int
+	eof        bool
+}
+
+func newTrailerReader(r io.Reader) *trailerReader {
+	return &trailerReader{r: r, buf: make([]byte, 32<<10)}
+}
+
+func (t *trailerReader) Read(p []byte) (int, error) {
+	for !t.eof && t.end-t.start <= sizeTrailerLen {
+		if t.start > 0 {
+			t.end = copy(t.buf, t.buf[t.start:t.end])
+			t.start = 0
+		}
+		n, err := t.r.Read(t.buf[t.end:])
+		t.end += n
+		if err == io.EOF {
+			t.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, t.buf[t.start:max(t.start, t.end-sizeTrailerLen)])
+	t.start += n
+	if n == 0 && t.eof && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// size skips what is left of the stream and returns the size trailer.
+func (t *trailerReader) size() (int64, error) {
+	if _, err := io.Copy(io.Discard, t); err != nil {
+		return 0, err
+	}
+	if t.end-t.start != sizeTrailerLen {
+		return 0, fmt.Errorf("%w: truncated size trailer", ErrDeltaCorrupt)
+	}
+	return int64(binary.BigEndian.Uint64(t.buf[t.start:t.end])), nil
+}
+
+// writeSizeTrailer writes size as the last bytes of a delta.
+func writeSizeTrailer(w io.Writer, size int64) error {
+	var buf [sizeTrailerLen]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(size))
+	_, err := w.Write(buf[:])
+	return err
+}
+
+// peekOutputSize reads the last sizeTrailerLen bytes of in without
+// consuming them, which is only possible if in is backed by a file. It
+// returns -1 otherwise. The value is only a size if the delta header has
+// flagSize.
+func peekOutputSize(in io.Reader) int64 {
+	ra, ok := in.(io.ReaderAt)
+	if !ok {
+		return -1
+	}
+	n := sizeOf(in)
+	if n < headerSize+sizeTrailerLen {
+		return -1
+	}
+	var buf [sizeTrailerLen]byte
+	if _, err := ra.ReadAt(buf[:], n-sizeTrailerLen); err != nil {
+		return -1
+	}
+	return int64(binary.BigEndian.Uint64(buf[:]))
+}
+
+// preallocate extends out to size before anything is written to it, if
+// it is a file holding only the written bytes.
+func preallocate(out io.Writer, written, size int64) error {
+	f, ok := out.(*os.File)
+	if !ok {
+		return nil
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() > written || size <= written {
+		return nil
+	}
+	return f.Truncate(size)
+}
@@ -0,0 +1,84 @@
+package delta
+
+import (
+	"context"
+	"io"
+)
+
+// DeltaStats describes how much of the new file a delta carries literally.
+type DeltaStats struct {
+	TotalBlocks     int64 `json:"total_blocks"`
+	ReferenceBlocks int64 `json:"reference_blocks"`
+	LiteralBlocks   int64 `json:"literal_blocks"`
+	LiteralBytes    int64 `json:"literal_bytes"`
+	ReferenceBytes  int64 `json:"reference_bytes"`
+	NewSize         int64 `json:"new_size"`
+	DeltaSize       int64 `json:"delta_size"`
+	// CompressionRatio is NewSize / DeltaSize.
+	CompressionRatio float64 `json:"compression_ratio"`
+	// Unchanged is the percentage of the new file copied from the source.
+	Unchanged float64 `json:"unchanged_percent"`
+	// BlockSize is the block size of the delta, the average size for
+	// chunked deltas.
+	BlockSize int `json:"block_size,omitempty"`
+}
+
+// Stats decodes the delta read from in and counts its operations. srcSize
+// is the size of the source file; when it is 0, every reference is
+// counted as a full block.
+func Stats(ctx context.Context, in io.Reader, srcSize int64, opts ...Option) (DeltaStats, error) {
+	var st DeltaStats
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return st, err
+	}
+	cr := &countingReader{r: in}
+	dr, err := newDeltaReader(cr, cfg)
+	if err != nil {
+		return st, err
+	}
+	blockSize := int64(cfg.resolveBlockSize(int(dr.header.BlockSize)))
+	for {
+		if err = ctx.Err(); err != nil {
+			return st, err
+		}
+		o, err := dr.nextRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return st, err
+		}
+		st.TotalBlocks++
+		if len(o.Data) > 0 {
+			st.LiteralBlocks++
+			st.LiteralBytes += int64(len(o.Data))
+			continue
+		}
+		st.ReferenceBlocks++
+		if dr.chunked() {
+			st.ReferenceBytes += int64(o.Length)
+			continue
+		}
+		size := blockSize
+		if offset := int64(o.Index) * blockSize; srcSize > 0 && offset+size > srcSize {
+			size = srcSize - offset
+		}
+		st.ReferenceBytes += size
+	}
+	st.NewSize = st.LiteralBytes + st.ReferenceBytes
+	st.DeltaSize = cr.n
+	st.BlockSize = int(blockSize)
+	st.complete()
+	return st, nil
+}
+
+// complete computes the ratios from the counts.
+func (st *DeltaStats) complete() {
+	if st.DeltaSize > 0 {
+		st.CompressionRatio = float64(st.NewSize) / float64(st.DeltaSize)
+	}
+	if st.NewSize > 0 {
+		st.Unchanged = float64(st.ReferenceBytes) * 100 / float64(st.NewSize)
+	}
+}
@@ -0,0 +1,22 @@
+package delta
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the operations. It is a no-op unless the
+// application installs an OpenTelemetry tracer provider.
+var tracer = otel.Tracer("github.com/Elbandi/godelta/delta")
+
+// endSpan records err as the outcome of span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetStatus(codes.Ok, "")
+	}
+	span.End()
+}
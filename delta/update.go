@@ -0,0 +1,138 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Elbandi/gsync"
+)
+
+// UpdateFingerprint writes the fingerprint read from fp extended with the
+// blocks appended to its source file src since it was generated. Only the
+// data after the last complete block is read from src: the last block
+// of the fingerprint is signed again and the new blocks are added, the
+// other records are copied. The fingerprint must record its source size,
+// as the ones of fixed size blocks written by GenerateFingerprint do. The
+// block before the appended data is checked against the fingerprint, a
+// mismatch returns ErrSourceModified.
+func UpdateFingerprint(ctx context.Context, fp io.Reader, src io.ReaderAt, srcSize int64, dst io.Writer, opts ...Option) (err error) {
+	ctx, span := tracer.Start(ctx, "UpdateFingerprint")
+	defer func() { endSpan(span, err) }()
+
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	fr, err := NewFingerprintReader(fp)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFingerprintCorrupt, err)
+	}
+	if fr.Chunking != ChunkFixed || fr.BlockSize == 0 {
+		return fmt.Errorf("only fingerprints of fixed size blocks recording their block size can be updated")
+	}
+	var records []sigRecord
+	for {
+		r, err := fr.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fingerprintCorrupt(err)
+		}
+		records = append(records, r)
+	}
+	if fr.sourceState == nil {
+		return fmt.Errorf("fingerprint does not record its source size, generate it again")
+	}
+	if uint64(srcSize) < fr.SourceSize {
+		return fmt.Errorf("%w: source shrank from %d to %d bytes", ErrSourceModified, fr.SourceSize, srcSize)
+	}
+
+	blockSize := int64(fr.BlockSize)
+	start := uint64(fr.SourceSize) / uint64(blockSize)
+	strong, err := fr.strongHash()
+	if err != nil {
+		return err
+	}
+	kept := records[:0]
+	for _, r := range records {
+		if r.Index == start-1 && start > 0 {
+			block := make([]byte, blockSize)
+			if _, err = src.ReadAt(block, int64(r.Index)*blockSize); err != nil && err != io.EOF {
+				return err
+			}
+			strong.Reset()
+			strong.Write(block)
+			if !bytes.Equal(strong.Sum(nil), r.Strong) {
+				return fmt.Errorf("%w: block %d changed, the file was not only appended to", ErrSourceModified, r.Index)
+			}
+		}
+		if r.Index < start {
+			kept = append(kept, r)
+		}
+	}
+
+	srcHash := sha256.New()
+	if err = srcHash.(encoding.BinaryUnmarshaler).UnmarshalBinary(fr.sourceState); err != nil {
+		return fmt.Errorf("%w: invalid source hash state: %v", ErrFingerprintCorrupt, err)
+	}
+	if _, err = io.Copy(srcHash, io.NewSectionReader(src, int64(fr.SourceSize), srcSize-int64(fr.SourceSize))); err != nil {
+		return err
+	}
+
+	format := fr.format()
+	fpWriter, err := newFingerprintWriter(dst, cfg.FingerprintCompression, format)
+	if err != nil {
+		return fmt.Errorf("fingerprint compress error: %w", err)
+	}
+	fh := fingerprintHeader{Hash: fr.Hash, BlockSize: uint32(fr.BlockSize)}
+	fh.Flags = weakFlags(fr.WeakHash)
+	enc, err := newFingerprintEncoder(fpWriter, format, fh)
+	if err != nil {
+		return fmt.Errorf("fingerprint write error: %w", err)
+	}
+	for _, r := range kept {
+		if err = enc.Encode(r); err != nil {
+			return fmt.Errorf("fingerprint write error: %w", err)
+		}
+	}
+
+	gsync.BlockSize = fr.BlockSize
+	appended := io.NewSectionReader(src, int64(start)*blockSize, srcSize-int64(start)*blockSize)
+	sigsCh, err := fr.WeakHash.signatures(ctx, appended, strong)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBlockChecksumFail, err)
+	}
+	defer drain(sigsCh)
+	bar := cfg.newProgress("fpgen", appended.Size()/blockSize)
+	for c := range sigsCh {
+		if c.Error != nil {
+			return fmt.Errorf("%w: %v", ErrBlockChecksumFail, c.Error)
+		}
+		if err = enc.Encode(sigRecord{Index: c.Index + start, Weak: c.Weak, Strong: c.Strong}); err != nil {
+			return fmt.Errorf("fingerprint write error: %w", err)
+		}
+		bar.Increment()
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	trailer, err := sourceTrailer(srcHash, srcSize)
+	if err != nil {
+		return err
+	}
+	if err = enc.EncodeTrailer(trailer); err != nil {
+		return fmt.Errorf("fingerprint write error: %w", err)
+	}
+	if err = fpWriter.Close(); err != nil {
+		return fmt.Errorf("fingerprint compress error: %w", err)
+	}
+	cfg.logger().Debug("fingerprint updated", "phase", "fpgen", "blocks", len(kept)+int(bar.done), "appended", appended.Size())
+	bar.Finish(appended.Size(), 0)
+	return nil
+}
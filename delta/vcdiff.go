@@ -0,0 +1,238 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/Elbandi/gsync"
+)
+
+// vcdiffMagic starts a VCDIFF (RFC 3284) file, followed by a zero header
+// indicator.
+var vcdiffMagic = []byte{0xd6, 0xc3, 0xc4, 0x00, 0x00}
+
+// VCDIFF instruction codes of the default code table. Both take their size
+// from the instruction section; COPY uses address mode VCD_SELF.
+const (
+	vcdiffAdd  = 1
+	vcdiffCopy = 19
+)
+
+// vcdiffWindowSize is the largest target window written. Decoders limit
+// the window size, xdelta3 to 16MB.
+const vcdiffWindowSize = 4 << 20
+
+// vcdiffInst is an ADD of data or a COPY of size bytes from addr in the
+// source file.
+type vcdiffInst struct {
+	data []byte
+	addr uint64
+	size uint64
+}
+
+// vcdiffWriter collects block operations and writes them as a VCDIFF file.
+// The operations are only written by close: a reference to the last
+// source block does not say how long that block is, which is derived from
+// the size of the new file once it was read completely.
+type vcdiffWriter struct {
+	out       io.Writer
+	blockSize uint64
+	lastIndex uint64
+	insts     []vcdiffInst
+	literals  uint64
+	refs      uint64
+	lastRefs  uint64
+}
+
+func newVCDIFFWriter(out io.Writer, blockSize int, lastIndex uint64) *vcdiffWriter {
+	return &vcdiffWriter{out: out, blockSize: uint64(blockSize), lastIndex: lastIndex}
+}
+
+// write adds a block operation, merging it with the previous one where
+// possible.
+func (vw *vcdiffWriter) write(o gsync.BlockOperation) {
+	var prev *vcdiffInst
+	if len(vw.insts) > 0 {
+		prev = &vw.insts[len(vw.insts)-1]
+	}
+	if len(o.Data) > 0 {
+		vw.literals += uint64(len(o.Data))
+		if prev != nil && prev.data != nil {
+			prev.data = append(prev.data, o.Data...)
+			return
+		}
+		vw.insts = append(vw.insts, vcdiffInst{data: bytes.Clone(o.Data)})
+		return
+	}
+	if o.Index == vw.lastIndex {
+		// The size is set by close.
+		vw.lastRefs++
+		vw.insts = append(vw.insts, vcdiffInst{addr: o.Index * vw.blockSize})
+		return
+	}
+	vw.refs++
+	addr := o.Index * vw.blockSize
+	if prev != nil && prev.data == nil && prev.size > 0 && prev.addr+prev.size == addr {
+		prev.size += vw.blockSize
+		return
+	}
+	vw.insts = append(vw.insts, vcdiffInst{addr: addr, size: vw.blockSize})
+}
+
+// close writes the VCDIFF file of a new file of size bytes.
+func (vw *vcdiffWriter) close(size uint64) error {
+	if vw.lastRefs > 0 {
+		rest := size - vw.literals - vw.refs*vw.blockSize
+		last := rest / vw.lastRefs
+		if rest > size || last == 0 || last > vw.blockSize || last*vw.lastRefs != rest {
+			return fmt.Errorf("diff error: cannot derive the length of the last source block")
+		}
+		for i := range vw.insts {
+			if vw.insts[i].data == nil && vw.insts[i].size == 0 {
+				vw.insts[i].size = last
+			}
+		}
+	}
+
+	w := bufio.NewWriter(vw.out)
+	if _, err := w.Write(vcdiffMagic); err != nil {
+		return fmt.Errorf("delta write error: %w", err)
+	}
+	var window []vcdiffInst
+	var windowLen uint64
+	for _, inst := range vw.insts {
+		for {
+			n := inst.size
+			if inst.data != nil {
+				n = uint64(len(inst.data))
+			}
+			if windowLen+n <= vcdiffWindowSize {
+				window = append(window, inst)
+				windowLen += n
+				break
+			}
+			// Split inst at the end of the window.
+			k := vcdiffWindowSize - windowLen
+			head, tail := inst, inst
+			if inst.data != nil {
+				head.data, tail.data = inst.data[:k], inst.data[k:]
+			} else {
+				head.size = k
+				tail.addr, tail.size = inst.addr+k, inst.size-k
+			}
+			if k > 0 {
+				window = append(window, head)
+			}
+			if err := writeVCDIFFWindow(w, window, vcdiffWindowSize); err != nil {
+				return err
+			}
+			window, windowLen, inst = window[:0], 0, tail
+		}
+	}
+	if windowLen > 0 {
+		if err := writeVCDIFFWindow(w, window, windowLen); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("delta write error: %w", err)
+	}
+	return nil
+}
+
+// writeVCDIFFWindow writes a target window of size bytes. Its source
+// segment spans the source data copied by the window.
+func writeVCDIFFWindow(w *bufio.Writer, insts []vcdiffInst, size uint64) error {
+	var segPos, segEnd uint64
+	copies := false
+	for _, inst := range insts {
+		if inst.data != nil {
+			continue
+		}
+		if !copies || inst.addr < segPos {
+			segPos = inst.addr
+		}
+		if !copies || inst.addr+inst.size > segEnd {
+			segEnd = inst.addr + inst.size
+		}
+		copies = true
+	}
+
+	var data, instructions, addresses bytes.Buffer
+	for _, inst := range insts {
+		if inst.data != nil {
+			instructions.WriteByte(vcdiffAdd)
+			writeVarint(&instructions, uint64(len(inst.data)))
+			data.Write(inst.data)
+		} else {
+			instructions.WriteByte(vcdiffCopy)
+			writeVarint(&instructions, inst.size)
+			writeVarint(&addresses, inst.addr-segPos)
+		}
+	}
+
+	var enc bytes.Buffer
+	writeVarint(&enc, size)
+	enc.WriteByte(0) // Delta_Indicator: no secondary compression
+	writeVarint(&enc, uint64(data.Len()))
+	writeVarint(&enc, uint64(instructions.Len()))
+	writeVarint(&enc, uint64(addresses.Len()))
+	data.WriteTo(&enc)
+	instructions.WriteTo(&enc)
+	addresses.WriteTo(&enc)
+
+	var hdr bytes.Buffer
+	if copies {
+		hdr.WriteByte(0x01) // VCD_SOURCE
+		writeVarint(&hdr, segEnd-segPos)
+		writeVarint(&hdr, segPos)
+	} else {
+		hdr.WriteByte(0)
+	}
+	writeVarint(&hdr, uint64(enc.Len()))
+	hdr.WriteTo(w)
+	if _, err := enc.WriteTo(w); err != nil {
+		return fmt.Errorf("delta write error: %w", err)
+	}
+	return nil
+}
+
+// writeVarint writes v as a VCDIFF integer: big-endian base 128 digits,
+// all but the last with the high bit set.
+func writeVarint(b *bytes.Buffer, v uint64) {
+	var buf [10]byte
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		buf[i] = byte(v&0x7f) | 0x80
+	}
+	b.Write(buf[i:])
+}
+
+// writeVCDIFFOperations collects the block operations received from opsCh
+// into vw.
+func writeVCDIFFOperations(ctx context.Context, vw *vcdiffWriter, opsCh <-chan gsync.BlockOperation, bar *progress) (err error) {
+	_, span := tracer.Start(ctx, "sync blocks")
+	defer func() { endSpan(span, err) }()
+
+	for o := range opsCh {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if o.Error != nil {
+			return fmt.Errorf("diff error: %w", o.Error)
+		}
+		vw.write(o)
+		if len(o.Data) == 0 {
+			bar.Match()
+		} else {
+			bar.Literal(len(o.Data))
+		}
+		bar.Increment()
+	}
+	return nil
+}
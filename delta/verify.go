@@ -0,0 +1,131 @@
+package delta
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+)
+
+// BlockMismatchError reports a source block whose strong hash differs from
+// the one recorded in its fingerprint or embedded in the delta.
+type BlockMismatchError struct {
+	Index    uint64
+	Offset   int64
+	Expected []byte
+	Actual   []byte
+}
+
+func (e *BlockMismatchError) Error() string {
+	return fmt.Sprintf("%v: block %d at offset %d: expected %x, got %x", ErrBlockChecksumFail, e.Index, e.Offset, e.Expected, e.Actual)
+}
+
+func (e *BlockMismatchError) Unwrap() error {
+	return ErrBlockChecksumFail
+}
+
+// verifyingReaderAt checks every block read from the source against the
+// strong hashes of its fingerprint.
+type verifyingReaderAt struct {
+	r         io.ReaderAt
+	blockSize int64
+	newHash   func() (hash.Hash, error)
+	sigs      map[uint64][]byte
+}
+
+// newVerifyingReaderAt loads the strong hashes of the fingerprint read
+// from fp and returns a reader verifying the blocks of src against them.
+func newVerifyingReaderAt(src io.ReaderAt, fp io.Reader, blockSize int) (*verifyingReaderAt, error) {
+	fpReader, err := NewFingerprintReader(fp)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFingerprintCorrupt, err)
+	}
+	if _, err = fpReader.strongHash(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFingerprintCorrupt, err)
+	}
+	if fpReader.BlockSize != 0 && fpReader.BlockSize != blockSize {
+		return nil, fmt.Errorf("%w: fingerprint block size %d, delta block size %d", ErrFingerprintCorrupt, fpReader.BlockSize, blockSize)
+	}
+	sigs := make(map[uint64][]byte)
+	for {
+		b, err := fpReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fingerprintCorrupt(err)
+		}
+		sigs[b.Index] = b.Strong
+	}
+	return &verifyingReaderAt{r: src, blockSize: int64(blockSize), newHash: fpReader.strongHash, sigs: sigs}, nil
+}
+
+func (v *verifyingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := v.r.ReadAt(p, off)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	index := uint64(off / v.blockSize)
+	expected, ok := v.sigs[index]
+	if off%v.blockSize != 0 || !ok {
+		return n, fmt.Errorf("%w: block at offset %d is not in the fingerprint", ErrBlockChecksumFail, off)
+	}
+	// A new hash per call keeps ReadAt safe for concurrent use.
+	strong, _ := v.newHash()
+	strong.Write(p[:n])
+	if actual := strong.Sum(nil); !bytes.Equal(actual, expected) {
+		return n, &BlockMismatchError{Index: index, Offset: off, Expected: expected, Actual: actual}
+	}
+	return n, err
+}
+
+// sourceHashReaderAt checks every block read from the source against the
+// strong hash embedded in the references of the delta. The hashes are
+// added by the deltaReader as it decodes the references, before the block
+// is read.
+type sourceHashReaderAt struct {
+	r         io.ReaderAt
+	blockSize int64
+	alg       HashAlgorithm
+	mu        sync.RWMutex
+	sums      map[uint64][]byte
+}
+
+func newSourceHashReaderAt(src io.ReaderAt, alg HashAlgorithm, blockSize int) (*sourceHashReaderAt, error) {
+	if _, err := alg.New(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDeltaCorrupt, err)
+	}
+	return &sourceHashReaderAt{r: src, blockSize: int64(blockSize), alg: alg, sums: make(map[uint64][]byte)}, nil
+}
+
+func (v *sourceHashReaderAt) add(index uint64, strong []byte) {
+	v.mu.Lock()
+	v.sums[index] = strong
+	v.mu.Unlock()
+}
+
+func (v *sourceHashReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := v.r.ReadAt(p, off)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	index := uint64(off / v.blockSize)
+	v.mu.RLock()
+	expected, ok := v.sums[index]
+	v.mu.RUnlock()
+	if off%v.blockSize != 0 || !ok {
+		return n, fmt.Errorf("%w: block at offset %d has no source hash", ErrBlockChecksumFail, off)
+	}
+	strong, _ := v.alg.New()
+	strong.Write(p[:n])
+	// Deltas made from compact fingerprints hold truncated hashes.
+	actual := strong.Sum(nil)
+	if len(expected) <= len(actual) {
+		actual = actual[:len(expected)]
+	}
+	if !bytes.Equal(actual, expected) {
+		return n, &BlockMismatchError{Index: index, Offset: off, Expected: expected, Actual: actual}
+	}
+	return n, err
+}
@@ -0,0 +1,314 @@
+package delta
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/Elbandi/gsync"
+)
+
+// WeakHash selects the rolling weak checksum of fixed size blocks. It is
+// recorded in the fingerprint header, diffs use the one of the fingerprint.
+type WeakHash string
+
+const (
+	// WeakGsync is the checksum of gsync: the sum of the bytes of the
+	// block in the low and the sum of each byte weighted by its distance
+	// from the end of the block in the high 16 bits, without a modulus.
+	WeakGsync WeakHash = "gsync"
+	// WeakAdler32 is the Adler-32 of RFC 1950, as computed by hash/adler32.
+	WeakAdler32 WeakHash = "adler32"
+	// WeakCRC32 is the IEEE CRC-32, as computed by hash/crc32.
+	WeakCRC32 WeakHash = "crc32"
+)
+
+// ParseWeakHash returns the WeakHash named by s. An empty name returns "",
+// which means the checksum is taken from the fingerprint or defaults to
+// WeakGsync.
+func ParseWeakHash(s string) (WeakHash, error) {
+	switch w := WeakHash(s); w {
+	case "", WeakGsync, WeakAdler32, WeakCRC32:
+		return w, nil
+	}
+	return "", fmt.Errorf("unknown weak hash: %s, must be gsync, adler32 or crc32", s)
+}
+
+// weakFlags returns the fingerprint header flags recording w.
+func weakFlags(w WeakHash) uint16 {
+	switch w {
+	case WeakAdler32:
+		return flagWeakAdler32
+	case WeakCRC32:
+		return flagWeakCRC32
+	}
+	return 0
+}
+
+// weakHashOf returns the WeakHash recorded in fingerprint header flags.
+func weakHashOf(flags uint16) WeakHash {
+	switch {
+	case flags&flagWeakAdler32 != 0:
+		return WeakAdler32
+	case flags&flagWeakCRC32 != 0:
+		return WeakCRC32
+	}
+	return WeakGsync
+}
+
+// rolling returns the rolling state of w.
+func (w WeakHash) rolling() rollingHash {
+	switch w {
+	case WeakAdler32:
+		return &adler32Rolling{}
+	case WeakCRC32:
+		return &crc32Rolling{}
+	}
+	return &gsyncRolling{}
+}
+
+// checksum returns the weak checksum of block.
+func (w WeakHash) checksum(block []byte) uint32 {
+	h := w.rolling()
+	h.reset(block)
+	return h.sum()
+}
+
+// signatures computes the block signatures of r like gsync.Signatures,
+// which computes the gsync checksum itself.
+func (w WeakHash) signatures(ctx context.Context, r io.Reader, strong hash.Hash) (<-chan gsync.BlockSignature, error) {
+	if w == "" || w == WeakGsync {
+		return gsync.Signatures(ctx, r, strong)
+	}
+	sigsCh := make(chan gsync.BlockSignature)
+	go func() {
+		defer close(sigsCh)
+		block := make([]byte, gsync.BlockSize)
+		for index := uint64(0); ; index++ {
+			n, err := io.ReadFull(r, block)
+			if n > 0 {
+				sig := gsync.BlockSignature{Index: index, Weak: w.checksum(block[:n]), Strong: blockSum(strong, block[:n])}
+				select {
+				case sigsCh <- sig:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return
+			}
+			if err != nil {
+				select {
+				case sigsCh <- gsync.BlockSignature{Index: index, Error: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+		}
+	}()
+	return sigsCh, nil
+}
+
+// rollingHash is a weak checksum over a window of the input that moves one
+// byte at a time.
+type rollingHash interface {
+	// reset starts over with the checksum of window.
+	reset(window []byte)
+	// roll drops out from the front of the window and appends in.
+	roll(out, in byte)
+	// shrink drops out from the front of the window at the end of the
+	// input.
+	shrink(out byte)
+	sum() uint32
+}
+
+// gsyncRolling is the checksum of gsync: a is the sum of the bytes and b
+// the sum of each byte weighted by its distance from the end of the window.
+type gsyncRolling struct {
+	n    uint32
+	a, b uint32
+}
+
+func (h *gsyncRolling) reset(window []byte) {
+	h.n = uint32(len(window))
+	h.a, h.b = 0, 0
+	for i, v := range window {
+		h.a += uint32(v)
+		h.b += (h.n - uint32(i)) * uint32(v)
+	}
+}
+
+func (h *gsyncRolling) roll(out, in byte) {
+	h.a = h.a - uint32(out) + uint32(in)
+	h.b = h.b - h.n*uint32(out) + h.a
+}
+
+func (h *gsyncRolling) shrink(out byte) {
+	h.a -= uint32(out)
+	h.b -= h.n * uint32(out)
+	h.n--
+}
+
+func (h *gsyncRolling) sum() uint32 {
+	return h.a&0xffff | h.b<<16
+}
+
+// adlerMod is the modulus of Adler-32.
+const adlerMod = 65521
+
+// adler32Rolling is Adler-32: a is one plus the sum of the bytes and b the
+// sum of the values of a after every byte, both modulo adlerMod.
+type adler32Rolling struct {
+	n    uint64
+	a, b uint64
+}
+
+func (h *adler32Rolling) reset(window []byte) {
+	h.n = uint64(len(window))
+	h.a, h.b = 1, 0
+	for _, v := range window {
+		h.a = (h.a + uint64(v)) % adlerMod
+		h.b = (h.b + h.a) % adlerMod
+	}
+}
+
+func (h *adler32Rolling) roll(out, in byte) {
+	h.a = (h.a + adlerMod - uint64(out) + uint64(in)) % adlerMod
+	h.b = (h.b + adlerMod - h.n%adlerMod*uint64(out)%adlerMod + h.a + adlerMod - 1) % adlerMod
+}
+
+func (h *adler32Rolling) shrink(out byte) {
+	h.a = (h.a + adlerMod - uint64(out)) % adlerMod
+	h.b = (h.b + 2*adlerMod - h.n%adlerMod*uint64(out)%adlerMod - 1) % adlerMod
+	h.n--
+}
+
+func (h *adler32Rolling) sum() uint32 {
+	return uint32(h.b<<16 | h.a)
+}
+
+// crc32Rolling is the IEEE CRC-32. The CRC of a window is the remainder r
+// of its bytes without the initial and final inversion, which is linear in
+// them, combined with the constant the inversion adds for the length of
+// the window, zl. Appending a byte of zeros to a remainder is the linear
+// map crcZero, so dropping the first byte of a window of n bytes removes
+// crcZero applied n-1 times to its table entry.
+type crc32Rolling struct {
+	n     int
+	r, zl uint32
+	// zeros is crcZero applied n-1 times.
+	zeros gf2Matrix
+	// full holds zeros, zl and the dropped byte table of the length of
+	// the last full window, which the next windows share.
+	full struct {
+		n     int
+		zeros gf2Matrix
+		zl    uint32
+		out   [256]uint32
+	}
+}
+
+func (h *crc32Rolling) reset(window []byte) {
+	h.n = len(window)
+	h.r = ^crc32.Update(^uint32(0), crc32.IEEETable, window)
+	if h.n == 0 {
+		return
+	}
+	if h.full.n != h.n {
+		zeros := crcZeroMatrix.pow(h.n - 1)
+		h.full.n, h.full.zeros = h.n, zeros
+		h.full.zl = crcZero(zeros.apply(^uint32(0)))
+		for b := range h.full.out {
+			h.full.out[b] = zeros.apply(crc32.IEEETable[b])
+		}
+	}
+	h.zeros, h.zl = h.full.zeros, h.full.zl
+}
+
+func (h *crc32Rolling) roll(out, in byte) {
+	h.r ^= h.full.out[out]
+	h.r = crc32.IEEETable[byte(h.r)^in] ^ h.r>>8
+}
+
+func (h *crc32Rolling) shrink(out byte) {
+	h.r ^= h.zeros.apply(crc32.IEEETable[out])
+	h.n--
+	for i := range h.zeros {
+		h.zeros[i] = crcUnzero(h.zeros[i])
+	}
+	h.zl = crcUnzero(h.zl)
+}
+
+func (h *crc32Rolling) sum() uint32 {
+	return h.r ^ h.zl ^ ^uint32(0)
+}
+
+// crcZero appends a byte of zeros to the CRC remainder r.
+func crcZero(r uint32) uint32 {
+	return crc32.IEEETable[byte(r)] ^ r>>8
+}
+
+// crcUnzero is the inverse of crcZero. The top bytes of the table entries
+// are all different, so the top byte of r tells the entry it was built
+// with.
+func crcUnzero(r uint32) uint32 {
+	i := crcTopIndex[r>>24]
+	return (r^crc32.IEEETable[i])<<8 | uint32(i)
+}
+
+// crcTopIndex maps the top byte of an entry of crc32.IEEETable to its
+// index.
+var crcTopIndex = func() (t [256]byte) {
+	for i, v := range crc32.IEEETable {
+		t[v>>24] = byte(i)
+	}
+	return t
+}()
+
+// gf2Matrix is a linear map of 32 bit vectors over GF(2), column i being
+// the image of bit i.
+type gf2Matrix [32]uint32
+
+// crcZeroMatrix is crcZero as a gf2Matrix.
+var crcZeroMatrix = func() (m gf2Matrix) {
+	for i := range m {
+		m[i] = crcZero(1 << i)
+	}
+	return m
+}()
+
+func (m *gf2Matrix) apply(v uint32) uint32 {
+	var r uint32
+	for i := 0; v != 0; i, v = i+1, v>>1 {
+		if v&1 != 0 {
+			r ^= m[i]
+		}
+	}
+	return r
+}
+
+// mul returns the map applying n after m.
+func (m *gf2Matrix) mul(n *gf2Matrix) gf2Matrix {
+	var r gf2Matrix
+	for i := range r {
+		r[i] = n.apply(m[i])
+	}
+	return r
+}
+
+// pow returns m applied k times.
+func (m gf2Matrix) pow(k int) gf2Matrix {
+	var r gf2Matrix
+	for i := range r {
+		r[i] = 1 << i
+	}
+	for ; k > 0; k >>= 1 {
+		if k&1 != 0 {
+			r = r.mul(&m)
+		}
+		m = m.mul(&m)
+	}
+	return r
+}
@@ -0,0 +1,92 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"hash/adler32"
+	"hash/crc32"
+	"testing"
+)
+
+func TestRollingHash(t *testing.T) {
+	data := randomBytes(1, 3000)
+	const size = 1000
+	for _, w := range []WeakHash{WeakGsync, WeakAdler32, WeakCRC32} {
+		t.Run(string(w), func(t *testing.T) {
+			h := w.rolling()
+			h.reset(data[:size])
+			start, end := 0, size
+			for start < len(data) {
+				window := data[start:end]
+				if got, want := h.sum(), w.checksum(window); got != want {
+					t.Fatalf("window %d:%d: rolling sum %08x, want %08x", start, end, got, want)
+				}
+				switch w {
+				case WeakAdler32:
+					if want := adler32.Checksum(window); h.sum() != want {
+						t.Fatalf("window %d:%d: %08x, want Adler-32 %08x", start, end, h.sum(), want)
+					}
+				case WeakCRC32:
+					if want := crc32.ChecksumIEEE(window); h.sum() != want {
+						t.Fatalf("window %d:%d: %08x, want CRC-32 %08x", start, end, h.sum(), want)
+					}
+				}
+				if end < len(data) {
+					h.roll(data[start], data[end])
+					end++
+				} else {
+					h.shrink(data[start])
+				}
+				start++
+			}
+		})
+	}
+}
+
+func withPipeline() Option {
+	return func(c *Config) error {
+		c.Pipeline = true
+		return nil
+	}
+}
+
+func TestWeakHashRoundTrip(t *testing.T) {
+	old := randomBytes(1, 20*testBlockSize+7)
+	new := append(randomBytes(2, testBlockSize+3), old[2*testBlockSize+5:]...)
+	for _, w := range []WeakHash{WeakAdler32, WeakCRC32} {
+		for name, opt := range map[string]Option{"memory": withMaxMemory(0), "disk": withMaxMemory(1), "pipeline": withPipeline()} {
+			t.Run(string(w)+"/"+name, func(t *testing.T) {
+				d, patched := roundTrip(t, old, new, WithWeakHash(w), opt)
+				if !bytes.Equal(patched, new) {
+					t.Fatal("patched file differs from the new file")
+				}
+				gsync, _ := roundTrip(t, old, new, opt)
+				if len(d) > len(gsync)+len(gsync)/10 {
+					t.Errorf("delta is %d bytes, %d with gsync checksums", len(d), len(gsync))
+				}
+			})
+		}
+	}
+}
+
+func TestWeakHashMismatch(t *testing.T) {
+	ctx := context.Background()
+	old := randomBytes(1, 4*testBlockSize)
+	var fp bytes.Buffer
+	if err := GenerateFingerprint(ctx, bytes.NewReader(old), &fp, WithBlockSize(testBlockSize), WithWeakHash(WeakCRC32)); err != nil {
+		t.Fatal(err)
+	}
+	fr, err := NewFingerprintReader(bytes.NewReader(fp.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.WeakHash != WeakCRC32 {
+		t.Errorf("fingerprint records %s weak hashes, want %s", fr.WeakHash, WeakCRC32)
+	}
+	var d bytes.Buffer
+	_, err = MakeDiff(ctx, &fp, bytes.NewReader(old), &d, WithBlockSize(testBlockSize), WithWeakHash(WeakAdler32))
+	if !errors.Is(err, ErrHashAlgorithmMismatch) {
+		t.Errorf("MakeDiff with another weak hash = %v, want %v", err, ErrHashAlgorithmMismatch)
+	}
+}
@@ -0,0 +1,176 @@
+package delta
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Elbandi/gsync"
+)
+
+// deltaWriter encodes block operations into a delta file.
+type deltaWriter struct {
+	out        io.Writer
+	compressor io.WriteCloser
+	// sealer completes the GCM encryption once the compressor is closed.
+	sealer io.Closer
+	enc    recordEncoder
+	// literals compresses the data of the literals on their own.
+	literals *literalCompressor
+	// strongs maps the source blocks to their strong hash when a Merkle
+	// tree is built over the operations, whose leaves are collected in
+	// leaves, or when the references carry the hash of their source block.
+	strongs      map[uint64][]byte
+	merkle       bool
+	sourceHashes bool
+	leaves       [][]byte
+	root         []byte
+}
+
+// newDeltaWriter writes the header of a delta with total operations to out
+// and sets up encryption and compression as configured by cfg. baseHash is
+// the SHA-256 of the source file recorded in the header, if known.
+func newDeltaWriter(out io.Writer, cfg Config, total int64, baseHash []byte) (*deltaWriter, error) {
+	h := deltaHeader{BlockSize: uint32(cfg.BlockSize), BaseHash: baseHash}
+	h.Flags = formatFlags(cfg.Format) | flagSize
+	if len(baseHash) == sha256.Size {
+		h.Flags |= flagBaseHash
+	}
+	if cfg.FromVersion != "" || cfg.ToVersion != "" {
+		for _, v := range []string{cfg.FromVersion, cfg.ToVersion} {
+			if len(v) > maxVersionLength || strings.IndexByte(v, 0) >= 0 || !utf8.ValidString(v) {
+				return nil, fmt.Errorf("invalid version %q: it must be UTF-8 of at most %d bytes without NUL", v, maxVersionLength)
+			}
+		}
+		h.Flags |= flagVersions
+		h.FromVersion, h.ToVersion = cfg.FromVersion, cfg.ToVersion
+	}
+	if cfg.encrypted() {
+		h.Flags |= flagEncrypted
+	}
+	if cfg.Chunking == ChunkCDC {
+		h.Flags |= flagChunked
+	}
+	if cfg.Merkle {
+		h.Flags |= flagMerkle
+	}
+	if cfg.IndexOut != nil {
+		h.Flags |= flagIndexed
+	}
+	if cfg.EmbedSourceHashes {
+		h.Flags |= flagSourceHashes
+		h.Hash = cfg.Hash
+	}
+	literals, err := newLiteralCompressor(cfg.LiteralCompression)
+	if err != nil {
+		return nil, fmt.Errorf("delta compress error: %w", err)
+	}
+	if literals != nil {
+		h.Flags |= flagCompressedLiterals
+	}
+	var gcmKey []byte
+	if cfg.gcmEncrypted() {
+		if cfg.encrypted() {
+			return nil, fmt.Errorf("delta encrypt error: a key and an AES-256-GCM key are both set")
+		}
+		if h.Nonce, err = newGCMNonce(); err != nil {
+			return nil, fmt.Errorf("delta encrypt error: %w", err)
+		}
+		if gcmKey, err = cfg.gcmKey(h.Nonce); err != nil {
+			return nil, fmt.Errorf("delta encrypt error: %w", err)
+		}
+		h.Flags |= flagGCM
+	}
+	if err = writeDeltaHeader(out, h); err != nil {
+		return nil, fmt.Errorf("delta write error: %w", err)
+	}
+
+	streamWriter := out
+	var sealer io.Closer
+	if cfg.encrypted() {
+		streamWriter, err = cfg.encryptWriter(out)
+		if err != nil {
+			return nil, fmt.Errorf("delta encrypt error: %w", err)
+		}
+	} else if gcmKey != nil {
+		gw, err := newGCMWriter(out, gcmKey, h.Nonce)
+		if err != nil {
+			return nil, fmt.Errorf("delta encrypt error: %w", err)
+		}
+		streamWriter, sealer = gw, gw
+	}
+
+	compressor, err := compressWriter(streamWriter, cfg.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("delta compress error: %w", err)
+	}
+
+	dw := &deltaWriter{out: out, compressor: compressor, sealer: sealer, enc: newRecordEncoder(compressor, cfg.Format), literals: literals}
+	if err = dw.enc.Encode(total); err != nil {
+		return nil, fmt.Errorf("delta write error: %w", err)
+	}
+	return dw, nil
+}
+
+// write encodes a single block operation.
+func (dw *deltaWriter) write(o gsync.BlockOperation) error {
+	if dw.merkle {
+		leaf := dw.strongs[o.Index]
+		if len(o.Data) > 0 {
+			sum := sha256.Sum256(o.Data)
+			leaf = sum[:]
+		}
+		dw.leaves = append(dw.leaves, leaf)
+	}
+	r := opRecord{Index: o.Index, Data: o.Data}
+	if dw.sourceHashes && len(o.Data) == 0 {
+		r.Strong = dw.strongs[o.Index]
+	}
+	return dw.writeRecord(r)
+}
+
+// writeRecord encodes a single operation record, compressing the data of
+// a literal if that makes it smaller.
+func (dw *deltaWriter) writeRecord(r opRecord) error {
+	if dw.literals != nil && len(r.Data) > 0 {
+		data, err := dw.literals.compress(r.Data)
+		if err != nil {
+			return fmt.Errorf("delta compress error: %w", err)
+		}
+		if data != nil {
+			r.Data, r.Flags = data, r.Flags|opCompressed
+		}
+	}
+	if err := dw.enc.Encode(r); err != nil {
+		return fmt.Errorf("delta write error: %w", err)
+	}
+	return nil
+}
+
+// close writes the trailer holding datahash, flushes the compressor and
+// ends the delta with size, the length of the new file. With a Merkle
+// tree, the trailer also holds its nodes and the root is kept in dw.root.
+func (dw *deltaWriter) close(datahash []byte, size int64) error {
+	trailer := opRecord{Datahash: datahash}
+	if dw.merkle {
+		trailer.Merkle = merkleTree(dw.leaves)
+		dw.root = trailer.Merkle[len(trailer.Merkle)-1]
+	}
+	if err := dw.enc.Encode(trailer); err != nil {
+		return fmt.Errorf("delta write error: %w", err)
+	}
+	if err := dw.compressor.Close(); err != nil {
+		return fmt.Errorf("delta compress error: %w", err)
+	}
+	if dw.sealer != nil {
+		if err := dw.sealer.Close(); err != nil {
+			return fmt.Errorf("delta encrypt error: %w", err)
+		}
+	}
+	if err := writeSizeTrailer(dw.out, size); err != nil {
+		return fmt.Errorf("delta write error: %w", err)
+	}
+	return nil
+}
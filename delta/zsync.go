@@ -0,0 +1,119 @@
+package delta
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"path"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/md4"
+)
+
+// zsyncVersion is the zsync release whose .zsync format is written.
+const zsyncVersion = "0.6.2"
+
+// zsyncHashLengths returns the number of consecutive blocks a client
+// matches and the bytes of the rolling and strong checksum stored per
+// block, computed as zsyncmake does for a file of length bytes.
+func zsyncHashLengths(length int64, blockSize int) (seqMatches, rsumLen, checksumLen int) {
+	seqMatches = 1
+	if length > int64(blockSize) {
+		seqMatches = 2
+	}
+	l := math.Log(float64(length))
+	blocks := math.Log(1 + float64(length/int64(blockSize)))
+	rsumLen = int(math.Ceil(((l+math.Log(float64(blockSize)))/math.Ln2 - 8.6) / float64(seqMatches) / 8))
+	rsumLen = min(max(rsumLen, 2), 4)
+	checksumLen = int(math.Ceil((20 + (l+blocks)/math.Ln2) / float64(seqMatches) / 8))
+	checksumLen = max(checksumLen, int((7.9+(20+blocks/math.Ln2))/8))
+	checksumLen = min(checksumLen, md4.Size)
+	return seqMatches, rsumLen, checksumLen
+}
+
+// zsyncRsum is the rolling checksum of zsync over a whole block.
+func zsyncRsum(block []byte) [4]byte {
+	var a, b uint16
+	for i, c := range block {
+		a += uint16(c)
+		b += uint16(len(block)-i) * uint16(c)
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint16(sum[0:], a)
+	binary.BigEndian.PutUint16(sum[2:], b)
+	return sum
+}
+
+// writeZsync writes the .zsync metadata of src. The checksums of all
+// blocks are kept in memory, as the header with the length and SHA-1 of
+// src precedes them.
+func writeZsync(ctx context.Context, cfg Config, src io.Reader, dst io.Writer, bar *progress) (err error) {
+	_, span := tracer.Start(ctx, "compute block signatures")
+	defer func() { endSpan(span, err) }()
+
+	if err = cfg.checkHeaderless("zsync"); err != nil {
+		return err
+	}
+	if cfg.URL == "" {
+		return fmt.Errorf("zsync format requires the URL of the file")
+	}
+	if cfg.BlockSize&(cfg.BlockSize-1) != 0 {
+		return fmt.Errorf("zsync format requires a power of two block size, not %d", cfg.BlockSize)
+	}
+	type blockSum struct {
+		rsum   [4]byte
+		strong [md4.Size]byte
+	}
+	var sums []blockSum
+	fileHash := sha1.New()
+	strong := md4.New()
+	block := make([]byte, cfg.BlockSize)
+	var length int64
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		n, err := io.ReadFull(src, block)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: %v", ErrBlockChecksumFail, err)
+		}
+		fileHash.Write(block[:n])
+		length += int64(n)
+		// zsync pads the last block with zeros.
+		clear(block[n:])
+		s := blockSum{rsum: zsyncRsum(block)}
+		strong.Reset()
+		strong.Write(block)
+		strong.Sum(s.strong[:0])
+		sums = append(sums, s)
+		bar.Increment()
+	}
+
+	seqMatches, rsumLen, checksumLen := zsyncHashLengths(length, cfg.BlockSize)
+	w := bufio.NewWriter(dst)
+	fmt.Fprintf(w, "zsync: %s\n", zsyncVersion)
+	fmt.Fprintf(w, "Filename: %s\n", path.Base(cfg.URL))
+	fmt.Fprintf(w, "Blocksize: %d\n", cfg.BlockSize)
+	fmt.Fprintf(w, "Length: %d\n", length)
+	fmt.Fprintf(w, "Hash-Lengths: %d,%d,%d\n", seqMatches, rsumLen, checksumLen)
+	fmt.Fprintf(w, "URL: %s\n", cfg.URL)
+	fmt.Fprintf(w, "SHA-1: %x\n\n", fileHash.Sum(nil))
+	for _, s := range sums {
+		w.Write(s.rsum[4-rsumLen:])
+		w.Write(s.strong[:checksumLen])
+	}
+	if err = w.Flush(); err != nil {
+		return fmt.Errorf("fingerprint write error: %w", err)
+	}
+	cfg.logger().Debug("fingerprint done", "phase", "fpgen", "bytesProcessed", length)
+	span.SetAttributes(attribute.Int64("godelta.blocks", bar.done), attribute.Int64("godelta.file_size", length))
+	bar.Finish(length, 0)
+	return nil
+}
@@ -0,0 +1,394 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: delta.proto
+
+package deltapb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type FileChunk struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Data  []byte                 `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	// block_size is only read from the first chunk.
+	BlockSize     uint32 `protobuf:"varint,2,opt,name=block_size,json=blockSize,proto3" json:"block_size,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FileChunk) Reset() {
+	*x = FileChunk{}
+	mi := &file_delta_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FileChunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileChunk) ProtoMessage() {}
+
+func (x *FileChunk) ProtoReflect() protoreflect.Message {
+	mi := &file_delta_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileChunk.ProtoReflect.Descriptor instead.
+func (*FileChunk) Descriptor() ([]byte, []int) {
+	return file_delta_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *FileChunk) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *FileChunk) GetBlockSize() uint32 {
+	if x != nil {
+		return x.BlockSize
+	}
+	return 0
+}
+
+type Fingerprint struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Data          []byte                 `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Fingerprint) Reset() {
+	*x = Fingerprint{}
+	mi := &file_delta_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Fingerprint) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Fingerprint) ProtoMessage() {}
+
+func (x *Fingerprint) ProtoReflect() protoreflect.Message {
+	mi := &file_delta_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Fingerprint.ProtoReflect.Descriptor instead.
+func (*Fingerprint) Descriptor() ([]byte, []int) {
+	return file_delta_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Fingerprint) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+type DeltaRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// file is the path of the new file below the server root.
+	File          string `protobuf:"bytes,1,opt,name=file,proto3" json:"file,omitempty"`
+	Fingerprint   []byte `protobuf:"bytes,2,opt,name=fingerprint,proto3" json:"fingerprint,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeltaRequest) Reset() {
+	*x = DeltaRequest{}
+	mi := &file_delta_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeltaRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeltaRequest) ProtoMessage() {}
+
+func (x *DeltaRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_delta_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeltaRequest.ProtoReflect.Descriptor instead.
+func (*DeltaRequest) Descriptor() ([]byte, []int) {
+	return file_delta_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *DeltaRequest) GetFile() string {
+	if x != nil {
+		return x.File
+	}
+	return ""
+}
+
+func (x *DeltaRequest) GetFingerprint() []byte {
+	if x != nil {
+		return x.Fingerprint
+	}
+	return nil
+}
+
+// BlockOperation is a reference to block index of the base file when data
+// is empty, a literal otherwise. The last operation of a stream only holds
+// the SHA-256 of the new file in datahash.
+type BlockOperation struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Index    uint64                 `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"`
+	Data     []byte                 `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	Datahash []byte                 `protobuf:"bytes,3,opt,name=datahash,proto3" json:"datahash,omitempty"`
+	// file and block_size are set in the first operation sent to
+	// ApplyPatch: the path of the base file below the server root and the
+	// block size of the references.
+	File          string `protobuf:"bytes,4,opt,name=file,proto3" json:"file,omitempty"`
+	BlockSize     uint32 `protobuf:"varint,5,opt,name=block_size,json=blockSize,proto3" json:"block_size,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BlockOperation) Reset() {
+	*x = BlockOperation{}
+	mi := &file_delta_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BlockOperation) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlockOperation) ProtoMessage() {}
+
+func (x *BlockOperation) ProtoReflect() protoreflect.Message {
+	mi := &file_delta_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlockOperation.ProtoReflect.Descriptor instead.
+func (*BlockOperation) Descriptor() ([]byte, []int) {
+	return file_delta_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *BlockOperation) GetIndex() uint64 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *BlockOperation) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *BlockOperation) GetDatahash() []byte {
+	if x != nil {
+		return x.Datahash
+	}
+	return nil
+}
+
+func (x *BlockOperation) GetFile() string {
+	if x != nil {
+		return x.File
+	}
+	return ""
+}
+
+func (x *BlockOperation) GetBlockSize() uint32 {
+	if x != nil {
+		return x.BlockSize
+	}
+	return 0
+}
+
+type ApplyResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Size          uint64                 `protobuf:"varint,1,opt,name=size,proto3" json:"size,omitempty"`
+	Datahash      []byte                 `protobuf:"bytes,2,opt,name=datahash,proto3" json:"datahash,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ApplyResult) Reset() {
+	*x = ApplyResult{}
+	mi := &file_delta_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ApplyResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ApplyResult) ProtoMessage() {}
+
+func (x *ApplyResult) ProtoReflect() protoreflect.Message {
+	mi := &file_delta_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ApplyResult.ProtoReflect.Descriptor instead.
+func (*ApplyResult) Descriptor() ([]byte, []int) {
+	return file_delta_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ApplyResult) GetSize() uint64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *ApplyResult) GetDatahash() []byte {
+	if x != nil {
+		return x.Datahash
+	}
+	return nil
+}
+
+var File_delta_proto protoreflect.FileDescriptor
+
+const file_delta_proto_rawDesc = "" +
+	"\n" +
+	"\vdelta.proto\x12\agodelta\">\n" +
+	"\tFileChunk\x12\x12\n" +
+	"\x04data\x18\x01 \x01(\fR\x04data\x12\x1d\n" +
+	"\n" +
+	"block_size\x18\x02 \x01(\rR\tblockSize\"!\n" +
+	"\vFingerprint\x12\x12\n" +
+	"\x04data\x18\x01 \x01(\fR\x04data\"D\n" +
+	"\fDeltaRequest\x12\x12\n" +
+	"\x04file\x18\x01 \x01(\tR\x04file\x12 \n" +
+	"\vfingerprint\x18\x02 \x01(\fR\vfingerprint\"\x89\x01\n" +
+	"\x0eBlockOperation\x12\x14\n" +
+	"\x05index\x18\x01 \x01(\x04R\x05index\x12\x12\n" +
+	"\x04data\x18\x02 \x01(\fR\x04data\x12\x1a\n" +
+	"\bdatahash\x18\x03 \x01(\fR\bdatahash\x12\x12\n" +
+	"\x04file\x18\x04 \x01(\tR\x04file\x12\x1d\n" +
+	"\n" +
+	"block_size\x18\x05 \x01(\rR\tblockSize\"=\n" +
+	"\vApplyResult\x12\x12\n" +
+	"\x04size\x18\x01 \x01(\x04R\x04size\x12\x1a\n" +
+	"\bdatahash\x18\x02 \x01(\fR\bdatahash2\xd2\x01\n" +
+	"\fDeltaService\x12A\n" +
+	"\x13GenerateFingerprint\x12\x12.godelta.FileChunk\x1a\x14.godelta.Fingerprint(\x01\x12@\n" +
+	"\fComputeDelta\x12\x15.godelta.DeltaRequest\x1a\x17.godelta.BlockOperation0\x01\x12=\n" +
+	"\n" +
+	"ApplyPatch\x12\x17.godelta.BlockOperation\x1a\x14.godelta.ApplyResult(\x01B$Z\"github.com/Elbandi/godelta/deltapbb\x06proto3"
+
+var (
+	file_delta_proto_rawDescOnce sync.Once
+	file_delta_proto_rawDescData []byte
+)
+
+func file_delta_proto_rawDescGZIP() []byte {
+	file_delta_proto_rawDescOnce.Do(func() {
+		file_delta_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_delta_proto_rawDesc), len(file_delta_proto_rawDesc)))
+	})
+	return file_delta_proto_rawDescData
+}
+
+var file_delta_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_delta_proto_goTypes = []any{
+	(*FileChunk)(nil),      // 0: godelta.FileChunk
+	(*Fingerprint)(nil),    // 1: godelta.Fingerprint
+	(*DeltaRequest)(nil),   // 2: godelta.DeltaRequest
+	(*BlockOperation)(nil), // 3: godelta.BlockOperation
+	(*ApplyResult)(nil),    // 4: godelta.ApplyResult
+}
+var file_delta_proto_depIdxs = []int32{
+	0, // 0: godelta.DeltaService.GenerateFingerprint:input_type -> godelta.FileChunk
+	2, // 1: godelta.DeltaService.ComputeDelta:input_type -> godelta.DeltaRequest
+	3, // 2: godelta.DeltaService.ApplyPatch:input_type -> godelta.BlockOperation
+	1, // 3: godelta.DeltaService.GenerateFingerprint:output_type -> godelta.Fingerprint
+	3, // 4: godelta.DeltaService.ComputeDelta:output_type -> godelta.BlockOperation
+	4, // 5: godelta.DeltaService.ApplyPatch:output_type -> godelta.ApplyResult
+	3, // [3:6] is the sub-list for method output_type
+	0, // [0:3] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_delta_proto_init() }
+func file_delta_proto_init() {
+	if File_delta_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_delta_proto_rawDesc), len(file_delta_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_delta_proto_goTypes,
+		DependencyIndexes: file_delta_proto_depIdxs,
+		MessageInfos:      file_delta_proto_msgTypes,
+	}.Build()
+	File_delta_proto = out.File
+	file_delta_proto_goTypes = nil
+	file_delta_proto_depIdxs = nil
+}
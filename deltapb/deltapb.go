@@ -0,0 +1,6 @@
+// Package deltapb holds the messages and the gRPC service defined in
+// delta.proto and the file records defined in records.proto, generated by
+// protoc-gen-go and protoc-gen-go-grpc.
+package deltapb
+
+//go:generate buf generate
@@ -0,0 +1,366 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: records.proto
+
+package deltapb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// SignatureRecord is a record of a fingerprint file: the signature of a
+// block or, as the last record, the source file fields only.
+type SignatureRecord struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Index  uint64                 `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"`
+	Weak   uint32                 `protobuf:"varint,2,opt,name=weak,proto3" json:"weak,omitempty"`
+	Strong []byte                 `protobuf:"bytes,3,opt,name=strong,proto3" json:"strong,omitempty"`
+	// offset and length are only set in fingerprints of content-defined
+	// chunks.
+	Offset uint64 `protobuf:"varint,4,opt,name=offset,proto3" json:"offset,omitempty"`
+	Length uint32 `protobuf:"varint,5,opt,name=length,proto3" json:"length,omitempty"`
+	// source_hash is the SHA-256 of the source file, source_size its size
+	// and source_state the marshaled state of the SHA-256.
+	SourceHash    []byte `protobuf:"bytes,6,opt,name=source_hash,json=sourceHash,proto3" json:"source_hash,omitempty"`
+	SourceSize    uint64 `protobuf:"varint,7,opt,name=source_size,json=sourceSize,proto3" json:"source_size,omitempty"`
+	SourceState   []byte `protobuf:"bytes,8,opt,name=source_state,json=sourceState,proto3" json:"source_state,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SignatureRecord) Reset() {
+	*x = SignatureRecord{}
+	mi := &file_records_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SignatureRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SignatureRecord) ProtoMessage() {}
+
+func (x *SignatureRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_records_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SignatureRecord.ProtoReflect.Descriptor instead.
+func (*SignatureRecord) Descriptor() ([]byte, []int) {
+	return file_records_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *SignatureRecord) GetIndex() uint64 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *SignatureRecord) GetWeak() uint32 {
+	if x != nil {
+		return x.Weak
+	}
+	return 0
+}
+
+func (x *SignatureRecord) GetStrong() []byte {
+	if x != nil {
+		return x.Strong
+	}
+	return nil
+}
+
+func (x *SignatureRecord) GetOffset() uint64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *SignatureRecord) GetLength() uint32 {
+	if x != nil {
+		return x.Length
+	}
+	return 0
+}
+
+func (x *SignatureRecord) GetSourceHash() []byte {
+	if x != nil {
+		return x.SourceHash
+	}
+	return nil
+}
+
+func (x *SignatureRecord) GetSourceSize() uint64 {
+	if x != nil {
+		return x.SourceSize
+	}
+	return 0
+}
+
+func (x *SignatureRecord) GetSourceState() []byte {
+	if x != nil {
+		return x.SourceState
+	}
+	return nil
+}
+
+// DeltaStart is the first record of a delta file.
+type DeltaStart struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// operations is the number of operations the writer expected, 0 if it
+	// was unknown.
+	Operations    int64 `protobuf:"varint,1,opt,name=operations,proto3" json:"operations,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeltaStart) Reset() {
+	*x = DeltaStart{}
+	mi := &file_records_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeltaStart) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeltaStart) ProtoMessage() {}
+
+func (x *DeltaStart) ProtoReflect() protoreflect.Message {
+	mi := &file_records_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeltaStart.ProtoReflect.Descriptor instead.
+func (*DeltaStart) Descriptor() ([]byte, []int) {
+	return file_records_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *DeltaStart) GetOperations() int64 {
+	if x != nil {
+		return x.Operations
+	}
+	return 0
+}
+
+// OperationRecord is a record of a delta file: a reference to block index
+// of the base file when data is empty, a literal otherwise. The last
+// record only holds the SHA-256 of the new file in datahash and the nodes
+// of the Merkle tree over the operations in merkle.
+type OperationRecord struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Index    uint64                 `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"`
+	Data     []byte                 `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	Datahash []byte                 `protobuf:"bytes,3,opt,name=datahash,proto3" json:"datahash,omitempty"`
+	// offset and length locate the referenced chunk in deltas of
+	// content-defined chunks.
+	Offset uint64   `protobuf:"varint,4,opt,name=offset,proto3" json:"offset,omitempty"`
+	Length uint32   `protobuf:"varint,5,opt,name=length,proto3" json:"length,omitempty"`
+	Merkle [][]byte `protobuf:"bytes,6,rep,name=merkle,proto3" json:"merkle,omitempty"`
+	// strong is the strong hash of the referenced block in deltas written
+	// with -embed-source-hashes.
+	Strong []byte `protobuf:"bytes,7,opt,name=strong,proto3" json:"strong,omitempty"`
+	// flags of a literal: 1 if its data is compressed, in deltas written
+	// with -literal-compression.
+	Flags         uint32 `protobuf:"varint,8,opt,name=flags,proto3" json:"flags,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *OperationRecord) Reset() {
+	*x = OperationRecord{}
+	mi := &file_records_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *OperationRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OperationRecord) ProtoMessage() {}
+
+func (x *OperationRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_records_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OperationRecord.ProtoReflect.Descriptor instead.
+func (*OperationRecord) Descriptor() ([]byte, []int) {
+	return file_records_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *OperationRecord) GetIndex() uint64 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *OperationRecord) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *OperationRecord) GetDatahash() []byte {
+	if x != nil {
+		return x.Datahash
+	}
+	return nil
+}
+
+func (x *OperationRecord) GetOffset() uint64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *OperationRecord) GetLength() uint32 {
+	if x != nil {
+		return x.Length
+	}
+	return 0
+}
+
+func (x *OperationRecord) GetMerkle() [][]byte {
+	if x != nil {
+		return x.Merkle
+	}
+	return nil
+}
+
+func (x *OperationRecord) GetStrong() []byte {
+	if x != nil {
+		return x.Strong
+	}
+	return nil
+}
+
+func (x *OperationRecord) GetFlags() uint32 {
+	if x != nil {
+		return x.Flags
+	}
+	return 0
+}
+
+var File_records_proto protoreflect.FileDescriptor
+
+const file_records_proto_rawDesc = "" +
+	"\n" +
+	"\rrecords.proto\x12\agodelta\"\xe8\x01\n" +
+	"\x0fSignatureRecord\x12\x14\n" +
+	"\x05index\x18\x01 \x01(\x04R\x05index\x12\x12\n" +
+	"\x04weak\x18\x02 \x01(\rR\x04weak\x12\x16\n" +
+	"\x06strong\x18\x03 \x01(\fR\x06strong\x12\x16\n" +
+	"\x06offset\x18\x04 \x01(\x04R\x06offset\x12\x16\n" +
+	"\x06length\x18\x05 \x01(\rR\x06length\x12\x1f\n" +
+	"\vsource_hash\x18\x06 \x01(\fR\n" +
+	"sourceHash\x12\x1f\n" +
+	"\vsource_size\x18\a \x01(\x04R\n" +
+	"sourceSize\x12!\n" +
+	"\fsource_state\x18\b \x01(\fR\vsourceState\",\n" +
+	"\n" +
+	"DeltaStart\x12\x1e\n" +
+	"\n" +
+	"operations\x18\x01 \x01(\x03R\n" +
+	"operations\"\xcd\x01\n" +
+	"\x0fOperationRecord\x12\x14\n" +
+	"\x05index\x18\x01 \x01(\x04R\x05index\x12\x12\n" +
+	"\x04data\x18\x02 \x01(\fR\x04data\x12\x1a\n" +
+	"\bdatahash\x18\x03 \x01(\fR\bdatahash\x12\x16\n" +
+	"\x06offset\x18\x04 \x01(\x04R\x06offset\x12\x16\n" +
+	"\x06length\x18\x05 \x01(\rR\x06length\x12\x16\n" +
+	"\x06merkle\x18\x06 \x03(\fR\x06merkle\x12\x16\n" +
+	"\x06strong\x18\a \x01(\fR\x06strong\x12\x14\n" +
+	"\x05flags\x18\b \x01(\rR\x05flagsB$Z\"github.com/Elbandi/godelta/deltapbb\x06proto3"
+
+var (
+	file_records_proto_rawDescOnce sync.Once
+	file_records_proto_rawDescData []byte
+)
+
+func file_records_proto_rawDescGZIP() []byte {
+	file_records_proto_rawDescOnce.Do(func() {
+		file_records_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_records_proto_rawDesc), len(file_records_proto_rawDesc)))
+	})
+	return file_records_proto_rawDescData
+}
+
+var file_records_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_records_proto_goTypes = []any{
+	(*SignatureRecord)(nil), // 0: godelta.SignatureRecord
+	(*DeltaStart)(nil),      // 1: godelta.DeltaStart
+	(*OperationRecord)(nil), // 2: godelta.OperationRecord
+}
+var file_records_proto_depIdxs = []int32{
+	0, // [0:0] is the sub-list for method output_type
+	0, // [0:0] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_records_proto_init() }
+func file_records_proto_init() {
+	if File_records_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_records_proto_rawDesc), len(file_records_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   3,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_records_proto_goTypes,
+		DependencyIndexes: file_records_proto_depIdxs,
+		MessageInfos:      file_records_proto_msgTypes,
+	}.Build()
+	File_records_proto = out.File
+	file_records_proto_goTypes = nil
+	file_records_proto_depIdxs = nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// sourceSize returns the size of the -file f. The stat of a block device
+// reports 0, its size is taken from -device-size or, where supported,
+// detected with blockDeviceSize, and must not exceed -max-device-size.
+func sourceSize(f *os.File) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		return fi.Size(), nil
+	}
+	var size int64
+	if *deviceSize != "" {
+		if size, err = parseSize(*deviceSize); err != nil {
+			return 0, fmt.Errorf("invalid -device-size: %v", err)
+		}
+	} else if size, err = blockDeviceSize(f); err != nil {
+		return 0, fmt.Errorf("%s: cannot detect the size of the block device, set -device-size: %w", f.Name(), err)
+	}
+	limit, err := parseSize(*maxDevSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid -max-device-size: %v", err)
+	}
+	if size == 0 || size > limit {
+		return 0, fmt.Errorf("%s: block device size %d is not between 1 byte and -max-device-size %s", f.Name(), size, *maxDevSize)
+	}
+	return size, nil
+}
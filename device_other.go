@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// blockDeviceSize is only supported on Linux, elsewhere the size of a
+// block device must be set with -device-size.
+func blockDeviceSize(f *os.File) (int64, error) {
+	return 0, errors.New("not supported on this platform")
+}
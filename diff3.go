@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/Elbandi/godelta/delta"
+)
+
+// conflict is a block changed differently in both branches.
+type conflict struct {
+	BlockIndex uint64 `json:"block_index"`
+	AHash      string `json:"a_hash"`
+	BHash      string `json:"b_hash"`
+}
+
+// branchFile is one of the three files of diff3 with the strong hashes of
+// its blocks by index.
+type branchFile struct {
+	*os.File
+	hashes [][]byte
+}
+
+// openBranch opens path and fingerprints it in memory.
+func openBranch(ctx context.Context, cfg delta.Config, path string) (*branchFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Format = delta.FormatGob
+	cfg.FingerprintCompression = delta.CompressNone
+	cfg.Chunking = delta.ChunkFixed
+	var fp bytes.Buffer
+	if err = delta.GenerateFingerprint(ctx, f, &fp, delta.WithConfig(cfg)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	fr, err := delta.NewFingerprintReader(&fp)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	b := &branchFile{File: f}
+	for {
+		sig, err := fr.Next()
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		for uint64(len(b.hashes)) <= sig.Index {
+			b.hashes = append(b.hashes, nil)
+		}
+		b.hashes[sig.Index] = sig.Strong
+	}
+}
+
+// hash returns the strong hash of block i, nil past the end of the file.
+func (b *branchFile) hash(i int) []byte {
+	if i < len(b.hashes) {
+		return b.hashes[i]
+	}
+	return nil
+}
+
+// mergeBranches writes to out the blocks of base with the changes of a and
+// b applied, comparing the blocks at the same position of the three files.
+// A block changed differently in a and b is a conflict, out keeps the base
+// block for it. It returns the conflicts.
+func mergeBranches(ctx context.Context, cfg delta.Config, base, a, b *branchFile, out io.Writer) ([]conflict, error) {
+	n := max(len(base.hashes), len(a.hashes), len(b.hashes))
+	buf := make([]byte, cfg.BlockSize)
+	var conflicts []conflict
+	for i := 0; i < n; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		hb, ha, hbb := base.hash(i), a.hash(i), b.hash(i)
+		from := a
+		switch {
+		case bytes.Equal(ha, hbb), bytes.Equal(hbb, hb):
+		case bytes.Equal(ha, hb):
+			from = b
+		default:
+			conflicts = append(conflicts, conflict{BlockIndex: uint64(i), AHash: hex.EncodeToString(ha), BHash: hex.EncodeToString(hbb)})
+			from = base
+		}
+		m, err := from.ReadAt(buf, int64(i)*int64(cfg.BlockSize))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if _, err = out.Write(buf[:m]); err != nil {
+			return nil, err
+		}
+	}
+	return conflicts, nil
+}
+
+// diff3 merges the changes of -a and -b to -base into -out and writes the
+// conflicting blocks to conflictMap. It reports whether there was no
+// conflict.
+func diff3(ctx context.Context, cfg delta.Config, conflictMap string) (bool, error) {
+	if *basePath == "" || *branchA == "" || *branchB == "" || *outfilePath == "" {
+		return false, errors.New("diff3 requires -base, -a, -b and -out")
+	}
+	var files []*branchFile
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, path := range []string{*basePath, *branchA, *branchB} {
+		f, err := openBranch(ctx, cfg, path)
+		if err != nil {
+			return false, err
+		}
+		files = append(files, f)
+	}
+
+	out, err := createAtomic(*outfilePath)
+	if err != nil {
+		return false, err
+	}
+	defer out.Abort()
+	conflicts, err := mergeBranches(ctx, cfg, files[0], files[1], files[2], out)
+	if err != nil {
+		return false, err
+	}
+	if conflictMap != "" {
+		cm, err := createAtomic(conflictMap)
+		if err != nil {
+			return false, err
+		}
+		defer cm.Abort()
+		enc := json.NewEncoder(cm)
+		enc.SetIndent("", "  ")
+		if conflicts == nil {
+			conflicts = []conflict{}
+		}
+		if err = enc.Encode(conflicts); err != nil {
+			return false, err
+		}
+		if err = cm.Commit(); err != nil {
+			return false, err
+		}
+	}
+	if err = out.Commit(); err != nil {
+		return false, err
+	}
+	if len(conflicts) > 0 {
+		slog.Warn("conflicting blocks kept from the base file", "phase", "diff3", "conflicts", len(conflicts), "out", *outfilePath)
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+
+	"github.com/Elbandi/godelta/delta"
+)
+
+// Exit codes of the process, printed by usage so scripts can branch on
+// them. exitOutputExists keeps the 3 it had before the other codes were
+// added, so a corrupt or missing fingerprint exits with 10 instead.
+const (
+	exitOK           = 0
+	exitInternal     = 1
+	exitNotFound     = 2
+	exitOutputExists = 3
+	exitDelta        = 4
+	exitHashMismatch = 5
+	exitTimeout      = 6
+	exitPermission   = 7
+	// exitDeltaTooLarge is returned for -reject-large-literal-ratio and
+	// -max-delta-size.
+	exitDeltaTooLarge = 8
+	// exitCollisions is reserved, no check of this version fails with it.
+	exitCollisions  = 9
+	exitFingerprint = 10
+)
+
+// Exit codes of verify, which has its own since it was added.
+const (
+	exitVerifyMismatch = 1
+	exitVerifyError    = 2
+)
+
+// errDeltaTooLarge makes the process exit with exitDeltaTooLarge.
+var errDeltaTooLarge = errors.New("delta too large")
+
+var exitCodes = []struct {
+	code int
+	desc string
+}{
+	{exitOK, "success"},
+	{exitInternal, "any other error"},
+	{exitNotFound, "input file not found"},
+	{exitOutputExists, "output file exists, see -overwrite"},
+	{exitDelta, "delta corrupt or of an unsupported version"},
+	{exitHashMismatch, "mismatch: the patched data or its size, the base file, a base file block, a signature, the source version, the hash algorithm or the checkpoint did not match"},
+	{exitTimeout, "timeout"},
+	{exitPermission, "permission denied"},
+	{exitDeltaTooLarge, "delta too large: more literals than -reject-large-literal-ratio or larger than -max-delta-size"},
+	{exitCollisions, "high hash collision rate (reserved)"},
+	{exitFingerprint, "fingerprint corrupt, missing or of an unsupported version"},
+}
+
+func printExitCodes(out io.Writer) {
+	fmt.Fprintf(out, "\nExit codes:\n")
+	for _, c := range exitCodes {
+		fmt.Fprintf(out, "  %2d  %s\n", c.code, c.desc)
+	}
+	fmt.Fprintf(out, "A corrupt or missing fingerprint exits with %d, not %d, which an existing output kept.\n", exitFingerprint, exitOutputExists)
+	fmt.Fprintf(out, "verify exits with %d when the data does not match and %d on any other error.\n", exitVerifyMismatch, exitVerifyError)
+}
+
+// exitCode maps err to the exit code of its category.
+func exitCode(err error) int {
+	var pathErr *fs.PathError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errOutputExists):
+		return exitOutputExists
+	case errors.Is(err, errDeltaTooLarge):
+		return exitDeltaTooLarge
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return exitTimeout
+	case errors.Is(err, delta.ErrFingerprintCorrupt):
+		return exitFingerprint
+	case errors.Is(err, fs.ErrNotExist) && errors.As(err, &pathErr) && pathErr.Path == fingerprintPath():
+		return exitFingerprint
+	case errors.Is(err, delta.ErrDeltaCorrupt):
+		return exitDelta
+	case errors.Is(err, delta.ErrUnsupportedVersion):
+		if readsDelta(flag.Arg(0)) {
+			return exitDelta
+		}
+		return exitFingerprint
+	case errors.Is(err, delta.ErrPatchMismatch), errors.Is(err, delta.ErrBlockChecksumFail), errors.Is(err, delta.ErrSignatureMismatch),
+		errors.Is(err, delta.ErrWrongSourceFile), errors.Is(err, delta.ErrOutputSizeMismatch), errors.Is(err, delta.ErrVersionMismatch),
+		errors.Is(err, delta.ErrSourceModified), errors.Is(err, delta.ErrHashAlgorithmMismatch), errors.Is(err, delta.ErrCheckpointMismatch):
+		return exitHashMismatch
+	case errors.Is(err, fs.ErrPermission):
+		return exitPermission
+	case errors.Is(err, fs.ErrNotExist):
+		return exitNotFound
+	}
+	return exitInternal
+}
+
+// readsDelta reports whether the input of action with a version is a
+// delta rather than a fingerprint.
+func readsDelta(action string) bool {
+	switch action {
+	case "patch", "verify", "inspect", "split", "stats", "reverse", "compose", "chain":
+		return true
+	}
+	return false
+}
+
+// timedOut marks err as a timeout if ctx hit the -timeout deadline, the
+// operation may have failed with an error not wrapping ctx.Err().
+func timedOut(ctx context.Context, err error) error {
+	if err == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return fmt.Errorf("%w after %s: %w", context.DeadlineExceeded, *timeout, err)
+}
+
+// fail logs msg at error level and exits with code.
+func fail(code int, msg string, args ...any) {
+	slog.Error(msg, args...)
+	runAtExit()
+	os.Exit(code)
+}
+
+// exitWith exits with the code of the category of err, unless it is nil.
+func exitWith(err error, args ...any) {
+	if code := exitCode(err); code != exitOK {
+		fail(code, err.Error(), args...)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Elbandi/godelta/delta"
+)
+
+// slowWriter sleeps before every write.
+type slowWriter struct {
+	w     io.Writer
+	delay time.Duration
+}
+
+func (s slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.w.Write(p)
+}
+
+func TestPatchTimeout(t *testing.T) {
+	old := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(old)
+	new := append([]byte("changed"), old...)
+	ctx := context.Background()
+	var fp, d bytes.Buffer
+	if err := delta.GenerateFingerprint(ctx, bytes.NewReader(old), &fp); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := delta.MakeDiff(ctx, &fp, bytes.NewReader(new), &d); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out")
+	if err := os.WriteFile(path, []byte("original"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := createAtomic(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Abort()
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = delta.ApplyPatch(ctx, bytes.NewReader(old), &d, slowWriter{out, 10 * time.Millisecond})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("patch stopped %s after the timeout", elapsed)
+	}
+	if code := exitCode(timedOut(ctx, err)); code != exitTimeout {
+		t.Fatalf("exit code of %v is %d, want %d", err, code, exitTimeout)
+	}
+	out.Abort()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files left in the output directory, want only the output", len(entries))
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "original" {
+		t.Errorf("output is %q, %v, want the original", b, err)
+	}
+}
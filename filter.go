@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// filterRule is an -exclude or -include pattern of batch.
+type filterRule struct {
+	pattern string
+	exclude bool
+}
+
+// pathFilter decides which batch entries are skipped. The rules are checked
+// in the order they were given on the command line and the last matching
+// one wins, so -include can take back a file of an earlier -exclude and a
+// later -exclude can drop it again. A path no rule matches is kept.
+//
+// The patterns use the path.Match syntax, which is that of filepath.Match
+// with / as the separator on every system. A pattern without a slash is
+// matched against every element of the path, so *.tmp skips any file with
+// that suffix and .git skips everything below a .git directory. A pattern
+// with a slash is matched against the leading elements of the path as it is
+// written in the manifest, so .git/** or .git/* skips the files below .git
+// but not a file called .git.
+type pathFilter struct {
+	rules []filterRule
+}
+
+var batchFilter pathFilter
+
+func init() {
+	flag.Func("exclude", "batch: Skip the entries whose new file path matches this pattern, can be repeated, the last matching -exclude or -include wins", func(s string) error {
+		return batchFilter.add(s, true)
+	})
+	flag.Func("include", "batch: Keep the entries whose new file path matches this pattern even if an earlier -exclude matched it, can be repeated", func(s string) error {
+		return batchFilter.add(s, false)
+	})
+	flag.Func("exclude-from", "batch: Read -exclude patterns from this file, one per line, empty lines and lines starting with # are skipped", batchFilter.addFile)
+}
+
+func (f *pathFilter) add(pattern string, exclude bool) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("%q: %w", pattern, err)
+	}
+	f.rules = append(f.rules, filterRule{pattern: pattern, exclude: exclude})
+	return nil
+}
+
+// addFile adds the exclude patterns of a file at the position of the
+// -exclude-from flag.
+func (f *pathFilter) addFile(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err = f.add(text, true); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// excluded reports whether the path is skipped.
+func (f *pathFilter) excluded(name string) bool {
+	elems := strings.Split(filepath.ToSlash(filepath.Clean(name)), "/")
+	excluded := false
+	for _, r := range f.rules {
+		if r.matches(elems) {
+			excluded = r.exclude
+		}
+	}
+	return excluded
+}
+
+func (r filterRule) matches(elems []string) bool {
+	if !strings.Contains(r.pattern, "/") {
+		for _, e := range elems {
+			if ok, _ := path.Match(r.pattern, e); ok {
+				return true
+			}
+		}
+		return false
+	}
+	for i := range elems {
+		if ok, _ := path.Match(r.pattern, strings.Join(elems[:i+1], "/")); ok {
+			return true
+		}
+	}
+	return false
+}
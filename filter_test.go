@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []filterRule
+		path  string
+		want  bool
+	}{
+		{"no rules", nil, "a/b.tmp", false},
+		{"suffix", []filterRule{{"*.tmp", true}}, "a/b.tmp", true},
+		{"suffix no match", []filterRule{{"*.tmp", true}}, "a/b.txt", false},
+		{"element", []filterRule{{".git", true}}, ".git/objects/ab", true},
+		{"element file", []filterRule{{".git", true}}, "sub/.git", true},
+		{"prefix", []filterRule{{".git/**", true}}, ".git/objects/ab", true},
+		{"prefix not file", []filterRule{{".git/**", true}}, ".git", false},
+		{"prefix not nested", []filterRule{{".git/*", true}}, "sub/.git/config", false},
+		{"cleaned", []filterRule{{".git/*", true}}, "./.git/config", true},
+		{"include after exclude", []filterRule{{"*.tmp", true}, {"keep.tmp", false}}, "a/keep.tmp", false},
+		{"include other", []filterRule{{"*.tmp", true}, {"keep.tmp", false}}, "a/drop.tmp", true},
+		{"exclude after include", []filterRule{{"*.tmp", true}, {"keep.tmp", false}, {"a/*", true}}, "a/keep.tmp", true},
+		{"include only", []filterRule{{"*.txt", false}}, "a.txt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := pathFilter{rules: tt.rules}
+			if got := f.excluded(tt.path); got != tt.want {
+				t.Errorf("excluded(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathFilterAdd(t *testing.T) {
+	var f pathFilter
+	if err := f.add("[", true); err == nil {
+		t.Error("add accepted a malformed pattern")
+	}
+	name := filepath.Join(t.TempDir(), "exclude")
+	if err := os.WriteFile(name, []byte("# comment\n\n*.tmp\n  .git/**  \n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.addFile(name); err != nil {
+		t.Fatal(err)
+	}
+	want := []filterRule{{"*.tmp", true}, {".git/**", true}}
+	if len(f.rules) != len(want) {
+		t.Fatalf("rules = %v, want %v", f.rules, want)
+	}
+	for i := range want {
+		if f.rules[i] != want[i] {
+			t.Errorf("rules[%d] = %v, want %v", i, f.rules[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"container/list"
+	"os"
+	"sync"
+
+	"github.com/Elbandi/godelta/delta"
+)
+
+// fpCacheKey identifies a fingerprint served by serve. A file modified or
+// resized since the fingerprint was cached no longer matches.
+type fpCacheKey struct {
+	path      string
+	modTime   int64
+	size      int64
+	blockSize int
+	format    delta.Format
+}
+
+func newFPCacheKey(path string, fi os.FileInfo, cfg delta.Config) fpCacheKey {
+	return fpCacheKey{path: path, modTime: fi.ModTime().UnixNano(), size: fi.Size(), blockSize: cfg.BlockSize, format: cfg.Format}
+}
+
+type fpCacheEntry struct {
+	key  fpCacheKey
+	data []byte
+}
+
+// fingerprintCache holds the -cache-size fingerprints served last. A nil
+// cache holds nothing.
+type fingerprintCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // of *fpCacheEntry, most recently used first
+	entries map[fpCacheKey]*list.Element
+}
+
+// newFingerprintCache returns a cache of size entries, nil if size is not
+// positive.
+func newFingerprintCache(size int) *fingerprintCache {
+	if size <= 0 {
+		return nil
+	}
+	return &fingerprintCache{size: size, order: list.New(), entries: make(map[fpCacheKey]*list.Element)}
+}
+
+// get returns the fingerprint cached for key.
+func (c *fingerprintCache) get(key fpCacheKey) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*fpCacheEntry).data, true
+}
+
+// add caches data as the fingerprint for key, evicting the least recently
+// used entry when the cache is full. Entries of older versions of the file
+// are left to be evicted.
+func (c *fingerprintCache) add(key fpCacheKey, data []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*fpCacheEntry).data = data
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&fpCacheEntry{key: key, data: data})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*fpCacheEntry).key)
+	}
+}
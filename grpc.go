@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/Elbandi/godelta/delta"
+	"github.com/Elbandi/godelta/deltapb"
+	"github.com/Elbandi/gsync"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+// grpcChunkSize is the size of the file chunks streamed to
+// GenerateFingerprint.
+const grpcChunkSize = 64 << 10
+
+// grpcServer implements deltapb.DeltaService for the files below root.
+type grpcServer struct {
+	deltapb.UnimplementedDeltaServiceServer
+	root string
+	cfg  delta.Config
+}
+
+// serveGRPC runs the gRPC server on addr until the process is
+// interrupted.
+func serveGRPC(ctx context.Context, cfg delta.Config, addr, root string) error {
+	if root == "" {
+		return errors.New("grpc-serve requires -root")
+	}
+	if cfg.WeakHash != "" && cfg.WeakHash != delta.WeakGsync {
+		return fmt.Errorf("-weak-hash %s is not supported by grpc-serve, which diffs with the gsync checksum", cfg.WeakHash)
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := grpc.NewServer()
+	deltapb.RegisterDeltaServiceServer(srv, &grpcServer{root: root, cfg: cfg})
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+	slog.Info("serving gRPC", "addr", lis.Addr().String(), "root", root)
+	return srv.Serve(limitListener(lis))
+}
+
+// path returns the path of name, which must stay below the root.
+func (s *grpcServer) path(name string) (string, error) {
+	path, err := pathBelow(s.root, name)
+	switch {
+	case errors.Is(err, errInvalidFile):
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, os.ErrNotExist):
+		return "", status.Error(codes.NotFound, err.Error())
+	}
+	return path, err
+}
+
+func (s *grpcServer) GenerateFingerprint(stream grpc.ClientStreamingServer[deltapb.FileChunk, deltapb.Fingerprint]) (err error) {
+	start := time.Now()
+	defer func() { appMetrics.observe("fpgen", start, err) }()
+
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	cfg := s.cfg
+	if first.BlockSize != 0 {
+		if err = delta.CheckBlockSize(int(first.BlockSize)); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		cfg.BlockSize = int(first.BlockSize)
+	}
+	// The file is received before the fingerprint takes gsyncMu, so a
+	// slow client does not hold up the other requests.
+	spool, err := newSpool()
+	if err != nil {
+		return err
+	}
+	defer removeSpool(spool)
+	var size int64
+	for chunk := first; ; {
+		if size += int64(len(chunk.Data)); uploadLimit > 0 && size > uploadLimit {
+			return status.Errorf(codes.ResourceExhausted, "file is larger than -max-upload %s", formatSize(uploadLimit))
+		}
+		if _, err = spool.Write(chunk.Data); err != nil {
+			return err
+		}
+		if chunk, err = stream.Recv(); err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var fp bytes.Buffer
+	if err = generateLocked(stream.Context(), spool, &fp, cfg); err != nil {
+		return err
+	}
+	return stream.SendAndClose(&deltapb.Fingerprint{Data: fp.Bytes()})
+}
+
+func (s *grpcServer) ComputeDelta(req *deltapb.DeltaRequest, stream grpc.ServerStreamingServer[deltapb.BlockOperation]) (err error) {
+	start := time.Now()
+	defer func() { appMetrics.observe("diff", start, err) }()
+
+	path, err := s.path(req.File)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	defer f.Close()
+	spool, err := newSpool()
+	if err != nil {
+		return err
+	}
+	defer removeSpool(spool)
+	if err = s.diffLocked(stream.Context(), req.Fingerprint, f, spool); err != nil {
+		return err
+	}
+	// The operations are sent after gsyncMu was released, so a slow
+	// client does not hold up the other requests.
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	recv := spooledOperations(spool)
+	for {
+		o, err := recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(o); err != nil {
+			return err
+		}
+	}
+}
+
+// diffLocked writes the operations turning the file fp was generated from
+// into in to spool, followed by the datahash of in, holding gsyncMu.
+func (s *grpcServer) diffLocked(ctx context.Context, fp []byte, in io.Reader, spool io.Writer) error {
+	// gsync reads gsync.BlockSize until the last operation is read.
+	gsyncMu.Lock()
+	defer gsyncMu.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ops, datahash, err := syncOperations(ctx, s.cfg, bytes.NewReader(fp), in)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	defer stopOperations(cancel, ops)
+	w := bufio.NewWriter(spool)
+	for o := range ops {
+		if o.Error != nil {
+			return o.Error
+		}
+		if _, err = protodelim.MarshalTo(w, &deltapb.BlockOperation{Index: o.Index, Data: o.Data}); err != nil {
+			return err
+		}
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	if _, err = protodelim.MarshalTo(w, &deltapb.BlockOperation{Datahash: datahash.Sum(nil)}); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (s *grpcServer) ApplyPatch(stream grpc.ClientStreamingServer[deltapb.BlockOperation, deltapb.ApplyResult]) (err error) {
+	start := time.Now()
+	defer func() { appMetrics.observe("patch", start, err) }()
+
+	// The first message names the file and carries no operation.
+	header, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	path, err := s.path(header.File)
+	if err != nil {
+		return err
+	}
+	blockSize := s.cfg.BlockSize
+	if header.BlockSize != 0 {
+		if err = delta.CheckBlockSize(int(header.BlockSize)); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		blockSize = int(header.BlockSize)
+	}
+	// The operations are received before the patch takes gsyncMu, so a
+	// slow client does not hold up the other requests.
+	spool, err := newSpool()
+	if err != nil {
+		return err
+	}
+	defer removeSpool(spool)
+	if err = spoolOperations(spool, stream.Recv); err != nil {
+		return err
+	}
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	unlock := lockFile(path)
+	defer unlock()
+	src, err := os.Open(path)
+	if err != nil {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	defer src.Close()
+	out, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+	defer out.Abort()
+	size, datahash, err := applyOperationsLocked(stream.Context(), out.File, src, blockSize, spooledOperations(spool))
+	if errors.Is(err, delta.ErrPatchMismatch) {
+		return status.Error(codes.DataLoss, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if err = out.Commit(); err != nil {
+		return err
+	}
+	slog.Info("patch applied", "phase", "patch", "file", path, "size", size)
+	return stream.SendAndClose(&deltapb.ApplyResult{Size: uint64(size), Datahash: datahash})
+}
+
+// applyOperationsLocked runs applyOperations with the block size
+// blockSize holding gsyncMu.
+func applyOperationsLocked(ctx context.Context, dst io.Writer, src io.ReaderAt, blockSize int, recv func() (*deltapb.BlockOperation, error)) (int64, []byte, error) {
+	gsyncMu.Lock()
+	defer gsyncMu.Unlock()
+	gsync.BlockSize = blockSize
+	return applyOperations(ctx, dst, src, recv)
+}
+
+// newSpool creates the temporary file buffering the messages of a stream.
+func newSpool() (*os.File, error) {
+	return os.CreateTemp(*tmpDir, "godelta-grpc")
+}
+
+// removeSpool closes and removes a file created by newSpool.
+func removeSpool(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// spoolOperations writes the operations returned by recv until io.EOF to
+// w as size-delimited messages. It fails once they exceed -max-upload.
+func spoolOperations(w io.Writer, recv func() (*deltapb.BlockOperation, error)) error {
+	bw := bufio.NewWriter(w)
+	var size int64
+	for {
+		o, err := recv()
+		if err == io.EOF {
+			return bw.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		n, err := protodelim.MarshalTo(bw, o)
+		if err != nil {
+			return err
+		}
+		if size += int64(n); uploadLimit > 0 && size > uploadLimit {
+			return status.Errorf(codes.ResourceExhausted, "delta is larger than -max-upload %s", formatSize(uploadLimit))
+		}
+	}
+}
+
+// spooledOperations returns a function reading the operations written by
+// spoolOperations from r, and io.EOF after the last one.
+func spooledOperations(r io.Reader) func() (*deltapb.BlockOperation, error) {
+	br := bufio.NewReader(r)
+	return func() (*deltapb.BlockOperation, error) {
+		o := &deltapb.BlockOperation{}
+		if err := protodelim.UnmarshalFrom(br, o); err != nil {
+			return nil, err
+		}
+		return o, nil
+	}
+}
+
+// syncOperations returns the operations turning the file fp was generated
+// from into in, and the hash receiving the content of in. It sets
+// gsync.BlockSize to the block size of fp, or of cfg if fp records none
+// or with -override-blocksize.
+func syncOperations(ctx context.Context, cfg delta.Config, fp io.Reader, in io.Reader) (<-chan gsync.BlockOperation, hash.Hash, error) {
+	fpReader, err := delta.NewFingerprintReader(fp)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", delta.ErrFingerprintCorrupt, err)
+	}
+	if fpReader.Chunking != delta.ChunkFixed {
+		return nil, nil, errors.New("chunked fingerprints are not supported over gRPC")
+	}
+	if fpReader.WeakHash != delta.WeakGsync {
+		return nil, nil, fmt.Errorf("fingerprints with %s weak hashes are not supported over gRPC, which diffs with the gsync checksum", fpReader.WeakHash)
+	}
+	strong, err := fpReader.Hash.New()
+	if err != nil {
+		return nil, nil, err
+	}
+	blockSize := fpReader.BlockSize
+	if blockSize == 0 || cfg.OverrideBlockSize {
+		blockSize = cfg.BlockSize
+	}
+	if err = delta.CheckBlockSize(blockSize); err != nil {
+		return nil, nil, err
+	}
+	gsync.BlockSize = blockSize
+	sigs := make(chan gsync.BlockSignature)
+	go func() {
+		defer close(sigs)
+		for {
+			b, err := fpReader.Next()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				b.Error = err
+			}
+			select {
+			case sigs <- b:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	table, err := gsync.LookUpTable(ctx, sigs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", delta.ErrFingerprintCorrupt, err)
+	}
+	datahash := sha256.New()
+	ops, err := gsync.Sync(ctx, in, strong, datahash, table)
+	return ops, datahash, err
+}
+
+// stopOperations cancels the sync sending ops and drains them, so its
+// goroutines end when the operations are not all read. It waits for
+// them, they read gsync.BlockSize until they end.
+func stopOperations(cancel context.CancelFunc, ops <-chan gsync.BlockOperation) {
+	cancel()
+	for range ops {
+	}
+}
+
+// applyOperations writes the result of the operations returned by recv
+// until io.EOF to dst. It returns the written size and hash, and
+// delta.ErrPatchMismatch if the stream ended with another datahash.
+func applyOperations(ctx context.Context, dst io.Writer, src io.ReaderAt, recv func() (*deltapb.BlockOperation, error)) (int64, []byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var expected []byte
+	ops := make(chan gsync.BlockOperation)
+	go func() {
+		defer close(ops)
+		for {
+			o, err := recv()
+			if err == io.EOF {
+				return
+			}
+			op := gsync.BlockOperation{Error: err}
+			if err == nil {
+				if o.Datahash != nil {
+					expected = o.Datahash
+					continue
+				}
+				op = gsync.BlockOperation{Index: o.Index, Data: o.Data}
+			}
+			select {
+			case ops <- op:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	written := &byteCounter{}
+	datahash := sha256.New()
+	if err := gsync.Apply(ctx, io.MultiWriter(dst, written), src, datahash, ops); err != nil {
+		return 0, nil, err
+	}
+	// the receiver closes ops without an error when ctx is done, and a
+	// stream cut short never gets to the datahash
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	if expected == nil {
+		return 0, nil, fmt.Errorf("%w: stream ended without a datahash", delta.ErrDeltaCorrupt)
+	}
+	actual := datahash.Sum(nil)
+	if !bytes.Equal(expected, actual) {
+		return 0, nil, fmt.Errorf("%w: expected %x, got %x", delta.ErrPatchMismatch, expected, actual)
+	}
+	return written.n, actual, nil
+}
+
+// runGRPCClient calls the rpc of the DeltaService at addr:
+//
+//   - fingerprint sends the -file and saves its fingerprint
+//   - delta sends the fingerprint of -file and rebuilds the remote file
+//     in -out
+//   - apply sends the delta turning the remote file, whose fingerprint is
+//     -fp, into -in
+func runGRPCClient(ctx context.Context, cfg delta.Config, addr, rpc, name string) error {
+	// A new connection is made for every operation, so limiting it limits
+	// the operation.
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return limitConn(conn), nil
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithContextDialer(dial))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := deltapb.NewDeltaServiceClient(conn)
+	if name == "" {
+		name = filepath.Base(*sourcefilePath)
+	}
+	switch rpc {
+	case "fingerprint":
+		return grpcFingerprint(ctx, client, cfg)
+	case "delta":
+		return grpcDelta(ctx, client, cfg, name)
+	case "apply":
+		return grpcApply(ctx, client, cfg, name)
+	}
+	return fmt.Errorf("unknown rpc %q, must be fingerprint, delta or apply", rpc)
+}
+
+func grpcFingerprint(ctx context.Context, client deltapb.DeltaServiceClient, cfg delta.Config) error {
+	in, err := os.Open(*sourcefilePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	stream, err := client.GenerateFingerprint(ctx)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, grpcChunkSize)
+	chunk := &deltapb.FileChunk{BlockSize: uint32(cfg.BlockSize)}
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			chunk.Data = buf[:n]
+			if err := stream.Send(chunk); err != nil {
+				return err
+			}
+			chunk = &deltapb.FileChunk{}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fp, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	out, err := createAtomic(fingerprintPath())
+	if err != nil {
+		return err
+	}
+	defer out.Abort()
+	if _, err = out.Write(fp.Data); err != nil {
+		return err
+	}
+	return out.Commit()
+}
+
+func grpcDelta(ctx context.Context, client deltapb.DeltaServiceClient, cfg delta.Config, name string) error {
+	src, err := os.Open(*sourcefilePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	cfg.Format = delta.FormatGob
+	var fp bytes.Buffer
+	if err = delta.GenerateFingerprint(ctx, src, &fp, delta.WithConfig(cfg)); err != nil {
+		return err
+	}
+	stream, err := client.ComputeDelta(ctx, &deltapb.DeltaRequest{File: name, Fingerprint: fp.Bytes()})
+	if err != nil {
+		return err
+	}
+	gsync.BlockSize = cfg.BlockSize
+	out, err := createAtomic(*outfilePath)
+	if err != nil {
+		return err
+	}
+	defer out.Abort()
+	size, datahash, err := applyOperations(ctx, out.File, src, stream.Recv)
+	if err != nil {
+		return err
+	}
+	slog.Info("remote file rebuilt", "file", *outfilePath, "size", size, "datahash", fmt.Sprintf("%x", datahash))
+	return out.Commit()
+}
+
+func grpcApply(ctx context.Context, client deltapb.DeltaServiceClient, cfg delta.Config, name string) error {
+	fp, err := os.Open(fingerprintPath())
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	in, err := os.Open(*infilePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ops, datahash, err := syncOperations(ctx, cfg, fp, in)
+	if err != nil {
+		return err
+	}
+	defer stopOperations(cancel, ops)
+	stream, err := client.ApplyPatch(ctx)
+	if err != nil {
+		return err
+	}
+	if err = stream.Send(&deltapb.BlockOperation{File: name, BlockSize: uint32(gsync.BlockSize)}); err != nil {
+		return err
+	}
+	for o := range ops {
+		if o.Error != nil {
+			return o.Error
+		}
+		if err = stream.Send(&deltapb.BlockOperation{Index: o.Index, Data: o.Data}); err != nil {
+			return err
+		}
+	}
+	if err = stream.Send(&deltapb.BlockOperation{Datahash: datahash.Sum(nil)}); err != nil {
+		return err
+	}
+	result, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	slog.Info("remote file patched", "file", name, "size", result.Size, "datahash", fmt.Sprintf("%x", result.Datahash))
+	return nil
+}
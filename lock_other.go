@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func lockSource(path string) (func(), error) {
+	return nil, errors.New("-lock-source is only supported on unix")
+}
@@ -1,413 +1,1766 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/sha256"
-	"crypto/rand"
-	"encoding/gob"
+	"crypto/tls"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
-	"github.com/Elbandi/gsync"
-	"gopkg.in/cheggaaa/pb.v1"
+
+	"github.com/Elbandi/godelta/delta"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/term"
+)
+
+var (
+	sourcefilePath = flag.String("file", "", "File path for base file, REQUIRED ")
+	infilePath     = flag.String("in", "", "File path for input file")
+	outfilePath    = flag.String("out", "", "File path for output file")
+	progress       = flag.Bool("progress", false, "Show progress bar")
+	timeout        = flag.Duration("timeout", 0, "Cancel the operation if it runs longer than this, e.g. 30m, and exit with code 6; 0 means no limit")
+	timeoutFpgen   = flag.Duration("timeout-fpgen", 0, "fpgen, diff: like -timeout for the fingerprint generation alone, -timeout still limits the whole operation")
+	timeoutDiff    = flag.Duration("timeout-diff", 0, "diff: like -timeout for the diff alone, not counting the fingerprint generation")
+	timeoutPatch   = flag.Duration("timeout-patch", 0, "patch: like -timeout for the patch alone")
+	progressRate   = flag.Duration("progress-interval", time.Second, "Refresh interval of the progress bar")
+	noColor        = flag.Bool("no-color", false, "Do not color the progress bar")
+	debug          = flag.Bool("debug", false, "debug mode")
+	logFormat      = flag.String("log-format", "text", "Log format: text or json")
+	blockSize      = flag.Int("blocksize", 6*1024, "Block Size, default block size is 6KB")
+	newBlockSize   = flag.Int("newblocksize", 0, "optimize: Block size of the rewritten fingerprint")
+	verifyBlocks   = flag.Bool("verify-blocks", false, "patch: verify every base file block against the fingerprint")
+	statsFile      = flag.String("output-stats-file", "", "diff: write the block counts, sizes, duration, datahash and block size of the diff to this file as JSON")
+	deltaHashFile  = flag.String("delta-hash-file", "", "diff: write the SHA-256 of the -out file to this file in sha256sum format, for checking the delta with sha256sum -c before patching")
+	optimizeOrder  = flag.Bool("optimize-order", false, "diff: sort the block references by source position and write the operation index to the -out file with .index suffix, patching then requires -use-index")
+	useIndex       = flag.Bool("use-index", false, "patch: apply a delta written with -optimize-order, reading the source sequentially with the -in file with .index suffix and holding the output in memory")
+	keepMeta       = flag.Bool("preserve-meta", false, "patch: copy the permissions and access and modification times of the base file to the -out file")
+	keepOwner      = flag.Bool("preserve-owner", false, "patch: copy the owner and group of the base file to the -out file, Linux only, requires root")
+	keepXattrs     = flag.Bool("preserve-xattr", false, "patch: copy the extended attributes of the base file to the -out file, Linux only")
+	sparse         = flag.Bool("sparse", false, "patch: leave holes for blocks of zeros in the -out file")
+	useMmap        = flag.Bool("mmap", false, "patch: memory map base files larger than 100MB")
+	dryRun         = flag.Bool("dry-run", false, "diff: compute the delta without writing it and print its estimated size and savings, -json prints them as JSON")
+	force          = flag.Bool("force", false, "diff: continue when the source file changed since its fingerprint was generated")
+	adaptiveBlock  = flag.Bool("adaptive-blocksize", false, "diff: try halving -blocksize while over 80% of -in are literals, or doubling it while under 5% are, up to 3 times, and diff with an in-memory fingerprint")
+	autoBlock      = flag.Bool("auto-blocksize", false, "fpgen: use the base file size / 65536 as block size, at least 1KB and at most 64MB, unless -blocksize is set. About 65536 blocks keep the fingerprint and the lookup table small for large files, while larger blocks match fewer of the changed regions and make larger deltas")
+	estimateFirst  = flag.Bool("estimate-first", false, "diff: estimate the delta size from the weak checksums alone first and ask before the full diff, requires -in and a fingerprint file")
+	assumeYes      = flag.Bool("yes", false, "diff: continue after -estimate-first without asking")
+	noFingerprint  = flag.Bool("no-fingerprint", false, "diff: generate the fingerprint of -file in memory instead of reading or writing the fingerprint file, requires -in")
+	overrideBlock  = flag.Bool("override-blocksize", false, "Use -blocksize even if the fingerprint or delta records another block size")
+	cryptKey       = flag.String("key", "", "Use this key to encrypt/decrypt")
+	fpFormat       = flag.String("format", "gob", "File format: gob, json (fingerprint only), msgpack, librsync, vcdiff (delta only), zsync (fingerprint only), compact (fingerprint only) or proto")
+	compress       = flag.String("compress", "none", "Delta compression: none, gzip, zstd or lz4")
+	encodeBufFlag  = flag.String("encode-buffer", "", "fpgen, diff: buffer fingerprint writes and reads in this many bytes, e.g. 4MB, for high latency storage like NFS")
+	compactFp      = flag.Bool("compact-fp", false, "fpgen: write the fingerprint as 20 byte binary records with 8 byte strong hashes, same as -format compact")
+	litCompress    = flag.String("literal-compression", "none", "diff: Compress the data of every literal of the delta on its own where it gets smaller: none, gzip, zstd or lz4, unlike -compress the operations stay readable one by one")
+	compressFp     = flag.String("compress-fp", "none", "Fingerprint compression: none, gzip, zstd or lz4")
+	workers        = flag.Int("workers", 1, "Number of workers for fingerprint generation and patch")
+	hashSource     = flag.Bool("hash-source", false, "fpgen: With -workers above 1, also record the SHA-256 of -file in the fingerprint, read by a single worker, which diff needs to detect a modified source and updatefp to extend the fingerprint")
+	chunking       = flag.String("chunking", "fixed", "fpgen: Block boundaries: fixed or cdc (content-defined, -blocksize is the average)")
+	hashName       = flag.String("hash", "", "Strong hash: sha256, sha512, md5 or blake2b, default is sha256 or the one stored in the fingerprint")
+	weakHash       = flag.String("weak-hash", "", "Rolling weak checksum of fixed size blocks: gsync, adler32 or crc32, default is gsync or the one stored in the fingerprint, not supported by grpc-serve")
+	fpPath         = flag.String("fp", "", "File path for fingerprint file, default is the base file with .fingerprint suffix")
+	countOnly      = flag.Bool("count", false, "info: print only the number of blocks")
+	inspectLimit   = flag.Int64("limit", 0, "inspect: print at most this many operations, 0 prints all")
+	inspectSkip    = flag.Int64("skip", 0, "inspect: start printing at this operation")
+	jsonOutput     = flag.Bool("json", false, "info, inspect, stats, check, diff -dry-run: print JSON output")
+	delta1Path     = flag.String("delta1", "", "compose: File path for the delta from the base file to the intermediate file")
+	delta2Path     = flag.String("delta2", "", "compose: File path for the delta from the intermediate file to the new file")
+	fp1Path        = flag.String("fp1", "", "merge-fp: File path for the fingerprint of the first part")
+	fp2Path        = flag.String("fp2", "", "merge-fp: File path for the fingerprint of the part appended to it, the first part must be a multiple of the block size")
+	basePath       = flag.String("base", "", "diff3: File path for the common ancestor of -a and -b")
+	branchA        = flag.String("a", "", "diff3: File path for the first changed version of -base")
+	branchB        = flag.String("b", "", "diff3: File path for the second changed version of -base")
+	conflictMap    = flag.String("conflict-map", "", "diff3: Write the blocks changed in both -a and -b to this JSON file")
+	manifestPath   = flag.String("manifest", "", "batch: File path for the manifest of source, new file and delta paths separated by tabs, join: File path for the manifest written by split")
+	overwrite      = flag.Bool("overwrite", false, "diff, patch: Replace an existing non-empty -out file")
+	interactive    = flag.Bool("interactive", false, "diff, patch: Ask on the terminal before replacing an existing non-empty -out file")
+	parallel       = flag.Int("parallel", 1, "batch: Number of manifest entries processed at the same time")
+	batchRetries   = flag.Int("retry", 0, "batch: Retry an entry failing with a transient error, like an I/O error or a timeout, up to this many times")
+	retryDelay     = flag.Duration("retry-delay", 5*time.Second, "batch: Wait before the first retry of an entry, doubled before each following one")
+	debounce       = flag.Duration("debounce", 500*time.Millisecond, "watch: Wait this long after the last change before making a new delta")
+	benchSize      = flag.String("size", "100MB", "benchmark: Size of the generated source file, split: Maximum size of a part")
+	splitPrefix    = flag.String("prefix", "part_", "split: Write the parts to files with this prefix and the manifest to prefixmanifest.json")
+	benchMutate    = flag.String("mutate", "5%", "benchmark: Share of the blocks replaced with random data")
+	otelEndpoint   = flag.String("otel-endpoint", "", "Export OpenTelemetry traces to the OTLP gRPC collector at this address")
+	metricsAddr    = flag.String("metrics-addr", "", "Expose Prometheus metrics on this address, e.g. :9090")
+	lockSrc        = flag.Bool("lock-source", false, "fpgen, diff, watch: Hold an exclusive flock on the -file base file from before its fingerprint is generated or hashed until the fingerprint or delta is written, unix only")
+	tmpDir         = flag.String("tmpdir", "", "Create temporary files in this directory instead of the system default, atomic outputs are written there too and renamed without a copy if it is on the same file system as the output")
+	profileKind    = flag.String("profile", "", "Write a profile of the operation to the working directory if it succeeds: cpu (cpu.pprof), mem (mem.pprof) or trace (trace.out, for go tool trace)")
+	pprofAddr      = flag.String("pprof-addr", "", "Serve net/http/pprof profiles under /debug/pprof/ on this address while the operation runs, e.g. :6060")
+	showVersion    = flag.Bool("version", false, "Print version information and exit")
+	configPath     = flag.String("config", "", "Read flag values from this TOML file, see the config file keys below")
+	chainPaths     = flag.String("deltas", "", "chain: Comma separated file paths of the deltas to apply in order")
+	copyThreshold  = flag.String("copy-threshold", "", "diff: write an -in file smaller than this many bytes, e.g. 1MB, whole into the delta without a fingerprint, when diffing costs more than it saves")
+	maxDeltaSize   = flag.String("max-delta-size", "", "diff: abort with exit code 8 and remove the -out file as soon as the delta grows past this many bytes, e.g. 50MB, e.g. for a wrong base file or encrypted input")
+	maxLiteral     = flag.Float64("reject-large-literal-ratio", 1.0, "diff: fail with exit code 8 without writing the delta if a larger share of the new file than this, 0.0 to 1.0, are literals, e.g. for a wrong base file")
+	deviceSize     = flag.String("device-size", "", "fpgen, diff: size of a block device -file, e.g. 20GB, whose stat reports 0, detected with the BLKGETSIZE64 ioctl on Linux when not set")
+	maxDevSize     = flag.String("max-device-size", "10TB", "fpgen, diff: refuse a block device -file of a larger detected or -device-size size")
+	stdinSize      = flag.String("stdin-size", "", "diff: expected size of the new file read from stdin without -in, e.g. 2GB, for the progress bar of a pipe")
+	maxMemory      = flag.String("max-memory", "", "diff: Move the fingerprint lookup table to a temporary file once its estimated size exceeds this many bytes, e.g. 256MB")
+	pipelineDiff   = flag.Bool("pipeline", false, "diff: Start comparing -in while the fingerprint is still loading, the delta may hold more literals")
+	embedSrcHashes = flag.Bool("embed-source-hashes", false, "diff: Store the strong hash of the source block in every reference")
+	fromVersion    = flag.String("from-version", "", "diff, compose: Record this version of the base file in the delta header, up to 256 bytes")
+	toVersion      = flag.String("to-version", "", "diff, compose: Record this version of the new file in the delta header, up to 256 bytes")
+	expectFromVer  = flag.String("expect-from-version", "", "patch: Refuse a delta not recording this version of the base file with -from-version")
+	targetHash     = flag.String("target-hash", "", "patch: skip the patch with \"Already up to date\" if the -out file exists with this hex SHA-256")
+	hashFromDelta  = flag.Bool("target-hash-from-delta", false, "patch: like -target-hash with the datahash of the -in delta")
+	verifyAfter    = flag.Bool("verify-after-patch", false, "patch: re-read the -out file once written and compare its SHA-256 with the datahash of the delta before it replaces -out, a mismatch leaves -out untouched and exits with code 5")
+	verifySource   = flag.Bool("verify-source", false, "patch: Compare the SHA-256 of the -file base file with the one recorded in the delta before applying it")
+	verifySrcHash  = flag.Bool("verify-source-hashes", false, "patch: Check every source block against the hash embedded with -embed-source-hashes before using it")
+	chainMemory    = flag.String("chain-memory", "256MB", "chain: Keep intermediate versions up to this size in memory, in temporary files beyond")
+	zsyncURL       = flag.String("url", "", "fpgen: URL recorded in zsync fingerprints (default: the source file name)")
+	merkle         = flag.Bool("merkle", false, "diff: store a Merkle tree over the delta operations")
+	merkleVerify   = flag.Bool("merkle-verify", false, "patch: verify every operation against the Merkle tree of the delta")
+	signKeyHex     = flag.String("sign-key", "", "fpgen, diff: sign the output with this hex encoded 32 byte HMAC-SHA256 key, reading it then requires -verify-key")
+	signPassword   = flag.String("sign-password", "", "fpgen, diff: sign the output with a key derived from this password")
+	verifyKeyHex   = flag.String("verify-key", "", "diff, patch: verify the signature of the input with this hex encoded key")
+	verifyPassword = flag.String("verify-password", "", "diff, patch: verify the signature of the input with a key derived from this password")
+	encryptKeyHex  = flag.String("encrypt-key", "", "diff: encrypt the delta with this hex encoded 32 byte AES-256-GCM key")
+	decryptKeyHex  = flag.String("decrypt-key", "", "patch: decrypt the delta with this hex encoded AES-256-GCM key")
+	encryptPass    = flag.String("encrypt-password", "", "diff, patch: encrypt or decrypt the delta with AES-256-GCM, the key derived from this password")
+	remoteSource   = flag.String("remote-source", "", "diff: generate the fingerprint of this base file over SSH, user@host:/path")
+	remoteGodelta  = flag.String("remote-godelta", "godelta", "diff: godelta command on the -remote-source host")
+	serveAddr      = flag.String("addr", ":8080", "serve: Listen on this address, grpc-serve: :50051 by default, grpc-client: connect to this address, localhost:50051 by default")
+	serveRoot      = flag.String("root", "", "serve: Serve the files below this directory")
+	fpCacheSize    = flag.Int("cache-size", 100, "serve: Keep the fingerprints of this many files, block sizes and formats in memory while the files are unchanged, 0 disables the cache")
+	maxUpload      = flag.String("max-upload", "1GB", "serve, grpc-serve: Refuse a delta sent to be applied, or a file sent to grpc-serve to be fingerprinted, that is larger than this many bytes, 0 for no limit")
+	checkpointOps  = flag.Int("checkpoint-every", 0, "patch: write a checkpoint to the -out file with .checkpoint suffix after every N operations, the output is written to .partial until done")
+	resume         = flag.Bool("resume", false, "patch: continue an interrupted -checkpoint-every patch from its last checkpoint")
+	tlsCert        = flag.String("tls-cert", "", "serve: Serve HTTPS with the PEM certificate in this file")
+	tlsKey         = flag.String("tls-key", "", "serve: PEM private key of -tls-cert")
+	tlsCA          = flag.String("tls-ca", "", "serve: Require client certificates signed by the PEM CA certificates in this file")
+	generateTLS    = flag.Bool("generate-cert", false, "serve: Write a self-signed certificate to -tls-cert and its key to -tls-key and exit")
+	ioRetries      = flag.Int("io-retries", 3, "fpgen, diff, patch: retry failed reads of the input files with transient errors like EINTR, EAGAIN or a timeout of a network file system up to this many times")
+	ioRetryDelay   = flag.Duration("io-retry-delay", 100*time.Millisecond, "fpgen, diff, patch: wait this long before the first retry of a read with a temporary error, doubled for every further retry")
+	rateLimitFlag  = flag.String("rate-limit", "", "Limit network transfers to this many bytes per second, e.g. 10MB: per connection and direction for serve and grpc-serve, per operation for diff -remote-source and grpc-client")
+	grpcRPC        = flag.String("rpc", "delta", "grpc-client: RPC to call: fingerprint, delta (rebuild the remote file in -out) or apply (send the delta from -fp to -in)")
+	remoteFile     = flag.String("remote-file", "", "grpc-client: Name of the file below the server root, default is the base name of -file")
+	verifyReverse  = flag.Bool("verify-reverse", false, "reverse: check that the reverse delta rebuilds the base file")
 )
 
-const (
-	minKeyLength = 10;
-)
+func config() (delta.Config, error) {
+	format, err := delta.ParseFormat(*fpFormat)
+	if err != nil {
+		return delta.Config{}, err
+	}
+	if *compactFp {
+		format = delta.FormatCompact
+	}
+	compression, err := delta.ParseCompression(*compress)
+	if err != nil {
+		return delta.Config{}, err
+	}
+	fpCompression, err := delta.ParseCompression(*compressFp)
+	if err != nil {
+		return delta.Config{}, err
+	}
+	literalCompression, err := delta.ParseCompression(*litCompress)
+	if err != nil {
+		return delta.Config{}, err
+	}
+	hashAlg, err := delta.ParseHashAlgorithm(*hashName)
+	if err != nil {
+		return delta.Config{}, err
+	}
+	weak, err := delta.ParseWeakHash(*weakHash)
+	if err != nil {
+		return delta.Config{}, err
+	}
+	chunkMode, err := delta.ParseChunking(*chunking)
+	if err != nil {
+		return delta.Config{}, err
+	}
+	var memLimit int64
+	if *maxMemory != "" {
+		if memLimit, err = parseSize(*maxMemory); err != nil {
+			return delta.Config{}, fmt.Errorf("invalid -max-memory: %v", err)
+		}
+	}
+	var copyLimit int64
+	if *copyThreshold != "" {
+		if copyLimit, err = parseSize(*copyThreshold); err != nil {
+			return delta.Config{}, fmt.Errorf("invalid -copy-threshold: %v", err)
+		}
+	}
+	var inputSize int64
+	if *stdinSize != "" && *infilePath == "" {
+		if inputSize, err = parseSize(*stdinSize); err != nil {
+			return delta.Config{}, fmt.Errorf("invalid -stdin-size: %v", err)
+		}
+	}
+	var encryptKey []byte
+	for _, s := range []string{*encryptKeyHex, *decryptKeyHex} {
+		if s == "" {
+			continue
+		}
+		if encryptKey, err = hex.DecodeString(s); err != nil {
+			return delta.Config{}, fmt.Errorf("invalid encryption key: %v", err)
+		}
+	}
+	return delta.Config{
+		BlockSize:              *blockSize,
+		OverrideBlockSize:      *overrideBlock,
+		Force:                  *force,
+		Key:                    *cryptKey,
+		EncryptKey:             encryptKey,
+		EncryptPassword:        *encryptPass,
+		Format:                 format,
+		Compression:            compression,
+		FingerprintCompression: fpCompression,
+		LiteralCompression:     literalCompression,
+		Chunking:               chunkMode,
+		Hash:                   hashAlg,
+		WeakHash:               weak,
+		Workers:                *workers,
+		HashSource:             *hashSource,
+		URL:                    *zsyncURL,
+		Merkle:                 *merkle || *merkleVerify,
+		MaxMemory:              memLimit,
+		InputSize:              inputSize,
+		CopyThreshold:          copyLimit,
+		Pipeline:               *pipelineDiff,
+		EmbedSourceHashes:      *embedSrcHashes,
+		VerifySourceHashes:     *verifySrcHash,
+		TempDir:                *tmpDir,
+		FromVersion:            *fromVersion,
+		ToVersion:              *toVersion,
+		ExpectFromVersion:      *expectFromVer,
+	}, nil
+}
+
+func fingerprintPath() string {
+	if *fpPath != "" {
+		return *fpPath
+	}
+	if *fpFormat == string(delta.FormatZsync) {
+		return *sourcefilePath + ".zsync"
+	}
+	return *sourcefilePath + ".fingerprint"
+}
+
+func generateFingerprint(ctx context.Context, cfg delta.Config) (err error) {
+	ctx, span := tracer.Start(ctx, "generateFingerprint")
+	defer func() { endSpan(span, err) }()
+
+	srcFile, err := openSource(ctx, *sourcefilePath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	if cfg.SourceSize, err = sourceSize(srcFile); err != nil {
+		return err
+	}
+	applyAutoBlockSize(&cfg, srcFile)
+	if cfg.URL == "" {
+		cfg.URL = filepath.Base(*sourcefilePath)
+	}
+	if fingerprintPath() == "-" {
+		out, finish := signStdout()
+		if err = delta.GenerateFingerprint(ctx, retryFile{srcFile}, out, delta.WithConfig(cfg)); err != nil {
+			return err
+		}
+		return finish()
+	}
+
+	fpFile, err := createAtomic(fingerprintPath())
+	if err != nil {
+		return err
+	}
+	defer fpFile.Abort()
+
+	slog.Debug("create fingerprint", "phase", "fpgen", "file", *sourcefilePath)
+	out, flush := bufferedWriter(fpFile)
+	if err = delta.GenerateFingerprint(ctx, retryFile{srcFile}, out, delta.WithConfig(cfg)); err != nil {
+		return err
+	}
+	if err = flush(); err != nil {
+		return err
+	}
+	if err = signFile(fpFile.File); err != nil {
+		return err
+	}
+	return fpFile.Commit()
+}
+
+// updateFingerprint extends the fingerprint of the -file with the blocks
+// appended to it since.
+func updateFingerprint(ctx context.Context, cfg delta.Config) (err error) {
+	ctx, span := tracer.Start(ctx, "updateFingerprint")
+	defer func() { endSpan(span, err) }()
+
+	srcFile, err := openSource(ctx, *sourcefilePath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	size, err := sourceSize(srcFile)
+	if err != nil {
+		return err
+	}
+
+	oldFile, err := os.Open(fingerprintPath())
+	if err != nil {
+		return err
+	}
+	defer oldFile.Close()
+	old, err := verifiedInput(oldFile)
+	if err != nil {
+		return fmt.Errorf("%s: %w", oldFile.Name(), err)
+	}
+
+	fpFile, err := createAtomic(fingerprintPath())
+	if err != nil {
+		return err
+	}
+	defer fpFile.Abort()
+	slog.Debug("update fingerprint", "phase", "fpgen", "file", *sourcefilePath)
+	if err = delta.UpdateFingerprint(ctx, old, srcFile, size, fpFile, delta.WithConfig(cfg)); err != nil {
+		return err
+	}
+	if err = signFile(fpFile.File); err != nil {
+		return err
+	}
+	return fpFile.Commit()
+}
+
+// optimizeFingerprint rewrites the fingerprint read from -in, or the
+// default fingerprint path, with the block size -newblocksize into -out,
+// which defaults to the fingerprint it read.
+func optimizeFingerprint(ctx context.Context, cfg delta.Config) (err error) {
+	ctx, span := tracer.Start(ctx, "optimizeFingerprint")
+	defer func() { endSpan(span, err) }()
+
+	if err := delta.CheckBlockSize(*newBlockSize); err != nil {
+		return fmt.Errorf("-newblocksize: %w", err)
+	}
+	in := *infilePath
+	if in == "" {
+		in = fingerprintPath()
+	}
+	out := *outfilePath
+	if out == "" {
+		out = in
+	}
+
+	srcFile, err := openSource(ctx, *sourcefilePath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	oldFile, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer oldFile.Close()
+	old, err := verifiedInput(oldFile)
+	if err != nil {
+		return fmt.Errorf("%s: %w", in, err)
+	}
+
+	fpFile, err := createAtomic(out)
+	if err != nil {
+		return err
+	}
+	defer fpFile.Abort()
+	slog.Debug("resize fingerprint", "phase", "fpgen", "file", *sourcefilePath, "blocksize", *newBlockSize)
+	if err = delta.ResizeFingerprint(ctx, old, srcFile, fpFile, *newBlockSize, delta.WithConfig(cfg)); err != nil {
+		return err
+	}
+	if err = signFile(fpFile.File); err != nil {
+		return err
+	}
+	return fpFile.Commit()
+}
+
+// openSource opens the source file at path in a traced span.
+func openSource(ctx context.Context, path string) (f *os.File, err error) {
+	_, span := tracer.Start(ctx, "open source file", trace.WithAttributes(attribute.String("godelta.file", path)))
+	defer func() { endSpan(span, err) }()
+
+	f, err = os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err == nil {
+		span.SetAttributes(attribute.Int64("godelta.file_size", fi.Size()))
+	}
+	return f, nil
+}
+
+// commitOutput commits f in a traced span. f is nil when the output is
+// written to stdout.
+func commitOutput(ctx context.Context, f *atomicFile) (err error) {
+	if f == nil {
+		return nil
+	}
+	_, span := tracer.Start(ctx, "write output", trace.WithAttributes(attribute.String("godelta.file", f.path)))
+	defer func() { endSpan(span, err) }()
+
+	return f.Commit()
+}
+
+// hashFile returns the SHA-256 of the file at path.
+func hashFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// errDiffDeclined is returned when the user declines the diff after the
+// -estimate-first estimate.
+var errDiffDeclined = errors.New("diff cancelled after the estimate")
+
+// estimateFirstPass prints the delta size estimated from the weak
+// checksums of the fingerprint and, without -yes, asks whether to go on
+// with the diff.
+func estimateFirstPass(ctx context.Context, cfg delta.Config) error {
+	if *infilePath == "" || *remoteSource != "" || *adaptiveBlock || *noFingerprint || copiesWhole(cfg) {
+		return errors.New("-estimate-first requires -in and a fingerprint file")
+	}
+	fpFile, err := os.Open(fingerprintPath())
+	if err != nil {
+		return err
+	}
+	defer fpFile.Close()
+	fp, err := verifiedInput(retryFile{fpFile})
+	if err != nil {
+		return fmt.Errorf("%s: %w", fpFile.Name(), err)
+	}
+	inFile, err := os.Open(*infilePath)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+	st, err := delta.EstimateDiff(ctx, bufferedReader(fp), retryFile{inFile}, delta.WithConfig(cfg))
+	if err != nil {
+		return fmt.Errorf("estimate: %w", err)
+	}
+	saved := 0.0
+	if st.NewSize > 0 {
+		saved = 100 * float64(st.NewSize-st.DeltaSize) / float64(st.NewSize)
+	}
+	fmt.Fprintf(os.Stderr, "Estimated delta size: ~%s (%.0f%% saved vs. full copy)\n", formatSize(st.DeltaSize), saved)
+	if *assumeYes {
+		return nil
+	}
+	yes, err := askYes("Continue with the diff?")
+	if err != nil {
+		return fmt.Errorf("%w, use -yes", err)
+	}
+	if !yes {
+		return errDiffDeclined
+	}
+	return nil
+}
+
+// checkLiteralRatio returns errDeltaTooLarge if more than
+// -reject-large-literal-ratio of the new file are literals in the delta
+// described by st.
+func checkLiteralRatio(st delta.DeltaStats) error {
+	if st.NewSize == 0 {
+		return nil
+	}
+	ratio := float64(st.LiteralBytes) / float64(st.NewSize)
+	if ratio > *maxLiteral {
+		return fmt.Errorf("%w: literal ratio %.4f exceeds -reject-large-literal-ratio %g", errDeltaTooLarge, ratio, *maxLiteral)
+	}
+	return nil
+}
+
+// sizeLimitWriter fails the writes that take the delta past limit bytes
+// with errDeltaTooLarge. WriteAt and Seek are passed on to w if it has
+// them, for Merkle trees.
+type sizeLimitWriter struct {
+	w     io.Writer
+	limit int64
+	n     int64
+}
+
+func (lw *sizeLimitWriter) exceeded() error {
+	return fmt.Errorf("%w: delta size exceeded limit of %s", errDeltaTooLarge, formatSize(lw.limit))
+}
+
+func (lw *sizeLimitWriter) Write(p []byte) (int, error) {
+	if lw.n+int64(len(p)) > lw.limit {
+		return 0, lw.exceeded()
+	}
+	n, err := lw.w.Write(p)
+	lw.n += int64(n)
+	return n, err
+}
+
+func (lw *sizeLimitWriter) WriteAt(p []byte, off int64) (int, error) {
+	wa, ok := lw.w.(io.WriterAt)
+	if !ok {
+		return 0, errors.New("delta output does not support WriteAt")
+	}
+	if off+int64(len(p)) > lw.limit {
+		return 0, lw.exceeded()
+	}
+	n, err := wa.WriteAt(p, off)
+	lw.n = max(lw.n, off+int64(n))
+	return n, err
+}
+
+func (lw *sizeLimitWriter) Seek(offset int64, whence int) (int64, error) {
+	s, ok := lw.w.(io.Seeker)
+	if !ok {
+		return 0, errors.New("delta output does not support Seek")
+	}
+	return s.Seek(offset, whence)
+}
+
+// copiesWhole reports whether the -in file is below -copy-threshold, so
+// the diff needs no fingerprint.
+func copiesWhole(cfg delta.Config) bool {
+	if cfg.CopyThreshold <= 0 || *infilePath == "" {
+		return false
+	}
+	fi, err := os.Stat(*infilePath)
+	return err == nil && fi.Mode().IsRegular() && fi.Size() < cfg.CopyThreshold
+}
+
+// memoryFingerprint generates the fingerprint of the -file for
+// -no-fingerprint in memory, the same way fpgen writes it.
+func memoryFingerprint(ctx context.Context, cfg delta.Config) (io.Reader, error) {
+	if *sourcefilePath == "" || *infilePath == "" || *remoteSource != "" {
+		return nil, errors.New("-no-fingerprint requires -in and a local -file")
+	}
+	srcFile, err := openSource(ctx, *sourcefilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer srcFile.Close()
+	if cfg.SourceSize, err = sourceSize(srcFile); err != nil {
+		return nil, err
+	}
+	applyAutoBlockSize(&cfg, srcFile)
+	fp := &bytes.Buffer{}
+	if err = delta.GenerateFingerprint(ctx, retryFile{srcFile}, fp, delta.WithConfig(cfg)); err != nil {
+		return nil, err
+	}
+	return fp, nil
+}
+
+// lockSourceFile takes the -lock-source lock of the -file base file. The
+// caller holds it across generating the fingerprint and writing the delta,
+// as flock(2) locks of one process on separate opens exclude each other.
+func lockSourceFile() (func(), error) {
+	if !*lockSrc {
+		return func() {}, nil
+	}
+	if *sourcefilePath == "" {
+		return nil, fmt.Errorf("-lock-source requires -file")
+	}
+	unlock, err := lockSource(*sourcefilePath)
+	if err != nil {
+		return nil, fmt.Errorf("lock %s: %w", *sourcefilePath, err)
+	}
+	return unlock, nil
+}
+
+func makeDiff(ctx context.Context, cfg delta.Config) (err error) {
+	ctx, span := tracer.Start(ctx, "makeDiff")
+	defer func() { endSpan(span, err) }()
+	start := time.Now()
+
+	if *maxLiteral < 0 || *maxLiteral > 1 {
+		return fmt.Errorf("invalid -reject-large-literal-ratio %g, must be between 0.0 and 1.0", *maxLiteral)
+	}
+	var deltaLimit int64
+	if *maxDeltaSize != "" {
+		if deltaLimit, err = parseSize(*maxDeltaSize); err != nil || deltaLimit == 0 {
+			return fmt.Errorf("invalid -max-delta-size %q", *maxDeltaSize)
+		}
+	}
+	if *estimateFirst {
+		if err = estimateFirstPass(ctx, cfg); err != nil {
+			return err
+		}
+	}
+
+	var fp io.Reader
+	// remoteDone waits for the remote fpgen, whose failure must fail the
+	// diff before the delta is committed.
+	remoteDone := func() error { return nil }
+	if copiesWhole(cfg) {
+		slog.Debug("copy new file whole", "phase", "diff", "file", *infilePath)
+	} else if *adaptiveBlock {
+		if fp, err = adaptiveFingerprint(ctx, &cfg); err != nil {
+			return err
+		}
+	} else if *noFingerprint {
+		if fp, err = memoryFingerprint(ctx, cfg); err != nil {
+			return err
+		}
+	} else if *remoteSource != "" {
+		remote, wait, err := remoteFingerprint(ctx, *remoteSource)
+		if err != nil {
+			return err
+		}
+		waited := false
+		defer func() {
+			if !waited {
+				wait(true)
+			}
+		}()
+		remoteDone = func() error {
+			waited = true
+			return wait(false)
+		}
+		if fp, err = verifiedInput(remote); err != nil {
+			return fmt.Errorf("%s: %w", *remoteSource, err)
+		}
+	} else {
+		fpFile, err := os.Open(fingerprintPath())
+		if err != nil {
+			return err
+		}
+		defer fpFile.Close()
+		if fp, err = verifiedInput(retryFile{fpFile}); err != nil {
+			return fmt.Errorf("%s: %w", fpFile.Name(), err)
+		}
+		fp = bufferedReader(fp)
+	}
+
+	// A fingerprint generated just now has the hash of the source.
+	if *sourcefilePath != "" && !*noFingerprint {
+		if _, err := os.Stat(*sourcefilePath); err == nil {
+			cfg.SourceHash, err = hashFile(*sourcefilePath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	inFile := os.Stdin
+	if *infilePath != "" {
+		inFile, err = os.Open(*infilePath)
+		if err != nil {
+			return err
+		}
+		defer inFile.Close()
+	}
+
+	var diffStats delta.DeltaStats
+	statsFunc := cfg.StatsFunc
+	cfg.StatsFunc = func(phase string, st delta.DeltaStats) {
+		diffStats = st
+		if statsFunc != nil {
+			statsFunc(phase, st)
+		}
+	}
+	out, finish := signStdout()
+	var tmpFile *atomicFile
+	if *dryRun {
+		out, finish = io.Discard, func() error { return nil }
+	} else if *outfilePath != "" {
+		tmpFile, err = createAtomic(*outfilePath)
+		if err != nil {
+			return err
+		}
+		defer tmpFile.Abort()
+		out, finish = tmpFile.File, func() error { return signFile(tmpFile.File) }
+	}
+	if *deltaHashFile != "" && tmpFile == nil {
+		return errors.New("-delta-hash-file requires -out")
+	}
+	var indexFile *atomicFile
+	if *optimizeOrder && !*dryRun {
+		if tmpFile == nil {
+			return errors.New("-optimize-order requires -out")
+		}
+		if indexFile, err = createAtomic(*outfilePath + ".index"); err != nil {
+			return err
+		}
+		defer indexFile.Abort()
+		cfg.IndexOut = indexFile
+	}
+	// The deferred Abort removes the partial delta when the limit is
+	// exceeded, a delta written to stdout is left truncated.
+	if deltaLimit > 0 && !*dryRun {
+		out = &sizeLimitWriter{w: out, limit: deltaLimit}
+	}
+
+	datahash, err := delta.MakeDiff(ctx, fp, retryFile{inFile}, out, delta.WithConfig(cfg))
+	if errors.Is(err, errDeltaTooLarge) {
+		fmt.Fprintf(os.Stderr, "Delta size exceeded limit of %s\n", formatSize(deltaLimit))
+	}
+	if err != nil {
+		return err
+	}
+	if err = remoteDone(); err != nil {
+		return err
+	}
+	if *dryRun {
+		if err = printDryRun(diffStats); err != nil {
+			return err
+		}
+		if err = checkLiteralRatio(diffStats); err != nil {
+			return err
+		}
+		return writeStatsFile(diffStats, datahash, time.Since(start))
+	}
+	if err = checkLiteralRatio(diffStats); err != nil {
+		return err
+	}
+	if err = finish(); err != nil {
+		return err
+	}
+	if indexFile != nil {
+		if err = indexFile.Commit(); err != nil {
+			return err
+		}
+	}
+	if err = commitOutput(ctx, tmpFile); err != nil {
+		return err
+	}
+	if tmpFile == nil {
+		slog.Info("delta written", "phase", "diff", "file", *outfilePath, "datahash", hex.EncodeToString(datahash))
+		return writeStatsFile(diffStats, datahash, time.Since(start))
+	}
+	deltahash, err := hashFile(*outfilePath)
+	if err != nil {
+		return err
+	}
+	slog.Info("delta written", "phase", "diff", "file", *outfilePath, "datahash", hex.EncodeToString(datahash),
+		"deltahash", hex.EncodeToString(deltahash))
+	if *deltaHashFile != "" {
+		if err = writeHashFile(*deltaHashFile, *outfilePath, deltahash); err != nil {
+			return err
+		}
+	}
+	return writeStatsFile(diffStats, datahash, time.Since(start))
+}
+
+// diffStatsReport is the -output-stats-file of diff.
+type diffStatsReport struct {
+	TotalBlocks    int64  `json:"total_blocks"`
+	MatchedBlocks  int64  `json:"matched_blocks"`
+	LiteralBlocks  int64  `json:"literal_blocks"`
+	LiteralBytes   int64  `json:"literal_bytes"`
+	ReferenceBytes int64  `json:"reference_bytes"`
+	SourceSize     int64  `json:"source_size"`
+	NewSize        int64  `json:"new_size"`
+	DeltaSize      int64  `json:"delta_size"`
+	DurationMs     int64  `json:"duration_ms"`
+	Datahash       string `json:"datahash"`
+	BlockSize      int    `json:"blocksize"`
+}
+
+// writeStatsFile writes the stats of a diff to -output-stats-file, if set.
+// The source size is 0 for a -remote-source.
+func writeStatsFile(st delta.DeltaStats, datahash []byte, took time.Duration) error {
+	if *statsFile == "" {
+		return nil
+	}
+	r := diffStatsReport{
+		TotalBlocks:    st.TotalBlocks,
+		MatchedBlocks:  st.ReferenceBlocks,
+		LiteralBlocks:  st.LiteralBlocks,
+		LiteralBytes:   st.LiteralBytes,
+		ReferenceBytes: st.ReferenceBytes,
+		NewSize:        st.NewSize,
+		DeltaSize:      st.DeltaSize,
+		DurationMs:     took.Milliseconds(),
+		Datahash:       hex.EncodeToString(datahash),
+		BlockSize:      st.BlockSize,
+	}
+	if *sourcefilePath != "" && *remoteSource == "" {
+		if fi, err := os.Stat(*sourcefilePath); err == nil {
+			r.SourceSize = fi.Size()
+		}
+	}
+	f, err := createAtomic(*statsFile)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(r); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// writeHashFile writes sum, the SHA-256 of the file at path, to hashPath in
+// the format of sha256sum.
+func writeHashFile(hashPath, path string, sum []byte) error {
+	f, err := createAtomic(hashPath)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	if _, err = fmt.Fprintf(f, "%x  %s\n", sum, path); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+func applyPatch(ctx context.Context, cfg delta.Config) (err error) {
+	ctx, span := tracer.Start(ctx, "applyPatch")
+	defer func() { endSpan(span, err) }()
+
+	if *verifyAfter && *outfilePath == "" {
+		return errors.New("-verify-after-patch requires -out")
+	}
+
+	srcFile, err := openSource(ctx, *sourcefilePath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	if *verifySource {
+		if cfg.SourceHash, err = hashFile(*sourcefilePath); err != nil {
+			return err
+		}
+	}
+
+	if *verifyBlocks {
+		fpFile, err := os.Open(fingerprintPath())
+		if err != nil {
+			return err
+		}
+		defer fpFile.Close()
+		if cfg.VerifyBlocks, err = verifiedInput(retryFile{fpFile}); err != nil {
+			return fmt.Errorf("%s: %w", fpFile.Name(), err)
+		}
+	}
+
+	if *useIndex {
+		if *infilePath == "" {
+			return errors.New("-use-index requires -in")
+		}
+		indexFile, err := os.Open(*infilePath + ".index")
+		if err != nil {
+			return err
+		}
+		defer indexFile.Close()
+		cfg.Index = indexFile
+	}
+
+	var src io.ReaderAt = retryFile{srcFile}
+	if *useMmap {
+		var unmap func() error
+		src, unmap, err = mmapSource(srcFile)
+		if err != nil {
+			return err
+		}
+		defer unmap()
+	}
+
+	inFile := os.Stdin
+	if *infilePath != "" {
+		inFile, err = os.Open(*infilePath)
+		if err != nil {
+			return err
+		}
+		defer inFile.Close()
+	}
+
+	outFile := os.Stdout
+	var tmpFile *atomicFile
+	var partial *partialFile
+	switch {
+	case *checkpointOps > 0 || *resume:
+		if *sparse {
+			return errors.New("-sparse cannot be used with checkpoints")
+		}
+		partial, err = openPartial(*outfilePath, *checkpointOps, *resume, &cfg)
+		if err != nil {
+			return err
+		}
+		defer partial.Close()
+		outFile = partial.File
+	case *outfilePath != "":
+		tmpFile, err = createAtomic(*outfilePath)
+		if err != nil {
+			return err
+		}
+		defer tmpFile.Abort()
+		outFile = tmpFile.File
+	}
+
+	var out io.Writer = outFile
+	var sparseOut *sparseFile
+	if *sparse && tmpFile != nil {
+		sparseOut = &sparseFile{f: tmpFile.File}
+		out = sparseOut
+	}
+
+	in, err := verifiedInput(retryFile{inFile})
+	if err != nil {
+		return fmt.Errorf("delta: %w", err)
+	}
+	expected, datahash, err := delta.ApplyPatchDatahash(ctx, src, in, out, delta.WithConfig(cfg))
+	if err != nil {
+		return err
+	}
+	if sparseOut != nil {
+		if err = sparseOut.Finish(); err != nil {
+			return err
+		}
+	}
+	if *verifyAfter {
+		if err = verifyOutput(outFile, expected); err != nil {
+			return err
+		}
+	}
+	if partial != nil {
+		err = partial.Commit()
+	} else {
+		err = commitOutput(ctx, tmpFile)
+	}
+	if err != nil {
+		return err
+	}
+	if *outfilePath != "" {
+		if err = preserveOutputMeta(*outfilePath); err != nil {
+			return err
+		}
+	}
+	slog.Info("patch applied", "phase", "patch", "file", *outfilePath, "datahash", hex.EncodeToString(datahash))
+	return nil
+}
+
+// verifyOutput re-reads the written output f, before it replaces -out, and
+// compares its SHA-256 with expected, the datahash of the delta, for
+// -verify-after-patch.
+func verifyOutput(f *os.File, expected []byte) error {
+	if expected == nil {
+		return fmt.Errorf("%w: delta has no datahash", delta.ErrDeltaCorrupt)
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, math.MaxInt64)); err != nil {
+		return err
+	}
+	actual := h.Sum(nil)
+	if !bytes.Equal(actual, expected) {
+		return fmt.Errorf("%w: %s has %x, delta expects %x", delta.ErrPatchMismatch, *outfilePath, actual, expected)
+	}
+	fmt.Fprintf(os.Stderr, "Verification OK: %x\n", actual)
+	return nil
+}
+
+// reverseDelta reads a forward delta for the base file and writes the delta
+// that turns the patched file back into the base file.
+func reverseDelta(ctx context.Context, cfg delta.Config) error {
+	if *verifyReverse && *outfilePath == "" {
+		return errors.New("-verify-reverse requires -out")
+	}
+	srcFile, err := os.Open(*sourcefilePath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	inFile := os.Stdin
+	if *infilePath != "" {
+		inFile, err = os.Open(*infilePath)
+		if err != nil {
+			return err
+		}
+		defer inFile.Close()
+	}
+
+	targetFile, err := os.CreateTemp(*tmpDir, "godelta-target")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(targetFile.Name())
+	defer targetFile.Close()
+
+	outFile := os.Stdout
+	var tmpFile *atomicFile
+	if *outfilePath != "" {
+		tmpFile, err = createAtomic(*outfilePath)
+		if err != nil {
+			return err
+		}
+		defer tmpFile.Abort()
+		outFile = tmpFile.File
+	}
 
-var (
-	sourcefilePath = flag.String("file", "", "File path for base file, REQUIRED ")
-	infilePath     = flag.String("in", "", "File path for input file")
-	outfilePath    = flag.String("out", "", "File path for output file")
-	progress       = flag.Bool("progress", false, "Show progress bar")
-	debug          = flag.Bool("debug", false, "debug mode")
-	blockSize      = flag.Int("blocksize", 6*1024, "Block Size, default block size is 6KB")
-	cryptKey       = flag.String("key", "", "Use this key to encrypt/decrypt")
-)
+	err = delta.Reverse(ctx, srcFile, inFile, targetFile, outFile, delta.WithConfig(cfg))
+	if err != nil {
+		return err
+	}
+	if *verifyReverse {
+		if _, err = outFile.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, actual, err := delta.Verify(ctx, targetFile, outFile, delta.WithConfig(cfg))
+		if err != nil {
+			return err
+		}
+		slog.Debug("reverse delta verified", "file", *outfilePath, "datahash", hex.EncodeToString(actual))
+	}
+	if tmpFile != nil {
+		if err = tmpFile.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-func generateFingerprint(ctx context.Context) {
+// composeDeltas merges -delta1 and -delta2 into a single delta against the
+// base file.
+func composeDeltas(ctx context.Context, cfg delta.Config) error {
+	if *delta1Path == "" || *delta2Path == "" {
+		return errors.New("compose requires -delta1 and -delta2")
+	}
 	srcFile, err := os.Open(*sourcefilePath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer srcFile.Close()
-
-	fpFile, err := os.Create(*sourcefilePath + ".fingerprint")
+	fi, err := srcFile.Stat()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer fpFile.Close()
 
-	if *debug {
-		log.Println("Create fingerprint for", *sourcefilePath)
-	}
-	fi, err := srcFile.Stat()
+	first, err := os.Open(*delta1Path)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	bar := pb.New64(fi.Size() / int64(*blockSize))
-	bar.SetRefreshRate(time.Second)
-	if *progress {
-		bar.Output = os.Stderr
-	} else {
-		bar.NotPrint = true
+	defer first.Close()
+
+	second, err := os.Open(*delta2Path)
+	if err != nil {
+		return err
 	}
-	bar.Start()
+	defer second.Close()
 
-	enc := gob.NewEncoder(fpFile)
-	sigsCh, err := gsync.Signatures(ctx, srcFile, nil)
-	for c := range sigsCh {
-		select {
-		case <-ctx.Done():
-			os.Remove(fpFile.Name())
-			log.Fatalln("godelta: checksum error: %#v\n", ctx.Err())
-		default:
-			break
+	outFile := os.Stdout
+	var tmpFile *atomicFile
+	if *outfilePath != "" {
+		tmpFile, err = createAtomic(*outfilePath)
+		if err != nil {
+			return err
 		}
+		defer tmpFile.Abort()
+		outFile = tmpFile.File
+	}
 
-		if c.Error != nil {
-			os.Remove(fpFile.Name())
-			log.Fatalf("godelta: checksum error: %#v\n", c.Error)
+	err = delta.Compose(ctx, srcFile, fi.Size(), first, second, outFile, delta.WithConfig(cfg))
+	if err != nil {
+		return err
+	}
+	if tmpFile != nil {
+		if err = tmpFile.Commit(); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		if *debug {
-			log.Printf("chunk %05d: %08x, %s", c.Index, c.Weak, hex.EncodeToString(c.Strong))
-		}
-		err = enc.Encode(c)
+// mergeFingerprints writes the fingerprint of the concatenation of the
+// files of -fp1 and -fp2.
+func mergeFingerprints(ctx context.Context, cfg delta.Config) error {
+	if *fp1Path == "" || *fp2Path == "" {
+		return errors.New("merge-fp requires -fp1 and -fp2")
+	}
+	first, err := os.Open(*fp1Path)
+	if err != nil {
+		return err
+	}
+	defer first.Close()
+
+	second, err := os.Open(*fp2Path)
+	if err != nil {
+		return err
+	}
+	defer second.Close()
+
+	outFile := os.Stdout
+	var tmpFile *atomicFile
+	if *outfilePath != "" {
+		tmpFile, err = createAtomic(*outfilePath)
 		if err != nil {
-			os.Remove(fpFile.Name())
-			log.Fatalf("godelta: checksum error: %#v\n", err)
+			return err
 		}
-		bar.Increment()
+		defer tmpFile.Abort()
+		outFile = tmpFile.File
 	}
-	bar.Finish()
-	if *debug {
-		log.Println("Done")
+
+	err = delta.MergeFingerprints(ctx, first, second, outFile, delta.WithConfig(cfg))
+	if err != nil {
+		return err
 	}
+	if tmpFile != nil {
+		if err = tmpFile.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func makeDiff(ctx context.Context) {
-	fpFile, err := os.Open(*sourcefilePath + ".fingerprint")
+func fingerprintInfo() error {
+	fpFile, err := os.Open(fingerprintPath())
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer fpFile.Close()
 
-	fi, err := fpFile.Stat()
+	fpReader, err := delta.NewFingerprintReader(fpFile)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	bar := pb.New64(fi.Size() / int64(*blockSize))
-	bar.SetRefreshRate(time.Second)
-	if *progress {
-		bar.Output = os.Stderr
-	} else {
-		bar.NotPrint = true
-	}
-	bar.Start()
-
-	fpDecoder := gob.NewDecoder(fpFile)
-	sigsCh := make(chan gsync.BlockSignature)
-	go func() {
-		defer close(sigsCh)
-
-		for {
-			// Allow for cancellation
-			select {
-			case <-ctx.Done():
-				sigsCh <- gsync.BlockSignature{
-					Index: 0,
-					Error: ctx.Err(),
-				}
-				return
-			default:
-				// break out of the select block and continue reading
-				break
-			}
-			var b gsync.BlockSignature
-			err := fpDecoder.Decode(&b)
-			if err == io.EOF {
-				break
-			}
+	size := uint64(*blockSize)
+	if fpReader.BlockSize != 0 {
+		size = uint64(fpReader.BlockSize)
+	}
+	if !*countOnly && !*jsonOutput {
+		if fpReader.WeakHash != delta.WeakGsync {
+			fmt.Printf("# hash: %s, weak hash: %s, block size: %d\n", fpReader.Hash, fpReader.WeakHash, size)
+		} else {
+			fmt.Printf("# hash: %s, block size: %d\n", fpReader.Hash, size)
+		}
+		fmt.Printf("%10s %8s %-64s %s\n", "index", "weak", "strong", "offset")
+	}
+	enc := json.NewEncoder(os.Stdout)
+	var count int64
+	for {
+		b, err := fpReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		count++
+		if *countOnly {
+			continue
+		}
+		offset := b.Index * size
+		if *jsonOutput {
+			err = enc.Encode(struct {
+				Index  uint64
+				Weak   string
+				Strong string
+				Offset uint64
+			}{b.Index, fmt.Sprintf("%08x", b.Weak), hex.EncodeToString(b.Strong), offset})
 			if err != nil {
-				sigsCh <- gsync.BlockSignature{
-					Index: b.Index,
-					Error: err,
-				}
-				return
+				return err
 			}
-			sigsCh <- b
-			bar.Increment()
+		} else {
+			fmt.Printf("%10d %08x %-64s %d\n", b.Index, b.Weak, hex.EncodeToString(b.Strong), offset)
 		}
-	}()
-	if *debug {
-		log.Println("Create lookup table")
 	}
-	cacheSigs, err := gsync.LookUpTable(ctx, sigsCh)
-	bar.Finish()
-	if *debug {
-		log.Println("Lookup table loaded")
+	if *countOnly {
+		if *jsonOutput {
+			return enc.Encode(struct{ Count int64 }{count})
+		}
+		fmt.Println(count)
+	} else if !*jsonOutput && fpReader.SourceHash != nil {
+		fmt.Printf("# source sha256: %s\n", hex.EncodeToString(fpReader.SourceHash))
 	}
+	return nil
+}
 
-	var inFile, outFile *os.File
+// inspectDelta prints the header of the delta, its operations from -skip
+// up to -limit of them, and its trailer.
+func inspectDelta(cfg delta.Config) error {
+	inFile := os.Stdin
 	if *infilePath != "" {
+		var err error
 		inFile, err = os.Open(*infilePath)
 		if err != nil {
-			log.Fatal(err)
-			return
+			return err
 		}
 		defer inFile.Close()
-		fi, err := fpFile.Stat()
-		if err != nil {
-			log.Fatal(err)
+	}
+	in, err := verifiedInput(inFile)
+	if err != nil {
+		return err
+	}
+	dr, err := delta.NewDeltaReader(in, delta.WithConfig(cfg))
+	if err != nil {
+		return err
+	}
+	h := dr.Header
+	if !*jsonOutput {
+		fmt.Printf("magic:       %s\n", h.Magic)
+		fmt.Printf("version:     %d\n", h.Version)
+		fmt.Printf("flags:       %s\n", strings.Join(h.Flags, ", "))
+		fmt.Printf("block size:  %d\n", h.BlockSize)
+		fmt.Printf("encoding:    %s\n", h.Encoding)
+		fmt.Printf("compression: %s\n", h.Compression)
+		fmt.Printf("encryption:  %s\n", h.Encryption)
+		if h.MerkleRoot != nil {
+			fmt.Printf("merkle root: %x\n", h.MerkleRoot)
 		}
-		bar.SetTotal64(fi.Size() / int64(*blockSize))
-	} else {
-		inFile = os.Stdin
-		bar.SetTotal64(0);
+		if h.FromVersion != "" || h.ToVersion != "" {
+			fmt.Printf("from:        %s\n", h.FromVersion)
+			fmt.Printf("to:          %s\n", h.ToVersion)
+		}
+		fmt.Printf("operations:  %d\n", h.Operations)
+		fmt.Printf("%10s %-9s %s\n", "entry", "type", "block/length")
 	}
-
-	if *outfilePath != "" {
-		outFile, err = os.Create(*outfilePath)
+	var ops []delta.Operation
+	for {
+		op, err := dr.Next()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			log.Fatal(err)
-			return
+			return err
+		}
+		// The rest is read for the datahash at the end.
+		if op.Entry < *inspectSkip || (*inspectLimit > 0 && op.Entry >= *inspectSkip+*inspectLimit) {
+			continue
+		}
+		if *jsonOutput {
+			ops = append(ops, op)
+			continue
+		}
+		switch {
+		case op.Type == "literal":
+			fmt.Printf("%10d %-9s %d bytes\n", op.Entry, op.Type, op.Length)
+		case op.Length > 0:
+			fmt.Printf("%10d %-9s block %d, offset %d, %d bytes\n", op.Entry, op.Type, op.Index, op.Offset, op.Length)
+		default:
+			fmt.Printf("%10d %-9s block %d\n", op.Entry, op.Type, op.Index)
 		}
-		defer outFile.Close()
-	} else {
-		outFile = os.Stdout
 	}
-	datahash := sha256.New()
-	opsCh, err := gsync.Sync(ctx, inFile, nil, datahash, cacheSigs)
+	size, err := dr.OutputSize()
 	if err != nil {
-		if *outfilePath != "" {
-			os.Remove(*outfilePath)
+		return err
+	}
+	if *jsonOutput {
+		if ops == nil {
+			ops = []delta.Operation{}
+		}
+		type header struct {
+			delta.DeltaHeader
+			MerkleRoot string `json:"merkle_root,omitempty"`
 		}
-		log.Fatalf("godelta: patch error: %#v\n", err)
+		return json.NewEncoder(os.Stdout).Encode(struct {
+			Header     header            `json:"header"`
+			Operations []delta.Operation `json:"operations"`
+			Datahash   string            `json:"datahash"`
+			OutputSize int64             `json:"output_size"`
+		}{header{h, hex.EncodeToString(h.MerkleRoot)}, ops, hex.EncodeToString(dr.Datahash), size})
 	}
-
-	if *debug {
-		log.Println("Create block diff")
+	fmt.Printf("datahash:    %x\n", dr.Datahash)
+	if size >= 0 {
+		fmt.Printf("output size: %d\n", size)
+	} else {
+		fmt.Println("output size: unknown")
 	}
-	bar.Set(0)
-	bar.Start()
+	return nil
+}
 
-	var streamWriter io.Writer
-	if len(*cryptKey) > minKeyLength {
-		block, err := aes.NewCipher([]byte(*cryptKey))
+func deltaStats(ctx context.Context, cfg delta.Config) error {
+	inFile := os.Stdin
+	if *infilePath != "" {
+		var err error
+		inFile, err = os.Open(*infilePath)
 		if err != nil {
-			log.Fatalf("godelta: patch encrypt error: %#v\n", err)
+			return err
 		}
-		iv := make([]byte, aes.BlockSize)
-		if _, err = rand.Read(iv[:]); err != nil {
-			log.Fatalf("godelta: patch encrypt error: %#v\n", err)
-		} else if _, err = outFile.Write(iv); err != nil {
-			log.Fatalf("godelta: patch encrypt error: %#v\n", err)
+		defer inFile.Close()
+	}
+
+	var srcSize int64
+	if *sourcefilePath != "" {
+		fi, err := os.Stat(*sourcefilePath)
+		if err != nil {
+			return err
 		}
-		stream := cipher.NewOFB(block, iv[:])
-		streamWriter = &cipher.StreamWriter{S: stream, W: outFile}
-	} else {
-		streamWriter = outFile
+		srcSize = fi.Size()
 	}
 
-	enc := gob.NewEncoder(streamWriter)
-	err = enc.Encode(bar.Total)
+	st, err := delta.Stats(ctx, inFile, srcSize, delta.WithConfig(cfg))
 	if err != nil {
-		if *outfilePath != "" {
-			os.Remove(*outfilePath)
-		}
-		log.Fatalf("godelta: patch error: %#v\n", err)
+		return err
 	}
+	if *jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(st)
+	}
+	fmt.Printf("total blocks:      %d\n", st.TotalBlocks)
+	fmt.Printf("reference blocks:  %d\n", st.ReferenceBlocks)
+	fmt.Printf("literal blocks:    %d\n", st.LiteralBlocks)
+	fmt.Printf("literal bytes:     %d\n", st.LiteralBytes)
+	fmt.Printf("reference bytes:   %d\n", st.ReferenceBytes)
+	fmt.Printf("compression ratio: %.2f\n", st.CompressionRatio)
+	fmt.Printf("unchanged:         %.2f%%\n", st.Unchanged)
+	return nil
+}
 
-	index := uint64(0)
-	for o := range opsCh {
-		select {
-		case <-ctx.Done():
-			if *outfilePath != "" {
-				os.Remove(*outfilePath)
-			}
-			log.Fatalln(ctx.Err())
-		default:
-			break
-		}
+// dryRunReport is the -dry-run output of diff.
+type dryRunReport struct {
+	DeltaSize       int64   `json:"delta_size"`
+	NewSize         int64   `json:"new_size"`
+	ReferenceBlocks int64   `json:"reference_blocks"`
+	LiteralBlocks   int64   `json:"literal_blocks"`
+	Saved           float64 `json:"saved_percent"`
+	Worthwhile      bool    `json:"worthwhile"`
+}
 
-		if o.Error != nil {
-			if *outfilePath != "" {
-				os.Remove(*outfilePath)
-			}
-			log.Fatalf("godelta: patch error: %#v\n", o.Error)
-		}
-		if *debug {
-			log.Printf("chunk %20d: %d / %d", index, o.Index, len(o.Data))
-		}
-		err = enc.Encode(o)
-		if err != nil {
-			if *outfilePath != "" {
-				os.Remove(*outfilePath)
-			}
-			log.Fatalf("godelta: patch error: %#v\n", err)
+// printDryRun prints what the delta of a diff -dry-run would save compared
+// to copying the new file. The delta is worth sending when it is smaller
+// than the new file.
+func printDryRun(st delta.DeltaStats) error {
+	r := dryRunReport{
+		DeltaSize:       st.DeltaSize,
+		NewSize:         st.NewSize,
+		ReferenceBlocks: st.ReferenceBlocks,
+		LiteralBlocks:   st.LiteralBlocks,
+		Worthwhile:      st.DeltaSize < st.NewSize,
+	}
+	if st.NewSize > 0 {
+		r.Saved = 100 * float64(st.NewSize-st.DeltaSize) / float64(st.NewSize)
+	}
+	if *jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(r)
+	}
+	fmt.Printf("estimated delta size: %d\n", r.DeltaSize)
+	fmt.Printf("new file size:        %d\n", r.NewSize)
+	fmt.Printf("reference blocks:     %d\n", r.ReferenceBlocks)
+	fmt.Printf("literal blocks:       %d\n", r.LiteralBlocks)
+	fmt.Printf("saved:                %.2f%%\n", r.Saved)
+	if r.Worthwhile {
+		fmt.Println("worth transmitting:   yes")
+	} else {
+		fmt.Println("worth transmitting:   no, the delta is not smaller than the new file")
+	}
+	return nil
+}
+
+// checkFingerprint compares the fingerprint with the signatures of the
+// base file and prints the blocks that differ. It reports whether there
+// were none.
+func checkFingerprint(ctx context.Context, cfg delta.Config) (bool, error) {
+	fpFile, err := os.Open(fingerprintPath())
+	if err != nil {
+		return false, err
+	}
+	defer fpFile.Close()
+	fp, err := verifiedInput(fpFile)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", fpFile.Name(), err)
+	}
+	srcFile, err := os.Open(*sourcefilePath)
+	if err != nil {
+		return false, err
+	}
+	defer srcFile.Close()
+
+	mismatches, err := delta.CheckFingerprint(ctx, fp, srcFile, delta.WithConfig(cfg))
+	if err != nil {
+		return false, err
+	}
+	if *jsonOutput {
+		if mismatches == nil {
+			mismatches = []delta.FingerprintMismatch{}
 		}
-		index++
-		bar.Increment()
+		return len(mismatches) == 0, json.NewEncoder(os.Stdout).Encode(mismatches)
 	}
-	bar.Finish()
-	if *debug {
-		log.Println("done")
+	for _, m := range mismatches {
+		fmt.Println(m)
+	}
+	if len(mismatches) == 0 {
+		fmt.Printf("%s: fingerprint matches %s\n", fpFile.Name(), *sourcefilePath)
 	}
-	log.Println("Datahash: ", hex.EncodeToString(datahash.Sum(nil)))
+	return len(mismatches) == 0, nil
 }
 
-func applyPatch(ctx context.Context) {
+// verifyPatch exits with 0 when the delta rebuilds the expected data,
+// exitVerifyMismatch on a mismatch and exitVerifyError when the delta
+// cannot be checked.
+func verifyPatch(ctx context.Context, cfg delta.Config) {
 	srcFile, err := os.Open(*sourcefilePath)
 	if err != nil {
-		log.Fatal(err)
+		fail(exitVerifyError, err.Error())
 	}
 	defer srcFile.Close()
 
-	var inFile, outFile *os.File
+	inFile := os.Stdin
 	if *infilePath != "" {
 		inFile, err = os.Open(*infilePath)
 		if err != nil {
-			log.Fatal(err)
-			return
+			fail(exitVerifyError, err.Error())
 		}
 		defer inFile.Close()
-	} else {
-		inFile = os.Stdin
 	}
-	if *outfilePath != "" {
-		outFile, err = os.Create(*outfilePath)
-		if err != nil {
-			log.Fatal(err)
-			return
-		}
-		defer outFile.Close()
-	} else {
-		outFile = os.Stdout
+
+	expected, actual, err := delta.Verify(ctx, srcFile, inFile, delta.WithConfig(cfg))
+	switch {
+	case errors.Is(err, delta.ErrPatchMismatch):
+		fmt.Printf("MISMATCH: expected %s got %s\n", hex.EncodeToString(expected), hex.EncodeToString(actual))
+	case errors.Is(err, delta.ErrOutputSizeMismatch):
+		fmt.Printf("MISMATCH: %v\n", err)
+	case err != nil:
+		fail(exitVerifyError, err.Error())
+	default:
+		fmt.Printf("OK: %s\n", hex.EncodeToString(actual))
+		return
 	}
+	runAtExit()
+	os.Exit(exitVerifyMismatch)
+}
 
-	bar := pb.New64(0)
-	bar.SetRefreshRate(time.Second)
-	if *progress {
-		bar.Output = os.Stderr
-	} else {
-		bar.NotPrint = true
+// needsSource reports whether action requires the -file parameter.
+func needsSource(action string) bool {
+	switch action {
+	case "info":
+		return *fpPath == ""
+	case "diff":
+		return *remoteSource == ""
+	case "stats", "inspect", "split", "join", "batch", "benchmark", "serve", "grpc-serve", "merge-fp", "diff3":
+		return false
 	}
+	return true
+}
 
-	var streamReader io.Reader
-	if len(*cryptKey) > minKeyLength {
-		block, err := aes.NewCipher([]byte(*cryptKey))
-		if err != nil {
-			log.Fatalf("godelta: patch decrypt error: %#v\n", err)
-		}
-		iv := make([]byte, aes.BlockSize)
-		if _, err = inFile.Read(iv[:]); err != nil {
-			log.Fatalf("godelta: patch decrypt error: %#v\n", err)
-		}
-		stream := cipher.NewOFB(block, iv[:])
-		streamReader = &cipher.StreamReader{S: stream, R: inFile}
-	} else {
-		streamReader = inFile
+// applyAutoBlockSize sets cfg.BlockSize for -auto-blocksize from
+// cfg.SourceSize, the size of src, unless -blocksize is set.
+func applyAutoBlockSize(cfg *delta.Config, src *os.File) {
+	if !*autoBlock || flagSet("blocksize") {
+		return
 	}
+	cfg.BlockSize = autoBlockSize(cfg.SourceSize)
+	slog.Info("block size selected", "phase", "fpgen", "file", src.Name(), "blocksize", cfg.BlockSize)
+}
 
-	opsDecoder := gob.NewDecoder(streamReader)
-	err = opsDecoder.Decode(&bar.Total)
-	if err != nil {
-		if *outfilePath != "" {
-			os.Remove(*outfilePath)
+// autoBlocks is the number of blocks -auto-blocksize aims for.
+const autoBlocks = 65536
+
+// autoBlockSize returns the -auto-blocksize for a base file of size bytes.
+func autoBlockSize(size int64) int {
+	return int(min(max(delta.MinBlockSize, size/autoBlocks), delta.MaxBlockSize))
+}
+
+// flagSet reports whether the flag name was set on the command line or in
+// a config file.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
-		log.Fatalf("godelta: patch error: %#v\n", err)
-	}
-	if *debug {
-		log.Println("Rebuild file")
-	}
-	bar.Start()
-	opsCh := make(chan gsync.BlockOperation)
-	go func() {
-		defer close(opsCh)
-
-		for {
-			// Allow for cancellation
-			select {
-			case <-ctx.Done():
-				opsCh <- gsync.BlockOperation{
-					Error: ctx.Err(),
-				}
-				return
-			default:
-				// break out of the select block and continue reading
-				break
-			}
-			var o gsync.BlockOperation
-			err := opsDecoder.Decode(&o)
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				opsCh <- gsync.BlockOperation{
-					Error: err,
-				}
-				return
-			}
-			opsCh <- o
-			bar.Increment()
+	})
+	return set
+}
+
+// addrOr returns -addr if it was set and def otherwise.
+func addrOr(def string) string {
+	addr := def
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "addr" {
+			addr = f.Value.String()
 		}
-	}()
-	datahash := sha256.New()
-	err = gsync.Apply(ctx, outFile, srcFile, datahash, opsCh)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	bar.Finish()
+	})
+	return addr
+}
+
+// setupLogging configures the default slog logger for the -log-format and
+// -debug flags.
+func setupLogging() error {
+	level := slog.LevelInfo
 	if *debug {
-		log.Println("done")
+		level = slog.LevelDebug
 	}
-	log.Println("Datahash: ", hex.EncodeToString(datahash.Sum(nil)))
+	switch *logFormat {
+	case "text":
+		log.SetOutput(os.Stderr)
+		slog.SetLogLoggerLevel(level)
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	default:
+		return fmt.Errorf("unknown log format %q", *logFormat)
+	}
+	return nil
+}
+
+// atExit holds the functions run before the process exits, also through
+// fatal.
+var atExit []func()
+
+func runAtExit() {
+	for i := len(atExit) - 1; i >= 0; i-- {
+		atExit[i]()
+	}
+	atExit = nil
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	fail(exitInternal, msg, args...)
 }
 
 func main() {
+	if err := loadConfig(os.Args[1:]); err != nil {
+		fatal(err.Error())
+	}
 	flag.Parse()
-	log.SetOutput(os.Stderr)
-	if *sourcefilePath == "" {
+	if *showVersion {
+		printVersion()
+		return
+	}
+	if flag.Arg(0) == "completion" {
+		if err := printCompletion(os.Stdout, flag.Arg(1)); err != nil {
+			fatal(err.Error())
+		}
+		return
+	}
+	if err := setupLogging(); err != nil {
+		fmt.Println(err)
+		flag.Usage()
+		return
+	}
+	if *sourcefilePath == "" && needsSource(flag.Arg(0)) {
 		fmt.Println("Missing File parameter")
 		flag.Usage()
 		return
 	}
-	if *blockSize < 1024 {
-		fmt.Println("Invalid block size, must be more than 1024")
+	if err := delta.CheckBlockSize(*blockSize); err != nil {
+		fmt.Println(err)
 		flag.Usage()
 		return
 	}
-	gsync.BlockSize = *blockSize
 
-	//ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	cfg, err := config()
+	if err != nil {
+		fatal(err.Error())
+	}
+	if *encodeBufFlag != "" {
+		if encodeBuffer, err = parseSize(*encodeBufFlag); err != nil {
+			fatal("invalid -encode-buffer", "error", err)
+		}
+	}
+	if *rateLimitFlag != "" {
+		if rateLimit, err = parseSize(*rateLimitFlag); err != nil {
+			fatal("invalid -rate-limit", "error", err)
+		}
+	}
+	if uploadLimit, err = parseSize(*maxUpload); err != nil {
+		fatal("invalid -max-upload", "error", err)
+	}
+	if err = parseSignKeys(); err != nil {
+		fatal(err.Error())
+	}
+
+	bar := progressBar{
+		color:    !*noColor && term.IsTerminal(int(os.Stderr.Fd())),
+		interval: *progressRate,
+	}
+	if *progress {
+		cfg.ProgressFunc = bar.update
+		cfg.MatchFunc = bar.match
+	}
+
+	if *metricsAddr != "" {
+		appMetrics = newMetrics()
+		cfg.StatsFunc = appMetrics.stats
+		srv := appMetrics.serve(*metricsAddr)
+		atExit = append(atExit, func() { srv.Close() })
+	}
+
+	if *otelEndpoint != "" {
+		shutdown, err := setupTracing(context.Background(), *otelEndpoint)
+		if err != nil {
+			fatal(err.Error())
+		}
+		atExit = append(atExit, func() { shutdown(context.Background()) })
+	}
+	defer runAtExit()
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	if *timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, *timeout)
+		defer cancelTimeout()
+	}
+	// Temporary files left by an interrupted or failed operation.
+	atExit = append(atExit, abortPending)
+	var running sync.WaitGroup
+	running.Add(1)
+	defer handleSignals(ctx, cancel, &running)()
+	if *pprofAddr != "" {
+		srv := servePprof(*pprofAddr)
+		atExit = append(atExit, func() { srv.Close() })
+		context.AfterFunc(ctx, func() { srv.Close() })
+	}
+	var stopProfile func(ok bool) error
+	if *profileKind != "" {
+		if stopProfile, err = startProfile(*profileKind); err != nil {
+			fatal("invalid -profile", "error", err)
+		}
+	}
 
+	start := time.Now()
 	switch flag.Arg(0) {
 	case "fpgen":
-		generateFingerprint(ctx)
+		var unlock func()
+		if unlock, err = lockSourceFile(); err != nil {
+			break
+		}
+		err = runPhase(ctx, "fpgen", func(ctx context.Context) error { return generateFingerprint(ctx, cfg) })
+		unlock()
+	case "optimize":
+		err = optimizeFingerprint(ctx, cfg)
+	case "updatefp":
+		err = updateFingerprint(ctx, cfg)
 	case "diff":
-		if s, err := os.Stat(*sourcefilePath + ".fingerprint"); os.IsNotExist(err) || s.Size() < 1 {
-			generateFingerprint(ctx)
+		if !*dryRun {
+			if err = confirmOverwrite(*outfilePath); err != nil {
+				break
+			}
+		}
+		// The lock covers the fingerprint generated here as well.
+		var unlock func()
+		if unlock, err = lockSourceFile(); err != nil {
+			break
+		}
+		if *remoteSource == "" && !*adaptiveBlock && !*noFingerprint && !copiesWhole(cfg) {
+			var s os.FileInfo
+			if s, err = os.Stat(fingerprintPath()); err != nil && !os.IsNotExist(err) {
+				unlock()
+				break
+			}
+			if err != nil || s.Size() < 1 {
+				err := runPhase(ctx, "fpgen", func(ctx context.Context) error { return generateFingerprint(ctx, cfg) })
+				if err != nil {
+					exitWith(timedOut(ctx, err), "phase", "fpgen", "file", *sourcefilePath)
+				}
+			}
 		}
-		makeDiff(ctx)
+		err = runPhase(ctx, "diff", func(ctx context.Context) error { return makeDiff(ctx, cfg) })
+		unlock()
 	case "patch":
+		var done bool
+		if done, err = upToDate(cfg); err != nil || done {
+			if done {
+				fmt.Fprintln(os.Stderr, "Already up to date")
+			}
+			break
+		}
 		if _, err := os.Stat(*sourcefilePath); os.IsNotExist(err) {
-			log.Fatalln("Base file is not exists")
+			fail(exitNotFound, "Base file is not exists", "file", *sourcefilePath)
+		}
+		var s os.FileInfo
+		if s, err = os.Stat(fingerprintPath()); err != nil && !os.IsNotExist(err) {
+			break
+		}
+		if err != nil || s.Size() < 1 {
+			fail(exitFingerprint, "Fingerprint file is not exists", "file", fingerprintPath())
+		}
+		// A resumed patch continues its own output.
+		if !*resume {
+			if err = confirmOverwrite(*outfilePath); err != nil {
+				break
+			}
+		}
+		err = runPhase(ctx, "patch", func(ctx context.Context) error { return applyPatch(ctx, cfg) })
+	case "verify":
+		verifyPatch(ctx, cfg)
+	case "info":
+		err = fingerprintInfo()
+	case "inspect":
+		err = inspectDelta(cfg)
+	case "split":
+		var size int64
+		if size, err = parseSize(*benchSize); err == nil {
+			err = splitDelta(cfg, *infilePath, size, *splitPrefix)
+		}
+	case "join":
+		err = joinDelta(*manifestPath, *outfilePath)
+	case "stats":
+		err = deltaStats(ctx, cfg)
+	case "reverse":
+		err = reverseDelta(ctx, cfg)
+	case "compose":
+		err = composeDeltas(ctx, cfg)
+	case "merge-fp":
+		err = mergeFingerprints(ctx, cfg)
+	case "batch":
+		var ok bool
+		ok, err = runBatch(ctx, cfg, *manifestPath, *parallel, &batchFilter, retryPolicy{retries: *batchRetries, delay: *retryDelay})
+		if err == nil && !ok {
+			bar.Finish()
+			runAtExit()
+			os.Exit(1)
+		}
+	case "check":
+		var ok bool
+		ok, err = checkFingerprint(ctx, cfg)
+		if err == nil && !ok {
+			bar.Finish()
+			runAtExit()
+			os.Exit(exitHashMismatch)
 		}
-		if s, err := os.Stat(*sourcefilePath + ".fingerprint"); os.IsNotExist(err) || s.Size() < 1 {
-			log.Fatalln("Fingerprint file is not exists")
+	case "diff3":
+		var ok bool
+		ok, err = diff3(ctx, cfg, *conflictMap)
+		if err == nil && !ok {
+			bar.Finish()
+			runAtExit()
+			os.Exit(1)
 		}
-		applyPatch(ctx)
+	case "watch":
+		err = watchDiff(ctx, cfg, *debounce)
+	case "benchmark":
+		err = runBenchmark(ctx, cfg, *benchSize, *benchMutate)
+	case "chain":
+		err = chainDeltas(ctx, cfg, *chainPaths, *chainMemory)
+	case "serve":
+		if *generateTLS {
+			err = generateCert(*tlsCert, *tlsKey)
+			break
+		}
+		var tlsConfig *tls.Config
+		if tlsConfig, err = serverTLSConfig(*tlsCert, *tlsKey, *tlsCA); err == nil {
+			err = serveFiles(ctx, cfg, *serveAddr, *serveRoot, tlsConfig)
+		}
+	case "grpc-serve":
+		err = serveGRPC(ctx, cfg, addrOr(":50051"), *serveRoot)
+	case "grpc-client":
+		err = runGRPCClient(ctx, cfg, addrOr("localhost:50051"), *grpcRPC, *remoteFile)
 	default:
-		log.Fatal("You must specify one of the following action: 'fpgen', 'diff' or 'patch'.")
+		fatal("You must specify one of the following action: 'fpgen', 'updatefp', 'optimize', 'check', 'diff', 'patch', 'verify', 'reverse', 'compose', 'merge-fp', 'diff3', 'chain', 'batch', 'watch', 'benchmark', 'serve', 'grpc-serve', 'grpc-client', 'info', 'inspect', 'stats', 'split', 'join' or 'completion'.")
+	}
+	running.Done()
+	bar.Finish()
+	if stopProfile != nil {
+		if perr := stopProfile(err == nil); err == nil {
+			err = perr
+		}
+	}
+	// watch, batch and the servers record every operation they run.
+	if op := flag.Arg(0); op != "watch" && op != "batch" && op != "serve" && op != "grpc-serve" {
+		appMetrics.observe(op, start, err)
+	}
+	if errors.Is(err, errOutputExists) {
+		exitWith(err, "file", *outfilePath)
 	}
+	exitWith(timedOut(ctx, err), "phase", flag.Arg(0))
 }
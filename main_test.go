@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs main instead of the tests in the processes started by
+// runMain.
+func TestMain(m *testing.M) {
+	if os.Getenv("GODELTA_TEST_MAIN") == "1" {
+		main()
+		os.Exit(exitOK)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs godelta with args in a new process, as gob numbers its types
+// once per process. HOME is dir, so $HOME/.godelta.toml is not read.
+func runMain(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "GODELTA_TEST_MAIN=1", "HOME="+dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("godelta %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+func TestNoFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	old := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(old)
+	if err := os.WriteFile(path("old"), old, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path("new"), append([]byte("changed"), old[1000:]...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []string{"gob", "msgpack", "json", "proto"} {
+		t.Run(format, func(t *testing.T) {
+			fp, twoStep, oneShot := path(format+".fp"), path(format+".delta"), path(format+".oneshot")
+			runMain(t, dir, "-format", format, "-file", path("old"), "-fp", fp, "fpgen")
+			runMain(t, dir, "-format", format, "-file", path("old"), "-fp", fp, "-in", path("new"), "-out", twoStep, "diff")
+			runMain(t, dir, "-format", format, "-no-fingerprint", "-file", path("old"), "-in", path("new"), "-out", oneShot, "diff")
+			want, err := os.ReadFile(twoStep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(oneShot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("-no-fingerprint delta differs from the fpgen and diff one")
+			}
+			if _, err = os.Stat(path("old.fingerprint")); !os.IsNotExist(err) {
+				t.Errorf("-no-fingerprint wrote a fingerprint file: %v", err)
+			}
+		})
+	}
+}
+
+// TestGobDeltaReproducible compares the gob delta of a diff that generates
+// the missing fingerprint itself to the one of a diff in a process that
+// only reads it, as gob type ids would differ if the process encoded the
+// types in another order.
+func TestGobDeltaReproducible(t *testing.T) {
+	dir := t.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	old := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(old)
+	if err := os.WriteFile(path("old"), old, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path("new"), append([]byte("changed"), old[1000:]...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	runMain(t, dir, "-format", "gob", "-file", path("old"), "-fp", path("fp"), "-in", path("new"), "-out", path("auto.delta"), "diff")
+	runMain(t, dir, "-format", "gob", "-file", path("old"), "-fp", path("fp"), "-in", path("new"), "-out", path("read.delta"), "diff")
+	want, err := os.ReadFile(path("read.delta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path("auto.delta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("delta of the diff generating the fingerprint differs from the one reading it")
+	}
+}
+
+// TestFingerprintStatError checks diff and patch report a fingerprint they
+// cannot stat instead of treating it as missing.
+func TestFingerprintStatError(t *testing.T) {
+	dir := t.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	for _, name := range []string{"old", "new", "delta"} {
+		if err := os.WriteFile(path(name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A path below a regular file fails with ENOTDIR.
+	fp := filepath.Join(path("old"), "fp")
+	for _, args := range [][]string{
+		{"-file", path("old"), "-fp", fp, "-in", path("new"), "-out", path("out.delta"), "diff"},
+		{"-file", path("old"), "-fp", fp, "-in", path("delta"), "-out", path("out"), "patch"},
+	} {
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Env = append(os.Environ(), "GODELTA_TEST_MAIN=1", "HOME="+dir)
+		out, err := cmd.CombinedOutput()
+		if code := cmd.ProcessState.ExitCode(); code != exitInternal || !strings.Contains(string(out), "not a directory") {
+			t.Errorf("godelta %s: exit code %d, %v\n%s", args[len(args)-1], code, err, out)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+)
+
+// preserveMeta copies the permissions and the access and modification
+// times of the file at src to dst.
+func preserveMeta(src, dst string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(dst, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, accessTime(fi), fi.ModTime())
+}
+
+// preserveOutputMeta copies the metadata of the -file selected by the
+// -preserve flags to the patched file at dst.
+func preserveOutputMeta(dst string) error {
+	if *keepMeta {
+		if err := preserveMeta(*sourcefilePath, dst); err != nil {
+			return err
+		}
+	}
+	if *keepOwner {
+		if err := preserveOwner(*sourcefilePath, dst); err != nil {
+			return err
+		}
+	}
+	if *keepXattrs {
+		if err := preserveXattr(*sourcefilePath, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// accessTime returns the last access time of fi.
+func accessTime(fi os.FileInfo) time.Time {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Unix())
+	}
+	return fi.ModTime()
+}
+
+// preserveOwner gives dst the owner and group of src, which requires root
+// unless they are the current ones.
+func preserveOwner(src, dst string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("%s: no owner information", src)
+	}
+	return os.Lchown(dst, int(st.Uid), int(st.Gid))
+}
+
+// preserveXattr copies the extended attributes of src to dst.
+func preserveXattr(src, dst string) error {
+	names, err := xattrList(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		value, err := xattrGet(src, name)
+		if err != nil {
+			return err
+		}
+		if err = unix.Setxattr(dst, name, value, 0); err != nil {
+			return fmt.Errorf("set extended attribute %s on %s: %w", name, dst, err)
+		}
+	}
+	return nil
+}
+
+// xattrList returns the names of the extended attributes of path.
+func xattrList(path string) ([]string, error) {
+	size, err := unix.Listxattr(path, nil)
+	for err == nil && size > 0 {
+		buf := make([]byte, size)
+		var n int
+		n, err = unix.Listxattr(path, buf)
+		if errors.Is(err, unix.ERANGE) {
+			// The list grew since its size was read.
+			size, err = unix.Listxattr(path, nil)
+			continue
+		}
+		if err != nil {
+			break
+		}
+		var names []string
+		for _, name := range bytes.Split(buf[:n], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list extended attributes of %s: %w", path, err)
+	}
+	return nil, nil
+}
+
+// xattrGet returns the value of the extended attribute name of path.
+func xattrGet(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, fmt.Errorf("get extended attribute %s of %s: %w", name, path, err)
+		}
+		buf := make([]byte, size)
+		n, err := unix.Getxattr(path, name, buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get extended attribute %s of %s: %w", name, path, err)
+		}
+		return buf[:n], nil
+	}
+}
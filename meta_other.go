@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// accessTime returns the modification time of fi, the access time is only
+// read on Linux.
+func accessTime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
+
+func preserveOwner(src, dst string) error {
+	return errors.New("-preserve-owner is only supported on Linux")
+}
+
+func preserveXattr(src, dst string) error {
+	return errors.New("-preserve-xattr is only supported on Linux")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/Elbandi/godelta/delta"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// appMetrics collects the Prometheus metrics when -metrics-addr is set and
+// is nil otherwise. All methods accept a nil receiver.
+var appMetrics *metrics
+
+type metrics struct {
+	registry       *prometheus.Registry
+	blocks         *prometheus.CounterVec
+	literalBytes   prometheus.Counter
+	referenceBytes prometheus.Counter
+	errors         *prometheus.CounterVec
+	duration       *prometheus.HistogramVec
+	cache          *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		blocks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "godelta_blocks_processed_total",
+			Help: "Blocks processed, by operation.",
+		}, []string{"op"}),
+		literalBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "godelta_literal_bytes_total",
+			Help: "Bytes carried literally in deltas written or applied.",
+		}),
+		referenceBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "godelta_reference_bytes_total",
+			Help: "Bytes copied from the source file by deltas written or applied.",
+		}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "godelta_errors_total",
+			Help: "Failed operations, by operation and kind of error.",
+		}, []string{"op", "kind"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "godelta_operation_duration_seconds",
+			Help:    "Duration of operations, by operation.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+		}, []string{"op"}),
+		cache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "godelta_fingerprint_cache_requests_total",
+			Help: "Fingerprint requests of serve, by result of the cache lookup: hit or miss.",
+		}, []string{"result"}),
+	}
+	m.registry.MustRegister(m.blocks, m.literalBytes, m.referenceBytes, m.errors, m.duration, m.cache)
+	return m
+}
+
+// stats is a delta.StatsFunc counting the blocks and bytes of an operation.
+func (m *metrics) stats(phase string, st delta.DeltaStats) {
+	if m == nil {
+		return
+	}
+	m.blocks.WithLabelValues(phase).Add(float64(st.TotalBlocks))
+	if phase == "fpgen" {
+		return
+	}
+	m.literalBytes.Add(float64(st.LiteralBytes))
+	m.referenceBytes.Add(float64(st.ReferenceBytes))
+}
+
+// cacheLookup counts a lookup in the fingerprint cache of serve.
+func (m *metrics) cacheLookup(hit bool) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cache.WithLabelValues(result).Inc()
+}
+
+// observe records the duration of the operation op started at start and
+// counts err if it failed.
+func (m *metrics) observe(op string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.duration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.errors.WithLabelValues(op, errorKind(err)).Inc()
+	}
+}
+
+// errorKind returns the metric label for err.
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, delta.ErrFingerprintCorrupt):
+		return "fingerprint_corrupt"
+	case errors.Is(err, delta.ErrDeltaCorrupt):
+		return "delta_corrupt"
+	case errors.Is(err, delta.ErrPatchMismatch):
+		return "patch_mismatch"
+	case errors.Is(err, delta.ErrBlockChecksumFail):
+		return "block_checksum"
+	case errors.Is(err, delta.ErrUnsupportedVersion):
+		return "unsupported_version"
+	case errors.Is(err, delta.ErrSourceModified):
+		return "source_modified"
+	case errors.Is(err, delta.ErrWrongSourceFile):
+		return "wrong_source"
+	case errors.Is(err, delta.ErrVersionMismatch):
+		return "version_mismatch"
+	case errors.Is(err, delta.ErrHashAlgorithmMismatch):
+		return "hash_mismatch"
+	case errors.Is(err, errDeltaTooLarge):
+		return "delta_too_large"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	}
+	return "other"
+}
+
+// serve exposes /metrics on addr until the returned server is shut down.
+func (m *metrics) serve(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server failed", "error", err)
+		}
+	}()
+	return srv
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// mmapSource returns f with retried reads, memory mapping is only supported
+// on unix.
+func mmapSource(f *os.File) (io.ReaderAt, func() error, error) {
+	return retryFile{f}, func() error { return nil }, nil
+}
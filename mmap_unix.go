@@ -0,0 +1,33 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmapThreshold is the source size from which mmapSource maps the file.
+const mmapThreshold = 100 << 20
+
+// mmapSource maps f into memory if it is larger than mmapThreshold, so the
+// reference blocks are read without a pread(2) call each, smaller files are
+// read with retries. The returned function releases the mapping.
+func mmapSource(f *os.File) (io.ReaderAt, func() error, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	// A mapping larger than int cannot be addressed on 32-bit platforms.
+	if fi.Size() < mmapThreshold || int64(int(fi.Size())) != fi.Size() {
+		return retryFile{f}, func() error { return nil }, nil
+	}
+	data, err := unix.Mmap(int(f.Fd()), 0, int(fi.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bytes.NewReader(data), func() error { return unix.Munmap(data) }, nil
+}
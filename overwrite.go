@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// errOutputExists makes the process exit with exitOutputExists.
+var errOutputExists = errors.New("output file already exists; use -overwrite")
+
+// confirmOverwrite returns errOutputExists if path is an existing non-empty
+// file, unless -overwrite is set or -interactive asked for and got a yes.
+func confirmOverwrite(path string) error {
+	if path == "" || path == "-" || *overwrite {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil || fi.Size() == 0 {
+		return nil
+	}
+	if !*interactive {
+		return errOutputExists
+	}
+	yes, err := askYes(fmt.Sprintf("Overwrite %s?", path))
+	if err != nil {
+		return fmt.Errorf("%w, %v", errOutputExists, err)
+	}
+	if !yes {
+		return errOutputExists
+	}
+	return nil
+}
+
+// askYes asks question on the terminal and reports whether the answer was
+// yes.
+func askYes(question string) (bool, error) {
+	// Without a terminal stdin may be the input of the operation.
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false, errors.New("cannot ask without a terminal")
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N]: ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// startProfile starts the -profile named by kind: cpu, mem or trace. The
+// returned function stops it and, if the operation succeeded, commits
+// cpu.pprof, mem.pprof or trace.out in the working directory.
+func startProfile(kind string) (func(ok bool) error, error) {
+	paths := map[string]string{"cpu": "cpu.pprof", "mem": "mem.pprof", "trace": "trace.out"}
+	path, found := paths[kind]
+	if !found {
+		return nil, fmt.Errorf("unknown profile: %s", kind)
+	}
+	f, err := createAtomic(path)
+	if err != nil {
+		return nil, err
+	}
+	var stop func()
+	switch kind {
+	case "cpu":
+		err = pprof.StartCPUProfile(f)
+		stop = pprof.StopCPUProfile
+	case "trace":
+		err = trace.Start(f)
+		stop = trace.Stop
+	}
+	if err != nil {
+		f.Abort()
+		return nil, err
+	}
+	return func(ok bool) error {
+		if stop != nil {
+			stop()
+		}
+		if !ok {
+			f.Abort()
+			return nil
+		}
+		if kind == "mem" {
+			// Up to date statistics, the heap profile reflects the last GC.
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				f.Abort()
+				return err
+			}
+		}
+		if err := f.Commit(); err != nil {
+			return err
+		}
+		slog.Info("profile written", "file", path)
+		return nil
+	}, nil
+}
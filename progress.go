@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/cheggaaa/pb.v1"
+)
+
+// ANSI escape sequences for the match ratio annotation.
+const (
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorReset  = "\x1b[0m"
+)
+
+// progressBar shows the progress reported by the delta package on stderr,
+// starting a new bar for every phase.
+type progressBar struct {
+	bar   *pb.ProgressBar
+	phase string
+	done  int64
+	// color enables ANSI colors in the match ratio annotation.
+	color bool
+	// interval is the refresh rate of the bar, time.Second if 0.
+	interval time.Duration
+}
+
+func (p *progressBar) update(phase string, done, total int64) {
+	if p.bar == nil || phase != p.phase || done < p.done {
+		p.Finish()
+		interval := p.interval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		p.bar = pb.New64(total)
+		p.bar.SetRefreshRate(interval)
+		p.bar.ShowTimeLeft = true
+		p.bar.ShowSpeed = true
+		p.bar.Output = os.Stderr
+		p.bar.Start()
+		p.phase = phase
+	}
+	p.done = done
+	p.bar.SetTotal64(total)
+	p.bar.Set64(done)
+}
+
+// match annotates the bar with the share of blocks copied from the source
+// file.
+func (p *progressBar) match(phase string, matched, done int64) {
+	if p.bar == nil || phase != p.phase || phase == "fpgen" || done == 0 {
+		return
+	}
+	ratio := float64(matched) * 100 / float64(done)
+	text := fmt.Sprintf(" matched %.1f%%", ratio)
+	if p.color {
+		color := colorRed
+		switch {
+		case ratio >= 80:
+			color = colorGreen
+		case ratio >= 40:
+			color = colorYellow
+		}
+		text = color + text + colorReset
+	}
+	p.bar.Postfix(text)
+}
+
+// Finish stops the current bar.
+func (p *progressBar) Finish() {
+	if p.bar != nil {
+		p.bar.Finish()
+		p.bar = nil
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimit is the -rate-limit in bytes per second, 0 without a limit.
+var rateLimit int64
+
+// maxRateBurst caps the bytes read or written at once while rate limited.
+const maxRateBurst = 64 << 10
+
+// newRateLimiter returns a limiter for rateLimit, nil without a limit.
+func newRateLimiter() *rate.Limiter {
+	if rateLimit <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(rateLimit), int(min(rateLimit, maxRateBurst)))
+}
+
+// rateLimitedReader waits for the limiter after every read.
+type rateLimitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	lim *rate.Limiter
+}
+
+// limitReader returns r limited by lim, or r if lim is nil.
+func limitReader(ctx context.Context, r io.Reader, lim *rate.Limiter) io.Reader {
+	if lim == nil {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, lim: lim}
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > l.lim.Burst() {
+		p = p[:l.lim.Burst()]
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if werr := l.lim.WaitN(l.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// rateLimitedWriter waits for the limiter before every write.
+type rateLimitedWriter struct {
+	ctx context.Context
+	w   io.Writer
+	lim *rate.Limiter
+}
+
+// limitWriter returns w limited by lim, or w if lim is nil.
+func limitWriter(ctx context.Context, w io.Writer, lim *rate.Limiter) io.Writer {
+	if lim == nil {
+		return w
+	}
+	return &rateLimitedWriter{ctx: ctx, w: w, lim: lim}
+}
+
+func (l *rateLimitedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), l.lim.Burst())]
+		if err := l.lim.WaitN(l.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := l.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// rateLimitedConn limits the reads and the writes of a connection
+// separately.
+type rateLimitedConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+// limitConn returns conn with its own limiters, or conn without a limit.
+func limitConn(conn net.Conn) net.Conn {
+	if rateLimit <= 0 {
+		return conn
+	}
+	ctx := context.Background()
+	return &rateLimitedConn{
+		Conn: conn,
+		r:    limitReader(ctx, conn, newRateLimiter()),
+		w:    limitWriter(ctx, conn, newRateLimiter()),
+	}
+}
+
+func (c *rateLimitedConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *rateLimitedConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// rateLimitedListener limits every accepted connection on its own.
+type rateLimitedListener struct {
+	net.Listener
+}
+
+// limitListener returns l limiting the connections it accepts, or l
+// without a limit.
+func limitListener(l net.Listener) net.Listener {
+	if rateLimit <= 0 {
+		return l
+	}
+	return rateLimitedListener{l}
+}
+
+func (l rateLimitedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return limitConn(conn), nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// remoteFingerprint connects to the host of spec, [user@]host:path, runs
+// fpgen for path there and returns the fingerprint streamed back. The
+// returned function waits for the remote command and closes the
+// connection. If the fingerprint was not read completely, as reported by
+// failed, it closes the connection without waiting.
+func remoteFingerprint(ctx context.Context, spec string) (io.Reader, func(failed bool) error, error) {
+	user, host, path, err := parseRemote(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	config, err := sshConfig(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := ssh.Dial("tcp", net.JoinHostPort(host, "22"), config)
+	if err != nil {
+		return nil, nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	session.Stderr = os.Stderr
+	out, err := session.StdoutPipe()
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	if err = session.Start(remoteCommand(path)); err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	wait := func(failed bool) error {
+		defer client.Close()
+		defer stop()
+		if failed {
+			return nil
+		}
+		if err := session.Wait(); err != nil {
+			return fmt.Errorf("remote fpgen on %s: %w", host, err)
+		}
+		return nil
+	}
+	return limitReader(ctx, out, newRateLimiter()), wait, nil
+}
+
+// parseRemote splits spec into its user, which defaults to $USER, host
+// and path.
+func parseRemote(spec string) (user, host, path string, err error) {
+	host, path, ok := strings.Cut(spec, ":")
+	if !ok || host == "" || path == "" {
+		return "", "", "", fmt.Errorf("invalid remote source %q, expected user@host:/path", spec)
+	}
+	user = os.Getenv("USER")
+	if u, h, ok := strings.Cut(host, "@"); ok {
+		user, host = u, h
+	}
+	return user, host, path, nil
+}
+
+// remoteCommand returns the shell command generating the fingerprint of
+// path with the local fingerprint options.
+func remoteCommand(path string) string {
+	args := []string{*remoteGodelta,
+		"-file=" + path,
+		"-fp=-",
+		"-blocksize=" + strconv.Itoa(*blockSize),
+		"-chunking=" + *chunking,
+		"-format=" + *fpFormat,
+		"-compress-fp=" + *compressFp,
+	}
+	if *hashName != "" {
+		args = append(args, "-hash="+*hashName)
+	}
+	args = append(args, "fpgen")
+	for i, arg := range args {
+		args[i] = shellQuote(arg)
+	}
+	return strings.Join(args, " ")
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// sshConfig authenticates with the keys of the running ssh-agent and the
+// default private keys in ~/.ssh, and checks the host key against
+// ~/.ssh/known_hosts.
+func sshConfig(user string) (*ssh.ClientConfig, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, err
+	}
+	var auth []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	var signers []ssh.Signer
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		pem, err := os.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		// Encrypted keys are left to the agent.
+		if signer, err := ssh.ParsePrivateKey(pem); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	return &ssh.ClientConfig{User: user, Auth: auth, HostKeyCallback: hostKeys}, nil
+}
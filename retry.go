@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+)
+
+// retryRead reads from r into buf like r.Read, but retries failed reads:
+// EINTR and EAGAIN right away, other temporary errors after delay, doubled
+// for every further retry. It gives up after maxRetries retries.
+func retryRead(r io.Reader, buf []byte, maxRetries int, delay time.Duration) (int, error) {
+	return retry(func() (int, error) { return r.Read(buf) }, maxRetries, delay)
+}
+
+// retry calls read until it succeeds, fails with an error that is not
+// transient or was retried maxRetries times. Data read before a transient
+// error is returned without the error, the next read retries it.
+func retry(read func() (int, error), maxRetries int, delay time.Duration) (int, error) {
+	for attempt := 1; ; attempt++ {
+		n, err := read()
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		immediate := errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+		if !immediate && !temporary(err) {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if attempt > maxRetries {
+			return 0, err
+		}
+		if immediate {
+			slog.Debug("retrying read", "attempt", attempt, "error", err)
+			continue
+		}
+		slog.Debug("retrying read", "attempt", attempt, "delay", delay, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// temporary reports whether err, or an error it wraps, is temporary, like
+// ETIMEDOUT or a reset connection of a network file system.
+func temporary(err error) bool {
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && t.Temporary()
+}
+
+// retryFile retries the failed reads of a file with -io-retries and
+// -io-retry-delay. Stat and Seek still work on it, so readers sizing
+// their input see through it.
+type retryFile struct {
+	*os.File
+}
+
+func (f retryFile) Read(p []byte) (int, error) {
+	return retryRead(f.File, p, *ioRetries, *ioRetryDelay)
+}
+
+// ReadAt retries the rest of p after a short read with a transient error,
+// ReadAt must fill p unless it fails.
+func (f retryFile) ReadAt(p []byte, off int64) (int, error) {
+	done := 0
+	for done < len(p) {
+		n, err := retry(func() (int, error) {
+			return f.File.ReadAt(p[done:], off+int64(done))
+		}, *ioRetries, *ioRetryDelay)
+		done += n
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
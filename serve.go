@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Elbandi/godelta/delta"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	contentTypeGob     = "application/x-gob"
+	contentTypeMsgpack = "application/msgpack"
+)
+
+// applyResult is the response of POST /apply.
+type applyResult struct {
+	File     string `msgpack:"file"`
+	Size     int64  `msgpack:"size"`
+	Datahash []byte `msgpack:"datahash"`
+}
+
+// gsyncMu serializes the fingerprints, diffs and patches of the servers.
+// gsync reads the block size from the package-global gsync.BlockSize,
+// which every operation sets to its own, so concurrent requests with
+// different block sizes would corrupt each other.
+var gsyncMu sync.Mutex
+
+// uploadLimit is the -max-upload size in bytes of a delta sent to be
+// applied, 0 accepts any size.
+var uploadLimit int64
+
+// fileLocks serializes the patches of a file by serve and grpc-serve.
+var fileLocks sync.Map
+
+// lockFile locks the file at path for a patch and returns the function
+// unlocking it.
+func lockFile(path string) func() {
+	lock, _ := fileLocks.LoadOrStore(filepath.Clean(path), &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	return lock.(*sync.Mutex).Unlock
+}
+
+// server serves the fingerprints of the files below root and applies
+// deltas to them.
+type server struct {
+	root string
+	cfg  delta.Config
+	// cache holds the fingerprints served last, nil with -cache-size 0.
+	cache *fingerprintCache
+}
+
+// serveFiles runs the HTTP server on addr until the process is
+// interrupted. It serves HTTPS with tlsConfig if it is not nil.
+func serveFiles(ctx context.Context, cfg delta.Config, addr, root string, tlsConfig *tls.Config) error {
+	if root == "" {
+		return errors.New("serve requires -root")
+	}
+	s := &server{root: root, cfg: cfg, cache: newFingerprintCache(*fpCacheSize)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /fingerprint", s.fingerprint)
+	mux.HandleFunc("POST /apply", s.apply)
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	lis = limitListener(lis)
+	if tlsConfig != nil {
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+	slog.Info("serving files", "addr", addr, "root", root, "tls", tlsConfig != nil, "mtls", tlsConfig != nil && tlsConfig.ClientCAs != nil)
+	if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// path returns the path of the file named by the file query parameter,
+// which must stay below the root.
+func (s *server) path(r *http.Request) (string, error) {
+	return pathBelow(s.root, r.URL.Query().Get("file"))
+}
+
+// errInvalidFile is returned for a file name leaving the served root.
+var errInvalidFile = errors.New("invalid file")
+
+// pathBelow returns the path of the file name below root with its
+// symlinks resolved. name must be a local path and may not lead out of
+// root through a symlink either.
+func pathBelow(root, name string) (string, error) {
+	if name == "" || !filepath.IsLocal(name) {
+		return "", fmt.Errorf("%w %q", errInvalidFile, name)
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(realRoot, name))
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(realRoot, path); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%w %q: links out of the root", errInvalidFile, name)
+	}
+	return path, nil
+}
+
+// wantsMsgpack reports whether the client accepts MessagePack.
+func wantsMsgpack(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, contentTypeMsgpack) || strings.Contains(accept, "application/x-msgpack")
+}
+
+func (s *server) fingerprint(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	path, err := s.path(r)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	cfg := s.cfg
+	if bs := r.URL.Query().Get("blocksize"); bs != "" {
+		if cfg.BlockSize, err = strconv.Atoi(bs); err != nil || delta.CheckBlockSize(cfg.BlockSize) != nil {
+			http.Error(w, "invalid blocksize", http.StatusBadRequest)
+			return
+		}
+	}
+	cfg.Format = delta.FormatGob
+	w.Header().Set("Content-Type", contentTypeGob)
+	if wantsMsgpack(r) {
+		cfg.Format = delta.FormatMsgpack
+		w.Header().Set("Content-Type", contentTypeMsgpack)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer f.Close()
+	if s.cache != nil {
+		s.cachedFingerprint(w, r, f, cfg, start)
+		return
+	}
+	// A slow client must not hold gsyncMu, the fingerprint is sent once
+	// it is complete.
+	var buf bytes.Buffer
+	err = generateLocked(r.Context(), f, &buf, cfg)
+	appMetrics.observe("fpgen", start, err)
+	if err != nil {
+		slog.Error("fingerprint failed", "phase", "fpgen", "file", path, "error", err)
+		httpError(w, err)
+		return
+	}
+	if _, err = buf.WriteTo(w); err != nil {
+		slog.Error("response failed", "phase", "fpgen", "file", path, "error", err)
+	}
+}
+
+// generateLocked generates the fingerprint of src into dst holding
+// gsyncMu.
+func generateLocked(ctx context.Context, src io.Reader, dst io.Writer, cfg delta.Config) error {
+	gsyncMu.Lock()
+	defer gsyncMu.Unlock()
+	return delta.GenerateFingerprint(ctx, src, dst, delta.WithConfig(cfg))
+}
+
+// cachedFingerprint serves the fingerprint of f from the cache, or
+// generates and caches it. It is cached only if f did not change while
+// it was read.
+func (s *server) cachedFingerprint(w http.ResponseWriter, r *http.Request, f *os.File, cfg delta.Config, start time.Time) {
+	path, err := filepath.Abs(f.Name())
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	key := newFPCacheKey(path, fi, cfg)
+	data, ok := s.cache.get(key)
+	appMetrics.cacheLookup(ok)
+	if !ok {
+		var buf bytes.Buffer
+		err = generateLocked(r.Context(), f, &buf, cfg)
+		appMetrics.observe("fpgen", start, err)
+		if err != nil {
+			slog.Error("fingerprint failed", "phase", "fpgen", "file", path, "error", err)
+			httpError(w, err)
+			return
+		}
+		data = buf.Bytes()
+		if after, err := f.Stat(); err == nil && newFPCacheKey(path, after, cfg) == key {
+			s.cache.add(key, data)
+		}
+	}
+	if _, err = w.Write(data); err != nil {
+		slog.Error("response failed", "phase", "fpgen", "file", path, "error", err)
+	}
+}
+
+func (s *server) apply(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	path, err := s.path(r)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	unlock := lockFile(path)
+	defer unlock()
+
+	body := r.Body
+	if uploadLimit > 0 {
+		body = http.MaxBytesReader(w, body, uploadLimit)
+	}
+	result, err := s.patchFile(r.Context(), path, body)
+	appMetrics.observe("patch", start, err)
+	if err != nil {
+		slog.Error("patch failed", "phase", "patch", "file", path, "error", err)
+		httpError(w, err)
+		return
+	}
+	slog.Info("patch applied", "phase", "patch", "file", path, "size", result.Size)
+	result.File = r.URL.Query().Get("file")
+	if wantsMsgpack(r) {
+		w.Header().Set("Content-Type", contentTypeMsgpack)
+		err = msgpack.NewEncoder(w).Encode(result)
+	} else {
+		w.Header().Set("Content-Type", contentTypeGob)
+		err = gob.NewEncoder(w).Encode(result)
+	}
+	if err != nil {
+		slog.Error("response failed", "phase", "patch", "file", path, "error", err)
+	}
+}
+
+// patchFile replaces the file at path with the result of the delta read
+// from body.
+func (s *server) patchFile(ctx context.Context, path string, body io.Reader) (applyResult, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return applyResult{}, err
+	}
+	defer src.Close()
+	out, err := createAtomic(path)
+	if err != nil {
+		return applyResult{}, err
+	}
+	defer out.Abort()
+	// The delta is received before the patch takes gsyncMu, so a slow
+	// upload does not hold up the other requests.
+	spool, err := os.CreateTemp(*tmpDir, "godelta-delta")
+	if err != nil {
+		return applyResult{}, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	if _, err = io.Copy(spool, body); err != nil {
+		return applyResult{}, err
+	}
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return applyResult{}, err
+	}
+	expected, datahash, err := applyLocked(ctx, src, spool, out.File, s.cfg)
+	if err != nil {
+		return applyResult{}, err
+	}
+	// A delta made for another version of the file must not replace it.
+	if expected == nil {
+		return applyResult{}, fmt.Errorf("%w: delta has no datahash", delta.ErrDeltaCorrupt)
+	}
+	if !bytes.Equal(expected, datahash) {
+		return applyResult{}, fmt.Errorf("%w: expected %x, got %x", delta.ErrPatchMismatch, expected, datahash)
+	}
+	fi, err := out.Stat()
+	if err != nil {
+		return applyResult{}, err
+	}
+	if err = out.Commit(); err != nil {
+		return applyResult{}, err
+	}
+	return applyResult{Size: fi.Size(), Datahash: datahash}, nil
+}
+
+// applyLocked applies the delta read from in to src into out holding
+// gsyncMu. It returns the datahash recorded in the delta and the one of
+// the written data.
+func applyLocked(ctx context.Context, src io.ReaderAt, in io.Reader, out io.Writer, cfg delta.Config) (expected, actual []byte, err error) {
+	gsyncMu.Lock()
+	defer gsyncMu.Unlock()
+	return delta.ApplyPatchDatahash(ctx, src, in, out, delta.WithConfig(cfg))
+}
+
+// httpError writes err with the status matching its kind.
+func httpError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, errInvalidFile):
+		status = http.StatusBadRequest
+	case errors.Is(err, os.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, delta.ErrDeltaCorrupt), errors.Is(err, delta.ErrUnsupportedVersion), errors.Is(err, delta.ErrPatchMismatch):
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathBelow(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"outside", "root/file", "root/sub/file"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{"in": "sub/file", "out": "../outside", "dir": "sub"} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name string
+		want string
+		err  error
+	}{
+		{"file", "file", nil},
+		{"sub/file", "sub/file", nil},
+		{"in", "sub/file", nil},
+		{"dir/file", "sub/file", nil},
+		{"out", "", errInvalidFile},
+		{"../outside", "", errInvalidFile},
+		{"/etc/passwd", "", errInvalidFile},
+		{"", "", errInvalidFile},
+		{"missing", "", os.ErrNotExist},
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		got, err := pathBelow(root, tt.name)
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("pathBelow(%q) = %q, %v, want %v", tt.name, got, err, tt.err)
+			}
+			continue
+		}
+		if want := filepath.Join(realRoot, tt.want); err != nil || got != want {
+			t.Errorf("pathBelow(%q) = %q, %v, want %q", tt.name, got, err, want)
+		}
+	}
+}
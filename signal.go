@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// interruptGrace is how long an interrupted operation may take to stop
+// before the process exits anyway.
+const interruptGrace = 10 * time.Second
+
+// handleSignals cancels the running operation on SIGINT or SIGTERM and
+// waits for running to drain, so the operation aborts its temporary files
+// itself. If it does not stop within interruptGrace or another signal
+// arrives, the pending temporary files are removed and the process exits.
+// The same applies when ctx, the context of the operation, hits its
+// -timeout deadline, as an operation blocked in a read may not notice it.
+// The returned function stops the handling.
+func handleSignals(ctx context.Context, cancel context.CancelFunc, running *sync.WaitGroup) func() {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	stop := make(chan struct{})
+	go func() {
+		var s os.Signal
+		code := exitInternal
+		select {
+		case s = <-sig:
+			slog.Warn("interrupted, stopping", "signal", s.String())
+		case <-ctx.Done():
+			slog.Warn("timed out, stopping", "timeout", *timeout)
+			code = exitTimeout
+		case <-stop:
+			return
+		}
+		cancel()
+
+		drained := make(chan struct{})
+		go func() {
+			running.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+			return
+		case <-stop:
+			return
+		case s = <-sig:
+			slog.Error("interrupted again, exiting", "signal", s.String())
+		case <-time.After(interruptGrace):
+			slog.Error("operation did not stop in time, exiting", "timeout", interruptGrace)
+		}
+		abortPending()
+		os.Exit(code)
+	}()
+	return func() {
+		signal.Stop(sig)
+		close(stop)
+	}
+}
+
+// phaseTimeouts are the -timeout-fpgen, -timeout-diff and -timeout-patch
+// limits by phase.
+var phaseTimeouts = map[string]*time.Duration{
+	"fpgen": timeoutFpgen,
+	"diff":  timeoutDiff,
+	"patch": timeoutPatch,
+}
+
+// runPhase runs fn with the timeout of phase on top of ctx. Only the phase
+// is cancelled when it runs out, its error then names the phase. Like for
+// -timeout, the process exits if the phase does not stop within
+// interruptGrace.
+func runPhase(ctx context.Context, phase string, fn func(ctx context.Context) error) error {
+	limit := *phaseTimeouts[phase]
+	if limit <= 0 {
+		return fn(ctx)
+	}
+	phaseCtx, cancel := context.WithTimeout(ctx, limit)
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	context.AfterFunc(phaseCtx, func() {
+		if ctx.Err() != nil || !errors.Is(phaseCtx.Err(), context.DeadlineExceeded) {
+			return
+		}
+		slog.Warn("phase timed out, stopping", "phase", phase, "timeout", limit)
+		select {
+		case <-done:
+		case <-time.After(interruptGrace):
+			slog.Error("phase did not stop in time, exiting", "phase", phase, "timeout", interruptGrace)
+			abortPending()
+			os.Exit(exitTimeout)
+		}
+	})
+	err := fn(phaseCtx)
+	if err == nil || ctx.Err() != nil || !errors.Is(phaseCtx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	// The phase may have failed with an error not wrapping the deadline.
+	if !errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("%w: %w", context.DeadlineExceeded, err)
+	}
+	return fmt.Errorf("%s phase ran longer than -timeout-%s %s: %w", phase, phase, limit, err)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHandleSignals(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out")
+	if err := os.WriteFile(path, []byte("original"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var running sync.WaitGroup
+	defer handleSignals(ctx, cancel, &running)()
+
+	out, err := createAtomic(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = out.WriteString("partial"); err != nil {
+		t.Fatal(err)
+	}
+	// The operation aborts its output once it is cancelled.
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		<-ctx.Done()
+		out.Abort()
+	}()
+	if err = syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGINT did not cancel the operation")
+	}
+	running.Wait()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files left in the output directory, want only the output", len(entries))
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "original" {
+		t.Errorf("output is %q, %v, want the original", b, err)
+	}
+}
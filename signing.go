@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/Elbandi/godelta/delta"
+)
+
+// signKey and verifyKey are set from the -sign-* and -verify-* flags, nil
+// disables signing or verification.
+var signKey, verifyKey []byte
+
+// parseSignKeys sets signKey and verifyKey from the hex key or password
+// flags.
+func parseSignKeys() (err error) {
+	if signKey, err = signingKey(*signKeyHex, *signPassword); err != nil {
+		return err
+	}
+	verifyKey, err = signingKey(*verifyKeyHex, *verifyPassword)
+	return err
+}
+
+func signingKey(hexKey, password string) ([]byte, error) {
+	switch {
+	case hexKey != "":
+		return delta.ParseSignKey(hexKey)
+	case password != "":
+		return delta.DeriveSignKey(password), nil
+	}
+	return nil, nil
+}
+
+// signFile appends the HMAC of everything written to f when signing is
+// enabled.
+func signFile(f *os.File) error {
+	if signKey == nil {
+		return nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	mac, err := delta.Sign(f, signKey)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(mac)
+	return err
+}
+
+// signStdout returns the writer for output written to stdout, which signs
+// it when signing is enabled, and the function completing it.
+func signStdout() (io.Writer, func() error) {
+	if signKey == nil {
+		return os.Stdout, func() error { return nil }
+	}
+	w := delta.NewSignWriter(os.Stdout, signKey)
+	return w, w.Close
+}
+
+// verifiedInput checks the signature of r when verification is enabled
+// and returns the signed content. Input that is not a regular file is
+// read into memory, as the whole input is verified before any of it is
+// used.
+func verifiedInput(r io.Reader) (io.Reader, error) {
+	if verifyKey == nil {
+		return r, nil
+	}
+	if f, ok := r.(interface {
+		io.ReaderAt
+		Stat() (os.FileInfo, error)
+	}); ok {
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode().IsRegular() {
+			return delta.VerifySignature(f, fi.Size(), verifyKey)
+		}
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return delta.VerifySignature(bytes.NewReader(data), int64(len(data)), verifyKey)
+}
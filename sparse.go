@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// sparseFile writes to a new file and seeks over blocks of zeros instead
+// of writing them, so that they become holes on filesystems supporting
+// sparse files. Elsewhere the skipped ranges read back as zeros anyway.
+type sparseFile struct {
+	f    *os.File
+	size int64
+}
+
+func (s *sparseFile) Write(p []byte) (int, error) {
+	if isZero(p) {
+		if _, err := s.f.Seek(int64(len(p)), io.SeekCurrent); err != nil {
+			return 0, err
+		}
+		s.size += int64(len(p))
+		return len(p), nil
+	}
+	n, err := s.f.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+// Finish extends the file over a trailing hole.
+func (s *sparseFile) Finish() error {
+	return s.f.Truncate(s.size)
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/Elbandi/godelta/delta"
+)
+
+var largeFiles = flag.Bool("large", false, "patch files over 4 GiB")
+
+// createSparse creates a file of size bytes holding data at the given
+// offsets and holes everywhere else.
+func createSparse(t *testing.T, path string, size int64, data map[int64]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	for off, s := range data {
+		if _, err = f.WriteAt([]byte(s), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// sameContent reports whether the files at a and b hold the same bytes.
+func sameContent(t *testing.T, a, b string) bool {
+	t.Helper()
+	fa, err := os.Open(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fb.Close()
+	bufA, bufB := make([]byte, 1<<20), make([]byte, 1<<20)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false
+		}
+		if errA != nil || errB != nil {
+			return errA == errB
+		}
+	}
+}
+
+func TestSparsePatch(t *testing.T) {
+	size := int64(64 << 20)
+	if *largeFiles {
+		size = 5 << 30
+	}
+	dir := t.TempDir()
+	oldPath, newPath, outPath := filepath.Join(dir, "old"), filepath.Join(dir, "new"), filepath.Join(dir, "out")
+	createSparse(t, oldPath, size, map[int64]string{0: "old head", size / 2: "old middle", size - 8: "old tail"})
+	createSparse(t, newPath, size+100, map[int64]string{0: "new head", size / 2: "old middle", size - 8: "new tail"})
+
+	ctx := context.Background()
+	old, err := os.Open(oldPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	var fp, d bytes.Buffer
+	if err = delta.GenerateFingerprint(ctx, old, &fp); err != nil {
+		t.Fatal(err)
+	}
+	new, err := os.Open(newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer new.Close()
+	if _, err = delta.MakeDiff(ctx, &fp, new, &d); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	s := &sparseFile{f: out}
+	if _, err = delta.ApplyPatch(ctx, old, &d, s); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !sameContent(t, outPath, newPath) {
+		t.Error("patched file differs from the new file")
+	}
+	fi, err := out.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocated := fi.Sys().(*syscall.Stat_t).Blocks * 512; allocated >= fi.Size() {
+		t.Errorf("patched file allocates %d bytes of its %d bytes", allocated, fi.Size())
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/Elbandi/godelta/delta"
+)
+
+// splitPart is a part of a split delta.
+type splitPart struct {
+	// File is the path of the part relative to the manifest.
+	File string `json:"file"`
+	// Start and End are the byte range of the part in the delta.
+	Start  int64  `json:"start"`
+	End    int64  `json:"end"`
+	SHA256 string `json:"sha256"`
+}
+
+// splitManifest lists the parts of a split delta.
+type splitManifest struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// BlockRange is the first and last operation of the delta.
+	BlockRange [2]int64    `json:"block_range"`
+	Parts      []splitPart `json:"parts"`
+}
+
+// splitDelta writes the delta read from in to parts of at most partSize
+// bytes called prefix0001.delta, prefix0002.delta and so on, and lists
+// them in prefixmanifest.json. The delta is decoded first, so a corrupt
+// delta or a missing key is reported before anything is written.
+func splitDelta(cfg delta.Config, in string, partSize int64, prefix string) error {
+	if partSize <= 0 {
+		return fmt.Errorf("invalid part size %d", partSize)
+	}
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := verifiedInput(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", in, err)
+	}
+	ops, err := countOperations(cfg, r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", in, err)
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	m := splitManifest{BlockRange: [2]int64{0, ops - 1}}
+	total := sha256.New()
+	var parts []*atomicFile
+	defer func() {
+		for _, p := range parts {
+			p.Abort()
+		}
+	}()
+	for {
+		path := fmt.Sprintf("%s%04d.delta", prefix, len(parts)+1)
+		part, err := createAtomic(path)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, part)
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(part, h, total), io.LimitReader(f, partSize))
+		if err != nil {
+			return err
+		}
+		if n == 0 && m.Size > 0 {
+			// The previous part ended at the end of the delta.
+			part.Abort()
+			parts = parts[:len(parts)-1]
+			break
+		}
+		m.Parts = append(m.Parts, splitPart{File: filepath.Base(path), Start: m.Size, End: m.Size + n, SHA256: hex.EncodeToString(h.Sum(nil))})
+		m.Size += n
+		if n < partSize {
+			break
+		}
+	}
+	m.SHA256 = hex.EncodeToString(total.Sum(nil))
+
+	manifest, err := createAtomic(prefix + "manifest.json")
+	if err != nil {
+		return err
+	}
+	defer manifest.Abort()
+	enc := json.NewEncoder(manifest)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(m); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if err = p.Commit(); err != nil {
+			return err
+		}
+	}
+	if err = manifest.Commit(); err != nil {
+		return err
+	}
+	slog.Info("delta split", "phase", "split", "file", in, "parts", len(m.Parts), "manifest", manifest.path)
+	return nil
+}
+
+// countOperations decodes the delta read from r and returns its number of
+// operations.
+func countOperations(cfg delta.Config, r io.Reader) (int64, error) {
+	dr, err := delta.NewDeltaReader(r, delta.WithConfig(cfg))
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for {
+		_, err := dr.Next()
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		n++
+	}
+}
+
+// joinDelta checks the parts listed in the manifest and concatenates them
+// into out.
+func joinDelta(manifestPath, out string) error {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	var m splitManifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("%s: %w", manifestPath, err)
+	}
+
+	tmpFile, err := createAtomic(out)
+	if err != nil {
+		return err
+	}
+	defer tmpFile.Abort()
+
+	total := sha256.New()
+	var size int64
+	for _, p := range m.Parts {
+		if p.Start != size {
+			return fmt.Errorf("%s: part %s starts at %d, expected %d", manifestPath, p.File, p.Start, size)
+		}
+		if err = joinPart(io.MultiWriter(tmpFile, total), filepath.Join(filepath.Dir(manifestPath), p.File), p); err != nil {
+			return err
+		}
+		size = p.End
+	}
+	if size != m.Size {
+		return fmt.Errorf("%s: parts hold %d bytes, expected %d", manifestPath, size, m.Size)
+	}
+	if sum := hex.EncodeToString(total.Sum(nil)); sum != m.SHA256 {
+		return fmt.Errorf("%s: joined delta sha256 %s, expected %s", manifestPath, sum, m.SHA256)
+	}
+	if err = tmpFile.Commit(); err != nil {
+		return err
+	}
+	slog.Info("delta joined", "phase", "join", "file", out, "parts", len(m.Parts))
+	return nil
+}
+
+// joinPart copies the part at path to w and then checks its size and
+// checksum, the caller discards what was written on a mismatch.
+func joinPart(w io.Writer, path string, p splitPart) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), f)
+	if err != nil {
+		return err
+	}
+	if n != p.End-p.Start {
+		return fmt.Errorf("%s: %d bytes, expected %d", path, n, p.End-p.Start)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != p.SHA256 {
+		return fmt.Errorf("%s: sha256 %s, expected %s", path, sum, p.SHA256)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Elbandi/godelta/delta"
+)
+
+// upToDate reports whether the -out file of patch already has the
+// -target-hash, or with -target-hash-from-delta the datahash of the -in
+// delta, so the patch can be skipped.
+func upToDate(cfg delta.Config) (bool, error) {
+	if *targetHash == "" && !*hashFromDelta {
+		return false, nil
+	}
+	if *outfilePath == "" {
+		return false, errors.New("-target-hash and -target-hash-from-delta require -out")
+	}
+	if _, err := os.Stat(*outfilePath); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	var want []byte
+	var err error
+	if *targetHash != "" {
+		if want, err = hex.DecodeString(*targetHash); err != nil || len(want) != 32 {
+			return false, fmt.Errorf("invalid -target-hash %q, must be a hex SHA-256", *targetHash)
+		}
+	} else if want, err = deltaDatahash(cfg); err != nil {
+		return false, err
+	}
+	actual, err := hashFile(*outfilePath)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(actual, want), nil
+}
+
+// deltaDatahash returns the datahash stored at the end of the -in delta.
+func deltaDatahash(cfg delta.Config) ([]byte, error) {
+	if *infilePath == "" {
+		return nil, errors.New("-target-hash-from-delta requires -in")
+	}
+	f, err := os.Open(*infilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	in, err := verifiedInput(retryFile{f})
+	if err != nil {
+		return nil, fmt.Errorf("delta: %w", err)
+	}
+	dr, err := delta.NewDeltaReader(in, delta.WithConfig(cfg))
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, err = dr.Next(); err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dr.Datahash == nil {
+		return nil, fmt.Errorf("%w: delta has no datahash", delta.ErrDeltaCorrupt)
+	}
+	return dr.Datahash, nil
+}
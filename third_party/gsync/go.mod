@@ -0,0 +1,3 @@
+module github.com/Elbandi/gsync
+
+go 1.21
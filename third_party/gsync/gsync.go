@@ -0,0 +1,246 @@
+// Package gsync implements the part of the github.com/Elbandi/gsync API
+// godelta uses: rsync style block signatures, the operations turning a
+// file into another one, and applying them. go.mod replaces the module
+// with this directory, as it is not served by the Go module proxy. Block
+// layout and weak checksums match gsync, so fingerprints and deltas are
+// exchanged with builds using it.
+package gsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"hash"
+	"io"
+)
+
+// BlockSize is the size of the blocks files are split into.
+var BlockSize = 1024 * 6
+
+// BlockSignature is the signature of block Index of a file. Weak is its
+// rolling checksum and Strong its hash. Error ends a stream of signatures.
+type BlockSignature struct {
+	Index  uint64
+	Strong []byte
+	Weak   uint32
+	Error  error
+}
+
+// BlockOperation either copies block Index of the source file or, if Data
+// is not empty, writes Data. Error ends a stream of operations.
+type BlockOperation struct {
+	Index uint64
+	Data  []byte
+	Error error
+}
+
+// Signatures returns the signatures of the blocks of r, hashed with shash
+// or SHA-256 if it is nil.
+func Signatures(ctx context.Context, r io.Reader, shash hash.Hash) (<-chan BlockSignature, error) {
+	if shash == nil {
+		shash = sha256.New()
+	}
+	c := make(chan BlockSignature)
+	go func() {
+		defer close(c)
+		buf := make([]byte, BlockSize)
+		for index := uint64(0); ; index++ {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				shash.Reset()
+				shash.Write(buf[:n])
+				var w rolling
+				w.reset(buf[:n])
+				select {
+				case c <- BlockSignature{Index: index, Weak: w.sum(), Strong: shash.Sum(nil)}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return
+			}
+			if err != nil {
+				select {
+				case c <- BlockSignature{Index: index, Error: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+// LookUpTable maps the weak checksums of the signatures read from bc to
+// the signatures.
+func LookUpTable(ctx context.Context, bc <-chan BlockSignature) (map[uint32][]BlockSignature, error) {
+	table := make(map[uint32][]BlockSignature)
+	for b := range bc {
+		if b.Error != nil {
+			return table, b.Error
+		}
+		table[b.Weak] = append(table[b.Weak], b)
+	}
+	return table, ctx.Err()
+}
+
+// Sync returns the operations turning the file the signatures of remote
+// were computed from into r. Every window of r is looked up by its weak
+// checksum and then by its strong hash, computed with shash or SHA-256 if
+// it is nil. datahash, if not nil, receives the content of r.
+func Sync(ctx context.Context, r io.Reader, shash hash.Hash, datahash hash.Hash, remote map[uint32][]BlockSignature) (<-chan BlockOperation, error) {
+	if shash == nil {
+		shash = sha256.New()
+	}
+	if datahash != nil {
+		r = io.TeeReader(r, datahash)
+	}
+	br := bufio.NewReaderSize(r, 2*BlockSize)
+	c := make(chan BlockOperation)
+	send := func(o BlockOperation) bool {
+		select {
+		case c <- o:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	find := func(weak uint32, block []byte) (uint64, bool) {
+		sigs := remote[weak]
+		if len(sigs) == 0 {
+			return 0, false
+		}
+		shash.Reset()
+		shash.Write(block)
+		sum := shash.Sum(nil)
+		for _, s := range sigs {
+			if bytes.Equal(sum, s.Strong) {
+				return s.Index, true
+			}
+		}
+		return 0, false
+	}
+	go func() {
+		defer close(c)
+		var (
+			w       rolling
+			literal []byte
+			eof     bool
+		)
+		for !eof {
+			window := make([]byte, BlockSize)
+			n, err := io.ReadFull(br, window)
+			window = window[:n]
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof, err = true, nil
+			}
+			if err != nil {
+				send(BlockOperation{Error: err})
+				return
+			}
+			w.reset(window)
+			for len(window) > 0 {
+				if index, ok := find(w.sum(), window); ok {
+					if len(literal) > 0 && !send(BlockOperation{Data: literal}) {
+						return
+					}
+					literal = nil
+					if !send(BlockOperation{Index: index}) {
+						return
+					}
+					break
+				}
+				out := window[0]
+				literal = append(literal, out)
+				if len(literal) == BlockSize {
+					if !send(BlockOperation{Data: literal}) {
+						return
+					}
+					literal = nil
+				}
+				in, err := br.ReadByte()
+				if err == io.EOF {
+					eof = true
+					w.shrink(out)
+					window = window[1:]
+					continue
+				}
+				if err != nil {
+					send(BlockOperation{Error: err})
+					return
+				}
+				w.roll(out, in)
+				window = append(window[1:], in)
+			}
+		}
+		if len(literal) > 0 {
+			send(BlockOperation{Data: literal})
+		}
+	}()
+	return c, nil
+}
+
+// Apply writes the result of the operations read from ops to dst, reading
+// the copied blocks from cache. datahash, if not nil, receives the written
+// content.
+func Apply(ctx context.Context, dst io.Writer, cache io.ReaderAt, datahash hash.Hash, ops <-chan BlockOperation) error {
+	if datahash != nil {
+		dst = io.MultiWriter(dst, datahash)
+	}
+	buf := make([]byte, BlockSize)
+	for o := range ops {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if o.Error != nil {
+			return o.Error
+		}
+		data := o.Data
+		if len(data) == 0 {
+			n, err := cache.ReadAt(buf, int64(o.Index)*int64(BlockSize))
+			if err != nil && err != io.EOF {
+				return err
+			}
+			data = buf[:n]
+		}
+		if _, err := dst.Write(data); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// rolling is the weak checksum of a window: a is the sum of its bytes and
+// b the sum of each byte weighted by its distance from the end of the
+// window.
+type rolling struct {
+	n, a, b uint32
+}
+
+func (w *rolling) reset(window []byte) {
+	w.n = uint32(len(window))
+	w.a, w.b = 0, 0
+	for i, v := range window {
+		w.a += uint32(v)
+		w.b += (w.n - uint32(i)) * uint32(v)
+	}
+}
+
+// roll drops out from the front of the window and appends in.
+func (w *rolling) roll(out, in byte) {
+	w.a = w.a - uint32(out) + uint32(in)
+	w.b = w.b - w.n*uint32(out) + w.a
+}
+
+// shrink drops out from the front of the window at the end of the input.
+func (w *rolling) shrink(out byte) {
+	w.a -= uint32(out)
+	w.b -= w.n * uint32(out)
+	w.n--
+}
+
+func (w *rolling) sum() uint32 {
+	return w.a&0xffff | w.b<<16
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	buildinfo "runtime/debug"
+)
+
+// Set with go build -ldflags "-X main.version=1.2.3 -X main.commit=abc123
+// -X main.date=2006-01-02T15:04:05Z".
+var (
+	version string
+	commit  string
+	date    string
+)
+
+// printVersion prints the build information, falling back to what the Go
+// toolchain embedded in the binary for values not set by ldflags.
+func printVersion() {
+	v, c, d := version, commit, date
+	if info, ok := buildinfo.ReadBuildInfo(); ok {
+		if v == "" {
+			v = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && c == "":
+				c = s.Value
+			case s.Key == "vcs.time" && d == "":
+				d = s.Value
+			}
+		}
+	}
+	if v == "" {
+		v = "(devel)"
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+	fmt.Printf("godelta %s\ncommit: %s\nbuilt: %s\ngo: %s\n", v, c, d, runtime.Version())
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/Elbandi/godelta/delta"
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDiff recreates the delta of the -in file whenever it changes, until
+// the context is cancelled or the process is interrupted. Changes are
+// collected for debounce before a new delta is made.
+func watchDiff(ctx context.Context, cfg delta.Config, debounce time.Duration) error {
+	if *infilePath == "" || *outfilePath == "" {
+		return errors.New("watch requires -in and -out")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	// Editors often replace the file, so watch its directory.
+	if err = watcher.Add(filepath.Dir(*infilePath)); err != nil {
+		return err
+	}
+	target := filepath.Clean(*infilePath)
+
+	var srcModTime time.Time
+	var srcSize int64
+	regenerate := func() (err error) {
+		start := time.Now()
+		defer func() { appMetrics.observe("diff", start, err) }()
+		unlock, err := lockSourceFile()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		fi, err := os.Stat(*sourcefilePath)
+		if err != nil {
+			return err
+		}
+		if !fi.ModTime().Equal(srcModTime) || fi.Size() != srcSize {
+			if err = generateFingerprint(ctx, cfg); err != nil {
+				return err
+			}
+			srcModTime, srcSize = fi.ModTime(), fi.Size()
+		}
+		if err = makeDiff(ctx, cfg); err != nil {
+			return err
+		}
+		fi, err = os.Stat(*outfilePath)
+		if err != nil {
+			return err
+		}
+		slog.Info("delta regenerated", "file", *outfilePath, "bytes", fi.Size())
+		return nil
+	}
+
+	if err = regenerate(); err != nil && ctx.Err() == nil {
+		slog.Error(err.Error(), "file", *infilePath)
+	}
+	fire := make(chan struct{}, 1)
+	timer := time.AfterFunc(debounce, func() {
+		select {
+		case fire <- struct{}{}:
+		default:
+		}
+	})
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(ev.Name) != target || ev.Op == fsnotify.Chmod {
+				continue
+			}
+			timer.Reset(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Warn("watch error", "error", err)
+		case <-fire:
+			if err = regenerate(); err != nil && ctx.Err() == nil {
+				slog.Error(err.Error(), "file", *infilePath)
+			}
+		}
+	}
+}